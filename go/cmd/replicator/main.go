@@ -1,65 +1,765 @@
 package main
 
 import (
-	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"github.com/siddontang/go-mysql/mysql"
-	repl "github.com/siddontang/go-mysql/replication"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/siddontang/go-mysql/mysql"
+	"mysqlreplicator/loader"
+	"mysqlreplicator/replicator"
+	"mysqlreplicator/replicator/avro"
+	"mysqlreplicator/replicator/control"
+	"mysqlreplicator/replicator/debezium"
+	"mysqlreplicator/replicator/dmlbuilder"
+	"mysqlreplicator/replicator/filesink"
+	"mysqlreplicator/replicator/kafkasink"
+	"mysqlreplicator/replicator/routing"
 )
 
+// stringList collects repeated flags
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 var (
-	a            int = 3
-	mysql_host       = flag.String("host", "127.0.0.1", "MySQL Host")
-	mysql_port       = flag.Int("port", 3306, "MySQL Port")
-	mysql_id         = flag.Int("id", 100, "MySQL Port")
-	mysql_user       = flag.String("user", "root", "MySQL User")
-	mysql_passwd     = flag.String("passwd", "root", "MySQL Password")
+	log = loggo.GetLogger("main")
+
+	defaults = replicator.DefaultConfig()
+
+	config_file = flag.String("config", "", "YAML, TOML or JSON configuration file, flags override its keys")
+
+	server_id     = flag.Uint("id", uint(defaults.Source.ServerID), "Server ID used to register as a replica of the source")
+	source_host   = flag.String("host", defaults.Source.Host, "Source MySQL Host")
+	source_port   = flag.Int("port", defaults.Source.Port, "Source MySQL Port")
+	source_user   = flag.String("user", defaults.Source.User, "Source MySQL User")
+	source_passwd = flag.String("passwd", defaults.Source.Password, "Source MySQL Password")
+
+	source_passwd_file     = flag.String("passwd-file", "", "File holding the source MySQL Password, overrides -passwd")
+	source_tls_mode        = flag.String("tls-mode", "", "TLS mode of the source connection: disabled, required, verify_ca or verify_identity")
+	source_tls_ca          = flag.String("tls-ca", "", "CA certificate of the source server")
+	source_tls_cert        = flag.String("tls-cert", "", "Client certificate of the source connection")
+	source_tls_key         = flag.String("tls-key", "", "Client certificate key of the source connection")
+	source_tls_server_name = flag.String("tls-server-name", "", "Server name verified in the source certificate, defaults to -host")
+
+	target_host   = flag.String("target-host", defaults.Target.Host, "Target MySQL Host")
+	target_port   = flag.Int("target-port", defaults.Target.Port, "Target MySQL Port")
+	target_user   = flag.String("target-user", defaults.Target.User, "Target MySQL User")
+	target_passwd = flag.String("target-passwd", defaults.Target.Password, "Target MySQL Password")
+	target_db     = flag.String("target-db", defaults.Target.Database, "Default schema of the target connection")
+
+	target_passwd_file     = flag.String("target-passwd-file", "", "File holding the target MySQL Password, overrides -target-passwd")
+	target_tls_mode        = flag.String("target-tls-mode", "", "TLS mode of the target connection: disabled, required, verify_ca or verify_identity")
+	target_tls_ca          = flag.String("target-tls-ca", "", "CA certificate of the target server")
+	target_tls_cert        = flag.String("target-tls-cert", "", "Client certificate of the target connection")
+	target_tls_key         = flag.String("target-tls-key", "", "Client certificate key of the target connection")
+	target_tls_server_name = flag.String("target-tls-server-name", "", "Server name verified in the target certificate, defaults to -target-host")
+
+	source_flavor = flag.String("flavor", defaults.Source.Flavor, "Source server flavor, mysql or mariadb")
+	target_flavor = flag.String("target-flavor", defaults.Target.Flavor, "Target server flavor, mysql or mariadb")
+
+	log_file = flag.String("log-file", "", "Binlog file to start from when no checkpoint exists")
+	log_pos  = flag.Uint("log-pos", uint(defaults.Source.LogPos), "Binlog position to start from when no checkpoint exists")
+	gtid     = flag.String("gtid", "", "GTID set to start from when no checkpoint exists")
+
+	update_mode = flag.Bool("update-mode", false, "Apply updates as UPDATE of the row matching the before image instead of REPLACE")
+	batch_rows  = flag.Int("batch-rows", defaults.Apply.BatchRows, "Maximum number of rows of an event combined into a single statement")
+	workers     = flag.Int("workers", defaults.Apply.Workers, "Target connections applying transactions in parallel, transactions are applied serially below 2")
+	conflicts   = flag.String("conflicts", defaults.Apply.Conflicts, "Transactions applied in order by parallel workers: table, writing the same table, or row, writing the same primary key")
+
+	group_transactions = flag.Int("group-transactions", defaults.Apply.GroupTransactions, "Maximum number of source transactions committed in a single target transaction")
+	group_rows         = flag.Int("group-rows", defaults.Apply.GroupRows, "Rows committing a group of source transactions once reached")
+	group_delay        = flag.Duration("group-delay", time.Duration(defaults.Apply.GroupDelay), "Maximum time a transaction waits for the others of its group")
+
+	sink_type       = flag.String("sink", defaults.Sink.Type, "Where change events are sent: mysql, the target server, kafka or file")
+	kafka_topic     = flag.String("kafka-topic", defaults.Sink.Kafka.Topic, "Kafka topic of the events of a table, {schema} and {table} are replaced by its name")
+	kafka_ddl_topic = flag.String("kafka-ddl-topic", "", "Kafka topic of DDL events, defaults to -kafka-topic")
+	kafka_acks      = flag.String("kafka-acks", defaults.Sink.Kafka.Acks, "Acknowledgements a transaction waits for before it is checkpointed: all, leader or none")
+
+	file_dir         = flag.String("file-dir", "", "Directory of the files written by the file sink and of its checkpoint")
+	file_max_size    = flag.Int64("file-max-size", defaults.Sink.File.MaxSize, "Size in bytes files are rotated at, 0 disables rotation by size")
+	file_max_age     = flag.Duration("file-max-age", time.Duration(defaults.Sink.File.MaxAge), "Age files are rotated at, 0 disables rotation by age")
+	file_compression = flag.String("file-compression", defaults.Sink.File.Compression, "Compression of the files: none, gzip or zstd")
+
+	sink_format          = flag.String("sink-format", defaults.Sink.Format, "Format of the events sent to sinks: json, debezium or avro")
+	debezium_server_name = flag.String("debezium-server-name", "", "Logical name of the source in Debezium events, defaults to -host")
+	debezium_decimals    = flag.String("debezium-decimals", defaults.Sink.Debezium.DecimalHandling, "DECIMAL values in Debezium events: precise, string or double")
+	schema_registry      = flag.String("schema-registry", "", "URL of the Confluent schema registry of the avro format")
+	avro_namespace       = flag.String("avro-namespace", defaults.Sink.Avro.Namespace, "Namespace of the Avro records")
+
+	snapshot             = flag.Bool("snapshot", false, "Copy the source tables to the target and replicate from the copy when no checkpoint exists")
+	snapshot_chunk_rows  = flag.Int("snapshot-chunk-rows", defaults.Snapshot.ChunkRows, "Rows copied at once by the snapshot")
+	snapshot_drop_tables = flag.Bool("snapshot-drop-tables", false, "Drop the target tables and create them again, the snapshot otherwise refuses tables holding rows")
+	snapshot_keep_tables = flag.Bool("snapshot-keep-tables", false, "Copy into the existing target tables even if they hold rows")
+
+	backfill                 = flag.Bool("backfill", false, "Copy the source tables while the binlog is replicated, resuming from -backfill-progress-file")
+	backfill_watermark_table = flag.String("backfill-watermark-table", defaults.Backfill.WatermarkTable, "Source table the backfill writes its watermarks to, as schema.table")
+	backfill_chunk_rows      = flag.Int("backfill-chunk-rows", defaults.Backfill.ChunkRows, "Rows of a backfill chunk")
+	backfill_workers         = flag.Int("backfill-workers", defaults.Backfill.Workers, "Source connections copying backfill chunks in parallel")
+	backfill_progress_file   = flag.String("backfill-progress-file", "", "File saving the backfill chunks copied")
+
+	checkpoint_file  = flag.String("checkpoint-file", "", "Save checkpoints into this file")
+	checkpoint_table = flag.String("checkpoint-table", "", "Save checkpoints into this table of -target-db, or into schema.table on the target")
+
+	max_retries = flag.Int("max-retries", defaults.Restart.MaxRetries, "Consecutive restarts after a failure before exiting, negative retries forever")
+	max_backoff = flag.Duration("max-backoff", time.Duration(defaults.Restart.MaxBackoff), "Maximum delay between restarts")
+
+	control_socket = flag.String("control-socket", "", "Unix socket accepting commands, such as the resync of a table")
+
+	log_level = flag.String("log-level", defaults.Log.Level, "Log level")
+
+	include_schemas stringList
+	exclude_schemas stringList
+	include_tables  stringList
+	exclude_tables  stringList
+	skip_actions    stringList
+	routes          stringList
+	kafka_brokers   stringList
+	backfill_tables stringList
 )
 
+func init() {
+	flag.Var(&include_schemas, "include-schema", "Schema to replicate, can be repeated")
+	flag.Var(&exclude_schemas, "exclude-schema", "Schema to skip, can be repeated")
+	flag.Var(&include_tables, "include-table", "Regular expression on schema.table to replicate, can be repeated")
+	flag.Var(&exclude_tables, "exclude-table", "Regular expression on schema.table to skip, can be repeated")
+	flag.Var(&skip_actions, "skip", "Actions to skip as <schema.table regex>:<insert|update|delete|ddl>[,...], can be repeated")
+	flag.Var(&kafka_brokers, "kafka-broker", "Kafka broker address, can be repeated")
+	flag.Var(&backfill_tables, "backfill-table", "Regular expression on schema.table to backfill, every replicated table by default, can be repeated")
+	flag.Var(&routes, "route", "Route tables to other names on the target as \"<schema>.<table> -> <schema>.<table>\", * matches any name, can be repeated")
+}
+
 func main() {
-	//connstring := fmt.Sprintf("%s:%d", *mysql_host, *mysql_port)
-	//conn, err := client.Connect(connstring, *mysql_user, *mysql_passwd, "test2")
-	//if err != nil{
-	//	fmt.Printf("%s", connstring)
-	//	fmt.Printf("%v", err)
-	//	os.Exit(1)
-	//}
-	//conn.Ping()
-	cfg := repl.BinlogSyncerConfig{
-		ServerID: uint32(*mysql_id),
-		Flavor:   "mysql",
-		Host:     *mysql_host,
-		Port:     uint16(*mysql_port),
-		User:     *mysql_user,
-		Password: *mysql_passwd,
-	}
-	syncer := repl.NewBinlogSyncer(cfg)
-	//set, _ := mysql.ParseMysqlGTIDSet("")
-	streamer, err := syncer.StartSync(mysql.Position{})
-	if err != nil {
-		fmt.Printf("%v", err)
+	flag.Parse()
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+	if err := loggo.ConfigureLoggers(fmt.Sprintf("<root>=%s", config.Log.Level)); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid log level %s: %v\n", config.Log.Level, err)
+		os.Exit(2)
+	}
+	if flag.NArg() > 0 {
+		if err := runCommand(config, flag.Args()); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := run(config); err != nil {
+		log.Errorf("%v", err)
 		os.Exit(1)
+	}
+}
 
+// runCommand runs a command of the command line, the commands sent to the
+// replicator listening on the control socket are
+// "resync [-truncate] [-workers n] <schema>.<table>". "verify" compares the
+// target with the source
+func runCommand(config *replicator.Config, args []string) error {
+	switch args[0] {
+	case control.CommandResync:
+		if config.Control.Socket == "" {
+			return fmt.Errorf("Commands are sent to -control-socket, it must be set")
+		}
+		flags := flag.NewFlagSet(control.CommandResync, flag.ExitOnError)
+		truncate := flags.Bool("truncate", false, "Empty the target table before it is copied, its rows missing on the source are otherwise kept")
+		workers := flags.Int("workers", 1, "Source connections copying the table in parallel")
+		flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			return fmt.Errorf("Usage: resync [-truncate] [-workers n] <schema>.<table>")
+		}
+		request := control.Request{Command: control.CommandResync, Table: flags.Arg(0), Truncate: *truncate, Workers: *workers}
+		if err := control.Send(config.Control.Socket, request); err != nil {
+			return fmt.Errorf("Resync of %s failed: %v", request.Table, err)
+		}
+		fmt.Printf("Resync of %s complete\n", request.Table)
+		return nil
+	case commandVerify:
+		return runVerify(config, args[1:])
 	}
+	return fmt.Errorf("Unknown command %s, expected %s or %s", args[0], control.CommandResync, commandVerify)
+}
 
-	for {
-		ev, err := streamer.GetEvent(context.Background())
-		// Dump event
+const commandVerify = "verify"
+
+// runVerify compares the replicated tables of the target with the source and
+// writes the differing ranges as JSON, it fails when a range differs unless
+// -repair applied the rows of the source to them
+func runVerify(config *replicator.Config, args []string) error {
+	var tables stringList
+	flags := flag.NewFlagSet(commandVerify, flag.ExitOnError)
+	flags.Var(&tables, "table", "Regular expression on schema.table to verify, every replicated table by default, can be repeated")
+	report := flags.String("report", "", "File the JSON report is written to, stdout by default")
+	chunkRows := flags.Int("chunk-rows", replicator.DefaultChunkRows, "Source rows checksummed by query")
+	rowsPerSecond := flags.Int("rows-per-second", 0, "Rows checksummed per second on each server, unlimited when 0")
+	rechecks := flags.Int("rechecks", 3, "Times a differing range is checked again once replicated before it is reported")
+	repair := flags.Bool("repair", false, "Make the differing ranges of the target equal to the source")
+	repairOutput := flags.String("repair-output", "", "File the repair statements are written to for review instead of being applied, requires -repair")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return fmt.Errorf("Usage: verify [-table regex] [-report file] [-chunk-rows n] [-rows-per-second n] [-rechecks n] [-repair [-repair-output file]]")
+	}
+	if *repairOutput != "" && !*repair {
+		return fmt.Errorf("-repair-output requires -repair")
+	}
+	if config.Sink.Type != replicator.SinkMySQL {
+		return fmt.Errorf("Only the %s sink can be verified, got %s", replicator.SinkMySQL, config.Sink.Type)
+	}
+	router, err := config.Router()
+	if err != nil {
+		return err
+	}
+	sourceOptions, err := config.Source.LoaderOptions()
+	if err != nil {
+		return err
+	}
+	source, err := loader.NewLoaderWithOptions(sourceOptions)
+	if err != nil {
+		return fmt.Errorf("Unable to connect to source %s:%d: %v", config.Source.Host, config.Source.Port, err)
+	}
+	defer source.Close()
+	targetOptions, err := config.Target.LoaderOptions()
+	if err != nil {
+		return err
+	}
+	target, err := loader.NewLoaderWithOptions(targetOptions)
+	if err != nil {
+		return fmt.Errorf("Unable to connect to target %s:%d: %v", config.Target.Host, config.Target.Port, err)
+	}
+	defer target.Close()
+	store, err := newCheckpointStore(config, target)
+	if err != nil {
+		return err
+	}
+	// The backfill watermarks are never replicated
+	filter := config.Filter
+	filter.ExcludeTables = append(append([]string(nil), filter.ExcludeTables...), "^"+regexp.QuoteMeta(config.Backfill.WatermarkTable)+"$")
+	result, err := replicator.Verify(source, target, replicator.VerifyOptions{
+		Filter:        filter,
+		Tables:        tables,
+		Routes:        router,
+		ChunkRows:     *chunkRows,
+		RowsPerSecond: *rowsPerSecond,
+		Rechecks:      *rechecks,
+		Checkpoint:    store,
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if *report == "" {
+		os.Stdout.Write(data)
+	} else if err := ioutil.WriteFile(*report, data, 0644); err != nil {
+		return fmt.Errorf("Unable to write the report: %v", err)
+	}
+	if len(result.Mismatches) == 0 {
+		return nil
+	}
+	if !*repair {
+		return fmt.Errorf("%d ranges differ between source and target", len(result.Mismatches))
+	}
+	options := replicator.RepairOptions{BatchRows: config.Apply.BatchRows}
+	if *repairOutput != "" {
+		file, err := os.Create(*repairOutput)
 		if err != nil {
-			fmt.Printf("%v\n", err)
-			os.Exit(1)
+			return fmt.Errorf("Unable to create the repair output: %v", err)
+		}
+		defer file.Close()
+		options.Output = file
+	}
+	if _, err := replicator.Repair(source, target, result.Mismatches, options); err != nil {
+		return err
+	}
+	if options.Output != nil {
+		return fmt.Errorf("%d ranges differ between source and target, the repair statements are written to %s", len(result.Mismatches), *repairOutput)
+	}
+	return nil
+}
+
+// loadConfig reads the configuration file, the environment overrides and the
+// flags set on the command line, in increasing order of precedence
+func loadConfig() (*replicator.Config, error) {
+	config := replicator.DefaultConfig()
+	if *config_file != "" {
+		if err := config.ReadFile(*config_file); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.ApplyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if err == nil {
+			err = applyFlag(config, f.Name)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return config, config.Validate()
+}
+
+func applyFlag(config *replicator.Config, name string) error {
+	switch name {
+	case "id":
+		config.Source.ServerID = uint32(*server_id)
+	case "host":
+		config.Source.Host = *source_host
+	case "port":
+		config.Source.Port = *source_port
+	case "user":
+		config.Source.User = *source_user
+	case "passwd":
+		config.Source.Password = *source_passwd
+	case "passwd-file":
+		config.Source.PasswordFile = *source_passwd_file
+	case "tls-mode":
+		config.Source.TLS.Mode = *source_tls_mode
+	case "tls-ca":
+		config.Source.TLS.CA = *source_tls_ca
+	case "tls-cert":
+		config.Source.TLS.Cert = *source_tls_cert
+	case "tls-key":
+		config.Source.TLS.Key = *source_tls_key
+	case "tls-server-name":
+		config.Source.TLS.ServerName = *source_tls_server_name
+	case "target-host":
+		config.Target.Host = *target_host
+	case "target-port":
+		config.Target.Port = *target_port
+	case "target-user":
+		config.Target.User = *target_user
+	case "target-passwd":
+		config.Target.Password = *target_passwd
+	case "target-db":
+		config.Target.Database = *target_db
+	case "flavor":
+		config.Source.Flavor = *source_flavor
+	case "target-passwd-file":
+		config.Target.PasswordFile = *target_passwd_file
+	case "target-tls-mode":
+		config.Target.TLS.Mode = *target_tls_mode
+	case "target-tls-ca":
+		config.Target.TLS.CA = *target_tls_ca
+	case "target-tls-cert":
+		config.Target.TLS.Cert = *target_tls_cert
+	case "target-tls-key":
+		config.Target.TLS.Key = *target_tls_key
+	case "target-tls-server-name":
+		config.Target.TLS.ServerName = *target_tls_server_name
+	case "target-flavor":
+		config.Target.Flavor = *target_flavor
+	case "log-file":
+		config.Source.LogFile = *log_file
+	case "log-pos":
+		config.Source.LogPos = uint32(*log_pos)
+	case "gtid":
+		config.Source.GTID = *gtid
+	case "update-mode":
+		config.Apply.UpdateMode = *update_mode
+	case "batch-rows":
+		config.Apply.BatchRows = *batch_rows
+	case "workers":
+		config.Apply.Workers = *workers
+	case "conflicts":
+		config.Apply.Conflicts = *conflicts
+	case "group-transactions":
+		config.Apply.GroupTransactions = *group_transactions
+	case "group-rows":
+		config.Apply.GroupRows = *group_rows
+	case "group-delay":
+		config.Apply.GroupDelay = replicator.Duration(*group_delay)
+	case "sink":
+		config.Sink.Type = *sink_type
+	case "kafka-broker":
+		config.Sink.Kafka.Brokers = kafka_brokers
+	case "kafka-topic":
+		config.Sink.Kafka.Topic = *kafka_topic
+	case "kafka-ddl-topic":
+		config.Sink.Kafka.DDLTopic = *kafka_ddl_topic
+	case "kafka-acks":
+		config.Sink.Kafka.Acks = *kafka_acks
+	case "file-dir":
+		config.Sink.File.Dir = *file_dir
+	case "file-max-size":
+		config.Sink.File.MaxSize = *file_max_size
+	case "file-max-age":
+		config.Sink.File.MaxAge = replicator.Duration(*file_max_age)
+	case "file-compression":
+		config.Sink.File.Compression = *file_compression
+	case "sink-format":
+		config.Sink.Format = *sink_format
+	case "debezium-server-name":
+		config.Sink.Debezium.ServerName = *debezium_server_name
+	case "debezium-decimals":
+		config.Sink.Debezium.DecimalHandling = *debezium_decimals
+	case "schema-registry":
+		config.Sink.Avro.RegistryURL = *schema_registry
+	case "avro-namespace":
+		config.Sink.Avro.Namespace = *avro_namespace
+	case "snapshot":
+		config.Snapshot.Enabled = *snapshot
+	case "snapshot-chunk-rows":
+		config.Snapshot.ChunkRows = *snapshot_chunk_rows
+	case "snapshot-drop-tables":
+		config.Snapshot.DropTables = *snapshot_drop_tables
+	case "snapshot-keep-tables":
+		config.Snapshot.KeepTables = *snapshot_keep_tables
+	case "backfill":
+		config.Backfill.Enabled = *backfill
+	case "backfill-table":
+		config.Backfill.Tables = backfill_tables
+	case "backfill-watermark-table":
+		config.Backfill.WatermarkTable = *backfill_watermark_table
+	case "backfill-chunk-rows":
+		config.Backfill.ChunkRows = *backfill_chunk_rows
+	case "backfill-workers":
+		config.Backfill.Workers = *backfill_workers
+	case "backfill-progress-file":
+		config.Backfill.ProgressFile = *backfill_progress_file
+	case "checkpoint-file":
+		config.Checkpoint.File = *checkpoint_file
+	case "checkpoint-table":
+		config.Checkpoint.Table = *checkpoint_table
+	case "max-retries":
+		config.Restart.MaxRetries = *max_retries
+	case "max-backoff":
+		config.Restart.MaxBackoff = replicator.Duration(*max_backoff)
+	case "control-socket":
+		config.Control.Socket = *control_socket
+	case "log-level":
+		config.Log.Level = *log_level
+	case "include-schema":
+		config.Filter.IncludeSchemas = include_schemas
+	case "exclude-schema":
+		config.Filter.ExcludeSchemas = exclude_schemas
+	case "include-table":
+		config.Filter.IncludeTables = include_tables
+	case "exclude-table":
+		config.Filter.ExcludeTables = exclude_tables
+	case "skip":
+		config.Filter.Actions = nil
+		for _, spec := range skip_actions {
+			action, err := replicator.ParseActionFilter(spec)
+			if err != nil {
+				return err
+			}
+			config.Filter.Actions = append(config.Filter.Actions, action)
+		}
+	case "route":
+		config.Routes = routes
+	}
+	return nil
+}
+
+// newEncoder returns the encoder of config.Sink.Format
+func newEncoder(config *replicator.Config) (replicator.Encoder, error) {
+	location, err := time.LoadLocation(config.Source.TimestampLocation)
+	if err != nil {
+		return nil, err
+	}
+	switch config.Sink.Format {
+	case replicator.FormatDebezium:
+		name := config.Sink.Debezium.ServerName
+		if name == "" {
+			name = config.Source.Host
+		}
+		return debezium.NewEncoder(name, config.Sink.Debezium.DecimalHandling, location)
+	case replicator.FormatAvro:
+		registry := avro.NewRegistryClient(config.Sink.Avro.RegistryURL)
+		registry.Username, registry.Password = config.Sink.Avro.Username, config.Sink.Avro.Password
+		return avro.NewEncoder(registry, config.Sink.Avro.Namespace, location), nil
+	}
+	return replicator.JSONEncoder{}, nil
+}
+
+func run(config *replicator.Config) error {
+	router, err := config.Router()
+	if err != nil {
+		return err
+	}
+	var (
+		handler     replicator.DefaultWDHandler
+		destination string
+	)
+	switch config.Sink.Type {
+	case replicator.SinkKafka:
+		destination = strings.Join(config.Sink.Kafka.Brokers, ",")
+		encoder, err := newEncoder(config)
+		if err != nil {
+			return err
+		}
+		sink, err := kafkasink.NewSink(kafkasink.Config{
+			Brokers:  config.Sink.Kafka.Brokers,
+			Topic:    config.Sink.Kafka.Topic,
+			DDLTopic: config.Sink.Kafka.DDLTopic,
+			Acks:     config.Sink.Kafka.Acks,
+			Timeout:  time.Duration(config.Sink.Kafka.Timeout),
+			Encoder:  encoder,
+		})
+		if err != nil {
+			return err
+		}
+		defer sink.Close()
+		store, err := newCheckpointStore(config, nil)
+		if err != nil {
+			return err
+		}
+		handler = replicator.NewSinkHandler(sink, replicator.HandlerOptions{Checkpoint: store, Routes: router})
+	case replicator.SinkFile:
+		destination = config.Sink.File.Dir
+		encoder, err := newEncoder(config)
+		if err != nil {
+			return err
+		}
+		sink, err := filesink.NewSink(filesink.Config{
+			Dir:         config.Sink.File.Dir,
+			Prefix:      config.Sink.File.Prefix,
+			MaxSize:     config.Sink.File.MaxSize,
+			MaxAge:      time.Duration(config.Sink.File.MaxAge),
+			Compression: config.Sink.File.Compression,
+			Encoder:     encoder,
+		})
+		if err != nil {
+			return err
+		}
+		defer sink.Close()
+		handler = replicator.NewSinkHandler(sink, replicator.HandlerOptions{Checkpoint: sink, Routes: router})
+	default:
+		destination = fmt.Sprintf("%s:%d", config.Target.Host, config.Target.Port)
+		var loaders []loader.MySQLLoader
+		defer func() {
+			for _, l := range loaders {
+				l.Close()
+			}
+		}()
+		if handler, err = newLoaderHandler(config, router, &loaders); err != nil {
+			return err
+		}
+	}
+
+	filter := config.Filter
+	var backfill *replicator.Backfill
+	// Resyncs are copied as backfill chunks
+	if config.Backfill.Enabled || config.Control.Socket != "" {
+		options := replicator.BackfillOptions{
+			Filter:    config.Filter,
+			Tables:    config.Backfill.Tables,
+			Watermark: config.Backfill.WatermarkTable,
+			ChunkRows: config.Backfill.ChunkRows,
+		}
+		if config.Backfill.ProgressFile != "" {
+			options.Progress = replicator.NewFileProgressStore(config.Backfill.ProgressFile)
+		}
+		if backfill, err = replicator.NewBackfill(handler, options); err != nil {
+			return err
 		}
-		//if ev.Header.EventType == repl.QUERY_EVENT {
-		//	qe := ev.Event.(*repl.QueryEvent)
-		//
-		//	query:= string(qe.Query)
-		//	if query != "BEGIN" && string(qe.Schema) == "test" {
-		//		fmt.Println(string(qe.Query))
-		//		conn.Execute(string(qe.Query))
-		//	}
-		//}
-		ev.Dump(os.Stdout)
+		defer backfill.Stop()
+		// Canal reads the watermarks the handler never applies
+		handler, filter = backfill, backfill.Filter(config.Filter)
+	}
+
+	wdcanal := replicator.NewWdCanalFromConfig(config.Source, handler, filter)
+	if _, err := wdcanal.State(); err != nil {
+		return err
+	}
+	if err := setStartPosition(config, router, wdcanal, handler); err != nil {
+		return err
+	}
+
+	supervisor := replicator.NewSupervisor(wdcanal, config.SupervisorPolicy())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Infof("Received %v, stopping replication", sig)
+		supervisor.Stop()
+	}()
+
+	if config.Control.Socket != "" {
+		server, err := control.Listen(config.Control.Socket, wdcanal)
+		if err != nil {
+			return err
+		}
+		defer server.Close()
+	}
+	if config.Backfill.Enabled {
+		stopped, err := runBackfill(config, backfill)
+		if err != nil {
+			return err
+		}
+		defer stopped()
+	}
+
+	log.Infof("Replicating %s:%d to %s", config.Source.Host, config.Source.Port, destination)
+	return supervisor.Run()
+}
+
+// runBackfill runs backfill in the background on connections of its own, the
+// returned function stops it and closes them
+func runBackfill(config *replicator.Config, backfill *replicator.Backfill) (func(), error) {
+	options, err := config.Source.LoaderOptions()
+	if err != nil {
+		return nil, err
+	}
+	var sources []loader.MySQLLoader
+	closeSources := func() {
+		for _, source := range sources {
+			source.Close()
+		}
+	}
+	for i := 0; i < config.Backfill.Workers || i == 0; i++ {
+		source, err := loader.NewLoaderWithOptions(options)
+		if err != nil {
+			closeSources()
+			return nil, fmt.Errorf("Unable to connect backfill worker %d to source %s:%d: %v", i, config.Source.Host, config.Source.Port, err)
+		}
+		sources = append(sources, source)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := backfill.Run(sources); err != nil && err != replicator.ErrBackfillStopped {
+			log.Errorf("%v", err)
+		}
+	}()
+	return func() {
+		backfill.Stop()
+		<-done
+		closeSources()
+	}, nil
+}
+
+// newLoaderHandler returns the handler applying events to the target server,
+// the loaders it connects are appended to loaders
+func newLoaderHandler(config *replicator.Config, router *routing.Router, loaders *[]loader.MySQLLoader) (replicator.DefaultWDHandler, error) {
+	options, err := config.Target.LoaderOptions()
+	if err != nil {
+		return nil, err
+	}
+	target, err := loader.NewLoaderWithOptions(options)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to target %s:%d: %v", config.Target.Host, config.Target.Port, err)
+	}
+	*loaders = append(*loaders, target)
+
+	store, err := newCheckpointStore(config, target)
+	if err != nil {
+		return nil, err
+	}
+	handlerOptions := replicator.HandlerOptions{Checkpoint: store, Routes: router, Group: config.Group()}
+	handlerOptions.Builder.BatchRows = config.Apply.BatchRows
+	if config.Apply.UpdateMode {
+		handlerOptions.Builder.Mode = dmlbuilder.UpdateMode
+	}
+	if config.Apply.Workers <= 1 {
+		return replicator.NewWdHandlerWithOptions(target, handlerOptions), nil
+	}
+	handlerOptions.Conflicts = config.Apply.Conflicts
+	for i := 0; i < config.Apply.Workers; i++ {
+		worker, err := loader.NewLoaderWithOptions(options)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to connect worker %d to target %s:%d: %v", i, config.Target.Host, config.Target.Port, err)
+		}
+		*loaders = append(*loaders, worker)
+		handlerOptions.Workers = append(handlerOptions.Workers, worker)
+	}
+	return replicator.NewParallelWdHandler(target, handlerOptions)
+}
+
+func newCheckpointStore(config *replicator.Config, target loader.MySQLLoader) (replicator.CheckpointStore, error) {
+	switch {
+	case config.Checkpoint.Table != "":
+		name := config.Checkpoint.Name
+		if name == "" {
+			name = fmt.Sprintf("replicator-%d", config.Source.ServerID)
+		}
+		schema, table := config.CheckpointTable()
+		return replicator.NewTableCheckpointStore(target, schema, table, name)
+	case config.Checkpoint.File != "":
+		return replicator.NewFileCheckpointStore(config.Checkpoint.File), nil
+	}
+	log.Warningf("No checkpoint store configured, replication will not resume after a restart")
+	return nil, nil
+}
+
+// setStartPosition applies the configured start position unless a checkpoint
+// was restored
+func setStartPosition(config *replicator.Config, router *routing.Router, wdcanal replicator.WDCanal, handler replicator.DefaultWDHandler) error {
+	if handler.LastCommittedPos() != nil || handler.LastCommittedGITD() != nil {
+		return nil
+	}
+	source := config.Source
+	switch {
+	case config.Snapshot.Enabled:
+		checkpoint, err := takeSnapshot(config, router)
+		if err != nil {
+			return fmt.Errorf("Snapshot failed: %v", err)
+		}
+		return replicator.SetStartCheckpoint(wdcanal, handler, checkpoint)
+	case source.LogFile != "":
+		return wdcanal.SetPos(&mysql.Position{Name: source.LogFile, Pos: source.LogPos})
+	case source.GTID != "":
+		set, err := mysql.ParseGTIDSet(source.Flavor, source.GTID)
+		if err != nil {
+			return fmt.Errorf("Invalid GTID set %s: %v", source.GTID, err)
+		}
+		return wdcanal.SetGTID(&set)
+	}
+	return fmt.Errorf("No checkpoint found, source.log_file, source.gtid or snapshot.enabled is required")
+}
+
+// takeSnapshot copies the source tables to the target on connections of their
+// own, closed once the copy is done
+func takeSnapshot(config *replicator.Config, router *routing.Router) (*replicator.Checkpoint, error) {
+	sourceOptions, err := config.Source.LoaderOptions()
+	if err != nil {
+		return nil, err
+	}
+	source, err := loader.NewLoaderWithOptions(sourceOptions)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to source %s:%d: %v", config.Source.Host, config.Source.Port, err)
+	}
+	defer source.Close()
+	targetOptions, err := config.Target.LoaderOptions()
+	if err != nil {
+		return nil, err
+	}
+	target, err := loader.NewLoaderWithOptions(targetOptions)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to target %s:%d: %v", config.Target.Host, config.Target.Port, err)
 	}
+	defer target.Close()
+	log.Infof("Taking a snapshot of %s:%d", config.Source.Host, config.Source.Port)
+	return replicator.Snapshot(source, target, replicator.SnapshotOptions{
+		Filter:     config.Filter,
+		Routes:     router,
+		ChunkRows:  config.Snapshot.ChunkRows,
+		BatchRows:  config.Apply.BatchRows,
+		DropTables: config.Snapshot.DropTables,
+		KeepTables: config.Snapshot.KeepTables,
+	})
 }
@@ -0,0 +1,26 @@
+// Package memstore is a checkpoint store keeping checkpoints in memory, for
+// the tests of the packages outside of replicator
+package memstore
+
+import (
+	"mysqlreplicator/replicator"
+)
+
+// Store records the checkpoints saved, it is not transactional
+type Store struct {
+	Saved []*replicator.Checkpoint
+}
+
+// Load returns no checkpoint
+func (s *Store) Load() (*replicator.Checkpoint, error) {
+	return nil, nil
+}
+
+func (s *Store) Save(c *replicator.Checkpoint) error {
+	s.Saved = append(s.Saved, c)
+	return nil
+}
+
+func (s *Store) Transactional() bool {
+	return false
+}
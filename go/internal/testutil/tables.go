@@ -0,0 +1,49 @@
+package testutil
+
+import (
+	"strings"
+
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// Table returns test.name with an int id column, the primary key with pk,
+// followed by columns written as "name type"
+func Table(name string, pk bool, columns ...string) *schema.Table {
+	table := &schema.Table{Schema: "test", Name: name}
+	table.AddColumn("id", "int", "", "")
+	for _, column := range columns {
+		spec := strings.SplitN(column, " ", 2)
+		table.AddColumn(spec[0], spec[1], "", "")
+	}
+	if pk {
+		table.PKColumns = []int{0}
+	}
+	return table
+}
+
+// OrdersTable is shop.orders, an id primary key and a status
+func OrdersTable() *schema.Table {
+	table := &schema.Table{Schema: "shop", Name: "orders"}
+	table.AddColumn("id", "int", "", "")
+	table.AddColumn("status", "varchar(10)", "", "")
+	table.PKColumns = []int{0}
+	return table
+}
+
+// DataTypesTable mirrors createTableSpec of the dmlbuilder tests as canal
+// reads it from the source
+func DataTypesTable() *schema.Table {
+	table := &schema.Table{Schema: "test", Name: "testdatatypes"}
+	table.AddColumn("id", "int(8)", "", "")
+	table.AddColumn("d", "blob", "", "")
+	table.AddColumn("t", "text", "utf8mb4_general_ci", "")
+	table.AddColumn("f", "double", "", "")
+	table.AddColumn("de", "decimal(5,2)", "", "")
+	table.AddColumn("b", "bit(32)", "", "")
+	table.AddColumn("bool", "tinyint(1)", "", "")
+	table.AddColumn("datetimeval", "datetime(3)", "", "")
+	table.AddColumn("timestampval", "timestamp(3)", "", "")
+	table.AddColumn("size", "enum('A','B','C')", "utf8mb4_general_ci", "")
+	table.AddColumn("setvals", "set('A','B','C')", "utf8mb4_general_ci", "")
+	return table
+}
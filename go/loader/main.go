@@ -1,10 +1,12 @@
 package loader
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/juju/loggo"
 	"github.com/siddontang/go-mysql/client"
 	"github.com/siddontang/go-mysql/mysql"
+	"strings"
 )
 
 var (
@@ -17,6 +19,7 @@ type MySQLLoader interface {
 	ExecFunc(func(conn *client.Conn) error) error
 	Exec(string, ...interface{}) (*mysql.Result, error)
 	ExecBatch([]string) error
+	ExecStatements([]Statement) error
 	Begin() error
 	Commit() error
 	Rollback() error
@@ -27,7 +30,9 @@ type MySQLLoader interface {
 }
 
 type mySQLLoader struct {
-	client *client.Conn
+	client     *client.Conn
+	statements *statementCache
+	flavor     string
 }
 
 func NewDefaultLoader() (MySQLLoader, error) {
@@ -35,8 +40,47 @@ func NewDefaultLoader() (MySQLLoader, error) {
 }
 
 func NewLoader(host string, port int, user string, passwd string, db string) (MySQLLoader, error) {
+	return NewLoaderWithFlavor(host, port, user, passwd, db, mysql.MySQLFlavor)
+}
+
+// NewLoaderWithFlavor connects to a target server of the given flavor, mysql
+// or mariadb, the flavor selects how GTid reads the executed GTID set
+func NewLoaderWithFlavor(host string, port int, user string, passwd string, db string, flavor string) (MySQLLoader, error) {
+	return NewLoaderWithOptions(Options{Host: host, Port: port, User: user, Password: passwd, Database: db, Flavor: flavor})
+}
 
-	conn, err := client.Connect(fmt.Sprintf("%s:%d", host, port), user, passwd, "mysql")
+// Options are the connection settings of NewLoaderWithOptions
+type Options struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	// Database is created if missing and used by default, none when empty
+	Database string
+	Flavor   string
+	// TLS encrypts the connection when set. The authentication plugin, one
+	// of mysql_native_password, sha256_password and caching_sha2_password,
+	// is negotiated with the server, without TLS the sha256 plugins encrypt
+	// the password with the server public key
+	TLS *tls.Config
+	// StatementCache is the number of prepared statements kept open,
+	// DefaultStatementCache when 0
+	StatementCache int
+}
+
+func NewLoaderWithOptions(options Options) (MySQLLoader, error) {
+	flavor := options.Flavor
+	if flavor != mysql.MySQLFlavor && flavor != mysql.MariaDBFlavor {
+		return nil, fmt.Errorf("Unknown flavor %s", flavor)
+	}
+	db := options.Database
+
+	conn, err := client.Connect(fmt.Sprintf("%s:%d", options.Host, options.Port), options.User, options.Password, "mysql",
+		func(c *client.Conn) {
+			if options.TLS != nil {
+				c.SetTLSConfig(options.TLS)
+			}
+		})
 	if err != nil {
 		return nil, err
 	}
@@ -46,17 +90,30 @@ func NewLoader(host string, port int, user string, passwd string, db string) (My
 		return nil, err
 	}
 
-	if _, err := conn.Execute(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", db)); err != nil {
+	// TIMESTAMP values are replicated in UTC
+	if _, err := conn.Execute("SET time_zone = '+00:00'"); err != nil {
 		return nil, err
 	}
 
-	if err := conn.UseDB(db); err != nil {
-		return nil, err
+	// Without a database the connection is only read from, as the source of
+	// a snapshot
+	if db != "" {
+		if _, err := conn.Execute(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", strings.Replace(db, "`", "``", -1))); err != nil {
+			return nil, err
+		}
+
+		if err := conn.UseDB(db); err != nil {
+			return nil, err
+		}
 	}
 
 	instance := &mySQLLoader{
-		conn,
+		client: conn,
+		flavor: flavor,
 	}
+	instance.statements = newStatementCache(options.StatementCache, func(query string) (statement, error) {
+		return conn.Prepare(query)
+	})
 	return MySQLLoader(instance), nil
 }
 
@@ -87,7 +144,7 @@ func (l *mySQLLoader) Exec(query string, args ...interface{}) (*mysql.Result, er
 	if len(args) == 0 {
 		return l.client.Execute(query)
 	}
-	return l.client.Execute(query, args)
+	return l.client.Execute(query, args...)
 }
 
 func (l *mySQLLoader) ExecFunc(f func(client *client.Conn) error) error {
@@ -103,6 +160,21 @@ func (l *mySQLLoader) ExecBatch(queries []string) error {
 	return nil
 }
 
+// ExecStatements runs parameterised statements as prepared statements, the
+// most recently used queries stay prepared for the following calls
+func (l *mySQLLoader) ExecStatements(statements []Statement) error {
+	for _, s := range statements {
+		stmt, err := l.statements.get(s.Query)
+		if err != nil {
+			return fmt.Errorf("Error preparing \"%s\": %v", s.Query, err)
+		}
+		if _, err := stmt.Execute(s.Args...); err != nil {
+			return fmt.Errorf("Error running \"%s\": %v", s.Query, err)
+		}
+	}
+	return nil
+}
+
 func (l *mySQLLoader) Position() (string, uint64) {
 	var currentLog string = ""
 	var currentPos uint64 = 0
@@ -116,12 +188,27 @@ func (l *mySQLLoader) Position() (string, uint64) {
 }
 
 func (l *mySQLLoader) GTid() (mysql.GTIDSet, error) {
-	r, err := l.client.Execute("show global variables like 'gtid_executed';")
-	gtid, _ := mysql.ParseGTIDSet("mysql", string(r.Values[0][1].([]uint8)))
-	return gtid, err
+	variable := "gtid_executed"
+	if l.flavor == mysql.MariaDBFlavor {
+		variable = "gtid_current_pos"
+	}
+	r, err := l.client.Execute(fmt.Sprintf("show global variables like '%s';", variable))
+	if err != nil {
+		return nil, err
+	}
+	if r.RowNumber() == 0 {
+		return nil, fmt.Errorf("Variable %s not found", variable)
+	}
+	value, err := r.GetString(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	// gtid_executed lists one server per line
+	return mysql.ParseGTIDSet(l.flavor, strings.Replace(value, "\n", "", -1))
 }
 
 func (l *mySQLLoader) Close() error {
+	l.statements.close()
 	return l.client.Close()
 }
 
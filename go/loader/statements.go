@@ -0,0 +1,83 @@
+package loader
+
+import (
+	"container/list"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+// Statement is a query with "?" placeholders and the values bound to them,
+// values are never rendered into the query text
+type Statement struct {
+	Query string
+	Args  []interface{}
+}
+
+// DefaultStatementCache is the number of prepared statements a connection
+// keeps open. Servers allow max_prepared_stmt_count statements, 16382 by
+// default, across every connection
+const DefaultStatementCache = 256
+
+// statement is a prepared statement, *client.Stmt is a statement
+type statement interface {
+	Execute(args ...interface{}) (*mysql.Result, error)
+	Close() error
+}
+
+type cachedStatement struct {
+	query     string
+	statement statement
+}
+
+// statementCache keeps the most recently used prepared statements by query,
+// the least recently used one is closed when another query is prepared past
+// capacity. Batched statements have a query per row count, table and action
+type statementCache struct {
+	capacity int
+	prepare  func(query string) (statement, error)
+	// recent holds *cachedStatement, the most recently used first
+	recent  *list.List
+	entries map[string]*list.Element
+}
+
+func newStatementCache(capacity int, prepare func(query string) (statement, error)) *statementCache {
+	if capacity <= 0 {
+		capacity = DefaultStatementCache
+	}
+	return &statementCache{
+		capacity: capacity,
+		prepare:  prepare,
+		recent:   list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// get returns the prepared statement of query, preparing it if needed
+func (c *statementCache) get(query string) (statement, error) {
+	if e, ok := c.entries[query]; ok {
+		c.recent.MoveToFront(e)
+		return e.Value.(*cachedStatement).statement, nil
+	}
+	stmt, err := c.prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	c.entries[query] = c.recent.PushFront(&cachedStatement{query: query, statement: stmt})
+	for c.recent.Len() > c.capacity {
+		oldest := c.recent.Remove(c.recent.Back()).(*cachedStatement)
+		delete(c.entries, oldest.query)
+		if err := oldest.statement.Close(); err != nil {
+			log.Warningf("Unable to close statement \"%s\": %v", oldest.query, err)
+		}
+	}
+	return stmt, nil
+}
+
+// close closes every statement
+func (c *statementCache) close() {
+	for e := c.recent.Front(); e != nil; e = e.Next() {
+		_ = e.Value.(*cachedStatement).statement.Close()
+	}
+	c.recent.Init()
+	c.entries = make(map[string]*list.Element)
+}
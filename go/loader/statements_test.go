@@ -0,0 +1,56 @@
+package loader
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+type fakeStatement struct {
+	query  string
+	closed bool
+}
+
+func (s *fakeStatement) Execute(args ...interface{}) (*mysql.Result, error) {
+	return nil, nil
+}
+
+func (s *fakeStatement) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestStatementCacheEviction(t *testing.T) {
+	prepared := make(map[string][]*fakeStatement)
+	cache := newStatementCache(2, func(query string) (statement, error) {
+		if query == "broken" {
+			return nil, fmt.Errorf("syntax error")
+		}
+		stmt := &fakeStatement{query: query}
+		prepared[query] = append(prepared[query], stmt)
+		return stmt, nil
+	})
+	for _, query := range []string{"a", "b", "a", "c"} {
+		if _, err := cache.get(query); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	if len(prepared["a"]) != 1 || prepared["a"][0].closed {
+		t.Errorf("Expected the recently used statement to stay prepared, got %v", prepared["a"])
+	}
+	if !prepared["b"][0].closed || len(cache.entries) != 2 {
+		t.Errorf("Expected the least recently used statement to be closed, got %d cached", len(cache.entries))
+	}
+	if _, err := cache.get("b"); err != nil || len(prepared["b"]) != 2 || !prepared["a"][0].closed {
+		t.Errorf("Expected an evicted statement to be prepared again, got %v", err)
+	}
+	if _, err := cache.get("broken"); err == nil || len(cache.entries) != 2 {
+		t.Errorf("Expected the error of prepare, got %v", err)
+	}
+
+	cache.close()
+	if !prepared["c"][0].closed || !prepared["b"][1].closed || len(cache.entries) != 0 {
+		t.Errorf("Expected every statement to be closed")
+	}
+}
@@ -0,0 +1,104 @@
+package loader
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLS modes, named after the --ssl-mode values of the mysql client
+const (
+	TLSDisabled       = "disabled"
+	TLSRequired       = "required"
+	TLSVerifyCA       = "verify_ca"
+	TLSVerifyIdentity = "verify_identity"
+)
+
+// TLSConfig configures TLS on a connection from PEM files. Mode is disabled,
+// the default, required to encrypt without verifying the server, verify_ca to
+// verify the server certificate against CA, or verify_identity to also check
+// the certificate matches ServerName or the host connected to
+type TLSConfig struct {
+	Mode string `json:"mode" yaml:"mode" toml:"mode"`
+	// CA is the certificate authority of the server, the system pool is used
+	// when it is empty
+	CA string `json:"ca" yaml:"ca" toml:"ca"`
+	// Cert and Key are the client certificate and its key, both or none are set
+	Cert       string `json:"cert" yaml:"cert" toml:"cert"`
+	Key        string `json:"key" yaml:"key" toml:"key"`
+	ServerName string `json:"server_name" yaml:"server_name" toml:"server_name"`
+}
+
+// Enabled reports whether the connection uses TLS
+func (t TLSConfig) Enabled() bool {
+	return t.Mode != "" && t.Mode != TLSDisabled
+}
+
+// Build returns the tls.Config of a connection to host, nil when TLS is
+// disabled
+func (t TLSConfig) Build(host string) (*tls.Config, error) {
+	switch t.Mode {
+	case "", TLSDisabled:
+		return nil, nil
+	case TLSRequired, TLSVerifyCA, TLSVerifyIdentity:
+	default:
+		return nil, fmt.Errorf("Unknown TLS mode %s, expected %s, %s, %s or %s", t.Mode,
+			TLSDisabled, TLSRequired, TLSVerifyCA, TLSVerifyIdentity)
+	}
+
+	config := &tls.Config{ServerName: t.ServerName}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	if t.CA != "" {
+		pem, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read CA: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificate found in CA %s", t.CA)
+		}
+	} else if t.Mode == TLSVerifyCA {
+		return nil, fmt.Errorf("TLS mode %s requires a CA", t.Mode)
+	}
+	if t.Cert != "" || t.Key != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	switch t.Mode {
+	case TLSRequired:
+		config.InsecureSkipVerify = true
+	case TLSVerifyCA:
+		// The chain is verified without checking the host name
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = verifyChain(config.RootCAs)
+	}
+	return config, nil
+}
+
+func verifyChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return fmt.Errorf("Server sent no certificate")
+		}
+		certs := make([]*x509.Certificate, len(raw))
+		for i, der := range raw {
+			var err error
+			if certs[i], err = x509.ParseCertificate(der); err != nil {
+				return err
+			}
+		}
+		options := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range certs[1:] {
+			options.Intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(options)
+		return err
+	}
+}
@@ -0,0 +1,55 @@
+package loader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mysqlreplicator/internal/testutil"
+)
+
+func TestTLSConfigModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, cert := testutil.CA(t, dir)
+
+	for _, test := range []struct {
+		config TLSConfig
+		host   string
+		ok     bool
+	}{
+		{TLSConfig{Mode: TLSRequired}, "10.0.0.1", true},
+		{TLSConfig{Mode: TLSVerifyCA, CA: ca}, "10.0.0.1", true},
+		{TLSConfig{Mode: TLSVerifyIdentity, CA: ca}, "db.internal", true},
+		{TLSConfig{Mode: TLSVerifyIdentity, CA: ca, ServerName: "db.internal"}, "10.0.0.1", true},
+		{TLSConfig{Mode: TLSVerifyIdentity, CA: ca}, "10.0.0.1", false},
+		// The server certificate is not signed by the system pool
+		{TLSConfig{Mode: TLSVerifyIdentity}, "db.internal", false},
+	} {
+		config, err := test.config.Build(test.host)
+		if err != nil {
+			t.Fatalf("%+v: unexpected error %v", test.config, err)
+		}
+		if err := testutil.Handshake(t, config, cert); (err == nil) != test.ok {
+			t.Errorf("%+v to %s: expected success %v, got %v", test.config, test.host, test.ok, err)
+		}
+	}
+
+	if config, err := (TLSConfig{}).Build("db.internal"); config != nil || err != nil {
+		t.Errorf("Expected no TLS by default, got %v %v", config, err)
+	}
+	for _, config := range []TLSConfig{
+		{Mode: "prefer"},
+		{Mode: TLSVerifyCA},
+		{Mode: TLSRequired, CA: filepath.Join(dir, "missing.pem")},
+		{Mode: TLSRequired, Cert: ca},
+	} {
+		if _, err := config.Build("db.internal"); err == nil {
+			t.Errorf("%+v: expected error", config)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+// Package avro encodes change events as Avro records registered in a
+// Confluent schema registry
+package avro
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hamba/avro"
+	"github.com/shopspring/decimal"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+	"mysqlreplicator/replicator"
+	"mysqlreplicator/replicator/dmlbuilder"
+)
+
+// DefaultNamespace prefixes the names of the records without a namespace
+const DefaultNamespace = "mysqlreplicator"
+
+// magicByte starts the messages of the Confluent wire format, followed by the
+// schema id and the Avro binary encoding
+const magicByte = 0
+
+// Encoder encodes change events as Avro records in the Confluent wire format.
+// The record schemas of a table are derived from its columns and registered
+// with the subject of their full name, the record name strategy: the key is
+// "<namespace>.<schema>.<table>.Key" and the value is the Envelope record
+// holding the Value record of the row before and after the change. Schemas
+// are derived again when the table changes, registering a new version
+type Encoder struct {
+	registry  Registry
+	namespace string
+	location  *time.Location
+	mutex     sync.Mutex
+	// tables caches the schemas by source table
+	tables       map[string]*tableSchemas
+	schemaChange *registered
+}
+
+type registered struct {
+	schema avro.Schema
+	id     int
+	// api encodes with the schema, hamba/avro caches codecs by fingerprint
+	// and the fingerprint of a named reference is the name only, the
+	// versions of a record do not share a cache
+	api avro.API
+}
+
+type tableSchemas struct {
+	// namespace is the namespace of the records of the table
+	namespace string
+	value     *registered
+	// key is nil for tables without a primary key
+	key *registered
+}
+
+// NewEncoder returns an encoder registering schemas in registry, namespace is
+// DefaultNamespace when empty and TIMESTAMP values are decoded in location,
+// UTC when nil
+func NewEncoder(registry Registry, namespace string, location *time.Location) *Encoder {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	if location == nil {
+		location = time.UTC
+	}
+	return &Encoder{registry: registry, namespace: namespace, location: location, tables: make(map[string]*tableSchemas)}
+}
+
+// TableChanged drops the schemas of a table, they are derived and registered
+// again with the next event of the table
+func (e *Encoder) TableChanged(schema string, table string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	delete(e.tables, schema+"."+table)
+	return nil
+}
+
+// Encode returns the Envelope record of a row change or the SchemaChange
+// record of a DDL statement
+func (e *Encoder) Encode(event *replicator.ChangeEvent) ([]byte, error) {
+	if event.Action == replicator.DDLAction {
+		s, err := e.schemaChangeSchema()
+		if err != nil {
+			return nil, err
+		}
+		var table interface{}
+		if event.Table != "" {
+			table = event.Table
+		}
+		return e.marshal(s, map[string]interface{}{
+			"source": e.source(event),
+			"db":     event.Schema,
+			"table":  table,
+			"ddl":    event.Query,
+		})
+	}
+	op, ok := operations[event.Action]
+	if !ok {
+		return nil, fmt.Errorf("Unknown action %s", event.Action)
+	}
+	schemas, err := e.schemas(event)
+	if err != nil {
+		return nil, err
+	}
+	envelope := map[string]interface{}{
+		"before": nil,
+		"after":  nil,
+		"source": e.source(event),
+		"op":     op,
+	}
+	for name, values := range map[string][]interface{}{"before": event.Before, "after": event.After} {
+		if values == nil {
+			continue
+		}
+		row, err := e.row(event.Source, values, nil)
+		if err != nil {
+			return nil, err
+		}
+		// Unions holding records are maps keyed by the full name of the record
+		envelope[name] = map[string]interface{}{schemas.namespace + ".Value": row}
+	}
+	return e.marshal(schemas.value, envelope)
+}
+
+// EncodeKey returns the Key record of the primary key of the changed row, DDL
+// statements and rows of tables without a primary key have no key
+func (e *Encoder) EncodeKey(event *replicator.ChangeEvent) ([]byte, error) {
+	if event.Action == replicator.DDLAction {
+		return nil, nil
+	}
+	schemas, err := e.schemas(event)
+	if err != nil || schemas.key == nil {
+		return nil, err
+	}
+	values := event.After
+	if values == nil {
+		values = event.Before
+	}
+	key, err := e.row(event.Source, values, event.Source.PKColumns)
+	if err != nil {
+		return nil, err
+	}
+	return e.marshal(schemas.key, key)
+}
+
+var operations = map[string]string{
+	canal.InsertAction: "c",
+	canal.UpdateAction: "u",
+	canal.DeleteAction: "d",
+}
+
+func (e *Encoder) marshal(r *registered, v interface{}) ([]byte, error) {
+	b, err := r.api.Marshal(r.schema, v)
+	if err != nil {
+		return nil, err
+	}
+	message := make([]byte, 5, 5+len(b))
+	message[0] = magicByte
+	binary.BigEndian.PutUint32(message[1:], uint32(r.id))
+	return append(message, b...), nil
+}
+
+// schemas returns the registered schemas of the table of event
+func (e *Encoder) schemas(event *replicator.ChangeEvent) (*tableSchemas, error) {
+	table := event.Source
+	if table == nil {
+		return nil, fmt.Errorf("No table for %s event on %s.%s", event.Action, event.Schema, event.Table)
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if schemas, ok := e.tables[table.String()]; ok {
+		return schemas, nil
+	}
+	namespace := e.namespace + "." + Name(event.Schema) + "." + Name(event.Table)
+	value, err := e.register(namespace+".Envelope", envelopeSchema(namespace, table))
+	if err != nil {
+		return nil, err
+	}
+	schemas := &tableSchemas{namespace: namespace, value: value}
+	if len(table.PKColumns) > 0 {
+		if schemas.key, err = e.register(namespace+".Key", keySchema(namespace, table)); err != nil {
+			return nil, err
+		}
+	}
+	e.tables[table.String()] = schemas
+	return schemas, nil
+}
+
+func (e *Encoder) schemaChangeSchema() (*registered, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.schemaChange != nil {
+		return e.schemaChange, nil
+	}
+	s := record{
+		Type:      "record",
+		Name:      "SchemaChange",
+		Namespace: e.namespace,
+		Fields: []field{
+			{Name: "source", Type: sourceSchema},
+			{Name: "db", Type: "string"},
+			{Name: "table", Type: []interface{}{"null", "string"}, Default: null},
+			{Name: "ddl", Type: "string"},
+		},
+	}
+	var err error
+	e.schemaChange, err = e.register(e.namespace+".SchemaChange", s)
+	return e.schemaChange, err
+}
+
+func (e *Encoder) register(subject string, s record) (*registered, error) {
+	definition, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := avro.ParseWithCache(string(definition), "", &avro.SchemaCache{})
+	if err != nil {
+		return nil, fmt.Errorf("Invalid schema for %s: %v", subject, err)
+	}
+	id, err := e.registry.Register(subject, string(definition))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to register schema of %s: %v", subject, err)
+	}
+	return &registered{schema: parsed, id: id, api: avro.Config{}.Freeze()}, nil
+}
+
+func (e *Encoder) source(event *replicator.ChangeEvent) map[string]interface{} {
+	db, table := event.Schema, event.Table
+	if event.Source != nil {
+		db, table = event.Source.Schema, event.Source.Name
+	}
+	var gtid interface{}
+	if event.GTID != "" {
+		gtid = event.GTID
+	}
+	return map[string]interface{}{
+		"server_id": int64(event.ServerID),
+		"file":      event.Pos.Name,
+		"pos":       int64(event.Pos.Pos),
+		"gtid":      gtid,
+		"db":        db,
+		"table":     table,
+		"row":       int32(event.Row),
+		"ts_ms":     int64(event.Timestamp) * 1000,
+	}
+}
+
+// row returns the record of the given columns of values, every column when
+// columns is nil
+func (e *Encoder) row(table *schema.Table, values []interface{}, columns []int) (map[string]interface{}, error) {
+	if columns == nil {
+		columns = make([]int, len(table.Columns))
+		for i := range columns {
+			columns[i] = i
+		}
+	}
+	r := make(map[string]interface{}, len(columns))
+	for _, i := range columns {
+		column := &table.Columns[i]
+		var value interface{}
+		if i < len(values) {
+			var err error
+			if value, err = e.value(column, values[i]); err != nil {
+				return nil, err
+			}
+		}
+		r[Name(column.Name)] = value
+	}
+	return r, nil
+}
+
+// value converts a binlog value into the Go type hamba/avro encodes as the
+// type of columnType
+func (e *Encoder) value(column *schema.TableColumn, c interface{}) (interface{}, error) {
+	v, err := dmlbuilder.ColumnValue(column, c)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	name, args := dmlbuilder.TypeArgs(column)
+	switch column.Type {
+	case schema.TYPE_NUMBER:
+		n, ok := toInt64(v)
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("Invalid value %v for %s %s", v, column.Name, column.RawType)
+		case name == "bigint" && column.IsUnsigned:
+			return new(big.Rat).SetInt(new(big.Int).SetUint64(uint64(n))), nil
+		case integerType(column) == "long":
+			return n, nil
+		}
+		return int32(n), nil
+	case schema.TYPE_FLOAT:
+		f, ok := v.(float64)
+		if f32, is32 := v.(float32); is32 {
+			f, ok = float64(f32), true
+		}
+		if !ok {
+			return nil, fmt.Errorf("Invalid value %v for %s %s", v, column.Name, column.RawType)
+		}
+		if name == "float" {
+			return float32(f), nil
+		}
+		return f, nil
+	case schema.TYPE_DECIMAL:
+		var r *big.Rat
+		var ok bool
+		switch d := v.(type) {
+		case decimal.Decimal:
+			r, ok = new(big.Rat).SetString(d.String())
+		case float64:
+			r, ok = new(big.Rat).SetFloat64(d), true
+		default:
+			r, ok = new(big.Rat).SetString(fmt.Sprint(v))
+		}
+		if !ok {
+			return nil, fmt.Errorf("Invalid value %v for %s %s", v, column.Name, column.RawType)
+		}
+		return r, nil
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP, schema.TYPE_DATE:
+		location := time.UTC
+		if column.Type == schema.TYPE_TIMESTAMP {
+			location = e.location
+		}
+		layout := "2006-01-02 15:04:05.999999"
+		if column.Type == schema.TYPE_DATE {
+			layout = "2006-01-02"
+		}
+		t, err := time.ParseInLocation(layout, fmt.Sprint(v), location)
+		if err != nil {
+			// Zero dates have no representation
+			return nil, nil
+		}
+		return t.UTC(), nil
+	case schema.TYPE_TIME:
+		return dmlbuilder.TimeMicros(fmt.Sprint(v))
+	case schema.TYPE_BIT:
+		bits, _ := v.(uint64)
+		if len(args) == 0 || args[0] == 1 {
+			return bits != 0, nil
+		}
+		return int64(bits), nil
+	}
+	return v, nil
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case int:
+		return int64(n), true
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), true
+	case uint:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// Name replaces the characters Avro names do not allow with underscores
+func Name(s string) string {
+	var b strings.Builder
+	for i, c := range []rune(s) {
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9' {
+			b.WriteRune(c)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
@@ -0,0 +1,308 @@
+package avro
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hamba/avro"
+	"github.com/shopspring/decimal"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+	"mysqlreplicator/replicator"
+)
+
+// registryStub serves the registration endpoint of a Confluent schema
+// registry, new versions of a subject must read the data of the previous one
+type registryStub struct {
+	sync.Mutex
+	*httptest.Server
+	ids      map[string]int
+	schemas  map[int]avro.Schema
+	versions map[string][]int
+	username string
+}
+
+func newRegistryStub() *registryStub {
+	r := &registryStub{ids: make(map[string]int), schemas: make(map[int]avro.Schema), versions: make(map[string][]int)}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	return r
+}
+
+func (r *registryStub) serve(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+	subject := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/subjects/"), "/versions")
+	if req.Method != "POST" || subject == req.URL.Path {
+		http.NotFound(w, req)
+		return
+	}
+	if user, _, _ := req.BasicAuth(); user != r.username {
+		r.fail(w, http.StatusUnauthorized, 401, "Unauthorized")
+		return
+	}
+	var body struct {
+		Schema string `json:"schema"`
+	}
+	json.NewDecoder(req.Body).Decode(&body)
+	parsed, err := avro.ParseWithCache(body.Schema, "", &avro.SchemaCache{})
+	if err != nil {
+		r.fail(w, http.StatusUnprocessableEntity, 42201, "Invalid schema "+err.Error())
+		return
+	}
+	id, ok := r.ids[body.Schema]
+	if !ok {
+		if versions := r.versions[subject]; len(versions) > 0 {
+			previous := r.schemas[versions[len(versions)-1]]
+			if err := avro.NewSchemaCompatibility().Compatible(parsed, previous); err != nil {
+				r.fail(w, http.StatusConflict, 409, "Schema being registered is incompatible with an earlier schema")
+				return
+			}
+		}
+		id = len(r.ids) + 1
+		r.ids[body.Schema] = id
+		r.schemas[id] = parsed
+	}
+	if versions := r.versions[subject]; len(versions) == 0 || versions[len(versions)-1] != id {
+		r.versions[subject] = append(versions, id)
+	}
+	fmt.Fprintf(w, `{"id":%d}`, id)
+}
+
+func (r *registryStub) fail(w http.ResponseWriter, status int, code int, message string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error_code":%d,"message":%q}`, code, message)
+}
+
+// decode reads a message in the Confluent wire format
+func (r *registryStub) decode(t *testing.T, message []byte) (int, map[string]interface{}) {
+	if len(message) < 5 || message[0] != magicByte {
+		t.Fatalf("Invalid message %v", message)
+	}
+	id := int(binary.BigEndian.Uint32(message[1:5]))
+	r.Lock()
+	s := r.schemas[id]
+	r.Unlock()
+	if s == nil {
+		t.Fatalf("Unknown schema id %d", id)
+	}
+	var v map[string]interface{}
+	if err := (avro.Config{}).Freeze().Unmarshal(s, message[5:], &v); err != nil {
+		t.Fatalf("Unable to decode message: %v", err)
+	}
+	return id, v
+}
+
+// unwrap returns the value of a decoded union, which is a map keyed by the
+// name of its type
+func unwrap(v interface{}) interface{} {
+	if m, ok := v.(map[string]interface{}); ok && len(m) == 1 {
+		for _, value := range m {
+			return value
+		}
+	}
+	return v
+}
+
+// typedOrdersTable is shop.orders with a column of each type mapped to Avro,
+// unlike testutil.OrdersTable, and varchar columns added after them
+func typedOrdersTable(columns ...string) *schema.Table {
+	table := &schema.Table{Schema: "shop", Name: "orders"}
+	table.AddColumn("id", "bigint(20) unsigned", "", "")
+	table.AddColumn("total", "decimal(10,2)", "", "")
+	table.AddColumn("created", "datetime(6)", "", "")
+	table.AddColumn("paid", "timestamp", "", "")
+	table.AddColumn("day", "date", "", "")
+	table.AddColumn("status", "enum('new','paid')", "utf8mb4_general_ci", "")
+	table.AddColumn("note", "text", "utf8mb4_general_ci", "")
+	table.AddColumn("data", "blob", "", "")
+	table.AddColumn("elapsed", "time", "", "")
+	table.AddColumn("flags", "bit(8)", "", "")
+	table.AddColumn("ratio", "float", "", "")
+	table.AddColumn("qty", "smallint(5) unsigned", "", "")
+	table.AddColumn("item-count", "int(11)", "", "")
+	for _, column := range columns {
+		table.AddColumn(column, "varchar(10)", "utf8mb4_general_ci", "")
+	}
+	table.PKColumns = []int{0}
+	return table
+}
+
+func orderRow() []interface{} {
+	total, _ := decimal.NewFromString("12.50")
+	return []interface{}{
+		int64(-1), total, "2001-01-01 13:10:12.000001", "2001-01-01 10:10:12", "2001-01-01", int64(2),
+		[]byte("first order"), []byte{0, 1}, "-01:00:00", int64(5), float32(0.5), int16(-1), int32(3),
+	}
+}
+
+func orderEvent(table *schema.Table, action string, before, after []interface{}) *replicator.ChangeEvent {
+	return &replicator.ChangeEvent{
+		Action: action, Schema: "archive", Table: "orders", Source: table, Before: before, After: after,
+		ServerID: 100, Timestamp: 978340212, Row: 1,
+		Pos:  mysql.Position{Name: "mysql-bin.000003", Pos: 4721},
+		GTID: "3e11fa47-71ca-11e1-9e33-c80aa9429562:23",
+	}
+}
+
+func TestEncodeRecords(t *testing.T) {
+	registry := newRegistryStub()
+	defer registry.Close()
+	location, _ := time.LoadLocation("Europe/Paris")
+	encoder := NewEncoder(NewRegistryClient(registry.URL), "", location)
+	event := orderEvent(typedOrdersTable(), canal.InsertAction, nil, orderRow())
+
+	value, err := encoder.Encode(event)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	_, envelope := registry.decode(t, value)
+	after := unwrap(envelope["after"]).(map[string]interface{})
+	expected := map[string]string{
+		"total":      "25/2",
+		"created":    "2001-01-01 13:10:12.000001 +0000 UTC",
+		"paid":       "2001-01-01 09:10:12 +0000 UTC",
+		"day":        "2001-01-01 00:00:00 +0000 UTC",
+		"status":     "paid",
+		"note":       "first order",
+		"data":       "[0 1]",
+		"elapsed":    "-3600000000",
+		"flags":      "5",
+		"ratio":      "0.5",
+		"qty":        "65535",
+		"item_count": "3",
+	}
+	for column, v := range expected {
+		if got := fmt.Sprint(unwrap(after[column])); got != v {
+			t.Errorf("Expected %s for %s, got %s", v, column, got)
+		}
+	}
+	source := envelope["source"].(map[string]interface{})
+	if envelope["before"] != nil || envelope["op"] != "c" || source["table"] != "orders" || source["db"] != "shop" || source["pos"] != int64(4721) || source["row"] != 1 {
+		t.Fatalf("Unexpected envelope %v", envelope)
+	}
+	if versions := registry.versions["mysqlreplicator.archive.orders.Envelope"]; len(versions) != 1 {
+		t.Fatalf("Expected the envelope subject, got %v", registry.versions)
+	}
+
+	key, err := encoder.EncodeKey(event)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	// The decoder of hamba/avro truncates decimals to int64, the unsigned
+	// BIGINT is checked in its two's complement encoding
+	if expected := []byte{18, 0, 255, 255, 255, 255, 255, 255, 255, 255}; string(key[5:]) != string(expected) {
+		t.Fatalf("Unexpected key %v", key)
+	}
+
+	ddl := &replicator.ChangeEvent{Action: replicator.DDLAction, Schema: "archive", Table: "orders", Query: "ALTER TABLE orders ADD COLUMN c int"}
+	if value, err = encoder.Encode(ddl); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, record := registry.decode(t, value); record["ddl"] != ddl.Query || unwrap(record["table"]) != "orders" {
+		t.Fatalf("Unexpected schema change %v", record)
+	}
+	if key, err = encoder.EncodeKey(ddl); key != nil || err != nil {
+		t.Fatalf("DDL should have no key, got %v %v", key, err)
+	}
+}
+
+type encodingSink struct {
+	encoder  *Encoder
+	messages [][]byte
+}
+
+func (s *encodingSink) Publish(events []*replicator.ChangeEvent) error {
+	for _, event := range events {
+		message, err := s.encoder.Encode(event)
+		if err != nil {
+			return err
+		}
+		s.messages = append(s.messages, message)
+	}
+	return nil
+}
+
+func (s *encodingSink) Close() error {
+	return nil
+}
+
+func TestSchemaEvolution(t *testing.T) {
+	registry := newRegistryStub()
+	defer registry.Close()
+	encoder := NewEncoder(NewRegistryClient(registry.URL), "cdc", nil)
+	sink := &encodingSink{encoder: encoder}
+	handler := replicator.NewSinkHandler(sink, replicator.HandlerOptions{Schema: "archive", TableListener: encoder})
+	insert := func(table *schema.Table, pos uint32, values ...interface{}) error {
+		row := append(orderRow(), values...)
+		if err := handler.OnRow(&canal.RowsEvent{Table: table, Action: canal.InsertAction, Rows: [][]interface{}{row}}); err != nil {
+			return err
+		}
+		return handler.OnPosSynced(mysql.Position{Name: "log", Pos: pos}, false)
+	}
+	if err := insert(typedOrdersTable(), 100); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	// Canal reloads the table once the DDL is executed
+	if err := handler.OnTableChanged("shop", "orders"); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := insert(typedOrdersTable("coupon"), 200, "WELCOME"); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	subject := "cdc.archive.orders.Envelope"
+	if versions := registry.versions[subject]; len(versions) != 2 {
+		t.Fatalf("Expected a new version once the table changed, got %v", registry.versions)
+	}
+	first, _ := registry.decode(t, sink.messages[0])
+	second, envelope := registry.decode(t, sink.messages[1])
+	after := unwrap(envelope["after"]).(map[string]interface{})
+	if first == second || unwrap(after["coupon"]) != "WELCOME" {
+		t.Fatalf("Expected the new column with the new schema, got %v", after)
+	}
+
+	// A primary key column can not be added without breaking the readers
+	handler.OnTableChanged("shop", "orders")
+	table := typedOrdersTable("coupon")
+	table.PKColumns = []int{0, 13}
+	if err := insert(table, 300, "WELCOME"); err == nil || !strings.Contains(err.Error(), "incompatible") {
+		t.Fatalf("Expected the error of the registry, got %v", err)
+	}
+}
+
+func TestRegistryClient(t *testing.T) {
+	registry := newRegistryStub()
+	defer registry.Close()
+	registry.username = "replicator"
+	client := NewRegistryClient(registry.URL + "/")
+	s := `{"type":"record","name":"r","fields":[{"name":"a","type":"int"}]}`
+	if _, err := client.Register("r", s); err == nil || !strings.Contains(err.Error(), "Unauthorized (401)") {
+		t.Fatalf("Expected an authentication error, got %v", err)
+	}
+	client.Username = "replicator"
+	id, err := client.Register("r", s)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if again, _ := client.Register("r", s); again != id {
+		t.Fatalf("Registering a schema again should return its id")
+	}
+	if _, err := client.Register("r", "{"); err == nil {
+		t.Fatalf("Expected an error for an invalid schema")
+	}
+}
+
+func TestName(t *testing.T) {
+	for name, expected := range map[string]string{"item-count": "item_count", "1st": "_st", "été": "_t_", "": "_"} {
+		if got := Name(name); got != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, name, got)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package avro
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Registry assigns ids to the schemas registered under a subject, the id of
+// a schema already registered is returned again
+type Registry interface {
+	Register(subject string, schema string) (int, error)
+}
+
+const registryContentType = "application/vnd.schemaregistry.v1+json"
+
+// RegistryClient registers schemas with the REST API of a Confluent schema
+// registry, which checks their compatibility with the previous versions of
+// the subject
+type RegistryClient struct {
+	url string
+	// Username and Password authenticate with HTTP basic authentication
+	// when Username is set
+	Username string
+	Password string
+	Client   *http.Client
+}
+
+// NewRegistryClient returns a client of the registry at url
+func NewRegistryClient(url string) *RegistryClient {
+	return &RegistryClient{url: strings.TrimSuffix(url, "/"), Client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+type registryError struct {
+	Code    int    `json:"error_code"`
+	Message string `json:"message"`
+}
+
+// Register registers schema as a version of subject and returns its id
+func (c *RegistryClient) Register(subject string, schema string) (int, error) {
+	body, err := json.Marshal(map[string]string{"schema": schema})
+	if err != nil {
+		return 0, err
+	}
+	request, err := http.NewRequest("POST", c.url+"/subjects/"+url.PathEscape(subject)+"/versions", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", registryContentType)
+	request.Header.Set("Accept", registryContentType)
+	if c.Username != "" {
+		request.SetBasicAuth(c.Username, c.Password)
+	}
+	response, err := c.Client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		var e registryError
+		if err := json.NewDecoder(response.Body).Decode(&e); err != nil || e.Message == "" {
+			return 0, fmt.Errorf("Schema registry returned %s", response.Status)
+		}
+		return 0, fmt.Errorf("Schema registry returned %s: %s (%d)", response.Status, e.Message, e.Code)
+	}
+	var result struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("Invalid schema registry response: %v", err)
+	}
+	return result.ID, nil
+}
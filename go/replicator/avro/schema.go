@@ -0,0 +1,160 @@
+package avro
+
+import (
+	"encoding/json"
+
+	"github.com/siddontang/go-mysql/schema"
+	"mysqlreplicator/replicator/dmlbuilder"
+)
+
+// record is the JSON definition of an Avro record
+type record struct {
+	Type      string  `json:"type"`
+	Name      string  `json:"name"`
+	Namespace string  `json:"namespace,omitempty"`
+	Doc       string  `json:"doc,omitempty"`
+	Fields    []field `json:"fields"`
+}
+
+type field struct {
+	Name    string          `json:"name"`
+	Type    interface{}     `json:"type"`
+	Default json.RawMessage `json:"default,omitempty"`
+	Doc     string          `json:"doc,omitempty"`
+}
+
+type logical struct {
+	Type        string `json:"type"`
+	LogicalType string `json:"logicalType"`
+	Precision   int    `json:"precision,omitempty"`
+	Scale       int    `json:"scale,omitempty"`
+}
+
+var null = json.RawMessage("null")
+
+// sourceSchema describes where a change was read from, Pos is the position
+// its transaction ends at
+var sourceSchema = record{
+	Type:      "record",
+	Name:      "Source",
+	Namespace: DefaultNamespace,
+	Fields: []field{
+		{Name: "server_id", Type: "long"},
+		{Name: "file", Type: "string"},
+		{Name: "pos", Type: "long"},
+		{Name: "gtid", Type: []interface{}{"null", "string"}, Default: null},
+		{Name: "db", Type: "string"},
+		{Name: "table", Type: "string"},
+		{Name: "row", Type: "int"},
+		{Name: "ts_ms", Type: "long"},
+	},
+}
+
+// envelopeSchema is the record of a change of table, before and after are
+// Value records
+func envelopeSchema(namespace string, table *schema.Table) record {
+	value := record{Type: "record", Name: "Value", Namespace: namespace, Fields: columnFields(table, nil)}
+	return record{
+		Type:      "record",
+		Name:      "Envelope",
+		Namespace: namespace,
+		Fields: []field{
+			{Name: "before", Type: []interface{}{"null", value}, Default: null},
+			{Name: "after", Type: []interface{}{"null", "Value"}, Default: null},
+			{Name: "source", Type: sourceSchema},
+			{Name: "op", Type: "string"},
+		},
+	}
+}
+
+func keySchema(namespace string, table *schema.Table) record {
+	return record{Type: "record", Name: "Key", Namespace: namespace, Fields: columnFields(table, table.PKColumns)}
+}
+
+// columnFields returns the fields of the given columns, every column when
+// columns is nil. Canal does not report the nullability of columns, only
+// primary key columns are not nullable
+func columnFields(table *schema.Table, columns []int) []field {
+	if columns == nil {
+		columns = make([]int, len(table.Columns))
+		for i := range columns {
+			columns[i] = i
+		}
+	}
+	fields := make([]field, 0, len(columns))
+	for _, i := range columns {
+		column := &table.Columns[i]
+		f := field{Name: Name(column.Name), Type: columnType(column)}
+		if f.Name != column.Name {
+			f.Doc = column.Name
+		}
+		nullable := true
+		for _, pk := range table.PKColumns {
+			if pk == i {
+				nullable = false
+			}
+		}
+		if nullable {
+			f.Type, f.Default = []interface{}{"null", f.Type}, null
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// columnType maps a column to an Avro type, ENUM and SET values are strings as
+// their labels are not valid Avro names and TIME values are durations in
+// microseconds that can exceed a day
+func columnType(column *schema.TableColumn) interface{} {
+	name, args := dmlbuilder.TypeArgs(column)
+	switch column.Type {
+	case schema.TYPE_NUMBER:
+		if name == "bigint" && column.IsUnsigned {
+			return logical{Type: "bytes", LogicalType: "decimal", Precision: 20}
+		}
+		return integerType(column)
+	case schema.TYPE_FLOAT:
+		if name == "float" {
+			return "float"
+		}
+		return "double"
+	case schema.TYPE_DECIMAL:
+		d := logical{Type: "bytes", LogicalType: "decimal", Precision: 10}
+		if len(args) > 0 {
+			d.Precision = args[0]
+		}
+		if len(args) > 1 {
+			d.Scale = args[1]
+		}
+		return d
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP:
+		if len(args) > 0 && args[0] > 3 {
+			return logical{Type: "long", LogicalType: "timestamp-micros"}
+		}
+		return logical{Type: "long", LogicalType: "timestamp-millis"}
+	case schema.TYPE_DATE:
+		return logical{Type: "int", LogicalType: "date"}
+	case schema.TYPE_TIME:
+		return "long"
+	case schema.TYPE_BIT:
+		if len(args) == 0 || args[0] == 1 {
+			return "boolean"
+		}
+		return "long"
+	case schema.TYPE_STRING:
+		if dmlbuilder.IsBinary(column) {
+			return "bytes"
+		}
+	}
+	return "string"
+}
+
+// integerType is int for the integers an int32 holds, long otherwise
+func integerType(column *schema.TableColumn) string {
+	name, _ := dmlbuilder.TypeArgs(column)
+	switch {
+	case name == "bigint", name == "int" && column.IsUnsigned, name == "integer" && column.IsUnsigned:
+		return "long"
+	}
+	return "int"
+}
@@ -0,0 +1,935 @@
+package replicator
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+	"mysqlreplicator/internal/fileutil"
+	"mysqlreplicator/loader"
+	"mysqlreplicator/replicator/dmlbuilder"
+)
+
+// DefaultWatermarkTable is the source table backfill watermarks are written to
+const DefaultWatermarkTable = "replicator.backfill_watermarks"
+
+// ErrBackfillStopped is returned by Backfill.Run once Stop is called
+var ErrBackfillStopped = fmt.Errorf("Backfill stopped")
+
+// BackfillOptions configures a Backfill
+type BackfillOptions struct {
+	// Filter is the filter of the replicated tables, only replicated tables
+	// are backfilled and action filters are ignored
+	Filter Filter
+	// Tables are regular expressions on "schema.table" selecting the tables
+	// backfilled among the replicated ones, every one when empty
+	Tables []string
+	// Watermark is the "schema.table" source table watermarks are written
+	// to, DefaultWatermarkTable when empty. It is created if missing
+	Watermark string
+	// ChunkRows is the number of rows of a chunk, DefaultChunkRows when 0
+	ChunkRows int
+	// Progress saves the chunks copied, a backfill resumes from them. Every
+	// chunk is copied again after a restart when nil
+	Progress ProgressStore
+}
+
+// Backfill copies the source tables while their binlog is replicated by the
+// handler it wraps, following the watermarks of DBLog. Tables are split into
+// chunks of primary keys copied in parallel by Run: a chunk is read between a
+// low and a high watermark written to the source, and once canal reads the
+// high watermark the chunk rows are applied as an insert event of the
+// handler, without the rows the binlog changed between both watermarks. The
+// binlog always wins and chunks land with the semantics of binlog inserts,
+// the handler must not be in UpdateMode: a chunk applied again replaces rows.
+//
+// A chunk is done once the position of its high watermark is committed, the
+// chunks done are saved to the ProgressStore and skipped when the backfill
+// runs again. Canal must read the watermark table, see Filter
+type Backfill struct {
+	DefaultWDHandler
+	options   BackfillOptions
+	watermark [2]string
+	filter    *tableFilter
+	tables    []*regexp.Regexp
+	// mutex guards the windows read by canal and the workers
+	mutex   sync.Mutex
+	windows []*window
+	// closing are the windows closed by the current transaction and xid is
+	// set once it ends with a commit
+	closing []*window
+	xid     bool
+	// progressMutex guards the chunks and their saves
+	progressMutex sync.Mutex
+	stop          chan struct{}
+	stopOnce      sync.Once
+	run           int64
+	tokens        uint64
+	poll          time.Duration
+	heartbeat     time.Duration
+}
+
+// window tracks a chunk between its watermarks
+type window struct {
+	table     *schema.Table
+	low, high string
+	// open is set once canal read the low watermark, closed once it read
+	// the high watermark
+	open, closed bool
+	// stale is set when the table changed before the chunk was applied
+	stale bool
+	// truncate empties the target table once canal reads the high watermark,
+	// the window has no rows
+	truncate bool
+	// rows are the rows of the chunk and changed the primary keys the binlog
+	// changed since the low watermark
+	rows    [][]interface{}
+	changed map[string]bool
+	// pos ends the transaction the chunk was applied with
+	pos *mysql.Position
+}
+
+// NewBackfill returns a backfill applying chunks with handler
+func NewBackfill(handler DefaultWDHandler, options BackfillOptions) (*Backfill, error) {
+	if options.Watermark == "" {
+		options.Watermark = DefaultWatermarkTable
+	}
+	watermark := strings.SplitN(options.Watermark, ".", 2)
+	if len(watermark) != 2 || watermark[0] == "" || watermark[1] == "" {
+		return nil, fmt.Errorf("Invalid watermark table %s, expected <schema>.<table>", options.Watermark)
+	}
+	if options.ChunkRows <= 0 {
+		options.ChunkRows = DefaultChunkRows
+	}
+	filter, err := options.Filter.compile()
+	if err != nil {
+		return nil, err
+	}
+	tables, err := compileAll(options.Tables)
+	if err != nil {
+		return nil, err
+	}
+	return &Backfill{
+		DefaultWDHandler: handler,
+		options:          options,
+		watermark:        [2]string{watermark[0], watermark[1]},
+		filter:           filter,
+		tables:           tables,
+		stop:             make(chan struct{}),
+		run:              time.Now().UnixNano(),
+		poll:             100 * time.Millisecond,
+		heartbeat:        time.Second,
+	}, nil
+}
+
+func (b *Backfill) watermarkRegex() string {
+	return "^" + regexp.QuoteMeta(b.watermark[0]+"."+b.watermark[1]) + "$"
+}
+
+// Filter returns filter with the watermark table included, canal must be
+// created with it
+func (b *Backfill) Filter(filter Filter) Filter {
+	if len(filter.IncludeSchemas)+len(filter.IncludeTables) == 0 {
+		return filter
+	}
+	filter.IncludeTables = append(append([]string{}, filter.IncludeTables...), b.watermarkRegex())
+	return filter
+}
+
+// SetFilter passes filter on to the handler without the watermark table, its
+// rows and DDL are never applied
+func (b *Backfill) SetFilter(filter Filter) error {
+	f, ok := b.DefaultWDHandler.(Filterable)
+	if !ok {
+		return nil
+	}
+	filter.ExcludeTables = append(append([]string{}, filter.ExcludeTables...), b.watermarkRegex())
+	return f.SetFilter(filter)
+}
+
+func (b *Backfill) CheckpointStore() CheckpointStore {
+	if c, ok := b.DefaultWDHandler.(Checkpointer); ok {
+		return c.CheckpointStore()
+	}
+	return nil
+}
+
+// Failures receives the errors of the handler outside of events
+func (b *Backfill) Failures() <-chan error {
+	if f, ok := b.DefaultWDHandler.(Failing); ok {
+		return f.Failures()
+	}
+	return nil
+}
+
+// Close stops the workers and closes the handler
+func (b *Backfill) Close() error {
+	b.Stop()
+	if c, ok := b.DefaultWDHandler.(interface{ Close() error }); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Stop stops the workers, Run returns ErrBackfillStopped
+func (b *Backfill) Stop() {
+	b.stopOnce.Do(func() { close(b.stop) })
+}
+
+func (b *Backfill) OnRow(ev *canal.RowsEvent) error {
+	if ev.Table == nil {
+		return b.DefaultWDHandler.OnRow(ev)
+	}
+	if ev.Table.Schema == b.watermark[0] && ev.Table.Name == b.watermark[1] {
+		return b.onWatermark(ev)
+	}
+	b.mutex.Lock()
+	for _, w := range b.windows {
+		if w.open && !w.closed && w.table.Schema == ev.Table.Schema && w.table.Name == ev.Table.Name {
+			// Before and after images, a changed primary key drops both rows
+			for _, row := range ev.Rows {
+				w.changed[rowKey(ev.Table, row)] = true
+			}
+		}
+	}
+	b.mutex.Unlock()
+	return b.DefaultWDHandler.OnRow(ev)
+}
+
+// onWatermark opens and closes the windows of the watermarks of ev, the rows
+// of a closed window are applied in the transaction of its high watermark
+func (b *Backfill) onWatermark(ev *canal.RowsEvent) error {
+	column := ev.Table.FindColumn("value")
+	if column < 0 || ev.Action == canal.DeleteAction {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i, row := range ev.Rows {
+		if ev.Action == canal.UpdateAction && i%2 == 0 || column >= len(row) {
+			continue
+		}
+		value := fmt.Sprintf("%s", row[column])
+		for _, w := range b.windows {
+			switch value {
+			case w.low:
+				w.open = true
+			case w.high:
+				// A replayed watermark applies the chunk again
+				w.closed = true
+				if !w.open {
+					w.stale = true
+				}
+				b.closing = append(b.closing, w)
+				var err error
+				if !w.stale && w.truncate {
+					err = b.truncateTarget(w.table, ev)
+				} else if !w.stale {
+					err = b.apply(w, ev)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// apply passes the rows of w the binlog did not change to the handler
+func (b *Backfill) apply(w *window, ev *canal.RowsEvent) error {
+	var rows [][]interface{}
+	for _, row := range w.rows {
+		if !w.changed[rowKey(w.table, row)] {
+			rows = append(rows, row)
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return b.DefaultWDHandler.OnRow(&canal.RowsEvent{Table: w.table, Action: canal.InsertAction, Rows: rows, Header: ev.Header})
+}
+
+// truncateTarget passes a TRUNCATE TABLE statement of table to the handler as
+// if canal read it from the binlog
+func (b *Backfill) truncateTarget(table *schema.Table, ev *canal.RowsEvent) error {
+	if err := b.DefaultWDHandler.OnTableChanged(table.Schema, table.Name); err != nil {
+		return err
+	}
+	var pos mysql.Position
+	if ev.Header != nil {
+		pos.Pos = ev.Header.LogPos
+	}
+	return b.DefaultWDHandler.OnDDL(pos, &replication.QueryEvent{
+		Schema: []byte(table.Schema),
+		Query:  []byte("TRUNCATE TABLE " + quoteName(table.Name)),
+	})
+}
+
+func (b *Backfill) OnXID(nextPos mysql.Position) error {
+	b.mutex.Lock()
+	b.xid = true
+	b.mutex.Unlock()
+	return b.DefaultWDHandler.OnXID(nextPos)
+}
+
+// OnPosSynced records the position the windows closed by the transaction are
+// applied at. The windows of a transaction the handler did not commit are
+// closed again when canal reads their high watermark again
+func (b *Backfill) OnPosSynced(pos mysql.Position, force bool) error {
+	err := b.DefaultWDHandler.OnPosSynced(pos, force)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, w := range b.closing {
+		if err == nil && b.xid {
+			w.pos = &pos
+		} else {
+			w.closed = false
+		}
+	}
+	b.closing, b.xid = nil, false
+	return err
+}
+
+// OnTableChanged drops the chunks of the table read before the change, they
+// are read again
+func (b *Backfill) OnTableChanged(schema string, table string) error {
+	b.mutex.Lock()
+	for _, w := range b.windows {
+		if !w.closed && w.table.Schema == schema && w.table.Name == table {
+			w.stale = true
+		}
+	}
+	b.mutex.Unlock()
+	return b.DefaultWDHandler.OnTableChanged(schema, table)
+}
+
+// rowKey returns the primary key of row as a string, the same for a row
+// decoded from the binlog and read by a query
+func rowKey(table *schema.Table, row []interface{}) string {
+	key := make([]interface{}, len(table.PKColumns))
+	for i, c := range table.PKColumns {
+		if c < len(row) {
+			key[i], _ = canonicalValue(&table.Columns[c], row[c])
+		}
+	}
+	return fmt.Sprintf("%v", key)
+}
+
+// canonicalValue renders a value of column as applied on targets, nil for
+// NULL. The binlog and the text protocol differ for the same value: DECIMAL
+// values are decoded as decimal.Decimal but read as "12.50", fractional
+// seconds are padded to the precision of the column by queries only
+func canonicalValue(column *schema.TableColumn, c interface{}) (interface{}, error) {
+	v, err := dmlbuilder.ColumnValue(column, c)
+	if v == nil || err != nil {
+		return nil, err
+	}
+	s := fmt.Sprintf("%v", v)
+	if b, ok := v.([]byte); ok {
+		s = string(b)
+	}
+	switch column.Type {
+	case schema.TYPE_DECIMAL:
+		var d decimal.Decimal
+		switch value := v.(type) {
+		case decimal.Decimal:
+			d = value
+		case float32:
+			d = decimal.NewFromFloat(float64(value))
+		case float64:
+			d = decimal.NewFromFloat(value)
+		default:
+			if d, err = decimal.NewFromString(s); err != nil {
+				return s, nil
+			}
+		}
+		return d.String(), nil
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP, schema.TYPE_TIME:
+		if strings.Contains(s, ".") {
+			s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+		}
+	}
+	return s, nil
+}
+
+// Run copies the chunks not done yet with a worker per source loader and
+// returns once they are all applied, canal must be running. Tables are split
+// into chunks the first time they are backfilled, tables without a primary
+// key are skipped
+func (b *Backfill) Run(sources []loader.MySQLLoader) error {
+	if len(sources) == 0 {
+		return fmt.Errorf("No source connection for the backfill")
+	}
+	if err := b.checkWatermark(); err != nil {
+		return err
+	}
+	if err := b.createWatermarkTable(sources[0]); err != nil {
+		return err
+	}
+	progress, err := b.load(sources[0])
+	if err != nil {
+		return err
+	}
+	var tasks []chunkTask
+	names := make([]string, 0, len(progress.Tables))
+	for name := range progress.Tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, chunk := range progress.Tables[name].Chunks {
+			if !chunk.Done {
+				tasks = append(tasks, chunkTask{progress.Tables[name], chunk})
+			}
+		}
+	}
+	log.Infof("Backfilling %d chunks of %d tables", len(tasks), len(names))
+	if err := b.copyAll(sources, tasks, progress); err != nil {
+		if err != ErrBackfillStopped {
+			b.Stop()
+		}
+		return err
+	}
+	log.Infof("Backfill of %d tables complete", len(names))
+	return nil
+}
+
+type chunkTask struct {
+	table *TableProgress
+	chunk *Chunk
+}
+
+// copyAll copies tasks with a worker per source until the first error, the
+// chunks done are saved into progress unless it is nil
+func (b *Backfill) copyAll(sources []loader.MySQLLoader, tasks []chunkTask, progress *BackfillProgress) error {
+	queue := make(chan chunkTask)
+	errs := make(chan error, len(sources))
+	cancel := make(chan struct{})
+	var cancelOnce sync.Once
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		wg.Add(1)
+		go func(worker int, source loader.MySQLLoader) {
+			defer wg.Done()
+			for t := range queue {
+				err := b.copyChunk(source, worker, t.table, t.chunk, cancel)
+				if err == nil {
+					err = b.done(progress, t.chunk)
+				}
+				if err == ErrBackfillStopped {
+					return
+				} else if err != nil {
+					errs <- fmt.Errorf("Unable to copy %s.%s: %v", t.table.Schema, t.table.Table, err)
+					cancelOnce.Do(func() { close(cancel) })
+					return
+				}
+			}
+		}(i+1, source)
+	}
+feed:
+	for _, t := range tasks {
+		select {
+		case queue <- t:
+		case <-cancel:
+			break feed
+		case <-b.stop:
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	case <-b.stop:
+		return ErrBackfillStopped
+	default:
+	}
+	return nil
+}
+
+// checkWatermark returns an error when canal does not read the watermark
+// table
+func (b *Backfill) checkWatermark() error {
+	if !b.filter.allows(b.watermark[0], b.watermark[1], "") {
+		return fmt.Errorf("The watermark table %s is not replicated", b.options.Watermark)
+	}
+	return nil
+}
+
+// ResyncOptions configures the resync of a table
+type ResyncOptions struct {
+	// Truncate empties the target table before it is copied, the target rows
+	// missing on the source are otherwise kept
+	Truncate bool
+	// Workers is the number of source connections copying chunks, 1 when 0
+	Workers int
+}
+
+// Resyncer is implemented by handlers copying a table again while the binlog
+// is replicated
+type Resyncer interface {
+	Resync(sources []loader.MySQLLoader, schema string, table string, options ResyncOptions) error
+}
+
+// Resync copies schema.table again with a worker per source, in chunks applied
+// as the chunks of Run. With options.Truncate the handler applies a TRUNCATE
+// TABLE statement of the table first, in the transaction of a watermark
+// written before the first chunk is read. Resyncs are not saved to the
+// progress store and the table must have a primary key
+func (b *Backfill) Resync(sources []loader.MySQLLoader, schemaName string, tableName string, options ResyncOptions) error {
+	if len(sources) == 0 {
+		return fmt.Errorf("No source connection for the resync")
+	}
+	if !b.filter.allows(schemaName, tableName, "") {
+		return fmt.Errorf("Table %s.%s is not replicated", schemaName, tableName)
+	}
+	if err := b.checkWatermark(); err != nil {
+		return err
+	}
+	if err := b.createWatermarkTable(sources[0]); err != nil {
+		return err
+	}
+	progress, err := b.plan(sources[0], schemaName, tableName)
+	if err != nil {
+		return fmt.Errorf("Unable to split %s.%s into chunks: %v", schemaName, tableName, err)
+	}
+	if progress == nil {
+		return fmt.Errorf("Table %s.%s has no primary key", schemaName, tableName)
+	}
+	if options.Truncate {
+		if err := b.truncate(sources[0], schemaName, tableName); err != nil {
+			return err
+		}
+	}
+	tasks := make([]chunkTask, len(progress.Chunks))
+	for i, chunk := range progress.Chunks {
+		tasks[i] = chunkTask{progress, chunk}
+	}
+	log.Infof("Resyncing %d chunks of %s.%s", len(tasks), schemaName, tableName)
+	if err := b.copyAll(sources, tasks, nil); err != nil {
+		return err
+	}
+	log.Infof("Resync of %s.%s complete", schemaName, tableName)
+	return nil
+}
+
+// truncate returns once the handler committed the truncation of the target
+// table, it is written again when the table changed meanwhile
+func (b *Backfill) truncate(source loader.MySQLLoader, schemaName string, tableName string) error {
+	for {
+		table, err := schema.NewTable(executer{source}, schemaName, tableName)
+		if err != nil {
+			return err
+		}
+		w := &window{table: table, high: b.token(0), open: true, truncate: true, changed: make(map[string]bool)}
+		b.register(w)
+		applied := false
+		if err = b.writeWatermark(source, 0, w.high); err == nil {
+			applied, err = b.wait(source, 0, w, nil)
+		}
+		b.unregister(w)
+		if err != nil || applied {
+			return err
+		}
+	}
+}
+
+func (b *Backfill) createWatermarkTable(source loader.MySQLLoader) error {
+	name := quoteName(b.watermark[0]) + "." + quoteName(b.watermark[1])
+	err := source.ExecBatch([]string{
+		"CREATE DATABASE IF NOT EXISTS " + quoteName(b.watermark[0]),
+		"CREATE TABLE IF NOT EXISTS " + name + " (id INT NOT NULL PRIMARY KEY, value VARCHAR(64) NOT NULL)",
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to create the watermark table %s: %v", b.options.Watermark, err)
+	}
+	return nil
+}
+
+// load returns the saved progress, the tables backfilled for the first time
+// are split into chunks
+func (b *Backfill) load(source loader.MySQLLoader) (*BackfillProgress, error) {
+	saved := &BackfillProgress{}
+	if b.options.Progress != nil {
+		loaded, err := b.options.Progress.Load()
+		if err != nil {
+			return nil, err
+		}
+		if loaded != nil {
+			saved = loaded
+		}
+	}
+	tables, err := snapshotTables(source, b.filter)
+	if err != nil {
+		return nil, err
+	}
+	// Tables dropped or no longer selected are forgotten
+	progress := &BackfillProgress{Tables: make(map[string]*TableProgress)}
+	for _, name := range tables {
+		key := name[0] + "." + name[1]
+		if name == b.watermark || len(b.tables) > 0 && !matchAny(b.tables, key) {
+			continue
+		}
+		if t, ok := saved.Tables[key]; ok {
+			progress.Tables[key] = t
+			continue
+		}
+		t, err := b.plan(source, name[0], name[1])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to split %s into chunks: %v", key, err)
+		}
+		if t == nil {
+			log.Warningf("Skipping backfill of %s without a primary key", key)
+			continue
+		}
+		progress.Tables[key] = t
+	}
+	if err := b.save(progress); err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
+
+// plan splits a table into chunks of ChunkRows rows, the table is nil
+// without a primary key
+func (b *Backfill) plan(source loader.MySQLLoader, schemaName string, tableName string) (*TableProgress, error) {
+	table, err := schema.NewTable(executer{source}, schemaName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	if len(table.PKColumns) == 0 {
+		return nil, nil
+	}
+	chunks, err := planChunks(source, table, b.options.ChunkRows)
+	if err != nil {
+		return nil, err
+	}
+	return &TableProgress{Schema: schemaName, Table: tableName, Chunks: chunks}, nil
+}
+
+// planChunks splits table into chunks of chunkRows rows by primary key, a
+// table without a primary key is a single chunk
+func planChunks(source loader.MySQLLoader, table *schema.Table, chunkRows int) ([]*Chunk, error) {
+	if len(table.PKColumns) == 0 {
+		return []*Chunk{{}}, nil
+	}
+	pk, placeholders := primaryKey(table)
+	name := quoteName(table.Schema) + "." + quoteName(table.Name)
+	var chunks []*Chunk
+	var from []interface{}
+	for {
+		query := fmt.Sprintf("SELECT %s FROM %s", pk, name)
+		if from != nil {
+			query += fmt.Sprintf(" WHERE (%s) > (%s)", pk, placeholders)
+		}
+		query += fmt.Sprintf(" ORDER BY %s LIMIT 1 OFFSET %d", pk, chunkRows-1)
+		res, err := source.Exec(query, from...)
+		if err != nil {
+			return nil, err
+		}
+		if res == nil || res.Resultset == nil || res.RowNumber() == 0 {
+			break
+		}
+		to := make([]interface{}, len(table.PKColumns))
+		for i, c := range table.PKColumns {
+			if to[i], err = dmlbuilder.ColumnValue(&table.Columns[c], res.Values[0][i]); err != nil {
+				return nil, err
+			}
+		}
+		chunks = append(chunks, &Chunk{From: from, To: to})
+		from = to
+	}
+	return append(chunks, &Chunk{From: from}), nil
+}
+
+// done saves chunk as done
+func (b *Backfill) done(progress *BackfillProgress, chunk *Chunk) error {
+	b.progressMutex.Lock()
+	defer b.progressMutex.Unlock()
+	chunk.Done = true
+	if progress == nil {
+		return nil
+	}
+	return b.saveLocked(progress)
+}
+
+func (b *Backfill) save(progress *BackfillProgress) error {
+	b.progressMutex.Lock()
+	defer b.progressMutex.Unlock()
+	return b.saveLocked(progress)
+}
+
+func (b *Backfill) saveLocked(progress *BackfillProgress) error {
+	if b.options.Progress == nil {
+		return nil
+	}
+	if err := b.options.Progress.Save(progress); err != nil {
+		return fmt.Errorf("Unable to save the backfill progress: %v", err)
+	}
+	return nil
+}
+
+// copyChunk copies a chunk between watermarks until it is applied, it is read
+// again when its table changed meanwhile
+func (b *Backfill) copyChunk(source loader.MySQLLoader, worker int, progress *TableProgress, chunk *Chunk, cancel <-chan struct{}) error {
+	for {
+		table, err := schema.NewTable(executer{source}, progress.Schema, progress.Table)
+		if err != nil {
+			return err
+		}
+		from, err := keyArgs(table, chunk.From)
+		if err != nil {
+			return err
+		}
+		to, err := keyArgs(table, chunk.To)
+		if err != nil {
+			return err
+		}
+		w := &window{table: table, low: b.token(worker), high: b.token(worker), changed: make(map[string]bool)}
+		b.register(w)
+		applied, err := b.copyWindow(source, worker, w, from, to, cancel)
+		b.unregister(w)
+		if err != nil || applied {
+			return err
+		}
+		log.Infof("Reading chunk (%v, %v] of %s again, the table changed", chunk.From, chunk.To, table)
+	}
+}
+
+func (b *Backfill) register(w *window) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.windows = append(b.windows, w)
+}
+
+func (b *Backfill) unregister(w *window) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i := range b.windows {
+		if b.windows[i] == w {
+			b.windows = append(b.windows[:i], b.windows[i+1:]...)
+			return
+		}
+	}
+}
+
+// copyWindow reads the chunk between the watermarks of w and waits until it
+// is applied, it returns false when the chunk must be read again
+func (b *Backfill) copyWindow(source loader.MySQLLoader, worker int, w *window, from []interface{}, to []interface{}, cancel <-chan struct{}) (bool, error) {
+	if err := b.writeWatermark(source, worker, w.low); err != nil {
+		return false, err
+	}
+	query, args := rangeQuery(w.table, from, to)
+	res, err := source.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	var rows [][]interface{}
+	if res != nil && res.Resultset != nil {
+		for _, values := range res.Values {
+			rows = append(rows, snapshotRow(w.table, values))
+		}
+	}
+	b.mutex.Lock()
+	w.rows = rows
+	b.mutex.Unlock()
+	if err := b.writeWatermark(source, worker, w.high); err != nil {
+		return false, err
+	}
+	return b.wait(source, worker, w, cancel)
+}
+
+// wait returns once the position the chunk of w was applied at is committed,
+// false when the table changed. Watermarks are written again while waiting
+// so that an idle source still moves the committed position. It returns
+// ErrBackfillStopped once the backfill is stopped or cancel closed
+func (b *Backfill) wait(source loader.MySQLLoader, worker int, w *window, cancel <-chan struct{}) (bool, error) {
+	ticker := time.NewTicker(b.poll)
+	defer ticker.Stop()
+	written := time.Now()
+	for {
+		select {
+		case <-b.stop:
+			return false, ErrBackfillStopped
+		case <-cancel:
+			return false, ErrBackfillStopped
+		case <-ticker.C:
+		}
+		b.mutex.Lock()
+		closed, stale, pos := w.closed, w.stale, w.pos
+		b.mutex.Unlock()
+		if closed && stale {
+			return false, nil
+		}
+		if committed := b.LastCommittedPos(); pos != nil && committed != nil && committed.Compare(*pos) >= 0 {
+			return true, nil
+		}
+		if time.Since(written) >= b.heartbeat {
+			if err := b.writeWatermark(source, worker, b.token(worker)); err != nil {
+				return false, err
+			}
+			written = time.Now()
+		}
+	}
+}
+
+// token returns a watermark value unique to the backfill
+func (b *Backfill) token(worker int) string {
+	return fmt.Sprintf("%x-%d-%d", b.run, worker, atomic.AddUint64(&b.tokens, 1))
+}
+
+// writeWatermark writes value into the row of worker in the watermark table
+func (b *Backfill) writeWatermark(source loader.MySQLLoader, worker int, value string) error {
+	name := quoteName(b.watermark[0]) + "." + quoteName(b.watermark[1])
+	_, err := source.Exec("INSERT INTO "+name+" (id, value) VALUES (?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)", worker, value)
+	if err != nil {
+		return fmt.Errorf("Unable to write watermark: %v", err)
+	}
+	return nil
+}
+
+// rangeQuery selects the rows of table with a primary key in (from, to], nil
+// bounds are open
+func rangeQuery(table *schema.Table, from []interface{}, to []interface{}) (string, []interface{}) {
+	pk, _ := primaryKey(table)
+	query := fmt.Sprintf("SELECT %s FROM %s.%s", selectColumns(table), quoteName(table.Schema), quoteName(table.Name))
+	where, args := rangeCondition(table, from, to)
+	return fmt.Sprintf("%s%s ORDER BY %s", query, where, pk), args
+}
+
+// rangeCondition returns the WHERE clause of the rows of table with a primary
+// key in (from, to], empty without bounds
+func rangeCondition(table *schema.Table, from []interface{}, to []interface{}) (string, []interface{}) {
+	pk, placeholders := primaryKey(table)
+	var where []string
+	var args []interface{}
+	if from != nil {
+		where = append(where, fmt.Sprintf("(%s) > (%s)", pk, placeholders))
+		args = append(args, from...)
+	}
+	if to != nil {
+		where = append(where, fmt.Sprintf("(%s) <= (%s)", pk, placeholders))
+		args = append(args, to...)
+	}
+	if len(where) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(where, " AND "), args
+}
+
+// keyArgs converts the primary key values of a chunk saved as JSON back into
+// query arguments: numbers are json.Number and binary strings base64
+func keyArgs(table *schema.Table, key []interface{}) ([]interface{}, error) {
+	if key == nil {
+		return nil, nil
+	}
+	if len(key) != len(table.PKColumns) {
+		return nil, fmt.Errorf("Chunk bound %v does not match the primary key of %s", key, table)
+	}
+	args := make([]interface{}, len(key))
+	for i, value := range key {
+		column := &table.Columns[table.PKColumns[i]]
+		args[i] = value
+		var err error
+		switch v := value.(type) {
+		case json.Number:
+			switch {
+			case column.Type == schema.TYPE_FLOAT:
+				args[i], err = v.Float64()
+			case column.IsUnsigned:
+				var n uint64
+				if _, err = fmt.Sscan(v.String(), &n); err == nil {
+					args[i] = n
+				}
+			default:
+				args[i], err = v.Int64()
+			}
+		case string:
+			if dmlbuilder.IsBinary(column) {
+				args[i], err = base64.StdEncoding.DecodeString(v)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid chunk bound %v for %s: %v", value, column.Name, err)
+		}
+	}
+	return args, nil
+}
+
+// BackfillProgress holds the chunks of the backfilled tables by
+// "schema.table"
+type BackfillProgress struct {
+	Tables map[string]*TableProgress `json:"tables"`
+}
+
+// TableProgress holds the chunks of a table in primary key order
+type TableProgress struct {
+	Schema string   `json:"schema"`
+	Table  string   `json:"table"`
+	Chunks []*Chunk `json:"chunks"`
+}
+
+// Chunk holds the rows with a primary key in (From, To], nil bounds are open
+type Chunk struct {
+	From []interface{} `json:"from"`
+	To   []interface{} `json:"to"`
+	Done bool          `json:"done"`
+}
+
+// ProgressStore saves the progress of a backfill, Load returns nil when
+// nothing was saved
+type ProgressStore interface {
+	Load() (*BackfillProgress, error)
+	Save(*BackfillProgress) error
+}
+
+type fileProgressStore struct {
+	path string
+}
+
+// NewFileProgressStore returns a store saving the progress as JSON in a file,
+// replaced atomically on every save
+func NewFileProgressStore(path string) ProgressStore {
+	return &fileProgressStore{path: path}
+}
+
+func (s *fileProgressStore) Load() (*BackfillProgress, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// Primary keys keep their precision
+	decoder.UseNumber()
+	progress := &BackfillProgress{}
+	if err := decoder.Decode(progress); err != nil {
+		return nil, fmt.Errorf("Invalid backfill progress file %s: %v", s.path, err)
+	}
+	return progress, nil
+}
+
+func (s *fileProgressStore) Save(progress *BackfillProgress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteAtomic(s.path, data)
+}
@@ -0,0 +1,347 @@
+package replicator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+	"mysqlreplicator/loader"
+)
+
+func watermarkTable() *schema.Table {
+	table := &schema.Table{Schema: "replicator", Name: "backfill_watermarks"}
+	table.AddColumn("id", "int", "", "")
+	table.AddColumn("value", "varchar(64)", "", "")
+	table.PKColumns = []int{0}
+	return table
+}
+
+func backfillTable() *schema.Table {
+	table := &schema.Table{Schema: "shop", Name: "orders"}
+	table.AddColumn("id", "int", "", "")
+	table.AddColumn("status", "varchar(10)", "", "")
+	table.PKColumns = []int{0}
+	return table
+}
+
+func newTestBackfill(t *testing.T, loader *MockLoader, options BackfillOptions) *Backfill {
+	handler := NewWdHandler(loader)
+	handler.SetPos(&mysql.Position{Name: "log", Pos: 100})
+	b, err := NewBackfill(handler, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.poll = time.Millisecond
+	b.heartbeat = time.Hour
+	return b
+}
+
+// commitWatermark passes the transaction writing value to the watermark table
+func commitWatermark(t *testing.T, b *Backfill, value string, pos uint32) {
+	if err := b.OnRow(&canal.RowsEvent{Table: watermarkTable(), Action: canal.UpdateAction, Rows: [][]interface{}{{1, "previous"}, {1, value}}}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	commit(t, b, pos)
+}
+
+func commit(t *testing.T, b *Backfill, pos uint32) {
+	if err := b.OnXID(mysql.Position{Name: "log", Pos: pos}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := b.OnPosSynced(mysql.Position{Name: "log", Pos: pos}, false); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
+
+func TestBackfillWindow(t *testing.T) {
+	loader := &MockLoader{}
+	b := newTestBackfill(t, loader, BackfillOptions{})
+	w := &window{table: backfillTable(), low: "low", high: "high", changed: make(map[string]bool)}
+	w.rows = [][]interface{}{{int32(1), "new"}, {int32(2), "new"}, {int32(3), "new"}}
+	b.windows = append(b.windows, w)
+
+	commitWatermark(t, b, "low", 200)
+	// The binlog wins over the rows read
+	update := &canal.RowsEvent{Table: backfillTable(), Action: canal.UpdateAction, Rows: [][]interface{}{{2, "new"}, {2, "paid"}}}
+	if err := b.OnRow(update); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	commit(t, b, 300)
+	commitWatermark(t, b, "high", 400)
+
+	if len(loader.queries) != 3 || fmt.Sprintf("%v", loader.args) != "[[2 paid] [1 new] [3 new]]" {
+		t.Fatalf("Expected the chunk without the changed row, got %v %v", loader.queries, loader.args)
+	}
+	if loader.commit != 2 {
+		t.Errorf("Expected the watermark transactions skipped, got %d commits", loader.commit)
+	}
+	if w.pos == nil || w.pos.Pos != 400 || !w.closed {
+		t.Errorf("Expected the chunk applied at the high watermark, got %v", w.pos)
+	}
+}
+
+func TestBackfillWindowDecimalKey(t *testing.T) {
+	loader := &MockLoader{}
+	b := newTestBackfill(t, loader, BackfillOptions{})
+	table := &schema.Table{Schema: "shop", Name: "prices"}
+	table.AddColumn("amount", "decimal(10,2)", "", "")
+	table.AddColumn("created", "datetime(3)", "", "")
+	table.AddColumn("label", "varchar(10)", "", "")
+	table.PKColumns = []int{0, 1}
+	w := &window{table: table, low: "low", high: "high", changed: make(map[string]bool)}
+	// Read by the text protocol
+	w.rows = [][]interface{}{{"12.50", "2001-01-01 13:10:12.500", []byte("old")}, {"13.00", "2001-01-01 13:10:12.000", []byte("old")}}
+	b.windows = append(b.windows, w)
+
+	commitWatermark(t, b, "low", 200)
+	amount, _ := decimal.NewFromString("12.5")
+	update := &canal.RowsEvent{Table: table, Action: canal.UpdateAction, Rows: [][]interface{}{
+		{amount, "2001-01-01 13:10:12.5", "old"}, {amount, "2001-01-01 13:10:12.5", "new"},
+	}}
+	if err := b.OnRow(update); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	commit(t, b, 300)
+	commitWatermark(t, b, "high", 400)
+
+	if len(loader.args) != 2 || fmt.Sprintf("%s", loader.args[1]) != "[13.00 2001-01-01 13:10:12.000 old]" {
+		t.Fatalf("Expected the chunk without the row changed by the binlog, got %s", loader.args)
+	}
+}
+
+func TestBackfillWindowNotCommitted(t *testing.T) {
+	loader := &MockLoader{}
+	b := newTestBackfill(t, loader, BackfillOptions{})
+	w := &window{table: backfillTable(), low: "low", high: "high", changed: make(map[string]bool)}
+	w.rows = [][]interface{}{{int32(1), "new"}}
+	b.windows = append(b.windows, w)
+	commitWatermark(t, b, "low", 200)
+
+	// Canal closed before the end of the transaction
+	if err := b.OnRow(&canal.RowsEvent{Table: watermarkTable(), Action: canal.InsertAction, Rows: [][]interface{}{{1, "high"}}}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := b.OnPosSynced(mysql.Position{Name: "log", Pos: 200}, true); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if w.closed || w.pos != nil || loader.rollback != 1 {
+		t.Fatalf("Expected the window open until the watermark is read again")
+	}
+	commitWatermark(t, b, "high", 300)
+	if w.pos == nil || w.pos.Pos != 300 || len(loader.args) != 2 {
+		t.Errorf("Expected the chunk applied again, got %v %v", w.pos, loader.args)
+	}
+}
+
+func TestBackfillTableChanged(t *testing.T) {
+	loader := &MockLoader{}
+	b := newTestBackfill(t, loader, BackfillOptions{})
+	w := &window{table: backfillTable(), low: "low", high: "high", changed: make(map[string]bool)}
+	w.rows = [][]interface{}{{int32(1), "new"}}
+	b.windows = append(b.windows, w)
+	commitWatermark(t, b, "low", 200)
+	if err := b.OnTableChanged("shop", "orders"); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	commitWatermark(t, b, "high", 300)
+	if !w.closed || !w.stale || len(loader.queries) != 0 {
+		t.Fatalf("Expected the chunk dropped, got %v", loader.queries)
+	}
+	if applied, err := b.wait(nil, 1, w, nil); applied || err != nil {
+		t.Errorf("Expected the chunk read again, got %v %v", applied, err)
+	}
+}
+
+func TestBackfillFilter(t *testing.T) {
+	loader := &MockLoader{}
+	b := newTestBackfill(t, loader, BackfillOptions{})
+	if filter := b.Filter(Filter{}); len(filter.IncludeTables) != 0 {
+		t.Errorf("Expected every table replicated, got %v", filter.IncludeTables)
+	}
+	filter := b.Filter(Filter{IncludeSchemas: []string{"shop"}})
+	compiled, _ := filter.compile()
+	if !compiled.allows("replicator", "backfill_watermarks", canal.InsertAction) {
+		t.Errorf("Expected canal to read the watermarks, got %v", filter.IncludeTables)
+	}
+	if err := b.SetFilter(filter); err != nil {
+		t.Fatal(err)
+	}
+	handler := b.DefaultWDHandler.(*defaultWDHandler)
+	if handler.filter.allows("replicator", "backfill_watermarks", DDLAction) || !handler.filter.allows("shop", "orders", DDLAction) {
+		t.Errorf("Expected the handler to skip the watermark table only")
+	}
+}
+
+// backfillSource passes the watermarks written to the source on to canal
+type backfillSource struct {
+	*snapshotSource
+	watermarks chan string
+}
+
+func (s *backfillSource) Exec(query string, args ...interface{}) (*mysql.Result, error) {
+	if strings.HasPrefix(query, "INSERT INTO `replicator`.`backfill_watermarks`") {
+		s.watermarks <- args[1].(string)
+		return &mysql.Result{}, nil
+	}
+	return s.snapshotSource.Exec(query, args...)
+}
+
+func newBackfillSource() *backfillSource {
+	source := newSnapshotSource()
+	source.results["SELECT `id` FROM `shop`.`orders` ORDER BY `id` LIMIT 1 OFFSET 1"] = [][]interface{}{{int32(2)}}
+	source.results["SELECT `id`,`status`,`flags` FROM `shop`.`orders` WHERE (`id`) <= (?) ORDER BY `id`[2]"] = [][]interface{}{
+		{int32(1), []byte("new"), nil},
+		{int32(2), []byte("paid"), nil},
+	}
+	source.results["SELECT `id`,`status`,`flags` FROM `shop`.`orders` WHERE (`id`) > (?) ORDER BY `id`[2]"] = [][]interface{}{
+		{int32(3), []byte("sent"), []byte{1}},
+	}
+	return &backfillSource{snapshotSource: source, watermarks: make(chan string)}
+}
+
+// replicate commits every watermark written to source as canal would
+func replicate(t *testing.T, b *Backfill, source *backfillSource) chan bool {
+	done := make(chan bool)
+	go func() {
+		pos := uint32(100)
+		for value := range source.watermarks {
+			pos += 100
+			commitWatermark(t, b, value, pos)
+		}
+		close(done)
+	}()
+	return done
+}
+
+func TestBackfillRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileProgressStore(filepath.Join(dir, "progress.json"))
+	options := BackfillOptions{Filter: Filter{ExcludeTables: []string{`\.tmp_`}}, ChunkRows: 2, Progress: store}
+
+	target := &MockLoader{}
+	b := newTestBackfill(t, target, options)
+	source := newBackfillSource()
+	done := replicate(t, b, source)
+	if err := b.Run([]loader.MySQLLoader{source}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	close(source.watermarks)
+	<-done
+	if source.queries[0] != "CREATE DATABASE IF NOT EXISTS `replicator`" {
+		t.Errorf("Expected the watermark table created, got %v", source.queries)
+	}
+	args := target.args
+	if len(args) != 3 || args[0][0] != int32(1) || fmt.Sprintf("%s", args[1][1]) != "paid" || args[2][2] != uint64(1) {
+		t.Fatalf("Expected the chunks applied, got %v", target.args)
+	}
+	progress, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders := progress.Tables["shop.orders"]
+	if len(progress.Tables) != 1 || len(orders.Chunks) != 2 || !orders.Chunks[0].Done || !orders.Chunks[1].Done {
+		t.Fatalf("Expected every chunk of shop.orders done, got %v", progress.Tables)
+	}
+	if fmt.Sprintf("%v %v", orders.Chunks[0].To, orders.Chunks[1].From) != "[2] [2]" {
+		t.Errorf("Unexpected chunk bounds %v", orders.Chunks)
+	}
+
+	// Chunks done are not copied again
+	b = newTestBackfill(t, &MockLoader{}, options)
+	source = newBackfillSource()
+	done = replicate(t, b, source)
+	if err := b.Run([]loader.MySQLLoader{source}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	close(source.watermarks)
+	<-done
+	for _, query := range source.reads {
+		if strings.HasPrefix(query, "SELECT `id`") {
+			t.Fatalf("Expected no chunk read, got %s", query)
+		}
+	}
+}
+
+func TestBackfillStop(t *testing.T) {
+	b := newTestBackfill(t, &MockLoader{}, BackfillOptions{ChunkRows: 2})
+	source := newBackfillSource()
+	// Canal never reads the watermarks
+	go func() {
+		for range source.watermarks {
+			b.Stop()
+		}
+	}()
+	if err := b.Run([]loader.MySQLLoader{source}); err != ErrBackfillStopped {
+		t.Fatalf("Expected the backfill stopped, got %v", err)
+	}
+	close(source.watermarks)
+}
+
+func TestKeyArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	table := &schema.Table{Schema: "shop", Name: "events"}
+	table.AddColumn("id", "bigint(20) unsigned", "", "")
+	table.AddColumn("hash", "varbinary(16)", "", "")
+	table.AddColumn("name", "varchar(10)", "utf8_general_ci", "")
+	table.PKColumns = []int{0, 1, 2}
+	store := NewFileProgressStore(filepath.Join(dir, "progress.json"))
+	key := []interface{}{uint64(18446744073709551615), []byte{0, 255}, "a"}
+	saved := &BackfillProgress{Tables: map[string]*TableProgress{"shop.events": {Schema: "shop", Table: "events", Chunks: []*Chunk{{To: key}}}}}
+	if err := store.Save(saved); err != nil {
+		t.Fatal(err)
+	}
+	progress, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, err := keyArgs(table, progress.Tables["shop.events"].Chunks[0].To)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if fmt.Sprintf("%#v", args) != fmt.Sprintf("%#v", key) {
+		t.Errorf("Expected %#v, got %#v", key, args)
+	}
+	if _, err := keyArgs(table, []interface{}{1}); err == nil {
+		t.Errorf("Expected error for a bound of another primary key")
+	}
+}
+
+func TestBackfillResync(t *testing.T) {
+	target := &MockLoader{}
+	b := newTestBackfill(t, target, BackfillOptions{Filter: Filter{ExcludeTables: []string{`\.tmp_`}}, ChunkRows: 2})
+	source := newBackfillSource()
+	done := replicate(t, b, source)
+	if err := b.Resync([]loader.MySQLLoader{source}, "shop", "orders", ResyncOptions{Truncate: true}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	close(source.watermarks)
+	<-done
+	if len(target.queries) != 5 || target.queries[0] != "USE `shop`" || target.queries[1] != "TRUNCATE TABLE `orders`" {
+		t.Fatalf("Expected the table truncated before the chunks, got %v", target.queries)
+	}
+	if len(target.args) != 3 || target.commit != 3 {
+		t.Errorf("Expected the truncation and the chunks committed, got %v and %d commits", target.args, target.commit)
+	}
+
+	for _, table := range []string{"tmp_orders", "notes"} {
+		if err := b.Resync([]loader.MySQLLoader{newBackfillSource()}, "shop", table, ResyncOptions{}); err == nil {
+			t.Errorf("Expected error for the resync of %s", table)
+		}
+	}
+}
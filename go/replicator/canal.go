@@ -3,11 +3,15 @@ package replicator
 import (
 	"context"
 	"fmt"
+	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	ls "github.com/siddontang/go-log/log"
 	"github.com/siddontang/go-mysql/canal"
 	"github.com/siddontang/go-mysql/mysql"
+	"mysqlreplicator/loader"
 )
 
 type State int
@@ -24,9 +28,12 @@ type WDCanal interface {
 	State() (State, error)
 	SetGTID(*mysql.GTIDSet) error
 	SetPos(*mysql.Position) error
+	SetFilter(Filter) error
+	Resync(schema string, table string, options ResyncOptions) error
 }
 
 type wdcanal struct {
+	sync.Mutex
 	context context.Context
 	c       *canal.Canal
 	error   error
@@ -38,82 +45,126 @@ type wdcanal struct {
 }
 
 func (e *wdcanal) Start() error {
+	e.Lock()
 	if e.state == Running {
+		e.Unlock()
 		return fmt.Errorf("Canal is already started")
 	}
-	
-	if e.c, e.error = newCanal(e.config, e.handler); e.error != nil {
+	if e.state == Terminated && e.c == nil {
+		// Canal could not be configured
+		e.Unlock()
 		return e.error
 	}
 
+	c, err := newCanal(e.config, e.handler)
+	if err != nil {
+		e.error = err
+		e.Unlock()
+		return err
+	}
+
+	e.c = c
 	e.error = nil
 	e.state = Running
+	e.Unlock()
 
-	errChan := e.run()
-	//wait for canal to start
-	time.Sleep(time.Millisecond * 200)
+	errChan := e.run(c)
 
+	//wait for canal to start
 	select {
-	// Context is Done, then check if error was generated
-	case <-e.c.Ctx().Done():
-		select {
-		case err := <-errChan:
-			e.state = Terminated
-			e.error = err
-		default:
-			e.state = Stopped
-		}
-	// Canal returned an error
+	// Canal returned an error or was closed
 	case err := <-errChan:
-		e.state = Terminated
-		e.error = err
+		e.terminate(c, err)
 	// Do not block when successful
-	default:
+	case <-time.After(time.Millisecond * 200):
 	}
-	return e.error
+	_, err = e.State()
+	return err
 }
 
-func (e *wdcanal) run() chan error {
-	errChan := make(chan error)
+// run starts canal in background, the returned channel receives the result of
+// the canal goroutine once it exits. A Failing handler terminates canal with
+// its failures
+func (e *wdcanal) run(c *canal.Canal) chan error {
+	errChan := make(chan error, 1)
+	done := make(chan struct{})
+
+	if f, ok := e.handler.(Failing); ok {
+		go func() {
+			select {
+			case err := <-f.Failures():
+				e.terminate(c, err)
+			case <-done:
+			}
+		}()
+	}
 
 	go func() {
+		defer close(done)
 		var err error
 		if e.handler.LastCommittedPos() != nil {
 			log.Infof("Starting from position %v", e.handler.LastCommittedPos())
-			err = e.c.RunFrom(*e.handler.LastCommittedPos())
+			err = c.RunFrom(*e.handler.LastCommittedPos())
 		} else if e.handler.LastCommittedGITD() != nil {
 			log.Infof("Starting from GTID %v", e.handler.LastCommittedGITD())
-			err = e.c.StartFromGTID(*e.handler.LastCommittedGITD())
+			err = c.StartFromGTID(*e.handler.LastCommittedGITD())
 		} else {
-			errChan <- fmt.Errorf("Not GTID or Position to start from")
-		}
-		if err != nil {
-			errChan <- err
+			err = fmt.Errorf("Not GTID or Position to start from")
 		}
+		errChan <- err
+		e.terminate(c, err)
 	}()
 	return errChan
 }
 
+// terminate records the exit of canal c, it is a no-op if c was stopped or
+// replaced in the meantime
+func (e *wdcanal) terminate(c *canal.Canal, err error) {
+	e.Lock()
+	if e.c != c || e.state != Running {
+		e.Unlock()
+		return
+	}
+	if err != nil {
+		log.Errorf("Canal terminated: %v", err)
+		e.state = Terminated
+		e.error = err
+	} else {
+		e.state = Stopped
+	}
+	e.Unlock()
+	// Release connections and discard any incomplete transaction
+	c.Close()
+}
+
 func (e *wdcanal) State() (State, error) {
+	e.Lock()
+	defer e.Unlock()
 	return e.state, e.error
 }
 
 func (e *wdcanal) Stop() {
-	switch e.state {
-	case Stopped, Terminated:
-	default:
-		e.c.Close()
-		e.state = Stopped
+	e.Lock()
+	if e.state != Running {
+		e.Unlock()
+		return
 	}
+	e.state = Stopped
+	c := e.c
+	e.Unlock()
+	c.Close()
 }
 
 func (e *wdcanal) SetGTID(set *mysql.GTIDSet) error {
-	switch e.state {
-	case Running:
+	e.Lock()
+	defer e.Unlock()
+	if e.state == Running {
 		return fmt.Errorf("Can not change GTID while canal is running")
-	default:
-		e.handler.SetGITD(set)
 	}
+	if set != nil && *set != nil && e.config != nil && gtidFlavor(*set) != e.config.Flavor {
+		return fmt.Errorf("GTID set %v is not a %s GTID set", *set, e.config.Flavor)
+	}
+	e.handler.SetGITD(set)
 	return nil
 }
 
@@ -121,6 +172,8 @@ func (e *wdcanal) SetPos(pos *mysql.Position) error {
 	if e.handler == nil {
 		return fmt.Errorf("Nil handler %v", e)
 	}
+	e.Lock()
+	defer e.Unlock()
 	switch e.state {
 	case Running:
 		return fmt.Errorf("Can not change log position while canal is running")
@@ -130,19 +183,96 @@ func (e *wdcanal) SetPos(pos *mysql.Position) error {
 	return nil
 }
 
-func newConf(server_id uint32, host string, port int, user string, passwd string, handler DefaultWDHandler) *canal.Config {
+// SetFilter selects the schemas, tables and actions to replicate, tables are
+// filtered by canal and the filter is passed on to handlers implementing
+// Filterable
+func (e *wdcanal) SetFilter(filter Filter) error {
+	e.Lock()
+	defer e.Unlock()
+	if e.state == Running {
+		return fmt.Errorf("Can not change filters while canal is running")
+	}
+	if e.config == nil {
+		return e.error
+	}
+	if _, err := filter.compile(); err != nil {
+		return err
+	}
+	if f, ok := e.handler.(Filterable); ok {
+		if err := f.SetFilter(filter); err != nil {
+			return err
+		}
+	}
+	e.config.IncludeTableRegex, e.config.ExcludeTableRegex = filter.canalRules()
+	return nil
+}
+
+// Resync copies schema.table from the source again while canal is running,
+// on options.Workers connections of its own. The handler must be a Resyncer
+// such as a Backfill, Resync returns once the copy is applied
+func (e *wdcanal) Resync(schema string, table string, options ResyncOptions) error {
+	resyncer, ok := e.handler.(Resyncer)
+	if !ok {
+		return fmt.Errorf("Resync requires a handler wrapped in a Backfill")
+	}
+	e.Lock()
+	state, config := e.state, e.config
+	e.Unlock()
+	if state != Running {
+		return fmt.Errorf("Canal must be running to resync %s.%s", schema, table)
+	}
+	host, port, err := net.SplitHostPort(config.Addr)
+	if err != nil {
+		return err
+	}
+	sourceOptions := loader.Options{User: config.User, Password: config.Password, Flavor: config.Flavor, Host: host}
+	if sourceOptions.Port, err = strconv.Atoi(port); err != nil {
+		return fmt.Errorf("Invalid source port %s: %v", port, err)
+	}
+	var sources []loader.MySQLLoader
+	defer func() {
+		for _, source := range sources {
+			source.Close()
+		}
+	}()
+	for i := 0; i < options.Workers || i == 0; i++ {
+		source, err := loader.NewLoaderWithOptions(sourceOptions)
+		if err != nil {
+			return fmt.Errorf("Unable to connect to source %s: %v", config.Addr, err)
+		}
+		sources = append(sources, source)
+	}
+	return resyncer.Resync(sources, schema, table, options)
+}
+
+// errSourceTLS is returned for a source with TLS enabled, canal builds the
+// binlog and schema connections itself and does not expose their TLS config
+var errSourceTLS = fmt.Errorf("TLS is not supported on the binlog connection by the canal library")
+
+func newConf(source SourceConfig) (*canal.Config, error) {
+	if source.TLS.Enabled() {
+		return nil, errSourceTLS
+	}
+	password, err := source.ReadPassword()
+	if err != nil {
+		return nil, err
+	}
+	location, err := time.LoadLocation(source.TimestampLocation)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid timestamp location %s: %v", source.TimestampLocation, err)
+	}
 	cfg := canal.NewDefaultConfig()
-	cfg.Addr = fmt.Sprintf("%s:%d", host, port)
-	cfg.User = user
-	cfg.Password = passwd
-	cfg.Flavor = "mysql"
-	cfg.ParseTime = false
-	cfg.ServerID = server_id
-	cfg.IncludeTableRegex = []string{""}
-	cfg.ExcludeTableRegex = []string{"^mysql.*"}
-	cfg.TimestampStringLocation = time.FixedZone("UTC", 0)
-	
-	return cfg
+	cfg.Addr = fmt.Sprintf("%s:%d", source.Host, source.Port)
+	cfg.User = source.User
+	cfg.Password = password
+	cfg.Flavor = source.Flavor
+	cfg.ParseTime = source.ParseTime
+	cfg.UseDecimal = true // DECIMAL values are kept exact
+	cfg.ServerID = source.ServerID
+	cfg.IncludeTableRegex, cfg.ExcludeTableRegex = Filter{}.canalRules()
+	cfg.TimestampStringLocation = location
+
+	return cfg, nil
 }
 
 func newCanal(config *canal.Config, handler canal.EventHandler) (*canal.Canal, error) {
@@ -156,14 +286,40 @@ func newCanal(config *canal.Config, handler canal.EventHandler) (*canal.Canal, e
 }
 
 func NewWdCanal(server_id uint32, host string, port int, user string, passwd string, handler DefaultWDHandler) WDCanal {
-	ls.SetLevel(ls.LevelFatal)
-	config := newConf(server_id, host, port, user, passwd, handler)
+	return NewWdCanalWithFilter(server_id, host, port, user, passwd, handler, Filter{})
+}
+
+// NewWdCanalWithFilter returns a canal replicating only what filter selects
+func NewWdCanalWithFilter(server_id uint32, host string, port int, user string, passwd string, handler DefaultWDHandler, filter Filter) WDCanal {
+	source := DefaultConfig().Source
+	source.ServerID = server_id
+	source.Host = host
+	source.Port = port
+	source.User = user
+	source.Password = passwd
+	return NewWdCanalFromConfig(source, handler, filter)
+}
 
-	return &wdcanal{
+// NewWdCanalFromConfig returns a canal replicating what filter selects from
+// the source server, errors are reported by State and Start
+func NewWdCanalFromConfig(source SourceConfig, handler DefaultWDHandler, filter Filter) WDCanal {
+	ls.SetLevel(ls.LevelFatal)
+	c := &wdcanal{
 		context: context.Background(),
 		state:   Stopped,
 		handler: handler,
-		config:  config,
 	}
-
+	var err error
+	if c.config, err = newConf(source); err != nil {
+		log.Errorf("%v", err)
+	} else if err = restoreCheckpoint(handler); err != nil {
+		log.Errorf("Unable to restore checkpoint: %v", err)
+	} else if err = c.SetFilter(filter); err != nil {
+		log.Errorf("Invalid filter: %v", err)
+	}
+	if err != nil {
+		c.state = Terminated
+		c.error = err
+	}
+	return c
 }
@@ -18,7 +18,7 @@ func TestNULLReplica(t *testing.T) {
 	defer dataloader.Close()
 	handler := &mock.MockHandler{}
 	wdcanal := NewWdCanal(uint32(100), "127.0.0.1", 3306, "root", "", handler)
-	wdcanal.SetPos(&mysql.Position{currentLog, uint32(currentPos)})
+	wdcanal.SetPos(&mysql.Position{Name: currentLog, Pos: uint32(currentPos)})
 	if err = wdcanal.Start(); err != nil {
 		t.Fatalf("Unable to start canal: %v", err)
 	}
@@ -67,7 +67,7 @@ func TestFullRowReplica(t *testing.T) {
 	defer dataloader.Close()
 	handler := &mock.MockHandler{}
 	wdcanal := NewWdCanal(uint32(100), "127.0.0.1", 3306, "root", "", handler)
-	wdcanal.SetPos(&mysql.Position{currentLog, uint32(currentPos)})
+	wdcanal.SetPos(&mysql.Position{Name: currentLog, Pos: uint32(currentPos)})
 	if err = wdcanal.Start(); err != nil {
 		t.Fatalf("Unable to start canal: %v", err)
 	}
@@ -118,7 +118,7 @@ func TestCoumnOrderingInCanal(t *testing.T) {
 	defer dataloader.Close()
 	handler := &mock.MockHandler{}
 	wdcanal := NewWdCanal(uint32(100), "127.0.0.1", 3306, "root", "", handler)
-	wdcanal.SetPos(&mysql.Position{currentLog, uint32(currentPos)})
+	wdcanal.SetPos(&mysql.Position{Name: currentLog, Pos: uint32(currentPos)})
 	if err = wdcanal.Start(); err != nil {
 		t.Fatalf("Unable to start canal: %v", err)
 	}
@@ -166,7 +166,7 @@ func TestCanalRestart(t *testing.T) {
 	handler := &mock.MockHandler{}
 	wdcanal := NewWdCanal(uint32(100), "127.0.0.1", 3306, "root", "", handler)
 
-	if err = wdcanal.SetPos(&mysql.Position{currentLog, uint32(currentPos)}); err != nil {
+	if err = wdcanal.SetPos(&mysql.Position{Name: currentLog, Pos: uint32(currentPos)}); err != nil {
 		t.Fatal(err)
 	}
 	err = wdcanal.Start()
@@ -0,0 +1,234 @@
+package replicator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"mysqlreplicator/internal/fileutil"
+	"mysqlreplicator/loader"
+)
+
+// Checkpoint is the last binlog position and GTID set applied to the target
+type Checkpoint struct {
+	Pos  *mysql.Position
+	GTID mysql.GTIDSet
+}
+
+// CheckpointStore persists checkpoints so replication can resume after a restart
+type CheckpointStore interface {
+	// Load returns the last saved checkpoint or nil if none was ever saved
+	Load() (*Checkpoint, error)
+	Save(*Checkpoint) error
+	// Transactional stores are saved inside the target transaction before it
+	// is committed, the others are saved once the commit succeeded
+	Transactional() bool
+}
+
+// Checkpointer is implemented by handlers owning a CheckpointStore
+type Checkpointer interface {
+	CheckpointStore() CheckpointStore
+}
+
+type checkpointRecord struct {
+	Name   string `json:"name"`
+	Pos    uint32 `json:"pos"`
+	GTID   string `json:"gtid,omitempty"`
+	Flavor string `json:"flavor,omitempty"`
+}
+
+func newCheckpointRecord(c *Checkpoint) checkpointRecord {
+	var r checkpointRecord
+	if c.Pos != nil {
+		r.Name, r.Pos = c.Pos.Name, c.Pos.Pos
+	}
+	if c.GTID != nil {
+		r.GTID = c.GTID.String()
+		r.Flavor = gtidFlavor(c.GTID)
+	}
+	return r
+}
+
+func (r checkpointRecord) checkpoint() (*Checkpoint, error) {
+	c := &Checkpoint{}
+	if r.Name != "" {
+		c.Pos = &mysql.Position{Name: r.Name, Pos: r.Pos}
+	}
+	if r.GTID != "" {
+		flavor := r.Flavor
+		if flavor == "" {
+			flavor = guessGTIDFlavor(r.GTID)
+		}
+		gtid, err := mysql.ParseGTIDSet(flavor, r.GTID)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid GTID set in checkpoint %s: %v", r.GTID, err)
+		}
+		c.GTID = gtid
+	}
+	return c, nil
+}
+
+// MarshalJSON encodes the checkpoint as NewFileCheckpointStore saves it
+func (c *Checkpoint) MarshalJSON() ([]byte, error) {
+	return json.Marshal(newCheckpointRecord(c))
+}
+
+func (c *Checkpoint) UnmarshalJSON(data []byte) error {
+	var r checkpointRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return err
+	}
+	checkpoint, err := r.checkpoint()
+	if err != nil {
+		return err
+	}
+	*c = *checkpoint
+	return nil
+}
+
+// gtidFlavor returns the flavor of the server a GTID set comes from
+func gtidFlavor(set mysql.GTIDSet) string {
+	if _, ok := set.(*mysql.MariadbGTIDSet); ok {
+		return mysql.MariaDBFlavor
+	}
+	return mysql.MySQLFlavor
+}
+
+// guessGTIDFlavor recognises GTID sets saved without their flavor, MySQL sets
+// are written "uuid:interval" and MariaDB sets "domain-server-sequence"
+func guessGTIDFlavor(set string) string {
+	if strings.Contains(set, ":") {
+		return mysql.MySQLFlavor
+	}
+	return mysql.MariaDBFlavor
+}
+
+type fileCheckpointStore struct {
+	path string
+}
+
+// NewFileCheckpointStore saves checkpoints as JSON into a local file,
+// the file is replaced atomically on every save
+func NewFileCheckpointStore(path string) CheckpointStore {
+	return &fileCheckpointStore{path: path}
+}
+
+func (s *fileCheckpointStore) Transactional() bool {
+	return false
+}
+
+func (s *fileCheckpointStore) Load() (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var r checkpointRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("Invalid checkpoint file %s: %v", s.path, err)
+	}
+	return r.checkpoint()
+}
+
+func (s *fileCheckpointStore) Save(c *Checkpoint) error {
+	data, err := json.Marshal(newCheckpointRecord(c))
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteAtomic(s.path, data)
+}
+
+type tableCheckpointStore struct {
+	client loader.MySQLLoader
+	table  string
+	name   string
+}
+
+// NewTableCheckpointStore saves checkpoints into schema.table on the target,
+// the row is written in the same transaction as the replicated rows. The
+// table is always qualified since replicated DDL changes the default schema
+// of the connection. Name identifies the replicator so several of them can
+// share the same table
+func NewTableCheckpointStore(client loader.MySQLLoader, schema string, table string, name string) (CheckpointStore, error) {
+	if schema == "" {
+		return nil, fmt.Errorf("The checkpoint table %s requires a schema", table)
+	}
+	if _, err := client.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", quoteName(schema))); err != nil {
+		return nil, fmt.Errorf("Unable to create checkpoint schema %s: %v", schema, err)
+	}
+	qualified := quoteName(schema) + "." + quoteName(table)
+	create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s ("+
+		"name VARCHAR(64) NOT NULL PRIMARY KEY,"+
+		"log_name VARCHAR(255) NOT NULL,"+
+		"log_pos INT UNSIGNED NOT NULL,"+
+		"gtid TEXT NOT NULL,"+
+		"updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP)", qualified)
+	if _, err := client.Exec(create); err != nil {
+		return nil, fmt.Errorf("Unable to create checkpoint table %s.%s: %v", schema, table, err)
+	}
+	return &tableCheckpointStore{
+		client: client,
+		table:  qualified,
+		name:   name,
+	}, nil
+}
+
+func (s *tableCheckpointStore) Transactional() bool {
+	return true
+}
+
+func (s *tableCheckpointStore) Load() (*Checkpoint, error) {
+	query := fmt.Sprintf("SELECT log_name, log_pos, gtid FROM %s WHERE name = ?", s.table)
+	res, err := s.client.Exec(query, s.name)
+	if err != nil {
+		return nil, err
+	}
+	if res.Resultset == nil || res.RowNumber() == 0 {
+		return nil, nil
+	}
+	var r checkpointRecord
+	if r.Name, err = res.GetString(0, 0); err != nil {
+		return nil, err
+	}
+	pos, err := res.GetUint(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	r.Pos = uint32(pos)
+	if r.GTID, err = res.GetString(0, 2); err != nil {
+		return nil, err
+	}
+	return r.checkpoint()
+}
+
+func (s *tableCheckpointStore) Save(c *Checkpoint) error {
+	r := newCheckpointRecord(c)
+	query := fmt.Sprintf("REPLACE INTO %s (name, log_name, log_pos, gtid) VALUES (?, ?, ?, ?)", s.table)
+	_, err := s.client.Exec(query, s.name, r.Name, r.Pos, r.GTID)
+	return err
+}
+
+// restoreCheckpoint sets the handler position from its checkpoint store
+func restoreCheckpoint(handler DefaultWDHandler) error {
+	c, ok := handler.(Checkpointer)
+	if !ok || c.CheckpointStore() == nil {
+		return nil
+	}
+	checkpoint, err := c.CheckpointStore().Load()
+	if err != nil || checkpoint == nil {
+		return err
+	}
+	if checkpoint.Pos != nil {
+		log.Infof("Restoring position %v from checkpoint", checkpoint.Pos)
+		handler.SetPos(checkpoint.Pos)
+	}
+	if checkpoint.GTID != nil {
+		log.Infof("Restoring GTID %v from checkpoint", checkpoint.GTID)
+		handler.SetGITD(&checkpoint.GTID)
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package replicator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+type MockCheckpointStore struct {
+	transactional bool
+	loader        *MockLoader
+	saved         []*Checkpoint
+	commits       []int
+	checkpoint    *Checkpoint
+}
+
+func (s *MockCheckpointStore) Load() (*Checkpoint, error) {
+	return s.checkpoint, nil
+}
+
+func (s *MockCheckpointStore) Save(c *Checkpoint) error {
+	s.saved = append(s.saved, c)
+	s.commits = append(s.commits, s.loader.commit)
+	return nil
+}
+
+func (s *MockCheckpointStore) Transactional() bool {
+	return s.transactional
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileCheckpointStore(filepath.Join(dir, "replicator.pos"))
+
+	if c, err := store.Load(); err != nil || c != nil {
+		t.Fatalf("Expected no checkpoint, got %v %v", c, err)
+	}
+	gtid, _ := mysql.ParseGTIDSet(mysql.MySQLFlavor, "de278ad0-2106-11e4-9f8e-6edd0ca20947:1-10")
+	if err := store.Save(&Checkpoint{Pos: &mysql.Position{Name: "mysql-bin.000003", Pos: 1234}, GTID: gtid}); err != nil {
+		t.Fatalf("Unable to save checkpoint: %v", err)
+	}
+	c, err := store.Load()
+	if err != nil {
+		t.Fatalf("Unable to load checkpoint: %v", err)
+	}
+	if c.Pos.Name != "mysql-bin.000003" || c.Pos.Pos != 1234 {
+		t.Fatalf("Wrong position %v", c.Pos)
+	}
+	if !c.GTID.Equal(gtid) {
+		t.Fatalf("Expected GTID %v, got %v", gtid, c.GTID)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("Temporary files left in checkpoint directory: %d", len(files))
+	}
+}
+
+func TestTableCheckpointStoreAfterDDL(t *testing.T) {
+	target := &snapshotSource{results: map[string][][]interface{}{
+		"SELECT log_name, log_pos, gtid FROM `replicator`.`checkpoints`": {{"mysql-bin.000002", uint64(100), ""}},
+	}}
+	store, err := NewTableCheckpointStore(target, "replicator", "checkpoints", "replicator-1")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	handler := NewCheckpointedWdHandler(target, "", store)
+	ddl := &replication.QueryEvent{Schema: []byte("shop"), Query: []byte("ALTER TABLE orders ADD COLUMN c int")}
+	if err := handler.OnDDL(mysql.Position{Name: "mysql-bin.000002", Pos: 100}, ddl); err != nil {
+		t.Fatalf("Unexpected error from OnDDL %v", err)
+	}
+	if err := handler.OnPosSynced(mysql.Position{Name: "mysql-bin.000002", Pos: 100}, true); err != nil {
+		t.Fatalf("Error committing DDL, %v", err)
+	}
+	if len(target.queries) != 2 || target.queries[0] != "USE `shop`" {
+		t.Fatalf("Expected the DDL to select its schema, got %v", target.queries)
+	}
+	expected := []string{
+		"CREATE DATABASE IF NOT EXISTS `replicator`",
+		"CREATE TABLE IF NOT EXISTS `replicator`.`checkpoints` (",
+		"REPLACE INTO `replicator`.`checkpoints` (",
+	}
+	if len(target.reads) != len(expected) {
+		t.Fatalf("Expected %d queries, got %q", len(expected), target.reads)
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(target.reads[i], prefix) {
+			t.Errorf("Expected %s..., got %s", prefix, target.reads[i])
+		}
+	}
+	// The checkpoint is read back whatever the schema of the connection
+	checkpoint, err := store.Load()
+	if err != nil || checkpoint == nil || checkpoint.Pos.Pos != 100 {
+		t.Errorf("Expected the saved checkpoint, got %v %v", checkpoint, err)
+	}
+}
+
+func TestTransactionalCheckpointIsSavedBeforeCommit(t *testing.T) {
+	loader := &MockLoader{}
+	store := &MockCheckpointStore{transactional: true, loader: loader}
+	handler := NewCheckpointedWdHandler(loader, "", store)
+	if err := handler.OnRow(&canal.RowsEvent{}); err != nil {
+		t.Fatalf("Unexpected error from OnRow %s", err)
+	}
+	if err := handler.OnPosSynced(mysql.Position{Name: "logname", Pos: 100}, false); err != nil {
+		t.Fatalf("Error committing transaction, %v", err)
+	}
+	if len(store.saved) != 1 || store.saved[0].Pos.Pos != 100 {
+		t.Fatalf("Checkpoint was not saved")
+	}
+	if store.commits[0] != 0 {
+		t.Fatalf("Checkpoint should be saved before the transaction is committed")
+	}
+}
+
+func TestCheckpointIsSavedAfterCommit(t *testing.T) {
+	loader := &MockLoader{}
+	store := &MockCheckpointStore{loader: loader}
+	handler := NewCheckpointedWdHandler(loader, "", store)
+	if err := handler.OnRow(&canal.RowsEvent{}); err != nil {
+		t.Fatalf("Unexpected error from OnRow %s", err)
+	}
+	if err := handler.OnPosSynced(mysql.Position{Name: "logname", Pos: 100}, false); err != nil {
+		t.Fatalf("Error committing transaction, %v", err)
+	}
+	if len(store.saved) != 1 || store.commits[0] != 1 {
+		t.Fatalf("Checkpoint should be saved after the transaction is committed")
+	}
+}
+
+func TestCheckpointTracksGTID(t *testing.T) {
+	loader := &MockLoader{}
+	store := &MockCheckpointStore{loader: loader}
+	handler := NewCheckpointedWdHandler(loader, "", store)
+	start, _ := mysql.ParseGTIDSet(mysql.MySQLFlavor, "de278ad0-2106-11e4-9f8e-6edd0ca20947:1-10")
+	handler.SetGITD(&start)
+	next, _ := mysql.ParseGTIDSet(mysql.MySQLFlavor, "de278ad0-2106-11e4-9f8e-6edd0ca20947:11")
+	_ = handler.OnGTID(next)
+	_ = handler.OnRow(&canal.RowsEvent{})
+	if err := handler.OnPosSynced(mysql.Position{Name: "logname", Pos: 100}, false); err != nil {
+		t.Fatalf("Error committing transaction, %v", err)
+	}
+	expected := "de278ad0-2106-11e4-9f8e-6edd0ca20947:1-11"
+	if store.saved[0].GTID.String() != expected {
+		t.Fatalf("Expected GTID %s, got %v", expected, store.saved[0].GTID)
+	}
+	if (*handler.LastCommittedGITD()).String() != expected {
+		t.Fatalf("Expected committed GTID %s, got %v", expected, *handler.LastCommittedGITD())
+	}
+}
+
+func TestRotationIsCheckpointed(t *testing.T) {
+	loader := &MockLoader{}
+	store := &MockCheckpointStore{loader: loader}
+	handler := NewCheckpointedWdHandler(loader, "", store)
+	_ = handler.OnRotate(&replication.RotateEvent{NextLogName: []byte("mysql-bin.000002"), Position: 4})
+	if err := handler.OnPosSynced(mysql.Position{Name: "mysql-bin.000002", Pos: 4}, true); err != nil {
+		t.Fatalf("Rotation should be synced, %v", err)
+	}
+	if len(store.saved) != 1 || store.saved[0].Pos.Name != "mysql-bin.000002" {
+		t.Fatalf("Rotation was not checkpointed")
+	}
+	if loader.commit != 0 {
+		t.Fatalf("Rotation should not commit")
+	}
+}
+
+func TestCanalRestoresCheckpoint(t *testing.T) {
+	loader := &MockLoader{}
+	store := &MockCheckpointStore{loader: loader, checkpoint: &Checkpoint{Pos: &mysql.Position{Name: "mysql-bin.000007", Pos: 42}}}
+	handler := NewCheckpointedWdHandler(loader, "", store)
+	NewWdCanal(uint32(100), "127.0.0.1", 3306, "root", "", handler)
+	if pos := handler.LastCommittedPos(); pos == nil || pos.Name != "mysql-bin.000007" || pos.Pos != 42 {
+		t.Fatalf("Position was not restored from checkpoint, %v", pos)
+	}
+}
+
+func TestMariaDBCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileCheckpointStore(filepath.Join(dir, "replicator.pos"))
+
+	loader := &MockLoader{}
+	handler := NewCheckpointedWdHandler(loader, "", store)
+	start, _ := mysql.ParseGTIDSet(mysql.MariaDBFlavor, "0-1-100")
+	handler.SetGITD(&start)
+	next, _ := mysql.ParseMariadbGTIDSet("0-2-101")
+	_ = handler.OnGTID(next)
+	_ = handler.OnRow(&canal.RowsEvent{})
+	if err := handler.OnPosSynced(mysql.Position{Name: "mariadb-bin.000001", Pos: 100}, false); err != nil {
+		t.Fatalf("Error committing transaction, %v", err)
+	}
+	c, err := store.Load()
+	if err != nil {
+		t.Fatalf("Unable to load checkpoint: %v", err)
+	}
+	if _, ok := c.GTID.(*mysql.MariadbGTIDSet); !ok || c.GTID.String() != "0-2-101" {
+		t.Fatalf("Expected MariaDB GTID 0-2-101, got %T %v", c.GTID, c.GTID)
+	}
+
+	// Checkpoints saved without a flavor
+	for set, flavor := range map[string]string{"0-1-5,1-1-7": mysql.MariaDBFlavor, "de278ad0-2106-11e4-9f8e-6edd0ca20947:1-10": mysql.MySQLFlavor} {
+		c, err := checkpointRecord{GTID: set}.checkpoint()
+		if err != nil || gtidFlavor(c.GTID) != flavor {
+			t.Errorf("Expected %s GTID set for %s, got %v %v", flavor, set, c, err)
+		}
+	}
+}
+
+func TestSetGTIDChecksFlavor(t *testing.T) {
+	source := DefaultConfig().Source
+	source.Flavor = mysql.MariaDBFlavor
+	handler := NewWdHandler(&MockLoader{})
+	wdcanal := NewWdCanalFromConfig(source, handler, Filter{})
+	mysqlSet, _ := mysql.ParseGTIDSet(mysql.MySQLFlavor, "de278ad0-2106-11e4-9f8e-6edd0ca20947:1-10")
+	if err := wdcanal.SetGTID(&mysqlSet); err == nil {
+		t.Fatalf("Expected error setting a MySQL GTID set on a MariaDB canal")
+	}
+	mariadbSet, _ := mysql.ParseGTIDSet(mysql.MariaDBFlavor, "0-1-100")
+	if err := wdcanal.SetGTID(&mariadbSet); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if handler.LastCommittedGITD() == nil || (*handler.LastCommittedGITD()).String() != "0-1-100" {
+		t.Fatalf("GTID was not set on the handler")
+	}
+}
@@ -0,0 +1,719 @@
+package replicator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/juju/loggo"
+	"github.com/siddontang/go-mysql/mysql"
+	"gopkg.in/yaml.v2"
+	"mysqlreplicator/loader"
+	"mysqlreplicator/replicator/routing"
+)
+
+// EnvPrefix prefixes the environment variables overriding configuration keys,
+// source.password is overridden by REPLICATOR_SOURCE_PASSWORD
+const EnvPrefix = "REPLICATOR"
+
+// DefaultTargetDatabase is the schema of the target holding the tables of
+// the replicator, as the backfill watermarks
+const DefaultTargetDatabase = "replicator"
+
+// Config is the configuration of a replicator, it is loaded from a YAML, TOML
+// or JSON file. Keys are the snake case names in the struct tags
+type Config struct {
+	Source SourceConfig `json:"source" yaml:"source" toml:"source"`
+	Target TargetConfig `json:"target" yaml:"target" toml:"target"`
+	Sink   SinkConfig   `json:"sink" yaml:"sink" toml:"sink"`
+	Filter Filter       `json:"filter" yaml:"filter" toml:"filter"`
+	// Routes are routing rules written "<schema>.<table> -> <schema>.<table>"
+	Routes     []string         `json:"routes" yaml:"routes" toml:"routes"`
+	Checkpoint CheckpointConfig `json:"checkpoint" yaml:"checkpoint" toml:"checkpoint"`
+	Snapshot   SnapshotConfig   `json:"snapshot" yaml:"snapshot" toml:"snapshot"`
+	Backfill   BackfillConfig   `json:"backfill" yaml:"backfill" toml:"backfill"`
+	Apply      ApplyConfig      `json:"apply" yaml:"apply" toml:"apply"`
+	Restart    RestartConfig    `json:"restart" yaml:"restart" toml:"restart"`
+	Control    ControlConfig    `json:"control" yaml:"control" toml:"control"`
+	Log        LogConfig        `json:"log" yaml:"log" toml:"log"`
+}
+
+// SourceConfig is the server replicated from and where replication starts
+// when no checkpoint exists
+type SourceConfig struct {
+	ServerID uint32 `json:"server_id" yaml:"server_id" toml:"server_id"`
+	Host     string `json:"host" yaml:"host" toml:"host"`
+	Port     int    `json:"port" yaml:"port" toml:"port"`
+	User     string `json:"user" yaml:"user" toml:"user"`
+	Password string `json:"password" yaml:"password" toml:"password"`
+	// PasswordFile is a file holding the password, it overrides Password
+	PasswordFile string           `json:"password_file" yaml:"password_file" toml:"password_file"`
+	TLS          loader.TLSConfig `json:"tls" yaml:"tls" toml:"tls"`
+	// Flavor is mysql or mariadb
+	Flavor string `json:"flavor" yaml:"flavor" toml:"flavor"`
+	// ParseTime decodes temporal values into time.Time instead of strings
+	ParseTime bool `json:"parse_time" yaml:"parse_time" toml:"parse_time"`
+	// TimestampLocation is the time zone TIMESTAMP values are decoded in
+	TimestampLocation string `json:"timestamp_location" yaml:"timestamp_location" toml:"timestamp_location"`
+	LogFile           string `json:"log_file" yaml:"log_file" toml:"log_file"`
+	LogPos            uint32 `json:"log_pos" yaml:"log_pos" toml:"log_pos"`
+	GTID              string `json:"gtid" yaml:"gtid" toml:"gtid"`
+}
+
+// TargetConfig is the server replicated to
+type TargetConfig struct {
+	Host     string `json:"host" yaml:"host" toml:"host"`
+	Port     int    `json:"port" yaml:"port" toml:"port"`
+	User     string `json:"user" yaml:"user" toml:"user"`
+	Password string `json:"password" yaml:"password" toml:"password"`
+	// PasswordFile is a file holding the password, it overrides Password
+	PasswordFile string           `json:"password_file" yaml:"password_file" toml:"password_file"`
+	TLS          loader.TLSConfig `json:"tls" yaml:"tls" toml:"tls"`
+	// Database is the default schema of the connection, created if missing.
+	// It holds the checkpoint table and must not be a system schema
+	Database string `json:"database" yaml:"database" toml:"database"`
+	// Flavor is mysql or mariadb
+	Flavor string `json:"flavor" yaml:"flavor" toml:"flavor"`
+}
+
+// Sink types, change events are applied to the target server by SinkMySQL
+const (
+	SinkMySQL = "mysql"
+	SinkKafka = "kafka"
+	SinkFile  = "file"
+)
+
+// Formats of the change events published by sinks
+const (
+	FormatJSON     = "json"
+	FormatDebezium = "debezium"
+	FormatAvro     = "avro"
+)
+
+// SinkConfig selects where change events are sent
+type SinkConfig struct {
+	// Type is SinkMySQL, SinkKafka or SinkFile, the target section is only
+	// used by SinkMySQL
+	Type string `json:"type" yaml:"type" toml:"type"`
+	// Format is FormatJSON, FormatDebezium or FormatAvro, unused by SinkMySQL
+	Format   string         `json:"format" yaml:"format" toml:"format"`
+	Debezium DebeziumConfig `json:"debezium" yaml:"debezium" toml:"debezium"`
+	Avro     AvroConfig     `json:"avro" yaml:"avro" toml:"avro"`
+	Kafka    KafkaConfig    `json:"kafka" yaml:"kafka" toml:"kafka"`
+	File     FileConfig     `json:"file" yaml:"file" toml:"file"`
+}
+
+// DebeziumConfig configures the Debezium format, see debezium.Encoder
+type DebeziumConfig struct {
+	// ServerName is the logical name of the source, the source host when
+	// empty
+	ServerName string `json:"server_name" yaml:"server_name" toml:"server_name"`
+	// DecimalHandling is precise, string or double
+	DecimalHandling string `json:"decimal_handling" yaml:"decimal_handling" toml:"decimal_handling"`
+}
+
+// AvroConfig configures the Avro format, see avro.Encoder
+type AvroConfig struct {
+	// RegistryURL is the URL of the Confluent schema registry
+	RegistryURL string `json:"registry_url" yaml:"registry_url" toml:"registry_url"`
+	// Username and Password authenticate with the registry when Username is
+	// set
+	Username string `json:"username" yaml:"username" toml:"username"`
+	Password string `json:"password" yaml:"password" toml:"password"`
+	// Namespace prefixes the names of the records
+	Namespace string `json:"namespace" yaml:"namespace" toml:"namespace"`
+}
+
+// KafkaConfig configures the kafka sink, see kafkasink.Config
+type KafkaConfig struct {
+	Brokers  []string `json:"brokers" yaml:"brokers" toml:"brokers"`
+	Topic    string   `json:"topic" yaml:"topic" toml:"topic"`
+	DDLTopic string   `json:"ddl_topic" yaml:"ddl_topic" toml:"ddl_topic"`
+	// Acks is all, leader or none
+	Acks    string   `json:"acks" yaml:"acks" toml:"acks"`
+	Timeout Duration `json:"timeout" yaml:"timeout" toml:"timeout"`
+}
+
+// FileConfig configures the file sink, see filesink.Config. The sink saves
+// its checkpoints in Dir
+type FileConfig struct {
+	Dir    string `json:"dir" yaml:"dir" toml:"dir"`
+	Prefix string `json:"prefix" yaml:"prefix" toml:"prefix"`
+	// MaxSize is the size in bytes files are rotated at, MaxAge the age
+	MaxSize int64    `json:"max_size" yaml:"max_size" toml:"max_size"`
+	MaxAge  Duration `json:"max_age" yaml:"max_age" toml:"max_age"`
+	// Compression is none, gzip or zstd
+	Compression string `json:"compression" yaml:"compression" toml:"compression"`
+}
+
+// CheckpointConfig selects where checkpoints are saved, at most one of File
+// and Table can be set
+type CheckpointConfig struct {
+	File string `json:"file" yaml:"file" toml:"file"`
+	// Table is "schema.table" on the target, a table without schema is
+	// created in target.database
+	Table string `json:"table" yaml:"table" toml:"table"`
+	// Name identifies the replicator in a checkpoint table, it defaults to
+	// replicator-<server_id>
+	Name string `json:"name" yaml:"name" toml:"name"`
+}
+
+// SnapshotConfig copies the source tables to the target before replication
+// starts when no checkpoint exists, see Snapshot
+type SnapshotConfig struct {
+	Enabled   bool `json:"enabled" yaml:"enabled" toml:"enabled"`
+	ChunkRows int  `json:"chunk_rows" yaml:"chunk_rows" toml:"chunk_rows"`
+	// DropTables drops the target tables and creates them again, the
+	// snapshot otherwise refuses target tables holding rows
+	DropTables bool `json:"drop_tables" yaml:"drop_tables" toml:"drop_tables"`
+	// KeepTables copies into the existing target tables even if they hold
+	// rows
+	KeepTables bool `json:"keep_tables" yaml:"keep_tables" toml:"keep_tables"`
+}
+
+// BackfillConfig copies the source tables while the binlog is replicated, see
+// Backfill
+type BackfillConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled" toml:"enabled"`
+	// Tables are regular expressions on "schema.table" selecting the tables
+	// backfilled, every replicated table when empty
+	Tables []string `json:"tables" yaml:"tables" toml:"tables"`
+	// WatermarkTable is the "schema.table" source table watermarks are
+	// written to, it must be replicated
+	WatermarkTable string `json:"watermark_table" yaml:"watermark_table" toml:"watermark_table"`
+	ChunkRows      int    `json:"chunk_rows" yaml:"chunk_rows" toml:"chunk_rows"`
+	// Workers is the number of source connections copying chunks
+	Workers int `json:"workers" yaml:"workers" toml:"workers"`
+	// ProgressFile saves the chunks copied, the backfill resumes from it
+	ProgressFile string `json:"progress_file" yaml:"progress_file" toml:"progress_file"`
+}
+
+// ApplyConfig controls the statements applied on the target
+type ApplyConfig struct {
+	UpdateMode bool `json:"update_mode" yaml:"update_mode" toml:"update_mode"`
+	BatchRows  int  `json:"batch_rows" yaml:"batch_rows" toml:"batch_rows"`
+	// Workers is the number of target connections transactions are applied
+	// on in parallel, they are applied serially when it is lower than 2
+	Workers int `json:"workers" yaml:"workers" toml:"workers"`
+	// Conflicts is ConflictTable or ConflictRow, see NewParallelWdHandler
+	Conflicts string `json:"conflicts" yaml:"conflicts" toml:"conflicts"`
+	// GroupTransactions, GroupRows and GroupDelay are the GroupOptions
+	// merging source transactions into one target transaction
+	GroupTransactions int      `json:"group_transactions" yaml:"group_transactions" toml:"group_transactions"`
+	GroupRows         int      `json:"group_rows" yaml:"group_rows" toml:"group_rows"`
+	GroupDelay        Duration `json:"group_delay" yaml:"group_delay" toml:"group_delay"`
+}
+
+// RestartConfig is the SupervisorPolicy restarting a failed canal
+type RestartConfig struct {
+	MaxRetries     int      `json:"max_retries" yaml:"max_retries" toml:"max_retries"`
+	InitialBackoff Duration `json:"initial_backoff" yaml:"initial_backoff" toml:"initial_backoff"`
+	MaxBackoff     Duration `json:"max_backoff" yaml:"max_backoff" toml:"max_backoff"`
+}
+
+// ControlConfig accepts commands such as a table resync while replicating
+type ControlConfig struct {
+	// Socket is the path of the unix socket commands are sent to
+	Socket string `json:"socket" yaml:"socket" toml:"socket"`
+}
+
+type LogConfig struct {
+	Level string `json:"level" yaml:"level" toml:"level"`
+}
+
+// Duration is a time.Duration written as "1m30s" in configuration files
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func DefaultConfig() *Config {
+	policy := DefaultSupervisorPolicy()
+	return &Config{
+		Source: SourceConfig{
+			ServerID:          100,
+			Host:              "127.0.0.1",
+			Port:              3306,
+			User:              "root",
+			Flavor:            mysql.MySQLFlavor,
+			TimestampLocation: "UTC",
+			LogPos:            4,
+		},
+		Target: TargetConfig{
+			Host:     "127.0.0.1",
+			Port:     3307,
+			User:     "root",
+			Database: DefaultTargetDatabase,
+			Flavor:   mysql.MySQLFlavor,
+		},
+		Sink: SinkConfig{
+			Type:     SinkMySQL,
+			Format:   FormatJSON,
+			Debezium: DebeziumConfig{DecimalHandling: "precise"},
+			Avro:     AvroConfig{Namespace: "mysqlreplicator"},
+			Kafka:    KafkaConfig{Topic: "{schema}.{table}", Acks: "all", Timeout: Duration(30 * time.Second)},
+			File:     FileConfig{Prefix: "changes", MaxSize: 128 << 20, Compression: "none"},
+		},
+		Snapshot: SnapshotConfig{ChunkRows: DefaultChunkRows},
+		Backfill: BackfillConfig{WatermarkTable: DefaultWatermarkTable, ChunkRows: DefaultChunkRows, Workers: 4},
+		Apply:    ApplyConfig{BatchRows: 100, Conflicts: ConflictTable, GroupDelay: Duration(DefaultGroupDelay)},
+		Restart: RestartConfig{
+			MaxRetries:     policy.MaxRetries,
+			InitialBackoff: Duration(policy.InitialBackoff),
+			MaxBackoff:     Duration(policy.MaxBackoff),
+		},
+		Log: LogConfig{Level: "INFO"},
+	}
+}
+
+// LoadConfig reads the configuration file at path over the defaults, applies
+// the environment overrides and validates the result. The format is selected
+// by the file extension: .yaml, .yml, .toml or .json
+func LoadConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+	if err := config.ReadFile(path); err != nil {
+		return nil, err
+	}
+	if err := config.ApplyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ReadFile sets the keys found in the configuration file at path
+func (c *Config) ReadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := c.decode(filepath.Ext(path), data); err != nil {
+		return fmt.Errorf("Invalid configuration %s: %v", path, err)
+	}
+	return nil
+}
+
+// decode rejects unknown keys so that misspelled keys are not ignored
+func (c *Config) decode(ext string, data []byte) error {
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		return yaml.UnmarshalStrict(data, c)
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(c)
+	case ".toml":
+		meta, err := toml.Decode(string(data), c)
+		if err != nil {
+			return err
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown key %s", undecoded[0])
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported format %s, expected .yaml, .yml, .toml or .json", ext)
+}
+
+// ApplyEnv overrides keys with the environment variables returned by lookup,
+// list values are comma separated. Action filters can not be overridden
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	return applyEnv(reflect.ValueOf(c).Elem(), "", lookup)
+}
+
+var textUnmarshaler = reflect.TypeOf((*interface{ UnmarshalText([]byte) error })(nil)).Elem()
+
+func applyEnv(v reflect.Value, key string, lookup func(string) (string, bool)) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		name := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if key != "" {
+			name = key + "." + name
+		}
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, name, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		env := EnvPrefix + "_" + strings.ToUpper(strings.Replace(name, ".", "_", -1))
+		value, ok := lookup(env)
+		if !ok {
+			continue
+		}
+		if err := setValue(field, value); err != nil {
+			return fmt.Errorf("%s (%s): %v", name, env, err)
+		}
+	}
+	return nil
+}
+
+func setValue(field reflect.Value, value string) error {
+	if field.Addr().Type().Implements(textUnmarshaler) {
+		return field.Addr().Interface().(interface{ UnmarshalText([]byte) error }).UnmarshalText([]byte(value))
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %s", value)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %s", value)
+		}
+		field.SetInt(n)
+	case reflect.Uint32:
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid unsigned integer %s", value)
+		}
+		field.SetUint(n)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("can not be set from the environment")
+		}
+		var values []string
+		if value != "" {
+			values = strings.Split(value, ",")
+		}
+		field.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("can not be set from the environment")
+	}
+	return nil
+}
+
+// Validate checks every key, the error lists all invalid keys
+func (c *Config) Validate() error {
+	var problems []string
+	invalid := func(key string, format string, args ...interface{}) {
+		problems = append(problems, key+": "+fmt.Sprintf(format, args...))
+	}
+	if c.Source.ServerID == 0 {
+		invalid("source.server_id", "must be greater than 0")
+	}
+	validateServer("source", c.Source.Host, c.Source.Port, invalid)
+	validateServer("target", c.Target.Host, c.Target.Port, invalid)
+	validateCredentials("source", c.Source.Password, c.Source.PasswordFile, c.Source.TLS, c.Source.Host, invalid)
+	// Other sinks do not connect to the target
+	if c.Sink.Type == SinkMySQL {
+		validateCredentials("target", c.Target.Password, c.Target.PasswordFile, c.Target.TLS, c.Target.Host, invalid)
+	}
+	if c.Source.TLS.Enabled() {
+		invalid("source.tls", "%v", errSourceTLS)
+	}
+	validateFlavor("source", c.Source.Flavor, invalid)
+	validateFlavor("target", c.Target.Flavor, invalid)
+	if _, err := time.LoadLocation(c.Source.TimestampLocation); err != nil {
+		invalid("source.timestamp_location", "%v", err)
+	}
+	if c.Source.GTID != "" {
+		if _, err := mysql.ParseGTIDSet(c.Source.Flavor, c.Source.GTID); err != nil {
+			invalid("source.gtid", "%v", err)
+		}
+	}
+	if _, err := c.Filter.compile(); err != nil {
+		invalid("filter", "%v", err)
+	}
+	for i, spec := range c.Routes {
+		if _, err := routing.Parse(spec); err != nil {
+			invalid(fmt.Sprintf("routes[%d]", i), "%v", err)
+		}
+	}
+	switch c.Sink.Type {
+	case SinkMySQL:
+		switch strings.ToLower(c.Target.Database) {
+		case "":
+			invalid("target.database", "must be set")
+		case "mysql", "information_schema", "performance_schema", "sys":
+			invalid("target.database", "must not be the system schema %s", c.Target.Database)
+		}
+	case SinkKafka:
+		if len(c.Sink.Kafka.Brokers) == 0 {
+			invalid("sink.kafka.brokers", "must be set")
+		}
+		if acks := c.Sink.Kafka.Acks; acks != "all" && acks != "leader" && acks != "none" {
+			invalid("sink.kafka.acks", "must be all, leader or none, got %q", acks)
+		}
+		if c.Checkpoint.Table != "" {
+			invalid("checkpoint.table", "requires the %s sink", SinkMySQL)
+		}
+	case SinkFile:
+		if c.Sink.File.Dir == "" {
+			invalid("sink.file.dir", "must be set")
+		}
+		if c.Sink.File.MaxSize < 0 {
+			invalid("sink.file.max_size", "must not be negative")
+		}
+		if c.Sink.File.MaxAge < 0 {
+			invalid("sink.file.max_age", "must not be negative")
+		}
+		if compression := c.Sink.File.Compression; compression != "none" && compression != "gzip" && compression != "zstd" {
+			invalid("sink.file.compression", "must be none, gzip or zstd, got %q", compression)
+		}
+		if c.Sink.Format == FormatAvro {
+			invalid("sink.format", "%s is not supported by the %s sink", FormatAvro, SinkFile)
+		}
+		if c.Checkpoint.File != "" || c.Checkpoint.Table != "" {
+			invalid("checkpoint", "the %s sink saves its checkpoints in sink.file.dir", SinkFile)
+		}
+	default:
+		invalid("sink.type", "must be %s, %s or %s, got %q", SinkMySQL, SinkKafka, SinkFile, c.Sink.Type)
+	}
+	switch c.Sink.Format {
+	case FormatJSON, FormatDebezium:
+	case FormatAvro:
+		if c.Sink.Avro.RegistryURL == "" {
+			invalid("sink.avro.registry_url", "must be set")
+		}
+	default:
+		invalid("sink.format", "must be %s, %s or %s, got %q", FormatJSON, FormatDebezium, FormatAvro, c.Sink.Format)
+	}
+	if d := c.Sink.Debezium.DecimalHandling; d != "precise" && d != "string" && d != "double" {
+		invalid("sink.debezium.decimal_handling", "must be precise, string or double, got %q", d)
+	}
+	if c.Snapshot.Enabled {
+		if c.Sink.Type != SinkMySQL {
+			invalid("snapshot.enabled", "requires the %s sink", SinkMySQL)
+		}
+		if c.Source.LogFile != "" || c.Source.GTID != "" {
+			invalid("snapshot.enabled", "replication starts from the snapshot, source.log_file and source.gtid must not be set")
+		}
+	}
+	if c.Snapshot.DropTables && c.Snapshot.KeepTables {
+		invalid("snapshot.drop_tables", "must not be set with snapshot.keep_tables")
+	}
+	if c.Snapshot.ChunkRows < 0 {
+		invalid("snapshot.chunk_rows", "must not be negative")
+	}
+	if c.Backfill.Enabled {
+		if c.Backfill.ProgressFile == "" {
+			invalid("backfill.progress_file", "must be set")
+		}
+		if c.Apply.UpdateMode {
+			invalid("backfill.enabled", "chunks are applied again after a restart, apply.update_mode must not be set")
+		}
+		if watermark := strings.SplitN(c.Backfill.WatermarkTable, ".", 2); len(watermark) != 2 || watermark[0] == "" || watermark[1] == "" {
+			invalid("backfill.watermark_table", "must be <schema>.<table>, got %q", c.Backfill.WatermarkTable)
+		} else if filter, err := c.Filter.compile(); err == nil && matchAny(filter.exclude, c.Backfill.WatermarkTable) {
+			invalid("backfill.watermark_table", "must not be excluded by the filter")
+		}
+	}
+	if _, err := compileAll(c.Backfill.Tables); err != nil {
+		invalid("backfill.tables", "%v", err)
+	}
+	if c.Control.Socket != "" && c.Apply.UpdateMode {
+		invalid("control.socket", "resyncs are applied as inserts, apply.update_mode must not be set")
+	}
+	if c.Backfill.ChunkRows < 0 {
+		invalid("backfill.chunk_rows", "must not be negative")
+	}
+	if c.Backfill.Workers < 0 {
+		invalid("backfill.workers", "must not be negative")
+	}
+	if c.Checkpoint.File != "" && c.Checkpoint.Table != "" {
+		invalid("checkpoint", "file and table can not both be set")
+	}
+	if schema, table := c.CheckpointTable(); c.Checkpoint.Table != "" && (schema == "" || table == "") {
+		invalid("checkpoint.table", "must be a table of target.database or schema.table, got %q", c.Checkpoint.Table)
+	}
+	if c.Apply.BatchRows < 0 {
+		invalid("apply.batch_rows", "must not be negative")
+	}
+	if c.Apply.Workers < 0 {
+		invalid("apply.workers", "must not be negative")
+	}
+	if c.Apply.Workers > 1 && c.Apply.UpdateMode {
+		invalid("apply.workers", "transactions applied in parallel are applied again after a restart, apply.update_mode must not be set")
+	}
+	if c.Apply.Conflicts != ConflictTable && c.Apply.Conflicts != ConflictRow {
+		invalid("apply.conflicts", "must be %s or %s, got %q", ConflictTable, ConflictRow, c.Apply.Conflicts)
+	}
+	if c.Apply.GroupTransactions < 0 {
+		invalid("apply.group_transactions", "must not be negative")
+	}
+	if c.Apply.GroupRows < 0 {
+		invalid("apply.group_rows", "must not be negative")
+	}
+	if group := c.Group(); group.enabled() {
+		if group.Delay <= 0 {
+			invalid("apply.group_delay", "must be greater than 0")
+		}
+		if c.Apply.Workers > 1 {
+			invalid("apply.workers", "transactions can not be grouped when applied in parallel")
+		}
+	}
+	if c.Restart.InitialBackoff <= 0 {
+		invalid("restart.initial_backoff", "must be greater than 0")
+	}
+	if c.Restart.MaxBackoff < c.Restart.InitialBackoff {
+		invalid("restart.max_backoff", "must not be lower than restart.initial_backoff")
+	}
+	if _, ok := loggo.ParseLevel(c.Log.Level); !ok {
+		invalid("log.level", "unknown level %q", c.Log.Level)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func validateServer(key string, host string, port int, invalid func(string, string, ...interface{})) {
+	if host == "" {
+		invalid(key+".host", "must be set")
+	}
+	if port <= 0 || port > 65535 {
+		invalid(key+".port", "must be between 1 and 65535, got %d", port)
+	}
+}
+
+func validateCredentials(key string, password string, passwordFile string, tls loader.TLSConfig, host string, invalid func(string, string, ...interface{})) {
+	if password == "" && passwordFile == "" {
+		invalid(key+".password", "must be set, or %s.password_file", key)
+	}
+	if passwordFile != "" {
+		if _, err := readPassword("", passwordFile); err != nil {
+			invalid(key+".password_file", "%v", err)
+		}
+	}
+	if _, err := tls.Build(host); err != nil {
+		invalid(key+".tls", "%v", err)
+	}
+}
+
+func validateFlavor(key string, flavor string, invalid func(string, string, ...interface{})) {
+	if flavor != mysql.MySQLFlavor && flavor != mysql.MariaDBFlavor {
+		invalid(key+".flavor", "must be %s or %s, got %q", mysql.MySQLFlavor, mysql.MariaDBFlavor, flavor)
+	}
+}
+
+// ReadPassword returns the password, read from PasswordFile when it is set
+func (s SourceConfig) ReadPassword() (string, error) {
+	return readPassword(s.Password, s.PasswordFile)
+}
+
+// ReadPassword returns the password, read from PasswordFile when it is set
+func (t TargetConfig) ReadPassword() (string, error) {
+	return readPassword(t.Password, t.PasswordFile)
+}
+
+// LoaderOptions returns the options of a connection reading from the source,
+// without a default database
+func (s SourceConfig) LoaderOptions() (loader.Options, error) {
+	password, err := s.ReadPassword()
+	if err != nil {
+		return loader.Options{}, err
+	}
+	tls, err := s.TLS.Build(s.Host)
+	if err != nil {
+		return loader.Options{}, err
+	}
+	return loader.Options{
+		Host:     s.Host,
+		Port:     s.Port,
+		User:     s.User,
+		Password: password,
+		Flavor:   s.Flavor,
+		TLS:      tls,
+	}, nil
+}
+
+// LoaderOptions returns the connection options of the target loader
+func (t TargetConfig) LoaderOptions() (loader.Options, error) {
+	password, err := t.ReadPassword()
+	if err != nil {
+		return loader.Options{}, err
+	}
+	tls, err := t.TLS.Build(t.Host)
+	if err != nil {
+		return loader.Options{}, err
+	}
+	return loader.Options{
+		Host:     t.Host,
+		Port:     t.Port,
+		User:     t.User,
+		Password: password,
+		Database: t.Database,
+		Flavor:   t.Flavor,
+		TLS:      tls,
+	}, nil
+}
+
+// readPassword reads the password in file, trailing new lines are dropped
+func readPassword(password string, file string) (string, error) {
+	if file == "" {
+		return password, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read password: %v", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Router returns the router of the configured routes, nil when there are none
+func (c *Config) Router() (*routing.Router, error) {
+	if len(c.Routes) == 0 {
+		return nil, nil
+	}
+	rules := make([]routing.Rule, len(c.Routes))
+	for i, spec := range c.Routes {
+		var err error
+		if rules[i], err = routing.Parse(spec); err != nil {
+			return nil, err
+		}
+	}
+	return routing.New(rules...)
+}
+
+// CheckpointTable returns the schema and name of the checkpoint table, in
+// target.database unless checkpoint.table is qualified
+func (c *Config) CheckpointTable() (string, string) {
+	if i := strings.Index(c.Checkpoint.Table, "."); i >= 0 {
+		return c.Checkpoint.Table[:i], c.Checkpoint.Table[i+1:]
+	}
+	return c.Target.Database, c.Checkpoint.Table
+}
+
+// Group returns the GroupOptions of the apply section
+func (c *Config) Group() GroupOptions {
+	return GroupOptions{
+		Transactions: c.Apply.GroupTransactions,
+		Rows:         c.Apply.GroupRows,
+		Delay:        time.Duration(c.Apply.GroupDelay),
+	}
+}
+
+// SupervisorPolicy returns the default policy with the configured restarts
+func (c *Config) SupervisorPolicy() SupervisorPolicy {
+	policy := DefaultSupervisorPolicy()
+	policy.MaxRetries = c.Restart.MaxRetries
+	policy.InitialBackoff = time.Duration(c.Restart.InitialBackoff)
+	policy.MaxBackoff = time.Duration(c.Restart.MaxBackoff)
+	return policy
+}
@@ -0,0 +1,386 @@
+package replicator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mysqlreplicator/loader"
+)
+
+var testConfigs = map[string]string{
+	"replicator.yaml": `
+source:
+  server_id: 7
+  host: source.db
+  flavor: mariadb
+  password: secret
+target:
+  host: target.db
+  port: 3306
+  password: secret
+filter:
+  include_schemas: [tenant_a]
+  skip:
+    - table: ^tenant_a\.
+      actions: [delete]
+routes:
+  - tenant_a.* -> shard_1.*
+apply:
+  batch_rows: 50
+restart:
+  max_backoff: 30s
+`,
+	"replicator.toml": `
+routes = ["tenant_a.* -> shard_1.*"]
+[source]
+server_id = 7
+host = "source.db"
+flavor = "mariadb"
+password = "secret"
+[target]
+host = "target.db"
+port = 3306
+password = "secret"
+[filter]
+include_schemas = ["tenant_a"]
+[[filter.skip]]
+table = '^tenant_a\.'
+actions = ["delete"]
+[apply]
+batch_rows = 50
+[restart]
+max_backoff = "30s"
+`,
+	"replicator.json": `{
+  "source": {"server_id": 7, "host": "source.db", "flavor": "mariadb", "password": "secret"},
+  "target": {"host": "target.db", "port": 3306, "password": "secret"},
+  "filter": {"include_schemas": ["tenant_a"], "skip": [{"table": "^tenant_a\\.", "actions": ["delete"]}]},
+  "routes": ["tenant_a.* -> shard_1.*"],
+  "apply": {"batch_rows": 50},
+  "restart": {"max_backoff": "30s"}
+}`,
+}
+
+func writeConfig(t *testing.T, dir string, name string, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// validConfig is the default configuration with the passwords it requires
+func validConfig() *Config {
+	config := DefaultConfig()
+	config.Source.Password, config.Target.Password = "secret", "secret"
+	return config
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range testConfigs {
+		config, err := LoadConfig(writeConfig(t, dir, name, content))
+		if err != nil {
+			t.Fatalf("Unable to load %s: %v", name, err)
+		}
+		if config.Source.ServerID != 7 || config.Source.Host != "source.db" || config.Source.Flavor != "mariadb" {
+			t.Errorf("%s: unexpected source %+v", name, config.Source)
+		}
+		if config.Source.Port != 3306 || config.Source.User != "root" {
+			t.Errorf("%s: defaults should be kept for missing keys, got %+v", name, config.Source)
+		}
+		if config.Target.Host != "target.db" || config.Target.Port != 3306 {
+			t.Errorf("%s: unexpected target %+v", name, config.Target)
+		}
+		if len(config.Filter.Actions) != 1 || config.Filter.Actions[0].Table != "^tenant_a\\." || config.Filter.Actions[0].Actions[0] != "delete" {
+			t.Errorf("%s: unexpected filter %+v", name, config.Filter)
+		}
+		if len(config.Routes) != 1 || config.Apply.BatchRows != 50 {
+			t.Errorf("%s: unexpected routes %v or batch rows %d", name, config.Routes, config.Apply.BatchRows)
+		}
+		if policy := config.SupervisorPolicy(); policy.MaxBackoff != 30*time.Second || policy.InitialBackoff != time.Second {
+			t.Errorf("%s: unexpected policy %+v", name, policy)
+		}
+	}
+}
+
+func TestConfigRejectsUnknownKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"typo.yaml": "source:\n  hots: source.db\n",
+		"typo.toml": "[source]\nhots = \"source.db\"\n",
+		"typo.json": `{"source": {"hots": "source.db"}}`,
+	} {
+		if _, err := LoadConfig(writeConfig(t, dir, name, content)); err == nil || !strings.Contains(err.Error(), "hots") {
+			t.Errorf("%s: expected error naming the unknown key, got %v", name, err)
+		}
+	}
+	if _, err := LoadConfig(writeConfig(t, dir, "replicator.ini", "")); err == nil {
+		t.Errorf("Expected error for an unsupported format")
+	}
+}
+
+func TestConfigEnvOverrides(t *testing.T) {
+	env := map[string]string{
+		"REPLICATOR_SOURCE_PASSWORD":           "secret",
+		"REPLICATOR_TARGET_PORT":               "3310",
+		"REPLICATOR_APPLY_UPDATE_MODE":         "true",
+		"REPLICATOR_RESTART_MAX_BACKOFF":       "2m",
+		"REPLICATOR_FILTER_INCLUDE_SCHEMAS":    "tenant_a,tenant_b",
+		"REPLICATOR_SOURCE_TIMESTAMP_LOCATION": "Europe/Rome",
+	}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+	config := DefaultConfig()
+	if err := config.ApplyEnv(lookup); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if config.Source.Password != "secret" || config.Target.Port != 3310 || !config.Apply.UpdateMode {
+		t.Fatalf("Environment not applied %+v %+v %+v", config.Source, config.Target, config.Apply)
+	}
+	if time.Duration(config.Restart.MaxBackoff) != 2*time.Minute || len(config.Filter.IncludeSchemas) != 2 {
+		t.Fatalf("Environment not applied %+v %+v", config.Restart, config.Filter)
+	}
+	if config.Source.TimestampLocation != "Europe/Rome" {
+		t.Fatalf("Environment not applied %+v", config.Source)
+	}
+
+	env = map[string]string{"REPLICATOR_TARGET_PORT": "x"}
+	if err := DefaultConfig().ApplyEnv(lookup); err == nil || !strings.Contains(err.Error(), "target.port") {
+		t.Fatalf("Expected error naming target.port, got %v", err)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("Default configuration should be valid once passwords are set: %v", err)
+	}
+	err := DefaultConfig().Validate()
+	for _, key := range []string{"source.password:", "target.password:"} {
+		if err == nil || !strings.Contains(err.Error(), key) {
+			t.Errorf("Expected error for %s without password, got %v", key, err)
+		}
+	}
+	config := validConfig()
+	config.Source.Port = 0
+	config.Source.Flavor = "postgres"
+	config.Filter.IncludeTables = []string{"("}
+	config.Routes = []string{"a.b -> c.d", "broken"}
+	config.Checkpoint = CheckpointConfig{File: "pos", Table: "pos"}
+	config.Log.Level = "LOUD"
+	config.Apply = ApplyConfig{Workers: -1, Conflicts: "gtid", GroupRows: -1}
+	err = config.Validate()
+	if err == nil {
+		t.Fatalf("Expected validation errors")
+	}
+	for _, key := range []string{"source.port", "source.flavor", "filter", "routes[1]", "checkpoint", "log.level", "apply.workers", "apply.conflicts", "apply.group_rows"} {
+		if !strings.Contains(err.Error(), key+":") {
+			t.Errorf("Expected error for %s in %v", key, err)
+		}
+	}
+}
+
+func TestConfigCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := DefaultConfig()
+	config.Source.PasswordFile = writeConfig(t, dir, "source.pass", "s3cret\n")
+	config.Target.PasswordFile = writeConfig(t, dir, "target.pass", "t4rget")
+	config.Target.TLS.Mode = loader.TLSRequired
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if password, err := config.Source.ReadPassword(); err != nil || password != "s3cret" {
+		t.Errorf("Expected the password of the file, got %q %v", password, err)
+	}
+	options, err := config.Target.LoaderOptions()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if options.Password != "t4rget" || options.TLS == nil || options.TLS.ServerName != config.Target.Host {
+		t.Errorf("Unexpected loader options %+v", options)
+	}
+	if cfg, err := newConf(config.Source); err != nil || cfg.Password != "s3cret" {
+		t.Errorf("Expected the canal to use the password of the file, got %v", err)
+	}
+
+	config.Source.TLS.Mode = loader.TLSRequired
+	config.Target.PasswordFile = filepath.Join(dir, "missing")
+	config.Target.TLS = loader.TLSConfig{Mode: loader.TLSVerifyCA}
+	err = config.Validate()
+	for _, key := range []string{"source.tls", "target.password_file", "target.tls"} {
+		if err == nil || !strings.Contains(err.Error(), key+":") {
+			t.Errorf("Expected error for %s in %v", key, err)
+		}
+	}
+	if _, err := newConf(config.Source); err != errSourceTLS {
+		t.Errorf("Expected source TLS to be rejected, got %v", err)
+	}
+}
+
+func TestConfigKafkaSink(t *testing.T) {
+	config := validConfig()
+	config.Sink.Type = SinkKafka
+	config.Checkpoint.Table = "checkpoints"
+	config.Sink.Kafka.Acks = "some"
+	config.Sink.Format = "protobuf"
+	config.Sink.Debezium.DecimalHandling = "exact"
+	err := config.Validate()
+	for _, key := range []string{"sink.kafka.brokers", "sink.kafka.acks", "checkpoint.table", "sink.format", "sink.debezium.decimal_handling"} {
+		if err == nil || !strings.Contains(err.Error(), key+":") {
+			t.Errorf("Expected error for %s in %v", key, err)
+		}
+	}
+	config.Sink.Format = FormatAvro
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "sink.avro.registry_url:") {
+		t.Errorf("Expected error for sink.avro.registry_url in %v", err)
+	}
+	config.Sink.Kafka.Brokers = []string{"kafka:9092"}
+	config.Sink.Kafka.Acks = "leader"
+	config.Sink.Format = FormatDebezium
+	config.Sink.Debezium.DecimalHandling = "string"
+	config.Checkpoint = CheckpointConfig{File: "checkpoint.json"}
+	if err := config.Validate(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestConfigFileSink(t *testing.T) {
+	config := validConfig()
+	config.Sink.Type = SinkFile
+	config.Sink.File.MaxAge = Duration(-time.Hour)
+	config.Sink.File.Compression = "lz4"
+	config.Checkpoint.File = "checkpoint.json"
+	err := config.Validate()
+	for _, key := range []string{"sink.file.dir", "sink.file.max_age", "sink.file.compression", "checkpoint"} {
+		if err == nil || !strings.Contains(err.Error(), key+":") {
+			t.Errorf("Expected error for %s in %v", key, err)
+		}
+	}
+	config.Sink.File = FileConfig{Dir: "/var/lib/replicator", MaxAge: Duration(time.Hour), Compression: "zstd"}
+	config.Checkpoint = CheckpointConfig{}
+	config.Sink.Format = FormatAvro
+	config.Sink.Avro.RegistryURL = "http://registry:8081"
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "sink.format:") {
+		t.Errorf("Expected error for sink.format in %v", err)
+	}
+	config.Sink.Format = FormatDebezium
+	if err := config.Validate(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestConfigSnapshot(t *testing.T) {
+	config := validConfig()
+	config.Snapshot.Enabled = true
+	config.Snapshot.ChunkRows = -1
+	config.Snapshot.DropTables = true
+	config.Snapshot.KeepTables = true
+	config.Source.LogFile = "mysql-bin.000001"
+	config.Sink.Type = SinkKafka
+	config.Sink.Kafka.Brokers = []string{"kafka:9092"}
+	err := config.Validate()
+	for _, problem := range []string{"snapshot.enabled: requires", "snapshot.enabled: replication starts", "snapshot.chunk_rows:", "snapshot.drop_tables:"} {
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %s in %v", problem, err)
+		}
+	}
+	config.Snapshot.ChunkRows = 0
+	config.Snapshot.KeepTables = false
+	config.Source.LogFile = ""
+	config.Sink.Type = SinkMySQL
+	if err := config.Validate(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestConfigBackfill(t *testing.T) {
+	config := validConfig()
+	config.Backfill.Enabled = true
+	config.Backfill.WatermarkTable = "mysql_meta.watermarks"
+	config.Backfill.Tables = []string{"("}
+	config.Backfill.Workers = -1
+	config.Apply.UpdateMode = true
+	config.Control.Socket = "/run/replicator.sock"
+	err := config.Validate()
+	for _, problem := range []string{"backfill.progress_file:", "backfill.enabled:", "control.socket:", "backfill.watermark_table: must not be excluded", "backfill.tables:", "backfill.workers:"} {
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %s in %v", problem, err)
+		}
+	}
+	config.Backfill.ProgressFile = "/var/lib/replicator/backfill.json"
+	config.Backfill.WatermarkTable = DefaultWatermarkTable
+	config.Backfill.Tables = []string{`^shop\.`}
+	config.Backfill.Workers = 0
+	config.Apply.UpdateMode = false
+	if err := config.Validate(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestConfigParallelUpdateMode(t *testing.T) {
+	config := validConfig()
+	config.Apply.Workers = 4
+	config.Apply.UpdateMode = true
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "apply.workers:") {
+		t.Errorf("Expected error for apply.workers, got %v", err)
+	}
+	config.Apply.Workers = 1
+	if err := config.Validate(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestConfigTargetDatabase(t *testing.T) {
+	config := validConfig()
+	if config.Target.Database != DefaultTargetDatabase {
+		t.Errorf("Expected %s by default, got %s", DefaultTargetDatabase, config.Target.Database)
+	}
+	for _, database := range []string{"", "mysql", "SYS"} {
+		config.Target.Database = database
+		if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "target.database:") {
+			t.Errorf("Expected error for target.database %q, got %v", database, err)
+		}
+	}
+	config.Sink.Type = SinkKafka
+	config.Sink.Kafka.Brokers = []string{"localhost:9092"}
+	// The target is not connected to
+	config.Target.Password = ""
+	if err := config.Validate(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestConfigCheckpointTable(t *testing.T) {
+	config := validConfig()
+	config.Target.Database = "replicator"
+	config.Checkpoint.Table = "checkpoints"
+	if schema, table := config.CheckpointTable(); schema != "replicator" || table != "checkpoints" {
+		t.Errorf("Expected the table in target.database, got %s.%s", schema, table)
+	}
+	config.Checkpoint.Table = "ops.checkpoints"
+	if schema, table := config.CheckpointTable(); schema != "ops" || table != "checkpoints" {
+		t.Errorf("Expected the qualified table, got %s.%s", schema, table)
+	}
+	config.Checkpoint.Table = "ops."
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "checkpoint.table:") {
+		t.Errorf("Expected error for checkpoint.table, got %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+// Package control serves commands to a running replicator on a unix socket,
+// a request and its response are each a line of JSON
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/juju/loggo"
+	"mysqlreplicator/replicator"
+)
+
+var log = loggo.GetLogger("replicator.control")
+
+// CommandResync copies a table from the source again, see WDCanal.Resync
+const CommandResync = "resync"
+
+// Request is a command sent to the socket
+type Request struct {
+	Command string `json:"command"`
+	// Table is the "schema.table" of a resync
+	Table    string `json:"table,omitempty"`
+	Truncate bool   `json:"truncate,omitempty"`
+	Workers  int    `json:"workers,omitempty"`
+}
+
+// Response is sent once a command completes, Error is empty when it succeeded
+type Response struct {
+	Error string `json:"error,omitempty"`
+}
+
+// Server runs the commands sent to its socket on a canal
+type Server struct {
+	canal    replicator.WDCanal
+	listener net.Listener
+	wg       sync.WaitGroup
+}
+
+// Listen serves the commands sent to the unix socket at path, a socket left
+// by a process that exited is replaced. Only the owner of the process may
+// connect, commands are not authenticated
+func Listen(path string, canal replicator.WDCanal) (*Server, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is served by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	// The socket is created without access for group and others, the umask
+	// of the process is restored once it is bound
+	umask := syscall.Umask(0077)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen on %s: %v", path, err)
+	}
+	s := &Server{canal: canal, listener: listener}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	var request Request
+	response := Response{}
+	if err := json.NewDecoder(conn).Decode(&request); err != nil {
+		response.Error = fmt.Sprintf("Invalid request: %v", err)
+	} else if err := s.execute(request); err != nil {
+		response.Error = err.Error()
+	}
+	if err := json.NewEncoder(conn).Encode(response); err != nil {
+		log.Warningf("Unable to answer %s request: %v", request.Command, err)
+	}
+}
+
+func (s *Server) execute(request Request) error {
+	switch request.Command {
+	case CommandResync:
+		names := strings.SplitN(request.Table, ".", 2)
+		if len(names) != 2 || names[0] == "" || names[1] == "" {
+			return fmt.Errorf("Invalid table %q, expected <schema>.<table>", request.Table)
+		}
+		log.Infof("Resync of %s requested", request.Table)
+		err := s.canal.Resync(names[0], names[1], replicator.ResyncOptions{Truncate: request.Truncate, Workers: request.Workers})
+		if err != nil {
+			log.Errorf("Resync of %s failed: %v", request.Table, err)
+		}
+		return err
+	}
+	return fmt.Errorf("Unknown command %q", request.Command)
+}
+
+// Close stops accepting commands, the commands running are not interrupted
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+// Send sends request to the socket at path and returns the error of its
+// response once the command completes
+func Send(path string, request Request) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return fmt.Errorf("Unable to connect to %s: %v", path, err)
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return err
+	}
+	var response Response
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return fmt.Errorf("No response to %s: %v", request.Command, err)
+	}
+	if response.Error != "" {
+		return fmt.Errorf("%s", response.Error)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package control
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"mysqlreplicator/replicator"
+)
+
+// resyncCanal records the resyncs requested
+type resyncCanal struct {
+	resyncs []string
+	err     error
+}
+
+func (c *resyncCanal) Start() error                      { return nil }
+func (c *resyncCanal) Stop()                             {}
+func (c *resyncCanal) State() (replicator.State, error)  { return replicator.Running, nil }
+func (c *resyncCanal) SetGTID(*mysql.GTIDSet) error      { return nil }
+func (c *resyncCanal) SetPos(*mysql.Position) error      { return nil }
+func (c *resyncCanal) SetFilter(replicator.Filter) error { return nil }
+func (c *resyncCanal) Resync(schema string, table string, options replicator.ResyncOptions) error {
+	c.resyncs = append(c.resyncs, fmt.Sprintf("%s.%s %v %d", schema, table, options.Truncate, options.Workers))
+	return c.err
+}
+
+func TestResync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "replicator.sock")
+	canal := &resyncCanal{}
+	server, err := Listen(path, canal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if err := Send(path, Request{Command: CommandResync, Table: "shop.orders", Truncate: true, Workers: 2}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(canal.resyncs) != 1 || canal.resyncs[0] != "shop.orders true 2" {
+		t.Fatalf("Expected the resync of shop.orders, got %v", canal.resyncs)
+	}
+	canal.err = fmt.Errorf("Table shop.orders has no primary key")
+	if err := Send(path, Request{Command: CommandResync, Table: "shop.orders"}); err == nil || err.Error() != canal.err.Error() {
+		t.Errorf("Expected the resync error, got %v", err)
+	}
+	if err := Send(path, Request{Command: CommandResync, Table: "orders"}); err == nil {
+		t.Errorf("Expected error for a table without schema")
+	}
+	if err := Send(path, Request{Command: "drop"}); err == nil {
+		t.Errorf("Expected error for an unknown command")
+	}
+}
+
+func TestListenReplacesSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "replicator.sock")
+	first, err := Listen(path, &resyncCanal{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Left by a process that did not close it
+	first.listener.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+	first.Close()
+	second, err := Listen(path, &resyncCanal{})
+	if err != nil {
+		t.Fatalf("Expected the socket replaced, got %v", err)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm()&0077 != 0 {
+		t.Errorf("Expected the socket restricted to its owner, got %v", info.Mode())
+	}
+	// A socket still served is not replaced
+	if _, err := Listen(path, &resyncCanal{}); err == nil || !strings.Contains(err.Error(), "another process") {
+		t.Errorf("Expected the served socket kept, got %v", err)
+	}
+	if err := Send(path, Request{Command: "drop"}); err == nil || !strings.Contains(err.Error(), "Unknown command") {
+		t.Errorf("Expected the server still answering, got %v", err)
+	}
+	second.Close()
+	if err := Send(path, Request{Command: CommandResync}); err == nil {
+		t.Errorf("Expected no server once closed")
+	}
+}
@@ -0,0 +1,560 @@
+// Package debezium encodes change events in the format of the Debezium MySQL
+// connector, as written by the Kafka Connect JsonConverter
+package debezium
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+	"mysqlreplicator/replicator"
+	"mysqlreplicator/replicator/dmlbuilder"
+)
+
+// Representations of DECIMAL values, as the decimal.handling.mode of Debezium
+const (
+	// DecimalPrecise encodes the unscaled value as bytes with the
+	// org.apache.kafka.connect.data.Decimal logical type
+	DecimalPrecise = "precise"
+	// DecimalString encodes the value as a string
+	DecimalString = "string"
+	// DecimalDouble encodes the value as a float64, precision can be lost
+	DecimalDouble = "double"
+)
+
+// Version is the connector version of the source block
+const Version = "mysqlreplicator"
+
+// Encoder encodes change events as Debezium envelopes holding the rows before
+// and after the change, the source metadata and the operation. Events of
+// DDL statements are encoded as Debezium schema change events
+type Encoder struct {
+	// ServerName is the logical name of the source, it prefixes the names of
+	// the schemas as the Debezium topic prefix does
+	ServerName string
+	// Decimals is DecimalPrecise, DecimalString or DecimalDouble,
+	// DecimalPrecise when empty
+	Decimals string
+	// Location is the time zone TIMESTAMP values are decoded in, UTC when nil
+	Location *time.Location
+	// OmitSchema writes the payload only, as the JsonConverter does when
+	// schemas.enable is false
+	OmitSchema bool
+	now        func() time.Time
+}
+
+// NewEncoder returns an encoder after checking its decimal handling mode
+func NewEncoder(serverName string, decimals string, location *time.Location) (*Encoder, error) {
+	switch decimals {
+	case DecimalPrecise, DecimalString, DecimalDouble, "":
+	default:
+		return nil, fmt.Errorf("Unknown decimal handling %s, expected %s, %s or %s", decimals, DecimalPrecise, DecimalString, DecimalDouble)
+	}
+	return &Encoder{ServerName: serverName, Decimals: decimals, Location: location}, nil
+}
+
+// Schema describes a value as the JsonConverter does
+type Schema struct {
+	Type       string            `json:"type"`
+	Fields     []*Schema         `json:"fields,omitempty"`
+	Optional   bool              `json:"optional"`
+	Name       string            `json:"name,omitempty"`
+	Version    int               `json:"version,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+	Field      string            `json:"field,omitempty"`
+}
+
+type message struct {
+	Schema  *Schema     `json:"schema"`
+	Payload interface{} `json:"payload"`
+}
+
+type envelope struct {
+	Before *row   `json:"before"`
+	After  *row   `json:"after"`
+	Source source `json:"source"`
+	Op     string `json:"op"`
+	TsMs   int64  `json:"ts_ms"`
+}
+
+type schemaChange struct {
+	Source       source `json:"source"`
+	DatabaseName string `json:"databaseName"`
+	DDL          string `json:"ddl"`
+}
+
+// source is the source block, Pos is the position the transaction of the
+// event ends at
+type source struct {
+	Version   string  `json:"version"`
+	Connector string  `json:"connector"`
+	Name      string  `json:"name"`
+	TsMs      int64   `json:"ts_ms"`
+	Snapshot  string  `json:"snapshot"`
+	DB        string  `json:"db"`
+	Table     *string `json:"table"`
+	ServerID  uint32  `json:"server_id"`
+	GTID      *string `json:"gtid"`
+	File      string  `json:"file"`
+	Pos       uint32  `json:"pos"`
+	Row       int     `json:"row"`
+	Thread    *int64  `json:"thread"`
+	Query     *string `json:"query"`
+}
+
+var sourceSchema = &Schema{
+	Type: "struct",
+	Name: "io.debezium.connector.mysql.Source",
+	Fields: []*Schema{
+		{Type: "string", Field: "version"},
+		{Type: "string", Field: "connector"},
+		{Type: "string", Field: "name"},
+		{Type: "int64", Field: "ts_ms"},
+		{Type: "string", Optional: true, Name: "io.debezium.data.Enum", Version: 1, Parameters: map[string]string{"allowed": "true,last,false"}, Field: "snapshot"},
+		{Type: "string", Field: "db"},
+		{Type: "string", Optional: true, Field: "table"},
+		{Type: "int64", Field: "server_id"},
+		{Type: "string", Optional: true, Field: "gtid"},
+		{Type: "string", Field: "file"},
+		{Type: "int64", Field: "pos"},
+		{Type: "int32", Field: "row"},
+		{Type: "int64", Optional: true, Field: "thread"},
+		{Type: "string", Optional: true, Field: "query"},
+	},
+	Field: "source",
+}
+
+// row keeps the columns in table order once marshalled
+type row struct {
+	names  []string
+	values []interface{}
+}
+
+func (r *row) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range r.names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(name)
+		value, err := json.Marshal(r.values[i])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to encode column %s: %v", name, err)
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+type geometry struct {
+	WKB  []byte `json:"wkb"`
+	SRID uint32 `json:"srid"`
+}
+
+var operations = map[string]string{
+	canal.InsertAction: "c",
+	canal.UpdateAction: "u",
+	canal.DeleteAction: "d",
+}
+
+// Encode returns the Debezium envelope of a row change or the schema change
+// event of a DDL statement
+func (e *Encoder) Encode(event *replicator.ChangeEvent) ([]byte, error) {
+	if event.Action == replicator.DDLAction {
+		return e.marshal(e.schemaChangeSchema(), schemaChange{
+			Source:       e.source(event),
+			DatabaseName: event.Schema,
+			DDL:          event.Query,
+		})
+	}
+	op, ok := operations[event.Action]
+	if !ok {
+		return nil, fmt.Errorf("Unknown action %s", event.Action)
+	}
+	if event.Source == nil {
+		return nil, fmt.Errorf("No table for %s event on %s.%s", event.Action, event.Schema, event.Table)
+	}
+	before, err := e.row(event.Source, event.Before)
+	if err != nil {
+		return nil, err
+	}
+	after, err := e.row(event.Source, event.After)
+	if err != nil {
+		return nil, err
+	}
+	return e.marshal(e.envelopeSchema(event), envelope{
+		Before: before,
+		After:  after,
+		Source: e.source(event),
+		Op:     op,
+		TsMs:   e.clock().UnixNano() / int64(time.Millisecond),
+	})
+}
+
+// EncodeKey returns the primary key of the changed row, or the database name
+// of a DDL statement. Rows of tables without a primary key have no key
+func (e *Encoder) EncodeKey(event *replicator.ChangeEvent) ([]byte, error) {
+	if event.Action == replicator.DDLAction {
+		keySchema := &Schema{
+			Type:   "struct",
+			Name:   "io.debezium.connector.mysql.SchemaChangeKey",
+			Fields: []*Schema{{Type: "string", Field: "databaseName"}},
+		}
+		return e.marshal(keySchema, map[string]string{"databaseName": event.Schema})
+	}
+	table := event.Source
+	values := event.After
+	if values == nil {
+		values = event.Before
+	}
+	if table == nil || len(table.PKColumns) == 0 || values == nil {
+		return nil, nil
+	}
+	keySchema := &Schema{Type: "struct", Name: e.prefix(event) + ".Key"}
+	key := &row{}
+	for _, i := range table.PKColumns {
+		column := &table.Columns[i]
+		field := e.columnSchema(column)
+		field.Optional = false
+		keySchema.Fields = append(keySchema.Fields, field)
+		value, err := e.value(column, values[i])
+		if err != nil {
+			return nil, err
+		}
+		key.names = append(key.names, column.Name)
+		key.values = append(key.values, value)
+	}
+	return e.marshal(keySchema, key)
+}
+
+func (e *Encoder) marshal(s *Schema, payload interface{}) ([]byte, error) {
+	if e.OmitSchema {
+		return json.Marshal(payload)
+	}
+	return json.Marshal(message{Schema: s, Payload: payload})
+}
+
+func (e *Encoder) clock() time.Time {
+	if e.now != nil {
+		return e.now()
+	}
+	return time.Now()
+}
+
+// prefix names the schemas of a table after its routed name
+func (e *Encoder) prefix(event *replicator.ChangeEvent) string {
+	return e.ServerName + "." + event.Schema + "." + event.Table
+}
+
+func (e *Encoder) source(event *replicator.ChangeEvent) source {
+	s := source{
+		Version:   Version,
+		Connector: "mysql",
+		Name:      e.ServerName,
+		TsMs:      int64(event.Timestamp) * 1000,
+		Snapshot:  "false",
+		DB:        event.Schema,
+		ServerID:  event.ServerID,
+		File:      event.Pos.Name,
+		Pos:       event.Pos.Pos,
+		Row:       event.Row,
+	}
+	table := event.Table
+	if event.Source != nil {
+		s.DB, table = event.Source.Schema, event.Source.Name
+	}
+	if table != "" {
+		s.Table = &table
+	}
+	if event.GTID != "" {
+		gtid := event.GTID
+		s.GTID = &gtid
+	}
+	return s
+}
+
+func (e *Encoder) envelopeSchema(event *replicator.ChangeEvent) *Schema {
+	prefix := e.prefix(event)
+	value := &Schema{Type: "struct", Optional: true, Name: prefix + ".Value"}
+	for i := range event.Source.Columns {
+		column := &event.Source.Columns[i]
+		field := e.columnSchema(column)
+		for _, pk := range event.Source.PKColumns {
+			if pk == i {
+				field.Optional = false
+			}
+		}
+		value.Fields = append(value.Fields, field)
+	}
+	before, after := *value, *value
+	before.Field, after.Field = "before", "after"
+	return &Schema{
+		Type: "struct",
+		Name: prefix + ".Envelope",
+		Fields: []*Schema{
+			&before,
+			&after,
+			sourceSchema,
+			{Type: "string", Field: "op"},
+			{Type: "int64", Optional: true, Field: "ts_ms"},
+		},
+	}
+}
+
+func (e *Encoder) schemaChangeSchema() *Schema {
+	return &Schema{
+		Type: "struct",
+		Name: "io.debezium.connector.mysql.SchemaChangeValue",
+		Fields: []*Schema{
+			sourceSchema,
+			{Type: "string", Field: "databaseName"},
+			{Type: "string", Field: "ddl"},
+		},
+	}
+}
+
+func (e *Encoder) row(table *schema.Table, values []interface{}) (*row, error) {
+	if values == nil {
+		return nil, nil
+	}
+	r := &row{}
+	for i := range table.Columns {
+		column := &table.Columns[i]
+		var value interface{}
+		if i < len(values) {
+			var err error
+			if value, err = e.value(column, values[i]); err != nil {
+				return nil, err
+			}
+		}
+		r.names = append(r.names, column.Name)
+		r.values = append(r.values, value)
+	}
+	return r, nil
+}
+
+// columnSchema maps column types as the Debezium MySQL connector does with
+// its default settings
+func (e *Encoder) columnSchema(column *schema.TableColumn) *Schema {
+	s := &Schema{Type: "string", Optional: true, Field: column.Name}
+	name, args := dmlbuilder.TypeArgs(column)
+	switch column.Type {
+	case schema.TYPE_NUMBER:
+		switch {
+		case name == "year":
+			s.Type, s.Name = "int32", "io.debezium.time.Year"
+		case name == "tinyint", name == "smallint" && !column.IsUnsigned:
+			s.Type = "int16"
+		case name == "bigint", name == "int" && column.IsUnsigned:
+			s.Type = "int64"
+		default:
+			s.Type = "int32"
+		}
+	case schema.TYPE_FLOAT:
+		s.Type = "float64"
+		if name == "float" {
+			s.Type = "float32"
+		}
+	case schema.TYPE_DECIMAL:
+		switch e.Decimals {
+		case DecimalString:
+		case DecimalDouble:
+			s.Type = "float64"
+		default:
+			precision, scale := decimalArgs(args)
+			s.Type, s.Name = "bytes", "org.apache.kafka.connect.data.Decimal"
+			s.Parameters = map[string]string{"scale": strconv.Itoa(scale), "connect.decimal.precision": strconv.Itoa(precision)}
+		}
+	case schema.TYPE_ENUM:
+		s.Name = "io.debezium.data.Enum"
+		s.Parameters = map[string]string{"allowed": strings.Join(column.EnumValues, ",")}
+	case schema.TYPE_SET:
+		s.Name = "io.debezium.data.EnumSet"
+		s.Parameters = map[string]string{"allowed": strings.Join(column.SetValues, ",")}
+	case schema.TYPE_DATETIME:
+		s.Type, s.Name = "int64", "io.debezium.time.Timestamp"
+		if fsp(args) > 3 {
+			s.Name = "io.debezium.time.MicroTimestamp"
+		}
+	case schema.TYPE_TIMESTAMP:
+		s.Name = "io.debezium.time.ZonedTimestamp"
+	case schema.TYPE_DATE:
+		s.Type, s.Name = "int32", "io.debezium.time.Date"
+	case schema.TYPE_TIME:
+		s.Type, s.Name = "int64", "io.debezium.time.MicroTime"
+	case schema.TYPE_BIT:
+		length := 1
+		if len(args) > 0 {
+			length = args[0]
+		}
+		if length == 1 {
+			s.Type = "boolean"
+		} else {
+			s.Type, s.Name = "bytes", "io.debezium.data.Bits"
+			s.Parameters = map[string]string{"length": strconv.Itoa(length)}
+		}
+	case schema.TYPE_JSON:
+		s.Name = "io.debezium.data.Json"
+	default:
+		switch {
+		case dmlbuilder.IsGeometry(column):
+			s.Type, s.Name = "struct", "io.debezium.data.geometry.Geometry"
+			s.Fields = []*Schema{{Type: "bytes", Field: "wkb"}, {Type: "int32", Optional: true, Field: "srid"}}
+		case dmlbuilder.IsBinary(column):
+			s.Type = "bytes"
+		}
+	}
+	if s.Name != "" {
+		s.Version = 1
+	}
+	return s
+}
+
+// value converts a binlog value into the representation of columnSchema
+func (e *Encoder) value(column *schema.TableColumn, c interface{}) (interface{}, error) {
+	v, err := dmlbuilder.ColumnValue(column, c)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	_, args := dmlbuilder.TypeArgs(column)
+	switch column.Type {
+	case schema.TYPE_DECIMAL:
+		return e.decimalValue(column, args, v)
+	case schema.TYPE_DATETIME:
+		t, ok := parseTime(v, time.UTC)
+		if !ok {
+			return nil, nil
+		}
+		if fsp(args) > 3 {
+			return t.UnixNano() / int64(time.Microsecond), nil
+		}
+		return t.UnixNano() / int64(time.Millisecond), nil
+	case schema.TYPE_TIMESTAMP:
+		location := e.Location
+		if location == nil {
+			location = time.UTC
+		}
+		t, ok := parseTime(v, location)
+		if !ok {
+			return nil, nil
+		}
+		layout := "2006-01-02T15:04:05"
+		if digits := fsp(args); digits > 0 {
+			layout += "." + strings.Repeat("0", digits)
+		}
+		return t.UTC().Format(layout + "Z07:00"), nil
+	case schema.TYPE_DATE:
+		t, err := time.ParseInLocation("2006-01-02", fmt.Sprint(v), time.UTC)
+		if err != nil {
+			// Zero dates have no representation
+			return nil, nil
+		}
+		return int32(t.Unix() / 86400), nil
+	case schema.TYPE_TIME:
+		return dmlbuilder.TimeMicros(fmt.Sprint(v))
+	case schema.TYPE_BIT:
+		bits, ok := v.(uint64)
+		if !ok {
+			return v, nil
+		}
+		length := 1
+		if len(args) > 0 {
+			length = args[0]
+		}
+		if length == 1 {
+			return bits != 0, nil
+		}
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, bits)
+		return b[:(length+7)/8], nil
+	}
+	if b, ok := v.([]byte); ok && dmlbuilder.IsGeometry(column) {
+		// Geometries are stored as the SRID followed by the WKB representation
+		if len(b) < 4 {
+			return nil, fmt.Errorf("Invalid geometry for %s", column.Name)
+		}
+		return geometry{WKB: b[4:], SRID: binary.LittleEndian.Uint32(b)}, nil
+	}
+	return v, nil
+}
+
+func (e *Encoder) decimalValue(column *schema.TableColumn, args []int, v interface{}) (interface{}, error) {
+	var d decimal.Decimal
+	switch value := v.(type) {
+	case decimal.Decimal:
+		d = value
+	case float64:
+		d = decimal.NewFromFloat(value)
+	default:
+		var err error
+		if d, err = decimal.NewFromString(fmt.Sprint(v)); err != nil {
+			return nil, fmt.Errorf("Invalid value %v for %s %s", v, column.Name, column.RawType)
+		}
+	}
+	_, scale := decimalArgs(args)
+	switch e.Decimals {
+	case DecimalString:
+		return d.StringFixed(int32(scale)), nil
+	case DecimalDouble:
+		f, _ := d.Float64()
+		return f, nil
+	}
+	unscaled, _ := new(big.Int).SetString(strings.Replace(d.StringFixed(int32(scale)), ".", "", 1), 10)
+	return twosComplement(unscaled), nil
+}
+
+// twosComplement is the big-endian two's complement of x in as few bytes as
+// possible, as java.math.BigInteger.toByteArray
+func twosComplement(x *big.Int) []byte {
+	magnitude := x
+	if x.Sign() < 0 {
+		magnitude = new(big.Int).Not(x)
+	}
+	n := magnitude.BitLen()/8 + 1
+	value := new(big.Int).Lsh(big.NewInt(1), uint(n*8))
+	value.Add(value, x)
+	b := value.Bytes()
+	if len(b) > n {
+		b = b[len(b)-n:]
+	}
+	return append(make([]byte, n-len(b)), b...)
+}
+
+func decimalArgs(args []int) (int, int) {
+	precision, scale := 10, 0
+	if len(args) > 0 {
+		precision = args[0]
+	}
+	if len(args) > 1 {
+		scale = args[1]
+	}
+	return precision, scale
+}
+
+// fsp is the fractional seconds precision of a temporal column
+func fsp(args []int) int {
+	if len(args) > 0 {
+		return args[0]
+	}
+	return 0
+}
+
+func parseTime(v interface{}, location *time.Location) (time.Time, bool) {
+	if t, ok := v.(time.Time); ok {
+		return t, true
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05.999999", fmt.Sprint(v), location)
+	return t, err == nil
+}
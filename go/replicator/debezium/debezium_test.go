@@ -0,0 +1,189 @@
+package debezium
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+	"mysqlreplicator/internal/testutil"
+	"mysqlreplicator/replicator"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the encoder")
+
+// insertCases are the rows of the dmlbuilder insert cases as decoded from the
+// binlog, TIMESTAMP values were inserted from the +01:00 time zone
+func insertCases() [][]interface{} {
+	de, _ := decimal.NewFromString("9.23")
+	return [][]interface{}{
+		{
+			int32(1), []byte("this is \xfe a blob with unicode ᛦ"), []byte("another text"), float64(9.2), de,
+			int64(3), int8(1), "2001-01-01 13:10:12.998", "2001-01-01 09:10:12.999", int64(2), int64(3),
+		},
+		{
+			int32(65000), []byte("ᛦᛦᛦ"), []byte("xx"), float64(9.2), de,
+			int64(2), int8(0), "2001-01-01 13:10:12.998", "2001-01-01 09:10:12.999", int64(2), int64(3),
+		},
+	}
+}
+
+func primaryKeyDeleteTable(pk bool) *schema.Table {
+	table := &schema.Table{Schema: "test", Name: "primarykeydelete"}
+	table.AddColumn("id", "int(8)", "", "")
+	table.AddColumn("data", "int(8)", "", "")
+	if pk {
+		table.PKColumns = []int{0}
+	}
+	return table
+}
+
+func testEncoder() *Encoder {
+	return &Encoder{ServerName: "dbserver1", now: func() time.Time { return time.Unix(1700000000, 0) }}
+}
+
+func changeEvent(table *schema.Table, action string, before, after []interface{}) *replicator.ChangeEvent {
+	return &replicator.ChangeEvent{
+		Action:    action,
+		Schema:    table.Schema,
+		Table:     table.Name,
+		Source:    table,
+		Before:    before,
+		After:     after,
+		ServerID:  100,
+		Timestamp: 978340212,
+		Pos:       mysql.Position{Name: "mysql-bin.000003", Pos: 4721},
+		GTID:      "3e11fa47-71ca-11e1-9e33-c80aa9429562:23",
+	}
+}
+
+// checkGolden compares the key and value of event with testdata/name.json
+func checkGolden(t *testing.T, encoder *Encoder, name string, event *replicator.ChangeEvent) {
+	key, err := encoder.EncodeKey(event)
+	if err != nil {
+		t.Fatalf("%s: unable to encode key %v", name, err)
+	}
+	value, err := encoder.Encode(event)
+	if err != nil {
+		t.Fatalf("%s: unable to encode value %v", name, err)
+	}
+	if key == nil {
+		key = []byte("null")
+	}
+	got, err := json.MarshalIndent(map[string]json.RawMessage{"key": key, "value": value}, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+	path := filepath.Join("testdata", name+".json")
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s: %v, run the tests with -update to create it", name, err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("%s: got\n%s\nexpected\n%s", name, got, expected)
+	}
+}
+
+func TestGoldenEvents(t *testing.T) {
+	rows := insertCases()
+	cases := map[string]*replicator.ChangeEvent{
+		"insert_datatypes_1":    changeEvent(testutil.DataTypesTable(), canal.InsertAction, nil, rows[0]),
+		"insert_datatypes_2":    changeEvent(testutil.DataTypesTable(), canal.InsertAction, nil, rows[1]),
+		"update_datatypes":      changeEvent(testutil.DataTypesTable(), canal.UpdateAction, rows[0], rows[1]),
+		"delete_primary_key":    changeEvent(primaryKeyDeleteTable(true), canal.DeleteAction, []interface{}{int32(1), int32(3)}, nil),
+		"delete_no_primary_key": changeEvent(primaryKeyDeleteTable(false), canal.DeleteAction, []interface{}{int32(1), int32(3)}, nil),
+		"ddl": {
+			Action:    replicator.DDLAction,
+			Schema:    "test",
+			Table:     "primarykeydelete",
+			Query:     "create table primarykeydelete (id int(8) PRIMARY KEY, data int(8))",
+			ServerID:  100,
+			Timestamp: 978340212,
+			Pos:       mysql.Position{Name: "mysql-bin.000003", Pos: 4200},
+		},
+	}
+	for name, event := range cases {
+		checkGolden(t, testEncoder(), name, event)
+	}
+
+	// Rows are published under their routed names
+	event := changeEvent(testutil.DataTypesTable(), canal.InsertAction, nil, rows[0])
+	event.Schema = "archive"
+	event.Row = 1
+	encoder := testEncoder()
+	encoder.Decimals = DecimalString
+	checkGolden(t, encoder, "insert_routed_decimal_string", event)
+}
+
+func TestTemporalAndBinaryValues(t *testing.T) {
+	table := &schema.Table{Schema: "test", Name: "temporal"}
+	table.AddColumn("d", "date", "", "")
+	table.AddColumn("t", "time(6)", "", "")
+	table.AddColumn("dt", "datetime(6)", "", "")
+	table.AddColumn("ts", "timestamp", "", "")
+	table.AddColumn("y", "year(4)", "", "")
+	table.AddColumn("flag", "bit(1)", "", "")
+	table.AddColumn("u", "int(10) unsigned", "", "")
+	table.AddColumn("neg", "decimal(6,3)", "", "")
+	table.AddColumn("location", "point", "", "")
+	point := []byte{0xe6, 0x10, 0, 0, 1, 1, 0, 0, 0}
+	neg, _ := decimal.NewFromString("-1.28")
+	row := []interface{}{"1969-12-31", "-838:59:59.000001", "2001-01-01 13:10:12.000001", "2001-01-01 10:10:12", 2001, int64(1), int32(-1), neg, point}
+	location, _ := time.LoadLocation("Europe/Paris")
+	encoder := testEncoder()
+	encoder.Location = location
+	encoder.OmitSchema = true
+	value, err := encoder.Encode(changeEvent(table, canal.InsertAction, nil, row))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	var payload struct {
+		After map[string]interface{} `json:"after"`
+	}
+	if err := json.Unmarshal(value, &payload); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"d":        -1.0,
+		"t":        -3020399000001.0,
+		"dt":       978354612000001.0,
+		"ts":       "2001-01-01T09:10:12Z",
+		"y":        2001.0,
+		"flag":     true,
+		"u":        4294967295.0,
+		"neg":      "+wA=",
+		"location": map[string]interface{}{"wkb": "AQEAAAA=", "srid": 4326.0},
+	}
+	for column, v := range expected {
+		if got, _ := json.Marshal(payload.After[column]); string(got) != mustMarshal(v) {
+			t.Errorf("Expected %s for %s, got %s", mustMarshal(v), column, got)
+		}
+	}
+}
+
+func mustMarshal(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func TestNewEncoder(t *testing.T) {
+	if _, err := NewEncoder("dbserver1", "exact", nil); err == nil {
+		t.Errorf("Expected error for an unknown decimal handling")
+	}
+	if _, err := NewEncoder("dbserver1", DecimalDouble, nil); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
@@ -1,8 +1,12 @@
 package dmlbuilder
 
 import (
+	"encoding/hex"
 	"fmt"
 	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+	"mysqlreplicator/loader"
+	"mysqlreplicator/replicator/routing"
 	"reflect"
 	"strconv"
 	"strings"
@@ -13,87 +17,385 @@ const (
 	NULL  = "NULL"
 )
 
+// MaxPlaceholders is the maximum number of placeholders of a prepared
+// statement, combined rows are split into several statements past it
+const MaxPlaceholders = 65535
+
+// Mode selects the statements used to apply inserts and updates
+type Mode int
+
+const (
+	// ReplaceMode applies inserts and updates as a REPLACE of the after image
+	ReplaceMode Mode = iota
+	// UpdateMode applies inserts as INSERT and updates as an UPDATE of the row
+	// matching the primary key of the before image, columns that only exist
+	// on the target are left untouched
+	UpdateMode
+)
+
+// Builder generates DML statements from rows events, the zero value uses
+// ReplaceMode and renders one statement per row
+type Builder struct {
+	Mode Mode
+	// BatchRows is the maximum number of rows combined into one statement,
+	// inserts become a multi VALUES statement and deletes on tables with a
+	// primary key a single DELETE ... WHERE pk IN (...). Updates are only
+	// combined in ReplaceMode
+	BatchRows int
+	// Router maps source tables to the tables written on the target, nil
+	// keeps the source names
+	Router *routing.Router
+}
+
+// GetDML renders the first row of the event with values inlined in the query
 func GetDML(event *canal.RowsEvent) string {
-	var table = event.Table.Name
-	var schema = event.Table.Schema
-	var values string
+	query, _ := Builder{}.DML(event)
+	return query
+}
+
+// GetDMLs renders every row of the event with values inlined in the queries
+func GetDMLs(event *canal.RowsEvent) ([]string, error) {
+	return Builder{}.DMLs(event)
+}
+
+// GetStatement is the parameterised version of GetDML
+func GetStatement(event *canal.RowsEvent) (loader.Statement, error) {
+	return Builder{}.Statement(event)
+}
+
+// GetStatements is the parameterised version of GetDMLs
+func GetStatements(event *canal.RowsEvent) ([]loader.Statement, error) {
+	return Builder{}.Statements(event)
+}
+
+// DML renders the first row of the event with values inlined in the query
+func (b Builder) DML(event *canal.RowsEvent) (string, error) {
+	rows, err := firstRow(event)
+	if err != nil {
+		return "", err
+	}
+	return b.build(event, rows, &values{inline: true})
+}
+
+// Statement renders the first row of the event with placeholders in place of
+// the values
+func (b Builder) Statement(event *canal.RowsEvent) (loader.Statement, error) {
+	rows, err := firstRow(event)
+	if err != nil {
+		return loader.Statement{}, err
+	}
+	v := &values{}
+	query, err := b.build(event, rows, v)
+	if err != nil {
+		return loader.Statement{}, err
+	}
+	return loader.Statement{Query: query, Args: v.args}, nil
+}
+
+// DMLs renders every row of the event with values inlined in the queries
+func (b Builder) DMLs(event *canal.RowsEvent) ([]string, error) {
+	var queries []string
+	err := b.each(event, func(rows [][]interface{}) error {
+		query, err := b.build(event, rows, &values{inline: true})
+		queries = append(queries, query)
+		return err
+	})
+	return queries, err
+}
+
+// Statements renders every row of the event with placeholders in place of the
+// values
+func (b Builder) Statements(event *canal.RowsEvent) ([]loader.Statement, error) {
+	var statements []loader.Statement
+	err := b.each(event, func(rows [][]interface{}) error {
+		v := &values{}
+		query, err := b.build(event, rows, v)
+		statements = append(statements, loader.Statement{Query: query, Args: v.args})
+		return err
+	})
+	return statements, err
+}
+
+// each splits the event rows into the groups rendered as a single statement,
+// update events carry [before, after] pairs that are never split. No group
+// binds more than MaxPlaceholders values
+func (b Builder) each(event *canal.RowsEvent, f func(rows [][]interface{}) error) error {
+	step := rowStep(event)
+	size := step
+	if b.BatchRows > 1 && b.combinable(event) {
+		rows := b.BatchRows
+		if limit := MaxPlaceholders / rowPlaceholders(event); rows > limit {
+			rows = limit
+		}
+		size = step * rows
+	}
+	for i := 0; i+step <= len(event.Rows); i += size {
+		end := i + size
+		if end > len(event.Rows) {
+			end = len(event.Rows) - (len(event.Rows)-i)%step
+		}
+		if err := f(event.Rows[i:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b Builder) combinable(event *canal.RowsEvent) bool {
+	switch event.Action {
+	case canal.UpdateAction:
+		return b.Mode == ReplaceMode
+	case canal.DeleteAction:
+		return len(event.Table.PKColumns) > 0
+	}
+	return true
+}
+
+// rowPlaceholders is the number of values a combined row binds, the primary
+// key of deleted rows and every value of the others
+func rowPlaceholders(event *canal.RowsEvent) int {
+	n := len(event.Table.Columns)
+	if event.Action == canal.DeleteAction {
+		n = len(event.Table.PKColumns)
+	} else if len(event.Rows) > 0 {
+		n = len(event.Rows[0])
+	}
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+func rowStep(event *canal.RowsEvent) int {
+	if event.Action == canal.UpdateAction {
+		return 2
+	}
+	return 1
+}
+
+// firstRow returns the first row of the event, the [before, after] pair of
+// updates
+func firstRow(event *canal.RowsEvent) ([][]interface{}, error) {
+	step := rowStep(event)
+	if len(event.Rows) < step {
+		return nil, fmt.Errorf("Event has %d rows but %s needs %d", len(event.Rows), event.Action, step)
+	}
+	return event.Rows[:step], nil
+}
+
+// build renders rows into a single statement, rows holds [before, after] pairs
+// for updates
+func (b Builder) build(event *canal.RowsEvent, rows [][]interface{}, v *values) (string, error) {
+	table := b.target(event.Table)
 	switch event.Action {
 	case canal.InsertAction:
-		values, _ = parseValues(event.Rows[0])
+		if b.Mode == UpdateMode {
+			return insertDML("INSERT", table, rows, v)
+		}
+		return insertDML("REPLACE", table, rows, v)
 	case canal.UpdateAction:
-		values, _ = parseValues(event.Rows[1])
+		if b.Mode == UpdateMode {
+			return updateDML(table, rows[0], rows[1], v)
+		}
+		after := make([][]interface{}, 0, len(rows)/2)
+		for i := 1; i < len(rows); i += 2 {
+			after = append(after, rows[i])
+		}
+		return insertDML("REPLACE", table, after, v)
 	case canal.DeleteAction:
-		return deleteDML(event)
+		if len(rows) > 1 {
+			return deleteRowsDML(table, rows, v)
+		}
+		return deleteDML(table, rows[0], v)
+	}
+	return "", fmt.Errorf("Unknown action %s", event.Action)
+}
+
+// target returns table renamed as routed on the target
+func (b Builder) target(table *schema.Table) *schema.Table {
+	if b.Router == nil {
+		return table
 	}
-	return fmt.Sprintf("REPLACE INTO %s.%s VALUES (%s);", schema, table, values)
+	routed := *table
+	routed.Schema, routed.Name = b.Router.Table(table.Schema, table.Name)
+	return &routed
 }
 
-func parseValues(rows []interface{}) (string, error) {
-	var values = make([]string, len(rows))
-	var err error
-	for i, c := range rows {
-		if values[i], err = typeToString(c); err != nil {
+func insertDML(verb string, table *schema.Table, rows [][]interface{}, v *values) (string, error) {
+	if len(rows) == 0 {
+		return "", fmt.Errorf("No rows to insert into %s", table)
+	}
+	width := len(rows[0])
+	if width > len(table.Columns) {
+		return "", fmt.Errorf("Row has %d values but %s has %d columns", width, table, len(table.Columns))
+	}
+	columns := make([]string, width)
+	for i := range columns {
+		columns[i] = quoteName(table.Columns[i].Name)
+	}
+	tuples := make([]string, len(rows))
+	for k, row := range rows {
+		if len(row) != width {
+			return "", fmt.Errorf("Rows of %s have a different number of values", table)
+		}
+		vals := make([]string, width)
+		var err error
+		for i, c := range row {
+			if vals[i], err = v.bind(&table.Columns[i], c); err != nil {
+				return "", err
+			}
+		}
+		tuples[k] = "(" + strings.Join(vals, ",") + ")"
+	}
+	return fmt.Sprintf("%s INTO %s (%s) VALUES %s", verb, tableName(table),
+		strings.Join(columns, ","), strings.Join(tuples, ",")), nil
+}
+
+func updateDML(table *schema.Table, before []interface{}, after []interface{}, v *values) (string, error) {
+	if len(after) > len(table.Columns) {
+		return "", fmt.Errorf("Row has %d values but %s has %d columns", len(after), table, len(table.Columns))
+	}
+	assignments := make([]string, len(after))
+	for i, c := range after {
+		val, err := v.bind(&table.Columns[i], c)
+		if err != nil {
 			return "", err
 		}
+		assignments[i] = quoteName(table.Columns[i].Name) + "=" + val
+	}
+	where, err := whereClause(table, before, v)
+	if err != nil {
+		return "", err
 	}
-	return strings.Join(values, ","), nil
+	return fmt.Sprintf("UPDATE %s SET %s WHERE %s", tableName(table), strings.Join(assignments, ","), where), nil
 }
 
-func deleteDML(event *canal.RowsEvent) string {
-	if len(event.Table.PKColumns) > 0 {
-		return deleteWithPK(event)
+func deleteDML(table *schema.Table, row []interface{}, v *values) (string, error) {
+	where, err := whereClause(table, row, v)
+	if err != nil {
+		return "", err
 	}
-	return deleteFullRow(event)
+	return fmt.Sprintf("DELETE FROM %s WHERE %s", tableName(table), where), nil
 }
 
-func deleteFullRow(event *canal.RowsEvent) string {
-	values := make([]string, len(event.Table.Columns))
-	for i, c := range event.Table.Columns {
-		val, _ := typeToString(event.Rows[0][i])
-		values[i] = c.Name + "=" + val
+// deleteRowsDML deletes several rows by primary key with a single IN clause
+func deleteRowsDML(table *schema.Table, rows [][]interface{}, v *values) (string, error) {
+	columns := make([]string, len(table.PKColumns))
+	for k, i := range table.PKColumns {
+		columns[k] = quoteName(table.Columns[i].Name)
 	}
-	where := strings.Join(values, " AND ")
-	return fmt.Sprintf("DELETE FROM %s.%s WHERE %s", event.Table.Schema, event.Table.Name, where)
+	keys := make([]string, len(rows))
+	for r, row := range rows {
+		vals := make([]string, len(table.PKColumns))
+		var err error
+		for k, i := range table.PKColumns {
+			if vals[k], err = v.bind(&table.Columns[i], row[i]); err != nil {
+				return "", err
+			}
+		}
+		keys[r] = strings.Join(vals, ",")
+	}
+	if len(columns) == 1 {
+		return fmt.Sprintf("DELETE FROM %s WHERE %s IN (%s)", tableName(table), columns[0], strings.Join(keys, ",")), nil
+	}
+	return fmt.Sprintf("DELETE FROM %s WHERE (%s) IN ((%s))", tableName(table),
+		strings.Join(columns, ","), strings.Join(keys, "),(")), nil
+}
+
+// whereClause matches the row by primary key, or by every column when the
+// table has no primary key
+func whereClause(table *schema.Table, row []interface{}, v *values) (string, error) {
+	columns := table.PKColumns
+	if len(columns) == 0 {
+		columns = make([]int, len(table.Columns))
+		for i := range columns {
+			columns[i] = i
+		}
+	}
+	conditions := make([]string, len(columns))
+	for k, i := range columns {
+		colname := quoteName(table.Columns[i].Name)
+		if row[i] == nil {
+			conditions[k] = colname + " IS NULL"
+			continue
+		}
+		val, err := v.bind(&table.Columns[i], row[i])
+		if err != nil {
+			return "", err
+		}
+		conditions[k] = colname + "=" + val
+	}
+	return strings.Join(conditions, " AND "), nil
 }
 
-func deleteWithPK(event *canal.RowsEvent) string {
-	values := make([]string, len(event.Table.PKColumns))
-	for _, i := range event.Table.PKColumns {
-		colname := event.Table.Columns[i].Name
-		val, _ := typeToString(event.Rows[0][i])
-		values[i] = colname + "=" + val
+func tableName(table *schema.Table) string {
+	return quoteName(table.Schema) + "." + quoteName(table.Name)
+}
+
+func quoteName(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// values renders row values either inline or as placeholders collecting the
+// bound arguments
+type values struct {
+	inline bool
+	args   []interface{}
+}
+
+func (v *values) bind(column *schema.TableColumn, c interface{}) (string, error) {
+	c, err := columnValue(column, c)
+	if err != nil {
+		return "", err
 	}
-	whereclause := strings.Join(values, " AND ")
-	return fmt.Sprintf("DELETE FROM %s.%s WHERE %s", event.Table.Schema, event.Table.Name, whereclause)
+	if v.inline {
+		return typeToString(c)
+	}
+	arg, err := toArg(c)
+	if err != nil {
+		return "", err
+	}
+	v.args = append(v.args, arg)
+	return "?", nil
 }
 
+// typeToString renders a value as a SQL literal
 func typeToString(c interface{}) (string, error) {
 	var out string
-	switch c.(type) {
+	switch v := c.(type) {
 	case int, int8, int16, int32, int64:
-		/* 
-		 * Implicitly handles BIT, BOOLEAN types
-		 * ENUM and Set are stored a bitmap and returned as interger in binlog 
-		  */
 		value := reflect.ValueOf(c).Int()
 		out = strconv.FormatInt(value, 10)
 	case uint, uint8, uint16, uint32, uint64:
 		value := reflect.ValueOf(c).Uint()
 		out = strconv.FormatUint(value, 10)
+	case bool:
+		out = strconv.FormatBool(v)
 	case float64:
-		value := c.(float64)
-		out = QUOTE + strconv.FormatFloat(value, 'e', -1, 64) + QUOTE
+		out = strconv.FormatFloat(v, 'f', -1, 64)
 	case float32:
-		value := c.(float64)
-		out = QUOTE + strconv.FormatFloat(value, 'e', -1, 32) + QUOTE
+		out = strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case bitValue:
+		out = "b'" + strconv.FormatUint(uint64(v), 2) + QUOTE
+	case binaryValue:
+		out = "X'" + hex.EncodeToString(v) + QUOTE
 	case string:
-		out = QUOTE + c.(string) + QUOTE
+		out = QUOTE + escape(v) + QUOTE
 	case []byte:
-		out = QUOTE + string(c.([]byte)) + QUOTE
+		out = QUOTE + escape(string(v)) + QUOTE
+	case fmt.Stringer:
+		// Decimal values are rendered as exact numbers
+		out = v.String()
 	case nil:
 		out = NULL
 	default:
-		return "", fmt.Errorf("Unkown type %v", c)
+		return "", fmt.Errorf("Unkown type %T for value %v", c, c)
 	}
 	return out, nil
 }
+
+var escaper = strings.NewReplacer("\\", "\\\\", "'", "\\'", "\x00", "\\0", "\n", "\\n", "\r", "\\r", "\x1a", "\\Z")
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
@@ -1,4 +1,4 @@
-package dmlbuilder
+package dmlbuilder_test
 
 import (
 	"fmt"
@@ -6,6 +6,7 @@ import (
 	"github.com/siddontang/go-mysql/mysql"
 	"mysqlreplicator/loader"
 	"mysqlreplicator/replicator"
+	"mysqlreplicator/replicator/dmlbuilder"
 	"mysqlreplicator/replicator/mock"
 	"strings"
 	"testing"
@@ -43,7 +44,7 @@ func TestDataTypeConversions(t *testing.T) {
 	defer dataloader.Close()
 	handler := &mock.MockHandler{}
 	wdcanal := replicator.NewWdCanal(uint32(100), "127.0.0.1", 3306, "root", "", handler)
-	_ = wdcanal.SetPos(&mysql.Position{currentLog, uint32(currentPos)})
+	_ = wdcanal.SetPos(&mysql.Position{Name: currentLog, Pos: uint32(currentPos)})
 	if err = wdcanal.Start(); err != nil {
 		t.Fatalf("Unable to start canal: %v", err)
 	}
@@ -64,7 +65,7 @@ func TestDataTypeConversions(t *testing.T) {
 
 		transaction := handler.Trasactions[k][0]
 
-		query := GetDML(transaction)
+		query := dmlbuilder.GetDML(transaction)
 		dataloader.ExecFunc(func(c *client.Conn) error {
 			_, _ = dataloader.Exec("SET time_zone = '+00:00';") //Replication uses UTC
 			_, e := dataloader.Exec(query)
@@ -89,7 +90,7 @@ func TestDeleteDMLPK(t *testing.T) {
 	defer dataloader.Close()
 	handler := &mock.MockHandler{}
 	wdcanal := replicator.NewWdCanal(uint32(100), "127.0.0.1", 3306, "root", "", handler)
-	_ = wdcanal.SetPos(&mysql.Position{currentLog, uint32(currentPos)})
+	_ = wdcanal.SetPos(&mysql.Position{Name: currentLog, Pos: uint32(currentPos)})
 	if err = wdcanal.Start(); err != nil {
 		t.Fatalf("Unable to start canal: %v", err)
 	}
@@ -103,11 +104,11 @@ func TestDeleteDMLPK(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Unabled to prepare dataset for test: %v", err)
 	}
-	expected := "DELETE FROM test.primarykeydelete WHERE id=1"
+	expected := "DELETE FROM `test`.`primarykeydelete` WHERE `id`=1"
 	time.Sleep(100 * time.Millisecond)
 
 	transaction := handler.Trasactions[1][0]
-	if query := GetDML(transaction) ; query != expected {
+	if query := dmlbuilder.GetDML(transaction) ; query != expected {
 		t.Fatalf("Wrong Delete %s, expected %s", query, expected)
 	}
 
@@ -121,7 +122,7 @@ func TestDeleteDML(t *testing.T) {
 	defer dataloader.Close()
 	handler := &mock.MockHandler{}
 	wdcanal := replicator.NewWdCanal(uint32(100), "127.0.0.1", 3306, "root", "", handler)
-	_ = wdcanal.SetPos(&mysql.Position{currentLog, uint32(currentPos)})
+	_ = wdcanal.SetPos(&mysql.Position{Name: currentLog, Pos: uint32(currentPos)})
 	if err = wdcanal.Start(); err != nil {
 		t.Fatalf("Unable to start canal: %v", err)
 	}
@@ -135,11 +136,11 @@ func TestDeleteDML(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Unabled to prepare dataset for test: %v", err)
 	}
-	expected := "DELETE FROM test.primarykeydelete WHERE id=1 AND data=3"
+	expected := "DELETE FROM `test`.`primarykeydelete` WHERE `id`=1 AND `data`=3"
 	time.Sleep(100 * time.Millisecond)
 
 	transaction := handler.Trasactions[1][0]
-	if query := GetDML(transaction); query != expected {
+	if query := dmlbuilder.GetDML(transaction); query != expected {
 		t.Fatalf("Wrong Delete %s, expected %s", query,expected)
 	}
 
@@ -0,0 +1,25 @@
+package dmlbuilder
+
+import (
+	"fmt"
+)
+
+// toArg converts a binlog value into a type the binary protocol can send
+func toArg(c interface{}) (interface{}, error) {
+	switch v := c.(type) {
+	case int, int8, int16, int32, int64:
+		return v, nil
+	case uint, uint8, uint16, uint32, uint64:
+		return v, nil
+	case float32, float64, bool, string, []byte, nil:
+		return v, nil
+	case bitValue:
+		return uint64(v), nil
+	case binaryValue:
+		return []byte(v), nil
+	case fmt.Stringer:
+		// Decimal values
+		return v.String(), nil
+	}
+	return nil, fmt.Errorf("Unkown type %T for value %v", c, c)
+}
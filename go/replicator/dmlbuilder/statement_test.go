@@ -0,0 +1,210 @@
+package dmlbuilder_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+	"mysqlreplicator/internal/testutil"
+	"mysqlreplicator/replicator/dmlbuilder"
+)
+
+// testTable is test.statements, its id is the primary key with pk
+func testTable(pk bool) *schema.Table {
+	return testutil.Table("statements", pk, "data blob", "price decimal(5,2)")
+}
+
+func TestStatementKeepsValuesOutOfQuery(t *testing.T) {
+	value := []byte("it's a \\ blob with a \x00 NUL byte")
+	price, _ := decimal.NewFromString("9.23")
+	event := &canal.RowsEvent{Table: testTable(true), Action: canal.InsertAction, Rows: [][]interface{}{{1, value, price}}}
+	stmt, err := dmlbuilder.GetStatement(event)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if expected := "REPLACE INTO `test`.`statements` (`id`,`data`,`price`) VALUES (?,?,?)"; stmt.Query != expected {
+		t.Fatalf("Expected %s, got %s", expected, stmt.Query)
+	}
+	if string(stmt.Args[1].([]byte)) != string(value) {
+		t.Fatalf("Binary value was altered: %q", stmt.Args[1])
+	}
+	if stmt.Args[2] != "9.23" {
+		t.Fatalf("Expected decimal as exact string, got %v", stmt.Args[2])
+	}
+}
+
+func TestUpdateStatementUsesAfterImage(t *testing.T) {
+	event := &canal.RowsEvent{Table: testTable(true), Action: canal.UpdateAction, Rows: [][]interface{}{{1, "before", nil}, {1, "after", nil}}}
+	stmt, err := dmlbuilder.GetStatement(event)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if fmt.Sprintf("%v", stmt.Args) != "[1 after <nil>]" {
+		t.Fatalf("Expected after image, got %v", stmt.Args)
+	}
+}
+
+func TestDeleteStatement(t *testing.T) {
+	event := &canal.RowsEvent{Table: testTable(true), Action: canal.DeleteAction, Rows: [][]interface{}{{1, "'; DROP TABLE x; --", nil}}}
+	stmt, _ := dmlbuilder.GetStatement(event)
+	if expected := "DELETE FROM `test`.`statements` WHERE `id`=?"; stmt.Query != expected {
+		t.Fatalf("Expected %s, got %s", expected, stmt.Query)
+	}
+
+	event.Table = testTable(false)
+	stmt, _ = dmlbuilder.GetStatement(event)
+	if expected := "DELETE FROM `test`.`statements` WHERE `id`=? AND `data`=? AND `price` IS NULL"; stmt.Query != expected {
+		t.Fatalf("Expected %s, got %s", expected, stmt.Query)
+	}
+	if len(stmt.Args) != 2 {
+		t.Fatalf("NULL values should not be bound, got %v", stmt.Args)
+	}
+}
+
+func TestStatementUnknownType(t *testing.T) {
+	event := &canal.RowsEvent{Table: testTable(true), Action: canal.InsertAction, Rows: [][]interface{}{{1, struct{}{}, nil}}}
+	if _, err := dmlbuilder.GetStatement(event); err == nil {
+		t.Fatalf("Expected error for unsupported value type")
+	}
+}
+
+func TestStatementMissingRows(t *testing.T) {
+	update := &canal.RowsEvent{Table: testTable(true), Action: canal.UpdateAction, Rows: [][]interface{}{{1, "before", nil}}}
+	if _, err := dmlbuilder.GetStatement(update); err == nil {
+		t.Errorf("Expected error for an update without its after image")
+	}
+	insert := &canal.RowsEvent{Table: testTable(true), Action: canal.InsertAction}
+	if _, err := (dmlbuilder.Builder{}).DML(insert); err == nil {
+		t.Errorf("Expected error for an event without rows")
+	}
+}
+
+func TestUpdateModeStatements(t *testing.T) {
+	builder := dmlbuilder.Builder{Mode: dmlbuilder.UpdateMode}
+	update := &canal.RowsEvent{Table: testTable(true), Action: canal.UpdateAction, Rows: [][]interface{}{{1, "before", nil}, {2, "after", nil}}}
+	stmt, err := builder.Statement(update)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if expected := "UPDATE `test`.`statements` SET `id`=?,`data`=?,`price`=? WHERE `id`=?"; stmt.Query != expected {
+		t.Fatalf("Expected %s, got %s", expected, stmt.Query)
+	}
+	if fmt.Sprintf("%v", stmt.Args) != "[2 after <nil> 1]" {
+		t.Fatalf("Expected after image and before image key, got %v", stmt.Args)
+	}
+
+	insert := &canal.RowsEvent{Table: testTable(true), Action: canal.InsertAction, Rows: [][]interface{}{{1, "data", nil}}}
+	stmt, _ = builder.Statement(insert)
+	if expected := "INSERT INTO `test`.`statements` (`id`,`data`,`price`) VALUES (?,?,?)"; stmt.Query != expected {
+		t.Fatalf("Expected %s, got %s", expected, stmt.Query)
+	}
+}
+
+func TestInlineDMLQuotesIdentifiers(t *testing.T) {
+	table := &schema.Table{Schema: "my schema", Name: "odd`name"}
+	table.AddColumn("order", "int", "", "")
+	event := &canal.RowsEvent{Table: table, Action: canal.UpdateAction, Rows: [][]interface{}{{1}, {2}}}
+	if query, expected := dmlbuilder.GetDML(event), "REPLACE INTO `my schema`.`odd``name` (`order`) VALUES (2)"; query != expected {
+		t.Fatalf("Expected %s, got %s", expected, query)
+	}
+	query, _ := dmlbuilder.Builder{Mode: dmlbuilder.UpdateMode}.DML(event)
+	if expected := "UPDATE `my schema`.`odd``name` SET `order`=2 WHERE `order`=1"; query != expected {
+		t.Fatalf("Expected %s, got %s", expected, query)
+	}
+}
+
+func TestStatementsCoverEveryRow(t *testing.T) {
+	update := &canal.RowsEvent{Table: testTable(true), Action: canal.UpdateAction, Rows: [][]interface{}{
+		{1, "a", nil}, {1, "b", nil}, {2, "c", nil}, {2, "d", nil}, {3, "e", nil}, {3, "f", nil},
+	}}
+	stmts, err := dmlbuilder.GetStatements(update)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(stmts) != 3 {
+		t.Fatalf("Expected a statement for each row, got %d", len(stmts))
+	}
+	for i, expected := range []string{"[1 b <nil>]", "[2 d <nil>]", "[3 f <nil>]"} {
+		if fmt.Sprintf("%v", stmts[i].Args) != expected {
+			t.Fatalf("Expected %s, got %v", expected, stmts[i].Args)
+		}
+	}
+	queries, err := dmlbuilder.GetDMLs(update)
+	if err != nil || len(queries) != 3 {
+		t.Fatalf("Expected a query for each row, got %v %v", queries, err)
+	}
+}
+
+func TestBatchedStatements(t *testing.T) {
+	builder := dmlbuilder.Builder{BatchRows: 2}
+	insert := &canal.RowsEvent{Table: testTable(true), Action: canal.InsertAction, Rows: [][]interface{}{{1, "a", nil}, {2, "b", nil}, {3, "c", nil}}}
+	stmts, err := builder.Statements(insert)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(stmts) != 2 {
+		t.Fatalf("Expected 2 statements, got %d", len(stmts))
+	}
+	if expected := "REPLACE INTO `test`.`statements` (`id`,`data`,`price`) VALUES (?,?,?),(?,?,?)"; stmts[0].Query != expected {
+		t.Fatalf("Expected %s, got %s", expected, stmts[0].Query)
+	}
+	if len(stmts[0].Args) != 6 || len(stmts[1].Args) != 3 {
+		t.Fatalf("Wrong arguments %v %v", stmts[0].Args, stmts[1].Args)
+	}
+
+	update := &canal.RowsEvent{Table: testTable(true), Action: canal.UpdateAction, Rows: [][]interface{}{{1, "a", nil}, {1, "b", nil}, {2, "c", nil}, {2, "d", nil}}}
+	stmts, _ = builder.Statements(update)
+	if len(stmts) != 1 || fmt.Sprintf("%v", stmts[0].Args) != "[1 b <nil> 2 d <nil>]" {
+		t.Fatalf("Expected after images in a single statement, got %v", stmts)
+	}
+
+	builder.BatchRows = 10
+	deletes := &canal.RowsEvent{Table: testTable(true), Action: canal.DeleteAction, Rows: [][]interface{}{{1, "a", nil}, {2, "b", nil}, {3, "c", nil}}}
+	queries, _ := builder.DMLs(deletes)
+	if expected := "DELETE FROM `test`.`statements` WHERE `id` IN (1,2,3)"; len(queries) != 1 || queries[0] != expected {
+		t.Fatalf("Expected %s, got %v", expected, queries)
+	}
+
+	deletes.Table.PKColumns = []int{0, 1}
+	queries, _ = builder.DMLs(deletes)
+	if expected := "DELETE FROM `test`.`statements` WHERE (`id`,`data`) IN ((1,'a'),(2,'b'),(3,'c'))"; len(queries) != 1 || queries[0] != expected {
+		t.Fatalf("Expected %s, got %v", expected, queries)
+	}
+
+	deletes.Table = testTable(false)
+	if queries, _ = builder.DMLs(deletes); len(queries) != 3 {
+		t.Fatalf("Deletes without primary key should not be combined, got %v", queries)
+	}
+}
+
+func TestBatchedStatementsPlaceholders(t *testing.T) {
+	builder := dmlbuilder.Builder{BatchRows: 100000}
+	insert := &canal.RowsEvent{Table: testTable(true), Action: canal.InsertAction}
+	deletes := &canal.RowsEvent{Table: testTable(true), Action: canal.DeleteAction}
+	for i := 0; i < 30000; i++ {
+		insert.Rows = append(insert.Rows, []interface{}{i, "a", nil})
+		deletes.Rows = append(deletes.Rows, []interface{}{i, "a", nil})
+	}
+	for _, test := range []struct {
+		event      *canal.RowsEvent
+		statements int
+		args       int
+	}{{insert, 2, 90000}, {deletes, 1, 30000}} {
+		stmts, err := builder.Statements(test.event)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		args := 0
+		for _, stmt := range stmts {
+			if len(stmt.Args) > dmlbuilder.MaxPlaceholders {
+				t.Errorf("Expected %d placeholders at most, got %d", dmlbuilder.MaxPlaceholders, len(stmt.Args))
+			}
+			args += len(stmt.Args)
+		}
+		if len(stmts) != test.statements || args != test.args {
+			t.Errorf("Expected %d statements binding %d values, got %d binding %d", test.statements, test.args, len(stmts), args)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package dmlbuilder
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// bitValue is the value of a BIT column, rendered as a bit-value literal
+type bitValue uint64
+
+// binaryValue is a binary string rendered as an hexadecimal literal, used for
+// BLOB, BINARY and GEOMETRY columns. Geometries are replicated in their
+// internal format: SRID followed by the WKB representation
+type binaryValue []byte
+
+// datetimeFormat keeps up to microseconds, trailing zeros are dropped
+const datetimeFormat = "2006-01-02 15:04:05.999999"
+
+var geometryTypes = []string{"geometry", "point", "linestring", "polygon", "multipoint",
+	"multilinestring", "multipolygon", "geometrycollection", "geomcollection"}
+
+// columnValue converts a value decoded from the binlog into the value to
+// apply on the target according to the column type
+func columnValue(column *schema.TableColumn, c interface{}) (interface{}, error) {
+	if c == nil || column == nil {
+		return c, nil
+	}
+	if b, ok := c.([]byte); ok && IsGeometry(column) {
+		// POINT and MULTIPOINT are parsed as numbers by the schema
+		return binaryValue(b), nil
+	}
+	switch column.Type {
+	case schema.TYPE_ENUM:
+		index, ok := toInt64(c)
+		if !ok {
+			return c, nil
+		}
+		if index == 0 {
+			// Invalid values are stored as the empty string
+			return "", nil
+		}
+		if index < 0 || int(index) > len(column.EnumValues) {
+			return nil, fmt.Errorf("Invalid value %d for %s %s", index, column.Name, column.RawType)
+		}
+		return column.EnumValues[index-1], nil
+	case schema.TYPE_SET:
+		bitmap, ok := toInt64(c)
+		if !ok {
+			return c, nil
+		}
+		labels := make([]string, 0, len(column.SetValues))
+		for i, label := range column.SetValues {
+			if bitmap&(1<<uint(i)) != 0 {
+				labels = append(labels, label)
+			}
+		}
+		return strings.Join(labels, ","), nil
+	case schema.TYPE_BIT:
+		if bits, ok := toInt64(c); ok {
+			return bitValue(uint64(bits)), nil
+		}
+	case schema.TYPE_JSON:
+		// JSON can not be created from a binary string
+		if b, ok := c.([]byte); ok {
+			return string(b), nil
+		}
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP, schema.TYPE_DATE:
+		if t, ok := c.(time.Time); ok {
+			if column.Type == schema.TYPE_DATE {
+				return t.Format("2006-01-02"), nil
+			}
+			if column.Type == schema.TYPE_TIMESTAMP {
+				t = t.UTC()
+			}
+			return t.Format(datetimeFormat), nil
+		}
+	case schema.TYPE_NUMBER:
+		if column.IsUnsigned {
+			if v, ok := toInt64(c); ok && strings.HasPrefix(column.RawType, "mediumint") {
+				// MEDIUMINT is decoded from 3 bytes into a signed int32
+				return uint32(v) & 0xFFFFFF, nil
+			}
+			return toUnsigned(c), nil
+		}
+	case schema.TYPE_STRING:
+		if b, ok := c.([]byte); ok && IsBinary(column) {
+			return binaryValue(b), nil
+		}
+	}
+	return c, nil
+}
+
+// ColumnValue converts a value decoded from the binlog into a plain value
+// according to the column type, as applied on targets: ENUM and SET values as
+// their labels, BIT values as uint64, binary strings as []byte and other
+// strings as string
+func ColumnValue(column *schema.TableColumn, c interface{}) (interface{}, error) {
+	v, err := columnValue(column, c)
+	switch value := v.(type) {
+	case bitValue:
+		return uint64(value), err
+	case binaryValue:
+		return []byte(value), err
+	case []byte:
+		return string(value), err
+	}
+	return v, err
+}
+
+// IsBinary reports whether the values of column are binary strings
+func IsBinary(column *schema.TableColumn) bool {
+	if column.Collation == "binary" {
+		return true
+	}
+	raw := strings.ToLower(column.RawType)
+	if column.Collation == "" && (strings.Contains(raw, "blob") || strings.Contains(raw, "binary")) {
+		return true
+	}
+	return IsGeometry(column)
+}
+
+// IsGeometry reports whether column is a spatial type
+func IsGeometry(column *schema.TableColumn) bool {
+	raw := strings.ToLower(column.RawType)
+	for _, t := range geometryTypes {
+		if strings.HasPrefix(raw, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func toInt64(c interface{}) (int64, bool) {
+	switch c.(type) {
+	case int, int8, int16, int32, int64:
+		return reflect.ValueOf(c).Int(), true
+	case uint, uint8, uint16, uint32, uint64:
+		return int64(reflect.ValueOf(c).Uint()), true
+	}
+	return 0, false
+}
+
+// toUnsigned reinterprets a signed integer as unsigned of the same width
+func toUnsigned(c interface{}) interface{} {
+	switch v := c.(type) {
+	case int8:
+		return uint8(v)
+	case int16:
+		return uint16(v)
+	case int32:
+		return uint32(v)
+	case int64:
+		return uint64(v)
+	case int:
+		return uint(v)
+	}
+	return c
+}
+
+// TypeArgs splits the type of column, such as "decimal(5,2) unsigned", into its
+// name and arguments
+func TypeArgs(column *schema.TableColumn) (string, []int) {
+	raw := strings.ToLower(column.RawType)
+	end := strings.IndexAny(raw, "( ")
+	if end < 0 {
+		return raw, nil
+	}
+	name := raw[:end]
+	var args []int
+	if raw[end] == '(' {
+		if close := strings.IndexByte(raw, ')'); close > end {
+			for _, arg := range strings.Split(raw[end+1:close], ",") {
+				if n, err := strconv.Atoi(strings.TrimSpace(arg)); err == nil {
+					args = append(args, n)
+				}
+			}
+		}
+	}
+	return name, args
+}
+
+// TimeMicros converts a TIME value formatted as [-]HHH:MM:SS[.ffffff] into
+// microseconds
+func TimeMicros(s string) (int64, error) {
+	negative := strings.HasPrefix(s, "-")
+	parts := strings.Split(strings.TrimPrefix(s, "-"), ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("Invalid TIME value %s", s)
+	}
+	fraction := "000000"
+	if dot := strings.IndexByte(parts[2], '.'); dot >= 0 {
+		fraction = (parts[2][dot+1:] + fraction)[:6]
+		parts[2] = parts[2][:dot]
+	}
+	var fields [4]int64
+	for i, part := range append(parts, fraction) {
+		n, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid TIME value %s", s)
+		}
+		fields[i] = n
+	}
+	micros := ((fields[0]*60+fields[1])*60+fields[2])*1e6 + fields[3]
+	if negative {
+		micros = -micros
+	}
+	return micros, nil
+}
@@ -0,0 +1,80 @@
+package dmlbuilder_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+	"mysqlreplicator/internal/testutil"
+	"mysqlreplicator/replicator/dmlbuilder"
+)
+
+func TestDataTypeRendering(t *testing.T) {
+	de, _ := decimal.NewFromString("9.23")
+	row := []interface{}{
+		int32(1), []byte("this is \xfe a blob with unicode ᛦ"), []byte("it's another\\text"), float64(9.2), de,
+		int64(3), int8(1), "2001-01-01 13:10:12.998", "2001-01-01 09:10:12.999", int64(2), int64(3),
+	}
+	event := &canal.RowsEvent{Table: testutil.DataTypesTable(), Action: canal.InsertAction, Rows: [][]interface{}{row}}
+	query := dmlbuilder.GetDML(event)
+	expected := []string{
+		"1", "X'7468697320697320fe206120626c6f62207769746820756e69636f646520e19ba6'", "'it\\'s another\\\\text'",
+		"9.2", "9.23", "b'11'", "1", "'2001-01-01 13:10:12.998'", "'2001-01-01 09:10:12.999'", "'B'", "'A,B'",
+	}
+	if values := "VALUES (" + strings.Join(expected, ",") + ")"; !strings.HasSuffix(query, values) {
+		t.Fatalf("Expected %s, got %s", values, query)
+	}
+
+	stmt, err := dmlbuilder.GetStatement(event)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if fmt.Sprintf("%v", stmt.Args[4:]) != "[9.23 3 1 2001-01-01 13:10:12.998 2001-01-01 09:10:12.999 B A,B]" {
+		t.Fatalf("Unexpected arguments %v", stmt.Args[4:])
+	}
+}
+
+func TestNumericRendering(t *testing.T) {
+	table := &schema.Table{Schema: "test", Name: "numbers"}
+	table.AddColumn("f", "float", "", "")
+	table.AddColumn("d", "double", "", "")
+	table.AddColumn("u", "int(10) unsigned", "", "")
+	table.AddColumn("m", "mediumint(8) unsigned", "", "")
+	table.AddColumn("e", "enum('x','y')", "", "")
+	event := &canal.RowsEvent{Table: table, Action: canal.InsertAction, Rows: [][]interface{}{
+		{float32(0.1), float64(12345678901.5), int32(-1), int32(-1), int64(0)},
+	}}
+	expected := "(0.1,12345678901.5,4294967295,16777215,'')"
+	if query := dmlbuilder.GetDML(event); !strings.HasSuffix(query, expected) {
+		t.Fatalf("Expected %s, got %s", expected, query)
+	}
+
+	event.Rows[0][4] = int64(3)
+	if _, err := dmlbuilder.GetStatement(event); err == nil {
+		t.Fatalf("Expected error for an ENUM index out of range")
+	}
+}
+
+func TestJSONAndGeometryRendering(t *testing.T) {
+	table := &schema.Table{Schema: "test", Name: "documents"}
+	table.AddColumn("doc", "json", "", "")
+	table.AddColumn("location", "point", "", "")
+	point := []byte{0, 0, 0, 0, 1, 1, 0, 0, 0}
+	event := &canal.RowsEvent{Table: table, Action: canal.InsertAction, Rows: [][]interface{}{
+		{[]byte(`{"name": "o'neil"}`), point},
+	}}
+	expected := `('{"name": "o\'neil"}',X'000000000101000000')`
+	if query := dmlbuilder.GetDML(event); !strings.HasSuffix(query, expected) {
+		t.Fatalf("Expected %s, got %s", expected, query)
+	}
+	stmt, _ := dmlbuilder.GetStatement(event)
+	if _, ok := stmt.Args[0].(string); !ok {
+		t.Fatalf("JSON should be sent as a string, got %T", stmt.Args[0])
+	}
+	if _, ok := stmt.Args[1].([]byte); !ok {
+		t.Fatalf("Geometry should be sent as binary, got %T", stmt.Args[1])
+	}
+}
@@ -0,0 +1,362 @@
+// Package filesink writes change events as newline-delimited JSON to local
+// files, replicating without a target database
+package filesink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"mysqlreplicator/internal/fileutil"
+	"mysqlreplicator/replicator"
+)
+
+// Compression of the data files
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// DefaultPrefix starts the names of the files
+const DefaultPrefix = "changes"
+
+// Config configures a Sink
+type Config struct {
+	// Dir holds the data files and the checkpoint, it is created if missing
+	Dir string
+	// Prefix starts the names of the files, DefaultPrefix when empty. Data
+	// files are named "<prefix>-<sequence>.ndjson" followed by the extension
+	// of their compression and the checkpoint "<prefix>.checkpoint"
+	Prefix string
+	// MaxSize rotates a file once it holds MaxSize bytes, compressed bytes
+	// when compressed. Files are not rotated by size when 0
+	MaxSize int64
+	// MaxAge rotates a file opened MaxAge ago before the next transaction is
+	// written. Files are not rotated by age when 0
+	MaxAge time.Duration
+	// Compression is CompressionNone, CompressionGzip or CompressionZstd,
+	// CompressionNone when empty
+	Compression string
+	// Encoder encodes the lines, replicator.JSONEncoder when nil. It must not
+	// write newlines
+	Encoder replicator.Encoder
+}
+
+// Sink appends every change event as a line to the current data file, each
+// transaction is synced to disk before it is checkpointed. Compressed
+// transactions are written as gzip members or zstd frames of their own, the
+// files are valid at every synced offset.
+//
+// The Sink is the CheckpointStore of its handler: checkpoints are saved with
+// the file and offset the last transaction ends at. Data written after the
+// last checkpoint is truncated when the sink is opened again, the replicated
+// transactions are written once even after a crash
+type Sink struct {
+	sync.Mutex
+	config Config
+	now    func() time.Time
+	gzip   *gzip.Writer
+	zstd   *zstd.Encoder
+	file   *os.File
+	opened time.Time
+	// sequence is the sequence number of the last data file
+	sequence int
+	// name is the data file the last transaction was written to and offset
+	// its size once the transaction was synced
+	name   string
+	offset int64
+}
+
+// state is saved into the checkpoint file, the data files after Sequence and
+// the data of File after Offset were written after the checkpoint
+type state struct {
+	Checkpoint *replicator.Checkpoint `json:"checkpoint"`
+	Sequence   int                    `json:"sequence"`
+	File       string                 `json:"file,omitempty"`
+	Offset     int64                  `json:"offset"`
+}
+
+// NewSink returns a sink writing to config.Dir, the files written after the
+// last checkpoint are truncated
+func NewSink(config Config) (*Sink, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("No directory for the file sink")
+	}
+	if config.Prefix == "" {
+		config.Prefix = DefaultPrefix
+	}
+	if config.Encoder == nil {
+		config.Encoder = replicator.JSONEncoder{}
+	}
+	s := &Sink{config: config, now: time.Now}
+	switch config.Compression {
+	case CompressionNone, "":
+	case CompressionGzip:
+		s.gzip = gzip.NewWriter(nil)
+	case CompressionZstd:
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		s.zstd = encoder
+	default:
+		return nil, fmt.Errorf("Unknown compression %s, expected %s, %s or %s", config.Compression, CompressionNone, CompressionGzip, CompressionZstd)
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// recover truncates the data written after the last checkpoint and finds the
+// sequence number of the last data file
+func (s *Sink) recover() error {
+	saved, err := s.loadState()
+	if err != nil {
+		return err
+	}
+	files, err := s.dataFiles()
+	if err != nil {
+		return err
+	}
+	if saved != nil {
+		s.sequence, s.name, s.offset = saved.Sequence, saved.File, saved.Offset
+		if saved.File != "" {
+			if err := truncate(filepath.Join(s.config.Dir, saved.File), saved.Offset); err != nil {
+				return err
+			}
+		}
+	}
+	for sequence, name := range files {
+		if saved != nil && sequence > saved.Sequence {
+			if err := os.Remove(filepath.Join(s.config.Dir, name)); err != nil {
+				return err
+			}
+		} else if sequence > s.sequence {
+			s.sequence = sequence
+		}
+	}
+	return nil
+}
+
+// truncate cuts the file at path to size, files moved away once rotated are
+// ignored
+func truncate(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = f.Truncate(size); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to truncate %s to the checkpoint: %v", path, err)
+	}
+	return nil
+}
+
+// dataFiles returns the names of the data files in Dir by sequence number
+func (s *Sink) dataFiles() (map[int]string, error) {
+	entries, err := ioutil.ReadDir(s.config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[int]string)
+	for _, entry := range entries {
+		if sequence, err := s.parseSequence(entry.Name()); err == nil && !entry.IsDir() {
+			files[sequence] = entry.Name()
+		}
+	}
+	return files, nil
+}
+
+func (s *Sink) parseSequence(name string) (int, error) {
+	prefix := s.config.Prefix + "-"
+	i := strings.Index(name, ".ndjson")
+	if !strings.HasPrefix(name, prefix) || i < len(prefix) {
+		return 0, fmt.Errorf("%s is not a data file", name)
+	}
+	return strconv.Atoi(name[len(prefix):i])
+}
+
+func (s *Sink) fileName(sequence int) string {
+	name := fmt.Sprintf("%s-%08d.ndjson", s.config.Prefix, sequence)
+	switch {
+	case s.gzip != nil:
+		name += ".gz"
+	case s.zstd != nil:
+		name += ".zst"
+	}
+	return name
+}
+
+func (s *Sink) checkpointPath() string {
+	return filepath.Join(s.config.Dir, s.config.Prefix+".checkpoint")
+}
+
+// Publish appends the events of a transaction to the current data file and
+// syncs it, the file is rotated first when it reached MaxSize or MaxAge
+func (s *Sink) Publish(events []*replicator.ChangeEvent) error {
+	s.Lock()
+	defer s.Unlock()
+	var lines bytes.Buffer
+	for _, event := range events {
+		line, err := s.config.Encoder.Encode(event)
+		if err != nil {
+			return fmt.Errorf("Unable to encode %s event on %s.%s: %v", event.Action, event.Schema, event.Table, err)
+		}
+		lines.Write(line)
+		lines.WriteByte('\n')
+	}
+	data, err := s.compress(lines.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if s.file != nil && s.rotationDue() {
+		if err := s.closeFile(); err != nil {
+			return err
+		}
+	}
+	if s.file == nil {
+		if err := s.openFile(); err != nil {
+			return err
+		}
+	}
+	if _, err = s.file.Write(data); err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		// Drop the partial transaction, the file is appended to
+		if terr := s.file.Truncate(s.offset); terr != nil {
+			s.file.Close()
+			s.file = nil
+		}
+		return fmt.Errorf("Unable to write to %s: %v", s.name, err)
+	}
+	s.offset += int64(len(data))
+	return nil
+}
+
+// compress returns a gzip member or zstd frame of lines
+func (s *Sink) compress(lines []byte) ([]byte, error) {
+	switch {
+	case s.gzip != nil:
+		var b bytes.Buffer
+		s.gzip.Reset(&b)
+		if _, err := s.gzip.Write(lines); err != nil {
+			return nil, err
+		}
+		if err := s.gzip.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	case s.zstd != nil:
+		return s.zstd.EncodeAll(lines, nil), nil
+	}
+	return lines, nil
+}
+
+func (s *Sink) rotationDue() bool {
+	return s.config.MaxSize > 0 && s.offset >= s.config.MaxSize ||
+		s.config.MaxAge > 0 && s.now().Sub(s.opened) >= s.config.MaxAge
+}
+
+// openFile creates the next data file
+func (s *Sink) openFile() error {
+	name := s.fileName(s.sequence + 1)
+	f, err := os.OpenFile(filepath.Join(s.config.Dir, name), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	// The entry of the file must be durable before a checkpoint refers to it
+	if err := fileutil.SyncDir(s.config.Dir); err != nil {
+		f.Close()
+		return err
+	}
+	s.file, s.opened = f, s.now()
+	s.sequence, s.name, s.offset = s.sequence+1, name, 0
+	return nil
+}
+
+func (s *Sink) closeFile() error {
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// TableChanged notifies the encoder when it is a replicator.TableListener
+func (s *Sink) TableChanged(schema string, table string) error {
+	if listener, ok := s.config.Encoder.(replicator.TableListener); ok {
+		return listener.TableChanged(schema, table)
+	}
+	return nil
+}
+
+// Close closes the current data file
+func (s *Sink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	return s.closeFile()
+}
+
+func (s *Sink) Transactional() bool {
+	return false
+}
+
+// Load returns the last saved checkpoint
+func (s *Sink) Load() (*replicator.Checkpoint, error) {
+	saved, err := s.loadState()
+	if err != nil || saved == nil {
+		return nil, err
+	}
+	return saved.Checkpoint, nil
+}
+
+func (s *Sink) loadState() (*state, error) {
+	data, err := ioutil.ReadFile(s.checkpointPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	saved := &state{}
+	if err := json.Unmarshal(data, saved); err != nil {
+		return nil, fmt.Errorf("Invalid checkpoint file %s: %v", s.checkpointPath(), err)
+	}
+	return saved, nil
+}
+
+// Save saves c with the end of the last published transaction, the file is
+// replaced atomically
+func (s *Sink) Save(c *replicator.Checkpoint) error {
+	s.Lock()
+	saved := state{Checkpoint: c, Sequence: s.sequence, File: s.name, Offset: s.offset}
+	s.Unlock()
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteAtomic(s.checkpointPath(), data)
+}
@@ -0,0 +1,237 @@
+package filesink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"mysqlreplicator/internal/testutil"
+	"mysqlreplicator/replicator"
+)
+
+func insert(ids ...int) []*replicator.ChangeEvent {
+	var events []*replicator.ChangeEvent
+	for _, id := range ids {
+		events = append(events, &replicator.ChangeEvent{Action: canal.InsertAction, Schema: "shop", Table: "orders", Source: testutil.OrdersTable(), After: []interface{}{id, "new"}})
+	}
+	return events
+}
+
+// files returns the names of the data files in dir
+func files(t *testing.T, dir string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.ndjson*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(matches)
+	for i := range matches {
+		matches[i] = filepath.Base(matches[i])
+	}
+	return matches
+}
+
+// ids returns the ids of the rows inserted by the lines of a data file
+func ids(t *testing.T, path string) []int {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	switch filepath.Ext(path) {
+	case ".gz":
+		if r, err = gzip.NewReader(f); err != nil {
+			t.Fatal(err)
+		}
+	case ".zst":
+		decoder, err := zstd.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer decoder.Close()
+		r = decoder
+	}
+	var result []int
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var line struct {
+			After struct {
+				ID int `json:"id"`
+			} `json:"after"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("Invalid line %q: %v", scanner.Text(), err)
+		}
+		result = append(result, line.After.ID)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Unable to read %s: %v", path, err)
+	}
+	return result
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "filesink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestSinkWritesTransactions(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	sink, err := NewSink(Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := replicator.NewSinkHandler(sink, replicator.HandlerOptions{Checkpoint: sink})
+	rows := &canal.RowsEvent{Table: testutil.OrdersTable(), Action: canal.InsertAction, Rows: [][]interface{}{{1, "new"}, {2, "new"}}}
+	if err := handler.OnRow(rows); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := handler.OnPosSynced(mysql.Position{Name: "log", Pos: 100}, false); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if names := files(t, dir); len(names) != 1 || names[0] != "changes-00000001.ndjson" {
+		t.Fatalf("Expected a single data file, got %v", names)
+	}
+	if got := ids(t, filepath.Join(dir, "changes-00000001.ndjson")); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("Expected a line per row, got %v", got)
+	}
+	checkpoint, err := sink.Load()
+	if err != nil || checkpoint == nil || checkpoint.Pos.Name != "log" || checkpoint.Pos.Pos != 100 {
+		t.Fatalf("Expected the checkpoint of the transaction, got %v %v", checkpoint, err)
+	}
+}
+
+func TestSinkRotates(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	sink, err := NewSink(Config{Dir: dir, Prefix: "audit", MaxSize: 250, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	now := time.Date(2019, 5, 1, 10, 0, 0, 0, time.UTC)
+	sink.now = func() time.Time { return now }
+
+	// A transaction is never split
+	if err := sink.Publish(insert(1, 2, 3)); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := sink.Publish(insert(4)); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := sink.Publish(insert(5)); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	now = now.Add(time.Hour)
+	if err := sink.Publish(insert(6)); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	names := files(t, dir)
+	if len(names) != 3 {
+		t.Fatalf("Expected 3 data files, got %v", names)
+	}
+	expected := [][]int{{1, 2, 3}, {4, 5}, {6}}
+	for i, name := range names {
+		got := ids(t, filepath.Join(dir, name))
+		if len(got) != len(expected[i]) || got[0] != expected[i][0] {
+			t.Errorf("Expected %v in %s, got %v", expected[i], name, got)
+		}
+	}
+}
+
+func TestSinkCompression(t *testing.T) {
+	for _, compression := range []string{CompressionGzip, CompressionZstd} {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		sink, err := NewSink(Config{Dir: dir, Compression: compression})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for id := 1; id <= 3; id++ {
+			if err := sink.Publish(insert(id)); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+		}
+		sink.Close()
+		names := files(t, dir)
+		if len(names) != 1 {
+			t.Fatalf("Expected a single %s data file, got %v", compression, names)
+		}
+		if got := ids(t, filepath.Join(dir, names[0])); len(got) != 3 || got[2] != 3 {
+			t.Errorf("Expected every transaction of the %s file, got %v", compression, got)
+		}
+	}
+	if _, err := NewSink(Config{Dir: os.TempDir(), Compression: "lz4"}); err == nil {
+		t.Errorf("Expected error for unknown compression")
+	}
+}
+
+func TestSinkTruncatesAfterCheckpoint(t *testing.T) {
+	for _, compression := range []string{CompressionNone, CompressionGzip, CompressionZstd} {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		sink, err := NewSink(Config{Dir: dir, Compression: compression, MaxSize: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Publish(insert(1)); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if err := sink.Publish(insert(2)); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if err := sink.Save(&replicator.Checkpoint{Pos: &mysql.Position{Name: "log", Pos: 200}}); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		// Written but never checkpointed
+		sink.config.MaxSize = 0
+		if err := sink.Publish(insert(3)); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		sink.config.MaxSize = 1
+		if err := sink.Publish(insert(4)); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		sink.Close()
+
+		sink, err = NewSink(Config{Dir: dir, Compression: compression, MaxSize: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkpoint, err := sink.Load()
+		if err != nil || checkpoint.Pos.Pos != 200 {
+			t.Fatalf("Expected the saved checkpoint, got %v %v", checkpoint, err)
+		}
+		names := files(t, dir)
+		if len(names) != 2 {
+			t.Fatalf("Expected the files written after the checkpoint to be removed, got %v", names)
+		}
+		if got := ids(t, filepath.Join(dir, names[1])); len(got) != 1 || got[0] != 2 {
+			t.Fatalf("Expected the %s file truncated to the checkpoint, got %v", compression, got)
+		}
+		if err := sink.Publish(insert(3)); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		sink.Close()
+		if names := files(t, dir); len(names) != 3 || ids(t, filepath.Join(dir, names[2]))[0] != 3 {
+			t.Fatalf("Expected the transaction in a new file, got %v", names)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package replicator
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// DDLAction is the action of DDL statements in action filters, rows events
+// use canal.InsertAction, canal.UpdateAction and canal.DeleteAction
+const DDLAction = "ddl"
+
+// systemSchemas are never replicated
+var systemSchemas = []string{"^mysql.*"}
+
+// Filter selects the schemas, tables and actions to replicate. A table is
+// replicated when it matches any include rule, or there are none, and no
+// exclude rule
+type Filter struct {
+	// IncludeSchemas and ExcludeSchemas are schema names
+	IncludeSchemas []string `json:"include_schemas" yaml:"include_schemas" toml:"include_schemas"`
+	ExcludeSchemas []string `json:"exclude_schemas" yaml:"exclude_schemas" toml:"exclude_schemas"`
+	// IncludeTables and ExcludeTables are regular expressions on "schema.table"
+	IncludeTables []string `json:"include_tables" yaml:"include_tables" toml:"include_tables"`
+	ExcludeTables []string `json:"exclude_tables" yaml:"exclude_tables" toml:"exclude_tables"`
+	// Actions skips some actions on tables that are otherwise replicated
+	Actions []ActionFilter `json:"skip" yaml:"skip" toml:"skip"`
+}
+
+// ActionFilter skips Actions on the tables matching the Table regular
+// expression on "schema.table"
+type ActionFilter struct {
+	Table   string   `json:"table" yaml:"table" toml:"table"`
+	Actions []string `json:"actions" yaml:"actions" toml:"actions"`
+}
+
+// Filterable is implemented by handlers filtering the events they apply
+type Filterable interface {
+	SetFilter(Filter) error
+}
+
+// ParseActionFilter parses an action filter written as
+// "<table regex>:<action>[,<action>...]", "^tenant_x\.:delete" skips deletes
+// on every table of schema tenant_x
+func ParseActionFilter(spec string) (ActionFilter, error) {
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return ActionFilter{}, fmt.Errorf("Invalid action filter %s, expected <table regex>:<actions>", spec)
+	}
+	filter := ActionFilter{Table: spec[:i], Actions: strings.Split(spec[i+1:], ",")}
+	_, err := filter.compile()
+	return filter, err
+}
+
+// canalRules returns the include and exclude regular expressions of the canal
+// configuration, action filters can only be applied by the handler
+func (f Filter) canalRules() ([]string, []string) {
+	include := make([]string, 0, len(f.IncludeSchemas)+len(f.IncludeTables))
+	for _, schema := range f.IncludeSchemas {
+		include = append(include, schemaRegex(schema))
+	}
+	include = append(include, f.IncludeTables...)
+	if len(include) == 0 {
+		// Canal excludes every table when the include list is empty
+		include = []string{""}
+	}
+	exclude := append([]string{}, systemSchemas...)
+	for _, schema := range f.ExcludeSchemas {
+		exclude = append(exclude, schemaRegex(schema))
+	}
+	exclude = append(exclude, f.ExcludeTables...)
+	return include, exclude
+}
+
+func schemaRegex(schema string) string {
+	return "^" + regexp.QuoteMeta(schema) + "\\."
+}
+
+// tableFilter is the compiled form of a Filter
+type tableFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+	actions []actionFilter
+}
+
+type actionFilter struct {
+	table   *regexp.Regexp
+	actions map[string]bool
+}
+
+func (f Filter) compile() (*tableFilter, error) {
+	include, exclude := f.canalRules()
+	compiled := &tableFilter{}
+	var err error
+	if compiled.include, err = compileAll(include); err != nil {
+		return nil, err
+	}
+	if compiled.exclude, err = compileAll(exclude); err != nil {
+		return nil, err
+	}
+	for _, a := range f.Actions {
+		action, err := a.compile()
+		if err != nil {
+			return nil, err
+		}
+		compiled.actions = append(compiled.actions, action)
+	}
+	return compiled, nil
+}
+
+func (a ActionFilter) compile() (actionFilter, error) {
+	exp, err := regexp.Compile(a.Table)
+	if err != nil {
+		return actionFilter{}, fmt.Errorf("Invalid table filter %s: %v", a.Table, err)
+	}
+	actions := make(map[string]bool, len(a.Actions))
+	for _, action := range a.Actions {
+		switch action {
+		case canal.InsertAction, canal.UpdateAction, canal.DeleteAction, DDLAction:
+			actions[action] = true
+		default:
+			return actionFilter{}, fmt.Errorf("Unknown action %s in filter for %s", action, a.Table)
+		}
+	}
+	return actionFilter{table: exp, actions: actions}, nil
+}
+
+func compileAll(expressions []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, len(expressions))
+	for i, exp := range expressions {
+		var err error
+		if compiled[i], err = regexp.Compile(exp); err != nil {
+			return nil, fmt.Errorf("Invalid table filter %s: %v", exp, err)
+		}
+	}
+	return compiled, nil
+}
+
+// allows reports whether action on schema.table is replicated, it matches
+// tables the same way canal does
+func (f *tableFilter) allows(schema string, table string, action string) bool {
+	key := schema + "." + table
+	if !matchAny(f.include, key) || matchAny(f.exclude, key) {
+		return false
+	}
+	for _, a := range f.actions {
+		if a.actions[action] && a.table.MatchString(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// databaseStatement matches the DDL statements on a database
+var databaseStatement = regexp.MustCompile("(?i)^\\s*(?:CREATE|ALTER|DROP)\\s+(?:DATABASE|SCHEMA)\\s+(?:IF\\s+(?:NOT\\s+)?EXISTS\\s+)?" + identifier)
+
+// ddlTable returns the schema and table a DDL statement is filtered on,
+// changed is the table canal reported for it. Statements changing no table,
+// such as CREATE DATABASE, are filtered on the database they name or on the
+// schema they were executed against
+func ddlTable(changed [2]string, queryEvent *replication.QueryEvent) (string, string) {
+	if changed[0] != "" || changed[1] != "" {
+		return changed[0], changed[1]
+	}
+	if match := databaseStatement.FindStringSubmatch(string(queryEvent.Query)); match != nil {
+		return unquoteName(match[1]), ""
+	}
+	return string(queryEvent.Schema), ""
+}
+
+func matchAny(expressions []*regexp.Regexp, key string) bool {
+	for _, exp := range expressions {
+		if exp.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
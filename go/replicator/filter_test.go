@@ -0,0 +1,150 @@
+package replicator
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func tenantFilter() Filter {
+	return Filter{
+		IncludeSchemas: []string{"tenant_a", "tenant_b"},
+		ExcludeTables:  []string{"\\.tmp_"},
+		Actions:        []ActionFilter{{Table: "^tenant_b\\.", Actions: []string{canal.DeleteAction, DDLAction}}},
+	}
+}
+
+func TestCanalRules(t *testing.T) {
+	include, exclude := Filter{}.canalRules()
+	if fmt.Sprintf("%q %q", include, exclude) != `[""] ["^mysql.*"]` {
+		t.Fatalf("Unexpected default rules %q %q", include, exclude)
+	}
+	include, exclude = tenantFilter().canalRules()
+	if fmt.Sprintf("%q %q", include, exclude) != `["^tenant_a\\." "^tenant_b\\."] ["^mysql.*" "\\.tmp_"]` {
+		t.Fatalf("Unexpected rules %q %q", include, exclude)
+	}
+}
+
+func TestFilterAllows(t *testing.T) {
+	filter, err := tenantFilter().compile()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	cases := []struct {
+		schema, table, action string
+		allowed               bool
+	}{
+		{"tenant_a", "orders", canal.DeleteAction, true},
+		{"tenant_a", "tmp_orders", canal.InsertAction, false},
+		{"tenant_b", "orders", canal.UpdateAction, true},
+		{"tenant_b", "orders", canal.DeleteAction, false},
+		{"tenant_b", "orders", DDLAction, false},
+		{"tenant_c", "orders", canal.InsertAction, false},
+		{"mysql", "user", DDLAction, false},
+	}
+	for _, c := range cases {
+		if filter.allows(c.schema, c.table, c.action) != c.allowed {
+			t.Errorf("Expected %s on %s.%s allowed=%v", c.action, c.schema, c.table, c.allowed)
+		}
+	}
+}
+
+func TestInvalidFilter(t *testing.T) {
+	if _, err := (Filter{IncludeTables: []string{"("}}).compile(); err == nil {
+		t.Fatalf("Expected error for an invalid regular expression")
+	}
+	if _, err := ParseActionFilter("^tenant_b\\.:truncate"); err == nil {
+		t.Fatalf("Expected error for an unknown action")
+	}
+	if _, err := ParseActionFilter("^tenant_b\\."); err == nil {
+		t.Fatalf("Expected error for a filter without actions")
+	}
+	action, err := ParseActionFilter("^tenant_b\\.:delete,update")
+	if err != nil || action.Table != "^tenant_b\\." || len(action.Actions) != 2 {
+		t.Fatalf("Unexpected action filter %v %v", action, err)
+	}
+}
+
+func TestFilteredTransactionAdvancesPosition(t *testing.T) {
+	loader := &MockLoader{}
+	store := &MockCheckpointStore{loader: loader}
+	handler := NewCheckpointedWdHandler(loader, "", store)
+	handler.(Filterable).SetFilter(tenantFilter())
+	table := &schema.Table{Schema: "tenant_b", Name: "orders"}
+	table.AddColumn("id", "int", "", "")
+	event := &canal.RowsEvent{Table: table, Action: canal.DeleteAction, Rows: [][]interface{}{{1}}}
+	if err := handler.OnRow(event); err != nil {
+		t.Fatalf("Unexpected error from OnRow %s", err)
+	}
+	handler.OnXID(mysql.Position{Name: "logname", Pos: 100})
+	if err := handler.OnPosSynced(mysql.Position{Name: "logname", Pos: 100}, false); err != nil {
+		t.Fatalf("Unexpected error syncing a filtered transaction, %v", err)
+	}
+	if loader.begin != 0 || loader.exec != 0 || len(loader.queries) != 0 {
+		t.Fatalf("Filtered rows should not be applied, %v", loader.queries)
+	}
+	if handler.LastCommittedPos().Pos != 100 || len(store.saved) != 1 {
+		t.Fatalf("Filtered transaction should advance the checkpoint")
+	}
+	if err := handler.OnPosSynced(mysql.Position{Name: "logname", Pos: 200}, false); err == nil {
+		t.Fatalf("Position should only be synced once for a filtered transaction")
+	}
+}
+
+func TestFilteredDDL(t *testing.T) {
+	loader := &MockLoader{}
+	handler := NewWdHandler(loader)
+	handler.(Filterable).SetFilter(tenantFilter())
+	ddl := &replication.QueryEvent{Schema: []byte("tenant_b"), Query: []byte("DROP TABLE orders")}
+	handler.OnTableChanged("tenant_b", "orders")
+	if err := handler.OnDDL(mysql.Position{Name: "logname", Pos: 100}, ddl); err != nil {
+		t.Fatalf("Unexpected error from OnDDL %s", err)
+	}
+	if err := handler.OnPosSynced(mysql.Position{Name: "logname", Pos: 100}, true); err != nil {
+		t.Fatalf("Unexpected error syncing a filtered DDL, %v", err)
+	}
+	if loader.begin != 0 || len(loader.queries) != 0 {
+		t.Fatalf("Filtered DDL should not be applied, %v", loader.queries)
+	}
+
+	ddl = &replication.QueryEvent{Schema: []byte("tenant_a"), Query: []byte("DROP TABLE orders")}
+	handler.OnTableChanged("tenant_a", "orders")
+	if err := handler.OnDDL(mysql.Position{Name: "logname", Pos: 200}, ddl); err != nil {
+		t.Fatalf("Unexpected error from OnDDL %s", err)
+	}
+	if len(loader.queries) != 2 {
+		t.Fatalf("DDL on tenant_a should be applied, %v", loader.queries)
+	}
+}
+
+func TestFilteredDatabaseDDL(t *testing.T) {
+	loader := &MockLoader{}
+	handler := NewWdHandler(loader)
+	handler.(Filterable).SetFilter(tenantFilter())
+	sink := &MockSink{}
+	sinkHandler := NewSinkHandler(sink, HandlerOptions{})
+	sinkHandler.(Filterable).SetFilter(tenantFilter())
+	for i, query := range []string{"CREATE DATABASE IF NOT EXISTS `tenant_a`", "DROP SCHEMA other", "ALTER DATABASE tenant_a CHARACTER SET utf8mb4", "CREATE DATABASE tenant_c"} {
+		pos := mysql.Position{Name: "logname", Pos: uint32(100 * (i + 1))}
+		// Canal reports no table changed by statements on databases
+		ddl := &replication.QueryEvent{Schema: []byte("tenant_b"), Query: []byte(query)}
+		for _, h := range []DefaultWDHandler{handler, sinkHandler} {
+			if err := h.OnDDL(pos, ddl); err != nil {
+				t.Fatalf("Unexpected error from OnDDL %s", err)
+			}
+			if err := h.OnPosSynced(pos, true); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+		}
+	}
+	if loader.begin != 2 || fmt.Sprint(loader.queries) != "[USE `tenant_b` CREATE DATABASE IF NOT EXISTS `tenant_a` USE `tenant_b` ALTER DATABASE tenant_a CHARACTER SET utf8mb4]" {
+		t.Fatalf("Expected the DDL on tenant_a only, got %v", loader.queries)
+	}
+	if len(sink.published) != 2 || sink.published[1][0].Query != "ALTER DATABASE tenant_a CHARACTER SET utf8mb4" {
+		t.Fatalf("Expected the DDL on tenant_a published only, got %v", sink.published)
+	}
+}
@@ -0,0 +1,223 @@
+package replicator
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+// DefaultGroupDelay is the GroupOptions.Delay of a group without one
+const DefaultGroupDelay = time.Second
+
+// GroupOptions merges consecutive source transactions into a single target
+// transaction, committed with the position of the last one when a limit is
+// reached. Grouping is enabled when Transactions is greater than 1 or Rows is
+// set, a zero limit is not checked
+type GroupOptions struct {
+	// Transactions is the maximum number of source transactions of a group
+	Transactions int
+	// Rows is the number of rows events rows committing a group once reached
+	Rows int
+	// Delay is the maximum time the first transaction of a group waits for
+	// the others
+	Delay time.Duration
+}
+
+func (o GroupOptions) enabled() bool {
+	return o.Transactions > 1 || o.Rows > 0
+}
+
+// group tracks the source transactions buffered into currentTransaction,
+// events before start belong to transactions that ended at pending
+type group struct {
+	GroupOptions
+	start        int
+	transactions int
+	rows         int
+	pending      *Checkpoint
+	timer        *time.Timer
+	// err is the error of a group committed by the timer
+	err error
+}
+
+// Failing is implemented by handlers failing outside of canal events, as a
+// group committed by its timer. The canal is terminated with the errors of
+// Failures, the Supervisor then restarts it
+type Failing interface {
+	Failures() <-chan error
+}
+
+// Failures receives the errors of the groups committed by the timer as well,
+// to terminate the canal without waiting for an event
+func (h *defaultWDHandler) Failures() <-chan error {
+	return h.failures
+}
+
+func (g *group) full() bool {
+	return (g.Transactions > 0 && g.transactions >= g.Transactions) || (g.Rows > 0 && g.rows >= g.Rows)
+}
+
+// bufferRow adds a rows event to the group, rows are applied when the group
+// is committed
+func (h *defaultWDHandler) bufferRow(ev *canal.RowsEvent) error {
+	h.currentTransaction = append(h.currentTransaction, ev)
+	h.group.rows += len(ev.Rows)
+	h.inTransaction = true
+	return nil
+}
+
+// groupFailed returns the error of a group committed by the timer once
+func (h *defaultWDHandler) groupFailed() error {
+	if h.group == nil || h.group.err == nil {
+		return nil
+	}
+	err := h.group.err
+	h.group.err = nil
+	select {
+	case <-h.failures:
+	default:
+	}
+	return err
+}
+
+func (e *defaultWDHandler) syncGroup(position mysql.Position) error {
+	switch {
+	case e.inTransaction && len(e.currentTransaction) == e.group.start:
+		// DDL statements are committed on their own, after the group
+		return e.commit(position)
+	case e.inTransaction:
+		if last := e.groupPos(); last != nil && position.Compare(*last) == 0 {
+			// Canal syncs the last position again when it is closed in the
+			// middle of a transaction, the partial transaction is discarded
+			log.Infof("Discarding incomplete transaction after %v", position)
+			e.currentTransaction = e.currentTransaction[:e.group.start]
+			e.inTransaction = false
+			e.pendingGTID = nil
+			return e.flush()
+		}
+		return e.endTransaction(position)
+	case e.rotated:
+		e.rotated = false
+		return e.saveCheckpoint(&Checkpoint{Pos: e.position, GTID: e.gtidSet()})
+	case e.skipped:
+		e.skipped = false
+		return e.endTransaction(position)
+	}
+	// Canal syncs the position when it is closed
+	return e.flush()
+}
+
+// groupPos is the position of the last transaction of the group
+func (e *defaultWDHandler) groupPos() *mysql.Position {
+	if e.group.pending != nil {
+		return e.group.pending.Pos
+	}
+	return e.position
+}
+
+// endTransaction adds the transaction ending at position to the group and
+// commits the group when it is full
+func (e *defaultWDHandler) endTransaction(position mysql.Position) error {
+	gtid, err := e.committedGTID()
+	if err != nil {
+		e.discardGroup()
+		return err
+	}
+	e.inTransaction = false
+	e.pendingGTID = nil
+	e.group.pending = &Checkpoint{Pos: &position, GTID: gtid}
+	e.group.start = len(e.currentTransaction)
+	e.group.transactions++
+	if e.group.full() {
+		return e.flush()
+	}
+	if e.group.timer == nil {
+		e.group.timer = time.AfterFunc(e.group.Delay, e.flushExpired)
+	}
+	return nil
+}
+
+func (e *defaultWDHandler) flushExpired() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.flush(); err != nil {
+		log.Errorf("%v", err)
+		e.group.err = err
+		select {
+		case e.failures <- err:
+		default:
+		}
+	}
+}
+
+// flush commits the transactions of the group in a single target transaction
+func (e *defaultWDHandler) flush() error {
+	g := e.group
+	if g.timer != nil {
+		g.timer.Stop()
+		g.timer = nil
+	}
+	if g.pending == nil {
+		return nil
+	}
+	checkpoint := g.pending
+	events := e.currentTransaction[:g.start]
+	e.currentTransaction = append([]*canal.RowsEvent(nil), e.currentTransaction[g.start:]...)
+	g.pending, g.start, g.transactions, g.rows = nil, 0, 0, 0
+	for _, ev := range e.currentTransaction {
+		g.rows += len(ev.Rows)
+	}
+
+	if err := e.client.Begin(); err != nil {
+		e.discardGroup()
+		return err
+	}
+	for _, ev := range events {
+		stmts, err := e.builder.Statements(ev)
+		if err != nil {
+			err = fmt.Errorf("Unable to build statements for %s: %v", ev.Table, err)
+		} else {
+			err = e.client.ExecStatements(stmts)
+		}
+		if err != nil {
+			e.client.Rollback()
+			e.discardGroup()
+			return err
+		}
+	}
+	if e.store != nil && e.store.Transactional() {
+		if err := e.store.Save(checkpoint); err != nil {
+			e.client.Rollback()
+			e.discardGroup()
+			return fmt.Errorf("Unable to save checkpoint %v: %v", checkpoint.Pos, err)
+		}
+	}
+	if err := e.client.Commit(); err != nil {
+		e.client.Rollback()
+		e.discardGroup()
+		return err
+	}
+	e.position = checkpoint.Pos
+	if checkpoint.GTID != nil {
+		gtid := checkpoint.GTID
+		e.gtid = &gtid
+	}
+	if e.store != nil && !e.store.Transactional() {
+		return e.saveCheckpoint(checkpoint)
+	}
+	return nil
+}
+
+// discardGroup drops the buffered transactions after a failure, replication
+// restarts after the last committed position
+func (e *defaultWDHandler) discardGroup() {
+	if e.group.timer != nil {
+		e.group.timer.Stop()
+	}
+	*e.group = group{GroupOptions: e.group.GroupOptions}
+	e.currentTransaction = nil
+	e.inTransaction = false
+	e.pendingGTID = nil
+}
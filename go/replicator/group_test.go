@@ -0,0 +1,155 @@
+package replicator
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"mysqlreplicator/internal/testutil"
+)
+
+func TestGroupCommitsTransactionsTogether(t *testing.T) {
+	store := &MockCheckpointStore{loader: &MockLoader{}, transactional: true}
+	handler := NewWdHandlerWithOptions(store.loader, HandlerOptions{
+		Checkpoint: store,
+		Group:      GroupOptions{Transactions: 3, Delay: time.Hour},
+	})
+	handler.SetPos(&mysql.Position{Name: "log", Pos: 4})
+	for i := 0; i < 2; i++ {
+		if err := insertRows(handler, testutil.Table("a", true), uint32(100+i), i); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	if store.loader.begin != 0 || len(store.loader.queries) != 0 || handler.LastCommittedPos().Pos != 4 {
+		t.Fatalf("Transactions should wait for the group to be full, begin %d, queries %v", store.loader.begin, store.loader.queries)
+	}
+	if err := insertRows(handler, testutil.Table("a", true), 102, 2, 3); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if store.loader.begin != 1 || store.loader.commit != 1 || len(store.loader.queries) != 4 {
+		t.Fatalf("Expected a single transaction of 4 rows, begin %d commit %d queries %v", store.loader.begin, store.loader.commit, store.loader.queries)
+	}
+	if handler.LastCommittedPos().Pos != 102 || len(store.saved) != 1 || store.saved[0].Pos.Pos != 102 || store.commits[0] != 0 {
+		t.Fatalf("The group should be checkpointed with its last position before the commit, got %v", store.saved)
+	}
+}
+
+func TestGroupLimits(t *testing.T) {
+	loader := &MockLoader{}
+	handler := NewWdHandlerWithOptions(loader, HandlerOptions{Group: GroupOptions{Rows: 3, Delay: time.Hour}})
+	if err := insertRows(handler, testutil.Table("a", true), 100, 1, 2); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if loader.commit != 0 {
+		t.Fatalf("Group should not be committed before reaching the rows limit")
+	}
+	if err := insertRows(handler, testutil.Table("a", true), 101, 3); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if loader.commit != 1 || handler.LastCommittedPos().Pos != 101 {
+		t.Fatalf("Group should be committed once it reaches the rows limit")
+	}
+
+	loader = &MockLoader{}
+	handler = NewWdHandlerWithOptions(loader, HandlerOptions{Group: GroupOptions{Transactions: 10, Delay: 10 * time.Millisecond}})
+	if err := insertRows(handler, testutil.Table("a", true), 100, 1); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for pos := handler.LastCommittedPos(); pos == nil || pos.Pos != 100; pos = handler.LastCommittedPos() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Group should be committed after its delay")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGroupIsCommittedBeforeDDL(t *testing.T) {
+	loader := &MockLoader{}
+	handler := NewWdHandlerWithOptions(loader, HandlerOptions{Group: GroupOptions{Transactions: 10, Delay: time.Hour}})
+	if err := insertRows(handler, testutil.Table("a", true), 100, 1); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	ddl := &replication.QueryEvent{Schema: []byte("test"), Query: []byte("ALTER TABLE a ADD COLUMN c int")}
+	if err := handler.OnDDL(mysql.Position{Name: "log", Pos: 200}, ddl); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if loader.commit != 1 || handler.LastCommittedPos().Pos != 100 {
+		t.Fatalf("Group should be committed before the DDL")
+	}
+	if err := handler.OnPosSynced(mysql.Position{Name: "log", Pos: 200}, true); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if loader.commit != 2 || handler.LastCommittedPos().Pos != 200 {
+		t.Fatalf("DDL should be committed on its own")
+	}
+}
+
+func TestGroupDiscardsIncompleteTransactionOnClose(t *testing.T) {
+	loader := &MockLoader{}
+	handler := NewWdHandlerWithOptions(loader, HandlerOptions{Group: GroupOptions{Transactions: 10, Delay: time.Hour}})
+	if err := insertRows(handler, testutil.Table("a", true), 100, 1); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := handler.OnRow(rowsEvent(testutil.Table("a", true), 2)); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := handler.OnPosSynced(mysql.Position{Name: "log", Pos: 100}, true); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if loader.commit != 1 || fmt.Sprint(loader.args) != "[[1]]" || handler.LastCommittedPos().Pos != 100 {
+		t.Fatalf("Only the complete transaction should be committed, got %v", loader.args)
+	}
+}
+
+func TestGroupFailure(t *testing.T) {
+	loader := &MockLoader{err: fmt.Errorf("deadlock")}
+	handler := NewWdHandlerWithOptions(loader, HandlerOptions{Group: GroupOptions{Transactions: 2, Delay: time.Hour}})
+	handler.SetPos(&mysql.Position{Name: "log", Pos: 4})
+	if err := insertRows(handler, testutil.Table("a", true), 100, 1); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := insertRows(handler, testutil.Table("a", true), 101, 2); err == nil {
+		t.Fatalf("Expected the error of the group")
+	}
+	if loader.rollback != 1 || handler.LastCommittedPos().Pos != 4 {
+		t.Fatalf("Failed group should be rolled back")
+	}
+	loader.err = nil
+	if err := insertRows(handler, testutil.Table("a", true), 100, 1); err != nil {
+		t.Fatalf("Unexpected error after a restart %v", err)
+	}
+}
+
+func TestGroupTimerFailure(t *testing.T) {
+	loader := &MockLoader{err: fmt.Errorf("deadlock")}
+	handler := NewWdHandlerWithOptions(loader, HandlerOptions{Group: GroupOptions{Transactions: 2, Delay: 10 * time.Millisecond}})
+	handler.SetPos(&mysql.Position{Name: "log", Pos: 4})
+	if err := insertRows(handler, testutil.Table("a", true), 100, 1); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	select {
+	case err := <-handler.(Failing).Failures():
+		if err == nil || err.Error() != "deadlock" {
+			t.Fatalf("Expected the error of the group, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The failure of the group committed by the timer was not reported")
+	}
+	// Canal syncs the position when it is closed, the failure is then
+	// reported to it as well, and once
+	if err := handler.OnPosSynced(mysql.Position{Name: "log", Pos: 100}, true); err == nil {
+		t.Fatalf("Expected the error of the group")
+	}
+	loader.err = nil
+	if err := insertRows(handler, testutil.Table("a", true), 100, 1); err != nil {
+		t.Fatalf("Unexpected error after a restart %v", err)
+	}
+	select {
+	case err := <-handler.(Failing).Failures():
+		t.Fatalf("Unexpected failure %v", err)
+	default:
+	}
+}
@@ -2,10 +2,16 @@ package replicator
 
 import (
 	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
 	"github.com/siddontang/go-mysql/canal"
 	"github.com/siddontang/go-mysql/mysql"
 	"github.com/siddontang/go-mysql/replication"
 	"mysqlreplicator/loader"
+	"mysqlreplicator/replicator/dmlbuilder"
+	"mysqlreplicator/replicator/routing"
 )
 
 type DefaultWDHandler interface {
@@ -18,78 +24,515 @@ type DefaultWDHandler interface {
 
 type defaultWDHandler struct {
 	canal.DummyEventHandler
+	// mutex guards the handler against groups committed by their timer
+	mutex              sync.Mutex
 	position           *mysql.Position
 	gtid               *mysql.GTIDSet
 	inTransaction      bool
 	currentTransaction []*canal.RowsEvent
 	client             loader.MySQLLoader
+	router             *routing.Router
+	store              CheckpointStore
+	pendingGTID        mysql.GTIDSet
+	rotated            bool
+	builder            dmlbuilder.Builder
+	filter             *tableFilter
+	changedTable       [2]string
+	skipped            bool
+	applier            *parallelApplier
+	group              *group
+	failures           chan error
+	listener           TableListener
+}
+
+// TableListener is notified when canal reloads the schema of a source table,
+// before the DDL statement that changed it is handled
+type TableListener interface {
+	TableChanged(schema string, table string) error
+}
+
+// HandlerOptions configures the handler returned by NewWdHandlerWithOptions
+type HandlerOptions struct {
+	// Schema every table is written to, a shortcut for a Routes rule
+	// "*.* -> Schema.*" ignored when Routes is set
+	Schema string
+	// Routes maps source tables to target tables for DML and DDL, nil keeps
+	// the source names
+	Routes *routing.Router
+	// Checkpoint saves every committed position when set
+	Checkpoint CheckpointStore
+	// Builder generates the statements applied for rows events
+	Builder dmlbuilder.Builder
+	// Workers apply transactions in parallel in a NewParallelWdHandler, the
+	// handler loader then only applies DDL statements, once every worker is
+	// done, and saves the checkpoints
+	Workers []loader.MySQLLoader
+	// Conflicts selects the transactions applied in the source order by the
+	// Workers, ConflictTable when empty
+	Conflicts string
+	// Group merges source transactions into target transactions, it is
+	// ignored when transactions are applied by Workers
+	Group GroupOptions
+	// TableListener is notified of the tables changed by DDL statements
+	TableListener TableListener
 }
 
 func NewWdHandler(loader loader.MySQLLoader) DefaultWDHandler {
-	return &defaultWDHandler{
-		client: loader,
+	return NewWdHandlerWithOptions(loader, HandlerOptions{})
+}
+
+// NewWdHandlerForSchema returns a handler that applies rows events and DDL
+// statements to the given target schema whatever the schema name on the source is
+func NewWdHandlerForSchema(loader loader.MySQLLoader, schema string) DefaultWDHandler {
+	return NewWdHandlerWithOptions(loader, HandlerOptions{Schema: schema})
+}
+
+// NewCheckpointedWdHandler returns a handler saving every committed position
+// into store, an empty schema keeps the source schema names
+func NewCheckpointedWdHandler(loader loader.MySQLLoader, schema string, store CheckpointStore) DefaultWDHandler {
+	return NewWdHandlerWithOptions(loader, HandlerOptions{Schema: schema, Checkpoint: store})
+}
+
+// NewWdHandlerWithOptions returns a handler applying transactions serially,
+// options.Workers are ignored
+func NewWdHandlerWithOptions(loader loader.MySQLLoader, options HandlerOptions) DefaultWDHandler {
+	options.Workers = nil
+	handler, _ := newHandler(loader, options)
+	return handler
+}
+
+// NewParallelWdHandler returns a handler applying transactions in parallel
+// on options.Workers. Transactions are committed out of order, the
+// checkpoint is the last position every previous transaction has been
+// committed at, so that transactions following it can be applied again
+// after a restart
+func NewParallelWdHandler(loader loader.MySQLLoader, options HandlerOptions) (DefaultWDHandler, error) {
+	if len(options.Workers) == 0 {
+		return nil, fmt.Errorf("No workers to apply transactions")
 	}
+	// Transactions after the last contiguous checkpoint are applied again
+	if options.Builder.Mode == dmlbuilder.UpdateMode {
+		return nil, fmt.Errorf("Transactions applied in parallel require the replace mode")
+	}
+	return newHandler(loader, options)
+}
+
+func newHandler(loader loader.MySQLLoader, options HandlerOptions) (*defaultWDHandler, error) {
+	router := options.Routes
+	if router == nil && options.Schema != "" {
+		router = routing.ToSchema(options.Schema)
+	}
+	builder := options.Builder
+	builder.Router = router
+	handler := &defaultWDHandler{
+		client:   loader,
+		router:   router,
+		store:    options.Checkpoint,
+		builder:  builder,
+		listener: options.TableListener,
+	}
+	if len(options.Workers) > 0 {
+		var err error
+		if handler.applier, err = newParallelApplier(loader, options.Workers, options.Conflicts); err != nil {
+			return nil, err
+		}
+	} else if options.Group.enabled() {
+		handler.group = &group{GroupOptions: options.Group}
+		handler.failures = make(chan error, 1)
+		if handler.group.Delay <= 0 {
+			handler.group.Delay = DefaultGroupDelay
+		}
+	}
+	return handler, nil
+}
+
+// SetFilter skips the events filter does not select, transactions that are
+// skipped entirely still advance the committed position. Canal sets the
+// filter it was created with
+func (h *defaultWDHandler) SetFilter(filter Filter) error {
+	compiled, err := filter.compile()
+	if err != nil {
+		return err
+	}
+	h.filter = compiled
+	return nil
+}
+
+func (h *defaultWDHandler) CheckpointStore() CheckpointStore {
+	return h.store
 }
 
 func (h *defaultWDHandler) LastCommittedGITD() *mysql.GTIDSet {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
 	return h.gtid
 }
 
 func (h *defaultWDHandler) LastCommittedPos() *mysql.Position {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
 	return h.position
 }
 
 func (h *defaultWDHandler) SetGITD(set *mysql.GTIDSet) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
 	h.gtid = set
 }
 
 func (h *defaultWDHandler) SetPos(pos *mysql.Position) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
 	h.position = pos
 }
 
+// Close stops the workers, their loaders are not closed
 func (h *defaultWDHandler) Close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.applier != nil {
+		h.applier.close()
+	}
+	if h.group != nil && h.group.timer != nil {
+		h.group.timer.Stop()
+	}
 	return h.client.Close()
 }
 
 func (h *defaultWDHandler) OnRow(ev *canal.RowsEvent) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err := h.groupFailed(); err != nil {
+		return err
+	}
+	if h.filter != nil && ev.Table != nil && !h.filter.allows(ev.Table.Schema, ev.Table.Name, ev.Action) {
+		return nil
+	}
+	if h.applier != nil {
+		return h.buffer(ev)
+	}
+	if h.group != nil {
+		return h.bufferRow(ev)
+	}
 	if !h.inTransaction {
 		if err := h.client.Begin(); err != nil {
 			return err
 		}
 		h.inTransaction = true
 	}
-	if _, err := h.client.Exec(""); err != nil {
+	stmts, err := h.builder.Statements(ev)
+	if err != nil {
+		err = fmt.Errorf("Unable to build statements for %s: %v", ev.Table, err)
+	} else {
+		err = h.client.ExecStatements(stmts)
+	}
+	if err != nil {
 		h.client.Rollback()
+		h.inTransaction = false
 		return err
 	}
 	return nil
 }
 
 func (e *defaultWDHandler) OnRotate(ev *replication.RotateEvent) error {
-	e.position = &mysql.Position{string(ev.NextLogName), uint32(ev.Position)}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	// The new file is checkpointed once the previous one is applied
+	if e.applier != nil {
+		if err := e.drain(); err != nil {
+			return err
+		}
+		// DDL may change the foreign keys
+		e.applier.linked = nil
+	}
+	if e.group != nil {
+		if err := e.flush(); err != nil {
+			return err
+		}
+	}
+	e.position = &mysql.Position{Name: string(ev.NextLogName), Pos: uint32(ev.Position)}
+	e.rotated = true
+	return nil
+}
+
+func (e *defaultWDHandler) OnGTID(gtid mysql.GTIDSet) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.pendingGTID = gtid
+	return nil
+}
+
+// OnXID ends a transaction, nothing was applied when no transaction is open
+// because all its events were filtered
+func (e *defaultWDHandler) OnXID(nextPos mysql.Position) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if !e.inTransaction {
+		e.skipped = true
+	}
 	return nil
 }
+
+// OnTableChanged is called before OnDDL with the table the DDL changes
 func (e *defaultWDHandler) OnTableChanged(schema string, table string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.changedTable = [2]string{schema, table}
+	if e.listener != nil {
+		return e.listener.TableChanged(schema, table)
+	}
 	return nil
 }
 
 func (e *defaultWDHandler) OnDDL(nextPos mysql.Position, queryEvent *replication.QueryEvent) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.groupFailed(); err != nil {
+		return err
+	}
 	if e.inTransaction {
 		return fmt.Errorf("Current transaction has not ended, unexpected DDL query received")
 	}
+	if e.applier != nil {
+		if err := e.drain(); err != nil {
+			return err
+		}
+		// DDL may change the foreign keys
+		e.applier.linked = nil
+	}
+	if e.group != nil {
+		if err := e.flush(); err != nil {
+			return err
+		}
+	}
+	changed := e.changedTable
+	e.changedTable = [2]string{}
+	if schema, table := ddlTable(changed, queryEvent); e.filter != nil && !e.filter.allows(schema, table, DDLAction) {
+		log.Infof("Skipping DDL on %s.%s at %v", schema, table, nextPos)
+		e.skipped = true
+		return nil
+	}
+	if err := e.client.Begin(); err != nil {
+		return err
+	}
 	e.inTransaction = true // DDL is always a transaction
+	if err := e.client.ExecBatch(e.ddlStatements(queryEvent, changed)); err != nil {
+		e.client.Rollback()
+		e.inTransaction = false
+		log.Errorf("DDL at %v failed: %v", nextPos, err)
+		return fmt.Errorf("Unable to apply DDL at %v: %v", nextPos, err)
+	}
 	return nil
 }
 
+// ddlStatements selects the target of the schema the DDL was executed against
+// on the source and rewrites the tables it references as they are routed.
+// Unqualified references are only rewritten for changed, the table canal
+// reported for the DDL
+func (e *defaultWDHandler) ddlStatements(queryEvent *replication.QueryEvent, changed [2]string) []string {
+	source := string(queryEvent.Schema)
+	query := string(queryEvent.Query)
+	target := source
+	if e.router != nil {
+		target = e.router.Schema(source)
+		query = routeQualified(query, e.router, source, changed[0])
+		if changed[1] != "" && changed[0] == source {
+			if schema, table := e.router.Table(changed[0], changed[1]); schema != target || table != changed[1] {
+				query = routeUnqualified(query, changed[1], schema, table)
+			}
+		}
+	}
+	if target == "" {
+		return []string{query}
+	}
+	return []string{"USE " + quoteName(target), query}
+}
+
+const identifier = "(`(?:[^`]|``)+`|[A-Za-z0-9_$]+)"
+
+var (
+	qualifiedName   = regexp.MustCompile("(^|[\\s(,])" + identifier + "\\." + identifier)
+	unqualifiedName = regexp.MustCompile("(?i)(\\bTABLE\\s+(?:IF\\s+(?:NOT\\s+)?EXISTS\\s+)?)" + identifier + "([\\s(;]|$)")
+)
+
+// routeQualified rewrites "schema.table" references to tables of the given
+// schemas, other names such as decimal numbers are left untouched
+func routeQualified(query string, router *routing.Router, schemas ...string) string {
+	return qualifiedName.ReplaceAllStringFunc(query, func(match string) string {
+		parts := qualifiedName.FindStringSubmatch(match)
+		schema, table := unquoteName(parts[2]), unquoteName(parts[3])
+		if !contains(schemas, schema) {
+			return match
+		}
+		toSchema, toTable := router.Table(schema, table)
+		if toSchema == schema && toTable == table {
+			return match
+		}
+		name := parts[3]
+		if toTable != table {
+			name = quoteName(toTable)
+		}
+		return parts[1] + quoteName(toSchema) + "." + name
+	})
+}
+
+// routeUnqualified qualifies the references to table following a TABLE keyword
+func routeUnqualified(query string, table string, toSchema string, toTable string) string {
+	return unqualifiedName.ReplaceAllStringFunc(query, func(match string) string {
+		parts := unqualifiedName.FindStringSubmatch(match)
+		if unquoteName(parts[2]) != table {
+			return match
+		}
+		return parts[1] + quoteName(toSchema) + "." + quoteName(toTable) + parts[3]
+	})
+}
+
+func quoteName(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+func unquoteName(name string) string {
+	if len(name) > 1 && strings.HasPrefix(name, "`") && strings.HasSuffix(name, "`") {
+		return strings.Replace(name[1:len(name)-1], "``", "`", -1)
+	}
+	return name
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func (e *defaultWDHandler) OnPosSynced(position mysql.Position, force bool) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.groupFailed(); err != nil {
+		return err
+	}
+	if e.applier != nil {
+		return e.syncParallel(position)
+	}
+	if e.group != nil {
+		return e.syncGroup(position)
+	}
 	if !e.inTransaction {
+		if e.rotated {
+			// Rotations are synced outside of any transaction
+			e.rotated = false
+			return e.saveCheckpoint(&Checkpoint{Pos: e.position, GTID: e.gtidSet()})
+		}
+		if e.skipped {
+			return e.skip(position)
+		}
 		return fmt.Errorf("No transaction to commit")
 	}
+	return e.commit(position)
+}
+
+// commit commits the transaction open on the handler loader at position
+func (e *defaultWDHandler) commit(position mysql.Position) error {
+	if e.position != nil && position.Compare(*e.position) == 0 {
+		// Canal syncs the last position again when it is closed in the
+		// middle of a transaction, the partial transaction is discarded
+		log.Infof("Rolling back incomplete transaction after %v", position)
+		e.inTransaction = false
+		e.pendingGTID = nil
+		return e.client.Rollback()
+	}
+	gtid, err := e.committedGTID()
+	if err != nil {
+		e.client.Rollback()
+		e.inTransaction = false
+		return err
+	}
+	checkpoint := &Checkpoint{Pos: &position, GTID: gtid}
+	if e.store != nil && e.store.Transactional() {
+		if err := e.store.Save(checkpoint); err != nil {
+			e.client.Rollback()
+			e.inTransaction = false
+			return fmt.Errorf("Unable to save checkpoint %v: %v", position, err)
+		}
+	}
 	if err := e.client.Commit(); err != nil {
 		e.client.Rollback()
+		e.inTransaction = false
 		return err
 	}
 	e.position = &position
+	if gtid != nil {
+		e.gtid = &gtid
+	}
+	e.pendingGTID = nil
 	e.inTransaction = false
+	e.rotated = false
+	if e.store != nil && !e.store.Transactional() {
+		return e.saveCheckpoint(checkpoint)
+	}
+	return nil
+}
+
+// skip advances the committed position past a filtered transaction
+func (e *defaultWDHandler) skip(position mysql.Position) error {
+	e.skipped = false
+	gtid, err := e.committedGTID()
+	if err != nil {
+		return err
+	}
+	e.position = &position
+	if gtid != nil {
+		e.gtid = &gtid
+	}
+	e.pendingGTID = nil
+	return e.saveCheckpoint(&Checkpoint{Pos: &position, GTID: gtid})
+}
+
+func (e *defaultWDHandler) saveCheckpoint(checkpoint *Checkpoint) error {
+	if e.store == nil {
+		return nil
+	}
+	if err := e.store.Save(checkpoint); err != nil {
+		return fmt.Errorf("Unable to save checkpoint %v: %v", checkpoint.Pos, err)
+	}
 	return nil
 }
+
+func (e *defaultWDHandler) gtidSet() mysql.GTIDSet {
+	if e.gtid == nil {
+		return nil
+	}
+	return *e.gtid
+}
+
+// committedGTID merges the GTID of the current transaction into the executed
+// GTID set, the set is only tracked when replication started from a GTID set.
+// It includes the transactions dispatched to workers or added to a group
+func (e *defaultWDHandler) committedGTID() (mysql.GTIDSet, error) {
+	if e.gtid == nil || *e.gtid == nil {
+		return nil, nil
+	}
+	executed := *e.gtid
+	if e.applier != nil {
+		if last := e.applier.lastDispatched(); last != nil && last.GTID != nil {
+			executed = last.GTID
+		}
+	}
+	if e.group != nil && e.group.pending != nil && e.group.pending.GTID != nil {
+		executed = e.group.pending.GTID
+	}
+	return mergeGTID(executed, e.pendingGTID)
+}
+
+// mergeGTID returns a copy of the executed GTID set including gtid
+func mergeGTID(executed mysql.GTIDSet, gtid mysql.GTIDSet) (mysql.GTIDSet, error) {
+	merged := executed.Clone()
+	if gtid != nil {
+		if err := merged.Update(gtid.String()); err != nil {
+			return nil, fmt.Errorf("Unable to update GTID set %v with %v: %v", merged, gtid, err)
+		}
+	}
+	return merged, nil
+}
@@ -1,11 +1,15 @@
 package replicator
 
 import (
+	"fmt"
 	"github.com/siddontang/go-mysql/canal"
 	"github.com/siddontang/go-mysql/client"
 	"github.com/siddontang/go-mysql/mysql"
 	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
 	"math/rand"
+	"mysqlreplicator/loader"
+	"mysqlreplicator/replicator/routing"
 	"testing"
 )
 
@@ -15,6 +19,9 @@ type MockLoader struct {
 	rollback int
 	position int
 	exec     int
+	queries  []string
+	args     [][]interface{}
+	err      error
 }
 
 func (l *MockLoader) ExecFunc(f func(conn *client.Conn) error) error {
@@ -27,8 +34,24 @@ func (l *MockLoader) Exec(string, ...interface{}) (*mysql.Result, error) {
 	return nil, nil
 }
 
-func (l *MockLoader) ExecBatch([]string) error {
+func (l *MockLoader) ExecBatch(queries []string) error {
 	l.exec++
+	if l.err != nil {
+		return l.err
+	}
+	l.queries = append(l.queries, queries...)
+	return nil
+}
+
+func (l *MockLoader) ExecStatements(statements []loader.Statement) error {
+	l.exec++
+	if l.err != nil {
+		return l.err
+	}
+	for _, s := range statements {
+		l.queries = append(l.queries, s.Query)
+		l.args = append(l.args, s.Args)
+	}
 	return nil
 }
 
@@ -85,7 +108,7 @@ func TestSetGetPosition(t *testing.T) {
 			t.Fatalf("Unexpected error from OnRow %s", err)
 		}
 	}
-	if err := handler.OnPosSynced(mysql.Position{"logname", 100}, true); err != nil {
+	if err := handler.OnPosSynced(mysql.Position{Name: "logname", Pos: 100}, true); err != nil {
 		t.Fatalf("Unexpected error from OnRow %s", err)
 	}
 	pos := handler.LastCommittedPos()
@@ -100,7 +123,7 @@ func TestSetGetPosition(t *testing.T) {
 func TestOnPosSyncFailsIfNoTransactionExists(t *testing.T) {
 	loader := &MockLoader{}
 	handler := NewWdHandler(loader)
-	if err := handler.OnPosSynced(mysql.Position{"logname", 100}, true); err == nil {
+	if err := handler.OnPosSynced(mysql.Position{Name: "logname", Pos: 100}, true); err == nil {
 		t.Fatal("Should have no syncronized positon for a ghost transaction")
 	}
 }
@@ -138,3 +161,178 @@ func TestStandartTransaction(t *testing.T) {
 		t.Fatalf("Double commit for same transaction should not happen, %v", err)
 	}
 }
+
+func TestMultiRowEventIsApplied(t *testing.T) {
+	loader := &MockLoader{}
+	handler := NewWdHandler(loader)
+	table := &schema.Table{Schema: "test", Name: "t"}
+	table.AddColumn("id", "int", "", "")
+	table.AddColumn("data", "int", "", "")
+	insert := &canal.RowsEvent{Table: table, Action: canal.InsertAction, Rows: [][]interface{}{{1, 10}, {2, 20}, {3, 30}}}
+	update := &canal.RowsEvent{Table: table, Action: canal.UpdateAction, Rows: [][]interface{}{{1, 10}, {1, 11}, {2, 20}, {2, 21}}}
+	if err := handler.OnRow(insert); err != nil {
+		t.Fatalf("Unexpected error from OnRow %s", err)
+	}
+	if err := handler.OnRow(update); err != nil {
+		t.Fatalf("Unexpected error from OnRow %s", err)
+	}
+	expected := []string{"[1 10]", "[2 20]", "[3 30]", "[1 11]", "[2 21]"}
+	if len(loader.queries) != len(expected) {
+		t.Fatalf("Expected %d statements, got %d: %v", len(expected), len(loader.queries), loader.queries)
+	}
+	for i, args := range expected {
+		if loader.queries[i] != "REPLACE INTO `test`.`t` (`id`,`data`) VALUES (?,?)" {
+			t.Fatalf("Unexpected statement %s", loader.queries[i])
+		}
+		if fmt.Sprintf("%v", loader.args[i]) != args {
+			t.Fatalf("Expected arguments %s, got %v", args, loader.args[i])
+		}
+	}
+	if loader.begin != 1 {
+		t.Fatalf("Rows events should share the same transaction, begin count %d", loader.begin)
+	}
+	if err := handler.OnPosSynced(mysql.Position{Name: "logname", Pos: 100}, false); err != nil {
+		t.Fatalf("Error committing transaction, %v", err)
+	}
+	if loader.commit != 1 {
+		t.Fatalf("Wrong count of 'commits' statements for transaction: %d", loader.commit)
+	}
+}
+
+func TestDDLIsApplied(t *testing.T) {
+	loader := &MockLoader{}
+	handler := NewWdHandler(loader)
+	ddl := &replication.QueryEvent{Schema: []byte("test"), Query: []byte("ALTER TABLE test.t ADD COLUMN c int")}
+	if err := handler.OnDDL(mysql.Position{Name: "logname", Pos: 100}, ddl); err != nil {
+		t.Fatalf("Unexpected error from OnDDL %s", err)
+	}
+	if err := handler.OnPosSynced(mysql.Position{Name: "logname", Pos: 100}, true); err != nil {
+		t.Fatalf("Error committing DDL, %v", err)
+	}
+	expected := []string{"USE `test`", "ALTER TABLE test.t ADD COLUMN c int"}
+	if fmt.Sprintf("%q", loader.queries) != fmt.Sprintf("%q", expected) {
+		t.Fatalf("Expected %q, got %q", expected, loader.queries)
+	}
+	if loader.commit != 1 || handler.LastCommittedPos().Pos != 100 {
+		t.Fatalf("DDL should be committed with its position")
+	}
+}
+
+func TestDDLSchemaRewrite(t *testing.T) {
+	loader := &MockLoader{}
+	handler := NewWdHandlerForSchema(loader, "target")
+	ddl := &replication.QueryEvent{Schema: []byte("source"), Query: []byte("CREATE TABLE `source`.t (id int, c int) LIKE source.t2")}
+	if err := handler.OnDDL(mysql.Position{}, ddl); err != nil {
+		t.Fatalf("Unexpected error from OnDDL %s", err)
+	}
+	expected := []string{"USE `target`", "CREATE TABLE `target`.t (id int, c int) LIKE `target`.t2"}
+	if fmt.Sprintf("%q", loader.queries) != fmt.Sprintf("%q", expected) {
+		t.Fatalf("Expected %q, got %q", expected, loader.queries)
+	}
+}
+
+func TestDDLFailure(t *testing.T) {
+	loader := &MockLoader{err: fmt.Errorf("table exists")}
+	handler := NewWdHandler(loader)
+	ddl := &replication.QueryEvent{Schema: []byte("test"), Query: []byte("CREATE TABLE t (id int)")}
+	if err := handler.OnDDL(mysql.Position{}, ddl); err == nil {
+		t.Fatalf("Expected error from a failed DDL")
+	}
+	if loader.rollback != 1 {
+		t.Fatalf("Failed DDL should be rolled back")
+	}
+	if err := handler.OnPosSynced(mysql.Position{}, true); err == nil {
+		t.Fatalf("Position of a failed DDL should not be committed")
+	}
+}
+
+func TestIncompleteTransactionIsRolledBackOnClose(t *testing.T) {
+	loader := &MockLoader{}
+	handler := NewWdHandler(loader)
+	handler.SetPos(&mysql.Position{Name: "logname", Pos: 100})
+	if err := handler.OnRow(&canal.RowsEvent{}); err != nil {
+		t.Fatalf("Unexpected error from OnRow %s", err)
+	}
+	if err := handler.OnPosSynced(mysql.Position{Name: "logname", Pos: 100}, true); err != nil {
+		t.Fatalf("Unexpected error syncing the last position, %v", err)
+	}
+	if loader.commit != 0 || loader.rollback != 1 {
+		t.Fatalf("Incomplete transaction should be rolled back, commits %d rollbacks %d", loader.commit, loader.rollback)
+	}
+}
+
+func TestRoutedDML(t *testing.T) {
+	loader := &MockLoader{}
+	router, _ := routing.New(routing.Rule{From: "shop.orders", To: "archive.orders_2026"})
+	handler := NewWdHandlerWithOptions(loader, HandlerOptions{Routes: router})
+	table := &schema.Table{Schema: "shop", Name: "orders"}
+	table.AddColumn("id", "int", "", "")
+	if err := handler.OnRow(&canal.RowsEvent{Table: table, Action: canal.InsertAction, Rows: [][]interface{}{{1}}}); err != nil {
+		t.Fatalf("Unexpected error from OnRow %s", err)
+	}
+	if expected := "REPLACE INTO `archive`.`orders_2026` (`id`) VALUES (?)"; len(loader.queries) != 1 || loader.queries[0] != expected {
+		t.Fatalf("Expected %s, got %v", expected, loader.queries)
+	}
+	if table.Schema != "shop" || table.Name != "orders" {
+		t.Fatalf("Source table should not be modified, got %s", table)
+	}
+}
+
+func TestRoutedDDL(t *testing.T) {
+	router, _ := routing.New(
+		routing.Rule{From: "src_db.*", To: "dst_db.*"},
+		routing.Rule{From: "shop.orders", To: "archive.orders_2026"},
+	)
+	cases := []struct {
+		schema, table, query string
+		expected             []string
+	}{
+		{"src_db", "users", "ALTER TABLE users ADD COLUMN c decimal(5,2) DEFAULT 1.5",
+			[]string{"USE `dst_db`", "ALTER TABLE users ADD COLUMN c decimal(5,2) DEFAULT 1.5"}},
+		{"src_db", "users", "CREATE TABLE src_db.users LIKE `src_db`.`template`",
+			[]string{"USE `dst_db`", "CREATE TABLE `dst_db`.users LIKE `dst_db`.`template`"}},
+		{"shop", "orders", "CREATE TABLE IF NOT EXISTS `orders` (id int)",
+			[]string{"USE `shop`", "CREATE TABLE IF NOT EXISTS `archive`.`orders_2026` (id int)"}},
+		{"shop", "orders", "ALTER TABLE shop.orders ADD COLUMN c int",
+			[]string{"USE `shop`", "ALTER TABLE `archive`.`orders_2026` ADD COLUMN c int"}},
+	}
+	for _, c := range cases {
+		loader := &MockLoader{}
+		handler := NewWdHandlerWithOptions(loader, HandlerOptions{Routes: router})
+		handler.OnTableChanged(c.schema, c.table)
+		ddl := &replication.QueryEvent{Schema: []byte(c.schema), Query: []byte(c.query)}
+		if err := handler.OnDDL(mysql.Position{}, ddl); err != nil {
+			t.Fatalf("Unexpected error from OnDDL %s", err)
+		}
+		if fmt.Sprintf("%q", loader.queries) != fmt.Sprintf("%q", c.expected) {
+			t.Errorf("Expected %q, got %q", c.expected, loader.queries)
+		}
+	}
+}
+
+type tableListenerFunc func(schema string, table string) error
+
+func (f tableListenerFunc) TableChanged(schema string, table string) error {
+	return f(schema, table)
+}
+
+func TestTableListener(t *testing.T) {
+	var changed []string
+	listener := tableListenerFunc(func(schema string, table string) error {
+		changed = append(changed, schema+"."+table)
+		if table == "broken" {
+			return fmt.Errorf("unable to register schema")
+		}
+		return nil
+	})
+	handler := NewWdHandlerWithOptions(&MockLoader{}, HandlerOptions{TableListener: listener})
+	if err := handler.OnTableChanged("shop", "orders"); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := handler.OnTableChanged("shop", "broken"); err == nil {
+		t.Fatalf("Expected the error of the listener")
+	}
+	if fmt.Sprint(changed) != "[shop.orders shop.broken]" {
+		t.Fatalf("Listener should be notified of every table change, got %v", changed)
+	}
+}
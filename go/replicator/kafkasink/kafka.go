@@ -0,0 +1,215 @@
+// Package kafkasink publishes change events to Kafka topics
+package kafkasink
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"mysqlreplicator/replicator"
+)
+
+// Delivery guarantees, the number of acknowledgements a message waits for
+const (
+	// AcksAll waits for every in-sync replica
+	AcksAll = "all"
+	// AcksLeader waits for the partition leader only
+	AcksLeader = "leader"
+	// AcksNone does not wait, transactions can be lost when a broker fails
+	// after they were checkpointed
+	AcksNone = "none"
+)
+
+// DefaultTopic routes the events of every table to a topic of its own
+const DefaultTopic = "{schema}.{table}"
+
+const (
+	// DefaultBatchTimeout is the time a partition waits for more messages
+	// before it writes a batch. Publish waits for its batches, kafka-go
+	// defaults to a second that would bound every topic to a transaction per
+	// second
+	DefaultBatchTimeout = 5 * time.Millisecond
+	// DefaultBatchSize is the maximum number of messages of a batch
+	DefaultBatchSize = 1000
+)
+
+// Producer writes messages to a topic, WriteMessages returns once the brokers
+// acknowledged the messages. *kafka.Writer is a Producer
+type Producer interface {
+	WriteMessages(ctx context.Context, messages ...kafka.Message) error
+	Close() error
+}
+
+// Config configures a Sink
+type Config struct {
+	Brokers []string
+	// Topic is the topic of an event, {schema} and {table} are replaced by
+	// the routed names of its table. DefaultTopic when empty
+	Topic string
+	// DDLTopic is the topic of DDL events, Topic when empty
+	DDLTopic string
+	// Acks is AcksAll, AcksLeader or AcksNone, AcksAll when empty
+	Acks string
+	// Timeout is the time a transaction waits for its acknowledgements
+	Timeout time.Duration
+	// BatchTimeout is the time a partition waits for more messages before it
+	// writes a batch, DefaultBatchTimeout when 0
+	BatchTimeout time.Duration
+	// BatchSize is the maximum number of messages of a batch,
+	// DefaultBatchSize when 0
+	BatchSize int
+	// Encoder encodes message values, replicator.JSONEncoder when nil. Keys
+	// are encoded by Encoder when it is a replicator.KeyEncoder
+	Encoder replicator.Encoder
+}
+
+// Sink publishes every change event as a message keyed by the table name and
+// primary key, the messages of a transaction are acknowledged before it is
+// checkpointed
+type Sink struct {
+	sync.Mutex
+	config      Config
+	newProducer func(topic string) Producer
+	producers   map[string]Producer
+}
+
+// NewSink returns a sink writing to config.Brokers
+func NewSink(config Config) (*Sink, error) {
+	if len(config.Brokers) == 0 {
+		return nil, fmt.Errorf("No Kafka brokers")
+	}
+	acks, err := requiredAcks(config.Acks)
+	if err != nil {
+		return nil, err
+	}
+	if config.BatchTimeout <= 0 {
+		config.BatchTimeout = DefaultBatchTimeout
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+	return NewSinkWithProducer(config, func(topic string) Producer {
+		return kafka.NewWriter(writerConfig(config, acks, topic))
+	})
+}
+
+// writerConfig configures the writer of topic, messages are balanced over
+// the partitions by key
+func writerConfig(config Config, acks int, topic string) kafka.WriterConfig {
+	return kafka.WriterConfig{
+		Brokers:      config.Brokers,
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: acks,
+		BatchTimeout: config.BatchTimeout,
+		BatchSize:    config.BatchSize,
+	}
+}
+
+// NewSinkWithProducer returns a sink writing each topic with the producer
+// returned by newProducer, it is called once per topic
+func NewSinkWithProducer(config Config, newProducer func(topic string) Producer) (*Sink, error) {
+	if _, err := requiredAcks(config.Acks); err != nil {
+		return nil, err
+	}
+	if config.Topic == "" {
+		config.Topic = DefaultTopic
+	}
+	if config.DDLTopic == "" {
+		config.DDLTopic = config.Topic
+	}
+	if config.Encoder == nil {
+		config.Encoder = replicator.JSONEncoder{}
+	}
+	return &Sink{config: config, newProducer: newProducer, producers: make(map[string]Producer)}, nil
+}
+
+func requiredAcks(acks string) (int, error) {
+	switch acks {
+	case AcksAll, "":
+		return -1, nil
+	case AcksLeader:
+		return 1, nil
+	case AcksNone:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("Unknown acks %s, expected %s, %s or %s", acks, AcksAll, AcksLeader, AcksNone)
+}
+
+// Topic returns the topic of event
+func (s *Sink) Topic(event *replicator.ChangeEvent) string {
+	topic := s.config.Topic
+	if event.Action == replicator.DDLAction {
+		topic = s.config.DDLTopic
+	}
+	return strings.NewReplacer("{schema}", event.Schema, "{table}", event.Table).Replace(topic)
+}
+
+// Publish writes the events of a transaction, messages of a topic are written
+// in the transaction order
+func (s *Sink) Publish(events []*replicator.ChangeEvent) error {
+	s.Lock()
+	defer s.Unlock()
+	var topics []string
+	messages := make(map[string][]kafka.Message)
+	for _, event := range events {
+		value, err := s.config.Encoder.Encode(event)
+		if err != nil {
+			return fmt.Errorf("Unable to encode %s event on %s.%s: %v", event.Action, event.Schema, event.Table, err)
+		}
+		key := []byte(event.Key())
+		if encoder, ok := s.config.Encoder.(replicator.KeyEncoder); ok {
+			if key, err = encoder.EncodeKey(event); err != nil {
+				return fmt.Errorf("Unable to encode %s key on %s.%s: %v", event.Action, event.Schema, event.Table, err)
+			}
+		}
+		topic := s.Topic(event)
+		if _, ok := messages[topic]; !ok {
+			topics = append(topics, topic)
+		}
+		messages[topic] = append(messages[topic], kafka.Message{Key: key, Value: value})
+	}
+
+	ctx := context.Background()
+	if s.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.Timeout)
+		defer cancel()
+	}
+	for _, topic := range topics {
+		producer, ok := s.producers[topic]
+		if !ok {
+			producer = s.newProducer(topic)
+			s.producers[topic] = producer
+		}
+		if err := producer.WriteMessages(ctx, messages[topic]...); err != nil {
+			return fmt.Errorf("Unable to write to topic %s: %v", topic, err)
+		}
+	}
+	return nil
+}
+
+// TableChanged notifies the encoder when it is a replicator.TableListener
+func (s *Sink) TableChanged(schema string, table string) error {
+	if listener, ok := s.config.Encoder.(replicator.TableListener); ok {
+		return listener.TableChanged(schema, table)
+	}
+	return nil
+}
+
+// Close closes the producers of every topic
+func (s *Sink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	var err error
+	for topic, producer := range s.producers {
+		if cerr := producer.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.producers, topic)
+	}
+	return err
+}
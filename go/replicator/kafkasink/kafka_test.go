@@ -0,0 +1,188 @@
+package kafkasink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"mysqlreplicator/internal/testutil"
+	"mysqlreplicator/internal/testutil/memstore"
+	"mysqlreplicator/replicator"
+)
+
+// fakeBroker keeps the messages written to every topic in memory
+type fakeBroker struct {
+	sync.Mutex
+	topics map[string][]kafka.Message
+	err    error
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{topics: make(map[string][]kafka.Message)}
+}
+
+func (b *fakeBroker) producer(topic string) Producer {
+	return &fakeProducer{broker: b, topic: topic}
+}
+
+type fakeProducer struct {
+	broker *fakeBroker
+	topic  string
+}
+
+func (p *fakeProducer) WriteMessages(ctx context.Context, messages ...kafka.Message) error {
+	p.broker.Lock()
+	defer p.broker.Unlock()
+	if p.broker.err != nil {
+		return p.broker.err
+	}
+	p.broker.topics[p.topic] = append(p.broker.topics[p.topic], messages...)
+	return nil
+}
+
+func (p *fakeProducer) Close() error {
+	return nil
+}
+
+func TestSinkPublishesKeyedMessages(t *testing.T) {
+	broker := newFakeBroker()
+	sink, err := NewSinkWithProducer(Config{Topic: "cdc.{schema}.{table}", DDLTopic: "cdc.ddl"}, broker.producer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &memstore.Store{}
+	handler := replicator.NewSinkHandler(sink, replicator.HandlerOptions{Checkpoint: store})
+	table := testutil.OrdersTable()
+	rows := &canal.RowsEvent{Table: table, Action: canal.UpdateAction, Rows: [][]interface{}{{1, "new"}, {1, "paid"}, {2, "new"}, {2, "sent"}}}
+	if err := handler.OnRow(rows); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := handler.OnXID(mysql.Position{Name: "log", Pos: 100}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(broker.topics) != 0 {
+		t.Fatalf("Messages should be published once the transaction ends")
+	}
+	if err := handler.OnPosSynced(mysql.Position{Name: "log", Pos: 100}, false); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	messages := broker.topics["cdc.shop.orders"]
+	if len(messages) != 2 || string(messages[0].Key) != "shop.orders:1" || string(messages[1].Key) != "shop.orders:2" {
+		t.Fatalf("Expected a message per row keyed by primary key, got %v", broker.topics)
+	}
+	var value map[string]interface{}
+	if err := json.Unmarshal(messages[0].Value, &value); err != nil {
+		t.Fatal(err)
+	}
+	if value["action"] != "update" || fmt.Sprint(value["before"]) != "map[id:1 status:new]" || fmt.Sprint(value["after"]) != "map[id:1 status:paid]" || value["pos"] != 100.0 {
+		t.Fatalf("Unexpected message %s", messages[0].Value)
+	}
+	if len(store.Saved) != 1 || store.Saved[0].Pos.Pos != 100 {
+		t.Fatalf("Transaction should be checkpointed once published, got %v", store.Saved)
+	}
+
+	if err := handler.OnTableChanged("shop", "orders"); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	ddl := &replication.QueryEvent{Schema: []byte("shop"), Query: []byte("ALTER TABLE orders ADD COLUMN c int")}
+	if err := handler.OnDDL(mysql.Position{Name: "log", Pos: 200}, ddl); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := handler.OnPosSynced(mysql.Position{Name: "log", Pos: 200}, true); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if messages := broker.topics["cdc.ddl"]; len(messages) != 1 || string(messages[0].Key) != "shop.orders" {
+		t.Fatalf("Expected the DDL on its topic, got %v", broker.topics)
+	}
+}
+
+func TestSinkCheckpointsOnlyAcknowledgedTransactions(t *testing.T) {
+	broker := newFakeBroker()
+	broker.err = fmt.Errorf("not enough replicas")
+	sink, err := NewSinkWithProducer(Config{}, broker.producer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &memstore.Store{}
+	handler := replicator.NewSinkHandler(sink, replicator.HandlerOptions{Checkpoint: store})
+	handler.SetPos(&mysql.Position{Name: "log", Pos: 4})
+	if err := handler.OnRow(&canal.RowsEvent{Table: testutil.OrdersTable(), Action: canal.InsertAction, Rows: [][]interface{}{{1, "new"}}}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := handler.OnPosSynced(mysql.Position{Name: "log", Pos: 100}, false); err == nil {
+		t.Fatalf("Expected the error of the broker")
+	}
+	if len(store.Saved) != 0 || handler.LastCommittedPos().Pos != 4 {
+		t.Fatalf("Transaction should not be checkpointed, got %v", store.Saved)
+	}
+
+	broker.err = nil
+	if err := handler.OnRow(&canal.RowsEvent{Table: testutil.OrdersTable(), Action: canal.InsertAction, Rows: [][]interface{}{{1, "new"}}}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := handler.OnPosSynced(mysql.Position{Name: "log", Pos: 100}, false); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(broker.topics["shop.orders"]) != 1 || handler.LastCommittedPos().Pos != 100 {
+		t.Fatalf("Transaction should be published again, got %v", broker.topics)
+	}
+}
+
+func TestSinkConfig(t *testing.T) {
+	if _, err := NewSink(Config{}); err == nil {
+		t.Errorf("Expected error without brokers")
+	}
+	if _, err := NewSinkWithProducer(Config{Acks: "some"}, newFakeBroker().producer); err == nil {
+		t.Errorf("Expected error for unknown acks")
+	}
+}
+
+type keyEncoder struct {
+	replicator.JSONEncoder
+}
+
+func (keyEncoder) EncodeKey(event *replicator.ChangeEvent) ([]byte, error) {
+	return []byte(fmt.Sprintf(`{"id":%v}`, event.After[0])), nil
+}
+
+func TestSinkEncodesKeys(t *testing.T) {
+	broker := newFakeBroker()
+	sink, err := NewSinkWithProducer(Config{Encoder: keyEncoder{}}, broker.producer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := &replicator.ChangeEvent{Action: canal.InsertAction, Schema: "shop", Table: "orders", Source: testutil.OrdersTable(), After: []interface{}{1, "new"}}
+	if err := sink.Publish([]*replicator.ChangeEvent{event}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if messages := broker.topics["shop.orders"]; len(messages) != 1 || string(messages[0].Key) != `{"id":1}` {
+		t.Fatalf("Expected the key of the encoder, got %v", broker.topics)
+	}
+}
+
+func TestSinkWriterConfig(t *testing.T) {
+	sink, err := NewSink(Config{Brokers: []string{"kafka:9092"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// kafka-go would otherwise wait a second before it writes a batch
+	config := writerConfig(sink.config, -1, "shop.orders")
+	if config.BatchTimeout != DefaultBatchTimeout || config.BatchSize != DefaultBatchSize {
+		t.Errorf("Expected the default batches, got %v and %d", config.BatchTimeout, config.BatchSize)
+	}
+	sink, err = NewSink(Config{Brokers: []string{"kafka:9092"}, BatchTimeout: time.Second, BatchSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = writerConfig(sink.config, -1, "shop.orders")
+	if config.BatchTimeout != time.Second || config.BatchSize != 10 || config.Topic != "shop.orders" || config.Brokers[0] != "kafka:9092" {
+		t.Errorf("Expected the configured batches, got %+v", config)
+	}
+}
@@ -0,0 +1,452 @@
+package replicator
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"mysqlreplicator/loader"
+)
+
+// Conflict modes of the parallel applier
+const (
+	// ConflictTable serialises the transactions writing the same table
+	ConflictTable = "table"
+	// ConflictRow serialises the transactions writing rows with the same
+	// primary key, tables without a primary key fall back to ConflictTable.
+	// Secondary unique keys are not tracked, transactions swapping unique
+	// values between rows can be applied out of order
+	ConflictRow = "row"
+)
+
+// foreignKeysQuery lists the tables of the target referencing another table
+const foreignKeysQuery = "SELECT DISTINCT TABLE_SCHEMA, TABLE_NAME, REFERENCED_TABLE_SCHEMA, REFERENCED_TABLE_NAME " +
+	"FROM information_schema.KEY_COLUMN_USAGE WHERE REFERENCED_TABLE_NAME IS NOT NULL"
+
+// parallelApplier applies transactions on a pool of loaders. A transaction
+// is sent to the worker applying the transactions it conflicts with, so that
+// they are applied in the source order, or to the least busy worker when it
+// conflicts with none. A transaction conflicting with several workers waits
+// for them to finish. Tables linked by foreign keys of the target conflict as
+// a single table in both modes, a child row may not be applied before its
+// parent.
+//
+// Transactions are committed out of order, completed returns the checkpoint
+// of the last transaction all previous transactions have been committed with
+type parallelApplier struct {
+	sync.Mutex
+	cond      *sync.Cond
+	workers   []*applyWorker
+	conflicts string
+	// client reads the foreign keys of the target
+	client loader.MySQLLoader
+	// linked maps the tables linked by foreign keys to the first table of
+	// their group, it is read again when nil
+	linked map[string]string
+	// owners maps the keys written by queued transactions to the last one
+	owners map[string]*applyTxn
+	// inflight are the dispatched transactions in the source order, up to the
+	// first one not committed
+	inflight []*applyTxn
+	// last is the checkpoint of the last dispatched transaction
+	last    *Checkpoint
+	current *applyTxn
+	err     error
+	running sync.WaitGroup
+}
+
+type applyTxn struct {
+	statements []loader.Statement
+	keys       map[string]bool
+	checkpoint *Checkpoint
+	worker     *applyWorker
+	done       bool
+	applied    bool
+}
+
+type applyWorker struct {
+	client loader.MySQLLoader
+	queue  chan *applyTxn
+	queued int
+}
+
+func newParallelApplier(client loader.MySQLLoader, loaders []loader.MySQLLoader, conflicts string) (*parallelApplier, error) {
+	switch conflicts {
+	case "":
+		conflicts = ConflictTable
+	case ConflictTable, ConflictRow:
+	default:
+		return nil, fmt.Errorf("Unknown conflict mode %s, expected %s or %s", conflicts, ConflictTable, ConflictRow)
+	}
+	a := &parallelApplier{conflicts: conflicts, client: client, owners: make(map[string]*applyTxn)}
+	a.cond = sync.NewCond(a)
+	for _, l := range loaders {
+		w := &applyWorker{client: l, queue: make(chan *applyTxn, 64)}
+		a.workers = append(a.workers, w)
+		a.running.Add(1)
+		go a.run(w)
+	}
+	return a, nil
+}
+
+// add buffers the statements of a rows event of the current transaction,
+// schema and table are the target table
+func (a *parallelApplier) add(ev *canal.RowsEvent, schema string, table string, statements []loader.Statement) error {
+	if a.linked == nil {
+		if err := a.readForeignKeys(); err != nil {
+			return fmt.Errorf("Unable to read the foreign keys of the target: %v", err)
+		}
+	}
+	if a.current == nil {
+		a.current = &applyTxn{keys: make(map[string]bool)}
+	}
+	a.current.statements = append(a.current.statements, statements...)
+	name := schema + "." + table
+	if group, ok := a.linked[name]; ok {
+		a.current.keys[group] = true
+		return nil
+	}
+	if a.conflicts == ConflictTable || ev.Table == nil || len(ev.Table.PKColumns) == 0 {
+		a.current.keys[name] = true
+		return nil
+	}
+	for _, row := range ev.Rows {
+		values := make([]string, len(ev.Table.PKColumns))
+		for i, column := range ev.Table.PKColumns {
+			if column < len(row) {
+				values[i] = fmt.Sprintf("%v", row[column])
+			}
+		}
+		a.current.keys[name+"\x00"+strings.Join(values, "\x00")] = true
+	}
+	return nil
+}
+
+// readForeignKeys groups the tables of the target linked by foreign keys,
+// directly or through other tables
+func (a *parallelApplier) readForeignKeys() error {
+	res, err := a.client.Exec(foreignKeysQuery)
+	if err != nil {
+		return err
+	}
+	parents := make(map[string]string)
+	root := func(name string) string {
+		if _, ok := parents[name]; !ok {
+			parents[name] = name
+		}
+		for parents[name] != name {
+			name = parents[name]
+		}
+		return name
+	}
+	for i := 0; res != nil && res.Resultset != nil && i < res.RowNumber(); i++ {
+		var names [4]string
+		for j := range names {
+			if names[j], err = res.GetString(i, j); err != nil {
+				return err
+			}
+		}
+		child, parent := root(names[0]+"."+names[1]), root(names[2]+"."+names[3])
+		if child != parent {
+			parents[child] = parent
+		}
+	}
+	a.linked = make(map[string]string, len(parents))
+	for name := range parents {
+		a.linked[name] = root(name)
+	}
+	return nil
+}
+
+func (a *parallelApplier) buffered() bool {
+	return a.current != nil
+}
+
+func (a *parallelApplier) discard() {
+	a.current = nil
+}
+
+// lastDispatched returns the checkpoint of the last transaction dispatched
+// and not yet returned by completed
+func (a *parallelApplier) lastDispatched() *Checkpoint {
+	a.Lock()
+	defer a.Unlock()
+	return a.last
+}
+
+// commit dispatches the buffered transaction, which is committed with
+// checkpoint. A transaction without statements, such as a filtered one, only
+// advances the checkpoint. The error of a previous transaction is returned
+func (a *parallelApplier) commit(checkpoint *Checkpoint) error {
+	txn := a.current
+	a.current = nil
+	if txn == nil {
+		txn = &applyTxn{}
+	}
+	txn.checkpoint = checkpoint
+
+	a.Lock()
+	var worker *applyWorker
+	for {
+		if a.err != nil {
+			a.Unlock()
+			return a.err
+		}
+		var conflicting bool
+		if worker, conflicting = a.selectWorker(txn); !conflicting {
+			break
+		}
+		a.cond.Wait()
+	}
+	a.last = checkpoint
+	a.inflight = append(a.inflight, txn)
+	if len(txn.statements) == 0 {
+		txn.done, txn.applied = true, true
+		a.Unlock()
+		return nil
+	}
+	txn.worker = worker
+	worker.queued++
+	for key := range txn.keys {
+		a.owners[key] = txn
+	}
+	a.Unlock()
+	worker.queue <- txn
+	return nil
+}
+
+// selectWorker returns the worker of the transactions txn conflicts with, or
+// the least busy one. It reports a conflict when they run on several workers
+func (a *parallelApplier) selectWorker(txn *applyTxn) (*applyWorker, bool) {
+	var owner *applyWorker
+	for key := range txn.keys {
+		if queued, ok := a.owners[key]; ok {
+			if owner != nil && owner != queued.worker {
+				return nil, true
+			}
+			owner = queued.worker
+		}
+	}
+	if owner != nil {
+		return owner, false
+	}
+	for _, w := range a.workers {
+		if owner == nil || w.queued < owner.queued {
+			owner = w
+		}
+	}
+	return owner, false
+}
+
+func (a *parallelApplier) run(w *applyWorker) {
+	defer a.running.Done()
+	for txn := range w.queue {
+		a.Lock()
+		failed := a.err != nil
+		a.Unlock()
+		// Transactions following a failure are skipped, they are applied
+		// again when replication restarts from the last checkpoint
+		var err error
+		if !failed {
+			err = apply(w.client, txn.statements)
+		}
+
+		a.Lock()
+		txn.done = true
+		txn.applied = !failed && err == nil
+		w.queued--
+		for key := range txn.keys {
+			if a.owners[key] == txn {
+				delete(a.owners, key)
+			}
+		}
+		if err != nil && a.err == nil {
+			a.err = fmt.Errorf("Unable to apply transaction ending at %v: %v", txn.checkpoint.Pos, err)
+		}
+		a.cond.Broadcast()
+		a.Unlock()
+	}
+}
+
+func apply(client loader.MySQLLoader, statements []loader.Statement) error {
+	if err := client.Begin(); err != nil {
+		return err
+	}
+	if err := client.ExecStatements(statements); err != nil {
+		client.Rollback()
+		return err
+	}
+	if err := client.Commit(); err != nil {
+		client.Rollback()
+		return err
+	}
+	return nil
+}
+
+// completed returns the checkpoint of the last transaction committed after
+// all the previous ones, nil when it did not change since the last call
+func (a *parallelApplier) completed() *Checkpoint {
+	a.Lock()
+	defer a.Unlock()
+	var checkpoint *Checkpoint
+	for len(a.inflight) > 0 && a.inflight[0].applied {
+		checkpoint = a.inflight[0].checkpoint
+		a.inflight = a.inflight[1:]
+	}
+	if len(a.inflight) == 0 {
+		a.last = nil
+	}
+	return checkpoint
+}
+
+// wait blocks until every dispatched transaction is done, it returns the
+// error of the first failed transaction
+func (a *parallelApplier) wait() error {
+	a.Lock()
+	defer a.Unlock()
+	for !a.idle() {
+		a.cond.Wait()
+	}
+	return a.err
+}
+
+func (a *parallelApplier) idle() bool {
+	for _, txn := range a.inflight {
+		if !txn.done {
+			return false
+		}
+	}
+	return true
+}
+
+// reset waits for the workers and discards the transactions that were not
+// committed after a failure, they are dispatched again when replication
+// restarts from the last checkpoint
+func (a *parallelApplier) reset() {
+	a.Lock()
+	defer a.Unlock()
+	for !a.idle() {
+		a.cond.Wait()
+	}
+	a.current = nil
+	a.inflight = nil
+	a.last = nil
+	a.err = nil
+	a.owners = make(map[string]*applyTxn)
+}
+
+// close stops the workers once their queued transactions are done
+func (a *parallelApplier) close() {
+	for _, w := range a.workers {
+		close(w.queue)
+	}
+	a.running.Wait()
+}
+
+// buffer adds the statements of a rows event to the transaction dispatched
+// to the workers on commit
+func (h *defaultWDHandler) buffer(ev *canal.RowsEvent) error {
+	stmts, err := h.builder.Statements(ev)
+	if err != nil {
+		h.applier.discard()
+		h.inTransaction = false
+		return fmt.Errorf("Unable to build statements for %s: %v", ev.Table, err)
+	}
+	var schema, table string
+	if ev.Table != nil {
+		schema, table = h.router.Table(ev.Table.Schema, ev.Table.Name)
+	}
+	if err := h.applier.add(ev, schema, table, stmts); err != nil {
+		h.applier.discard()
+		h.inTransaction = false
+		return err
+	}
+	h.inTransaction = true
+	return nil
+}
+
+func (e *defaultWDHandler) syncParallel(position mysql.Position) error {
+	switch {
+	case e.inTransaction && e.applier.buffered():
+		if last := e.dispatchedPos(); last != nil && position.Compare(*last) == 0 {
+			// Canal syncs the last position again when it is closed in the
+			// middle of a transaction, the partial transaction is discarded
+			log.Infof("Discarding incomplete transaction after %v", position)
+			e.applier.discard()
+			e.inTransaction = false
+			e.pendingGTID = nil
+			return e.drain()
+		}
+		return e.dispatch(position)
+	case e.inTransaction:
+		// DDL statements are applied by the handler loader
+		return e.commit(position)
+	case e.rotated:
+		e.rotated = false
+		return e.saveCheckpoint(&Checkpoint{Pos: e.position, GTID: e.gtidSet()})
+	case e.skipped:
+		e.skipped = false
+		return e.dispatch(position)
+	}
+	// Canal syncs the position when it is closed
+	return e.drain()
+}
+
+// dispatchedPos is the position of the last dispatched transaction
+func (e *defaultWDHandler) dispatchedPos() *mysql.Position {
+	if last := e.applier.lastDispatched(); last != nil {
+		return last.Pos
+	}
+	return e.position
+}
+
+// dispatch hands the buffered transaction ending at position to the workers
+func (e *defaultWDHandler) dispatch(position mysql.Position) error {
+	e.inTransaction = false
+	gtid, err := e.committedGTID()
+	if err != nil {
+		e.applier.discard()
+		return err
+	}
+	e.pendingGTID = nil
+	if err := e.applier.commit(&Checkpoint{Pos: &position, GTID: gtid}); err != nil {
+		return e.fail(err)
+	}
+	return e.advance()
+}
+
+// drain waits for the workers and commits the position of the last
+// transaction
+func (e *defaultWDHandler) drain() error {
+	if err := e.applier.wait(); err != nil {
+		return e.fail(err)
+	}
+	return e.advance()
+}
+
+// fail commits the transactions applied before the failure and discards the
+// others, replication restarts after the last committed position
+func (e *defaultWDHandler) fail(err error) error {
+	e.applier.wait()
+	if cerr := e.advance(); cerr != nil {
+		log.Errorf("%v", cerr)
+	}
+	e.applier.reset()
+	return err
+}
+
+// advance commits the position of the transactions applied by the workers
+func (e *defaultWDHandler) advance() error {
+	checkpoint := e.applier.completed()
+	if checkpoint == nil {
+		return nil
+	}
+	e.position = checkpoint.Pos
+	if checkpoint.GTID != nil {
+		gtid := checkpoint.GTID
+		e.gtid = &gtid
+	}
+	return e.saveCheckpoint(checkpoint)
+}
@@ -0,0 +1,232 @@
+package replicator
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+	"mysqlreplicator/internal/testutil"
+	"mysqlreplicator/loader"
+	"mysqlreplicator/replicator/dmlbuilder"
+)
+
+// blockingLoader applies statements once release is closed
+type blockingLoader struct {
+	MockLoader
+	release chan struct{}
+}
+
+func (l *blockingLoader) ExecStatements(statements []loader.Statement) error {
+	<-l.release
+	return l.MockLoader.ExecStatements(statements)
+}
+
+func rowsEvent(table *schema.Table, ids ...int) *canal.RowsEvent {
+	rows := make([][]interface{}, len(ids))
+	for i, id := range ids {
+		rows[i] = []interface{}{id}
+	}
+	return &canal.RowsEvent{Table: table, Action: canal.InsertAction, Rows: rows}
+}
+
+// insertRows replays a transaction inserting ids, it ends at pos
+func insertRows(handler DefaultWDHandler, table *schema.Table, pos uint32, ids ...int) error {
+	if err := handler.OnRow(rowsEvent(table, ids...)); err != nil {
+		return err
+	}
+	if err := handler.OnXID(mysql.Position{Name: "log", Pos: pos}); err != nil {
+		return err
+	}
+	return handler.OnPosSynced(mysql.Position{Name: "log", Pos: pos}, false)
+}
+
+func TestParallelConflictsAreOrdered(t *testing.T) {
+	// Workers are blocked so that every transaction is dispatched first
+	release := make(chan struct{})
+	blocked := []*blockingLoader{{release: release}, {release: release}}
+	handler, err := NewParallelWdHandler(&MockLoader{}, HandlerOptions{
+		Workers: []loader.MySQLLoader{blocked[0], blocked[1]},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, table := range []string{"a", "b", "a", "b", "a"} {
+		if err := insertRows(handler, testutil.Table(table, true), uint32(100+i), i); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	close(release)
+	workers := []*MockLoader{&blocked[0].MockLoader, &blocked[1].MockLoader}
+	// Canal syncs the position when it is closed
+	if err := handler.OnPosSynced(mysql.Position{Name: "log", Pos: 104}, true); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if pos := handler.LastCommittedPos(); pos == nil || pos.Pos != 104 {
+		t.Fatalf("Expected every transaction to be committed, got %v", pos)
+	}
+	for _, w := range workers {
+		if len(w.queries) == 0 || w.commit != len(w.queries) {
+			t.Fatalf("Transactions should be spread over the workers, got %d and %d", workers[0].commit, workers[1].commit)
+		}
+		table := w.queries[0]
+		for i, query := range w.queries {
+			if query != table {
+				t.Errorf("Transactions on a table should be applied by one worker, got %v", w.queries)
+			}
+			if i > 0 && w.args[i][0].(int) < w.args[i-1][0].(int) {
+				t.Errorf("Transactions applied out of order %v", w.args)
+			}
+		}
+	}
+}
+
+func TestParallelRowConflicts(t *testing.T) {
+	release := make(chan struct{})
+	blocked := []*blockingLoader{{release: release}, {release: release}}
+	handler, err := NewParallelWdHandler(&MockLoader{}, HandlerOptions{
+		Workers:   []loader.MySQLLoader{blocked[0], blocked[1]},
+		Conflicts: ConflictRow,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := testutil.Table("a", true)
+	for i, id := range []int{1, 2, 1} {
+		if err := insertRows(handler, table, uint32(100+i), id); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	close(release)
+	workers := []*MockLoader{&blocked[0].MockLoader, &blocked[1].MockLoader}
+	if err := handler.OnPosSynced(mysql.Position{Name: "log", Pos: 102}, true); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if workers[0].commit+workers[1].commit != 3 {
+		t.Fatalf("Expected 3 transactions, got %d and %d", workers[0].commit, workers[1].commit)
+	}
+	for _, w := range workers {
+		if args := fmt.Sprint(w.args); args != "[[1] [1]]" && args != "[[2]]" {
+			t.Fatalf("Transactions on the same row should be applied by one worker, got %v", w.args)
+		}
+	}
+	if _, err := NewParallelWdHandler(&MockLoader{}, HandlerOptions{Workers: []loader.MySQLLoader{&MockLoader{}}, Conflicts: "gtid"}); err == nil {
+		t.Fatalf("Expected error for an unknown conflict mode")
+	}
+	options := HandlerOptions{Workers: []loader.MySQLLoader{&MockLoader{}}}
+	options.Builder.Mode = dmlbuilder.UpdateMode
+	if _, err := NewParallelWdHandler(&MockLoader{}, options); err == nil {
+		t.Fatalf("Expected error for transactions applied again in update mode")
+	}
+}
+
+func TestParallelForeignKeyConflicts(t *testing.T) {
+	release := make(chan struct{})
+	blocked := []*blockingLoader{{release: release}, {release: release}}
+	// test.items references test.orders
+	target := &snapshotSource{results: map[string][][]interface{}{
+		"SELECT DISTINCT TABLE_SCHEMA": {{"test", "items", "test", "orders"}},
+	}}
+	handler, err := NewParallelWdHandler(target, HandlerOptions{
+		Workers:   []loader.MySQLLoader{blocked[0], blocked[1]},
+		Conflicts: ConflictRow,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders, items, notes := testutil.Table("orders", true), testutil.Table("items", true), testutil.Table("notes", true)
+	for i, table := range []*schema.Table{orders, items, notes} {
+		if err := insertRows(handler, table, uint32(100+i), i+1); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	close(release)
+	workers := []*MockLoader{&blocked[0].MockLoader, &blocked[1].MockLoader}
+	if err := handler.OnPosSynced(mysql.Position{Name: "log", Pos: 102}, true); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	for _, w := range workers {
+		if queries := fmt.Sprint(w.queries); queries != "[REPLACE INTO `test`.`orders` (`id`) VALUES (?) REPLACE INTO `test`.`items` (`id`) VALUES (?)]" &&
+			queries != "[REPLACE INTO `test`.`notes` (`id`) VALUES (?)]" {
+			t.Fatalf("Rows of a child table should be applied after its parent by one worker, got %v", w.queries)
+		}
+	}
+	if len(target.reads) != 1 {
+		t.Errorf("Expected the foreign keys read once, got %v", target.reads)
+	}
+}
+
+func TestParallelCheckpointIsContiguous(t *testing.T) {
+	slow := &blockingLoader{release: make(chan struct{})}
+	fast := &MockLoader{}
+	store := &MockCheckpointStore{loader: &MockLoader{}}
+	handler, err := NewParallelWdHandler(store.loader, HandlerOptions{
+		Workers:    []loader.MySQLLoader{slow, fast},
+		Checkpoint: store,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.SetPos(&mysql.Position{Name: "log", Pos: 4})
+	if err := insertRows(handler, testutil.Table("a", true), 100, 1); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := insertRows(handler, testutil.Table("b", true), 200, 2); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	// A filtered transaction is checkpointed in order too
+	if err := handler.OnXID(mysql.Position{Name: "log", Pos: 300}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := handler.OnPosSynced(mysql.Position{Name: "log", Pos: 300}, false); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if pos := handler.LastCommittedPos(); pos.Pos != 4 || len(store.saved) != 0 {
+		t.Fatalf("Position should not pass a transaction being applied, got %v %v", pos, store.saved)
+	}
+
+	close(slow.release)
+	ddl := &replication.QueryEvent{Schema: []byte("test"), Query: []byte("ALTER TABLE a ADD COLUMN c int")}
+	if err := handler.OnDDL(mysql.Position{Name: "log", Pos: 400}, ddl); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if pos := handler.LastCommittedPos(); pos.Pos != 300 || len(store.saved) != 1 {
+		t.Fatalf("DDL should wait for the workers, got %v %v", pos, store.saved)
+	}
+	if err := handler.OnPosSynced(mysql.Position{Name: "log", Pos: 400}, true); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if pos := handler.LastCommittedPos(); pos.Pos != 400 || store.loader.commit != 1 || slow.commit != 1 || fast.commit != 1 {
+		t.Fatalf("Unexpected position %v or commits", pos)
+	}
+}
+
+func TestParallelFailureKeepsLastContiguousPosition(t *testing.T) {
+	failing := &blockingLoader{MockLoader: MockLoader{err: fmt.Errorf("deadlock")}, release: make(chan struct{})}
+	handler, err := NewParallelWdHandler(&MockLoader{}, HandlerOptions{
+		Workers: []loader.MySQLLoader{failing, &MockLoader{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.SetPos(&mysql.Position{Name: "log", Pos: 4})
+	if err := insertRows(handler, testutil.Table("a", true), 100, 1); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := insertRows(handler, testutil.Table("b", true), 200, 2); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	close(failing.release)
+	if err := handler.OnPosSynced(mysql.Position{Name: "log", Pos: 200}, true); err == nil {
+		t.Fatalf("Expected the error of the worker")
+	}
+	if pos := handler.LastCommittedPos(); pos.Pos != 4 || failing.rollback != 1 {
+		t.Fatalf("Failed transaction should be rolled back and not committed, got %v", pos)
+	}
+	// Replication restarts from the last position
+	if err := insertRows(handler, testutil.Table("b", true), 200, 2); err != nil {
+		t.Fatalf("Unexpected error after a restart %v", err)
+	}
+}
@@ -0,0 +1,274 @@
+package replicator
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+	"mysqlreplicator/loader"
+	"mysqlreplicator/replicator/dmlbuilder"
+)
+
+// DefaultRepairRetries is the number of times a range whose source rows
+// changed during its repair is repaired again
+const DefaultRepairRetries = 3
+
+// RepairOptions configures Repair
+type RepairOptions struct {
+	// BatchRows is the maximum number of inserted or deleted rows combined
+	// into one statement, see dmlbuilder.Builder
+	BatchRows int
+	// Output receives the statements as SQL for review instead of applying
+	// them to the target when set
+	Output io.Writer
+	// Retries is the number of times a range is repaired again when its
+	// source rows changed during the repair, DefaultRepairRetries when 0
+	Retries int
+}
+
+// RepairReport counts the rows Repair changed on the target
+type RepairReport struct {
+	Ranges   int `json:"ranges"`
+	Inserted int `json:"inserted"`
+	Updated  int `json:"updated"`
+	Deleted  int `json:"deleted"`
+}
+
+// Repair makes the ranges of mismatches on the target equal to the source:
+// the rows of a range are read on both servers and compared by primary key,
+// target rows missing on the source are deleted, the differing ones updated
+// and the missing ones inserted. Tables without a primary key cannot be
+// repaired.
+//
+// Replication may keep running, each range is repaired in a transaction of
+// its own that must not overwrite the changes replicated meanwhile: the target
+// rows of the range are read FOR UPDATE, which requires REPEATABLE READ on the
+// target to lock the gaps as well, and the source rows are read again before
+// the commit. The repair is rolled back and started again when they changed,
+// the binlog then carries the changes the target does not hold yet
+func Repair(source loader.MySQLLoader, target loader.MySQLLoader, mismatches []*Mismatch, options RepairOptions) (*RepairReport, error) {
+	if options.Retries <= 0 {
+		options.Retries = DefaultRepairRetries
+	}
+	report := &RepairReport{}
+	for _, mismatch := range mismatches {
+		if err := repairRange(source, target, mismatch, options, report); err != nil {
+			return report, fmt.Errorf("Unable to repair %s.%s between %v and %v: %v", mismatch.TargetSchema, mismatch.TargetTable, mismatch.From, mismatch.To, err)
+		}
+		report.Ranges++
+	}
+	log.Infof("Repaired %d ranges, %d rows inserted, %d updated and %d deleted", report.Ranges, report.Inserted, report.Updated, report.Deleted)
+	return report, nil
+}
+
+// rangeRepair holds the rows events making a range equal on the target and
+// the source rows they were computed from
+type rangeRepair struct {
+	sourceRows [][]interface{}
+	events     []*canal.RowsEvent
+	report     RepairReport
+}
+
+func repairRange(source loader.MySQLLoader, target loader.MySQLLoader, mismatch *Mismatch, options RepairOptions, report *RepairReport) error {
+	table, err := schema.NewTable(executer{source}, mismatch.Schema, mismatch.Table)
+	if err != nil {
+		return err
+	}
+	if len(table.PKColumns) == 0 {
+		return fmt.Errorf("%s has no primary key", table)
+	}
+	builder := dmlbuilder.Builder{Mode: dmlbuilder.UpdateMode, BatchRows: options.BatchRows}
+	if options.Output != nil {
+		repair, err := repairEvents(source, target, table, mismatch, false)
+		if err != nil {
+			return err
+		}
+		report.add(repair.report)
+		return writeRepair(options.Output, builder, repair.events)
+	}
+	for attempt := 1; ; attempt++ {
+		if err := target.Begin(); err != nil {
+			return err
+		}
+		repair, changed, err := applyRepair(source, target, table, mismatch, builder)
+		if err != nil {
+			target.Rollback()
+			return err
+		}
+		if !changed {
+			if err := target.Commit(); err != nil {
+				target.Rollback()
+				return err
+			}
+			report.add(repair.report)
+			return nil
+		}
+		target.Rollback()
+		if attempt > options.Retries {
+			return fmt.Errorf("The source rows changed during %d repairs", attempt)
+		}
+		log.Warningf("%s changed between %v and %v during the repair, repairing again", table, mismatch.From, mismatch.To)
+	}
+}
+
+func (r *RepairReport) add(rows RepairReport) {
+	r.Inserted += rows.Inserted
+	r.Updated += rows.Updated
+	r.Deleted += rows.Deleted
+}
+
+// repairEvents returns the rows events making the range of mismatch equal on
+// the target, deletes first so that inserts never conflict with them. The
+// target rows are locked until the end of the transaction with lock
+func repairEvents(source loader.MySQLLoader, target loader.MySQLLoader, table *schema.Table, mismatch *Mismatch, lock bool) (*rangeRepair, error) {
+	routed := *table
+	routed.Schema, routed.Name = mismatch.TargetSchema, mismatch.TargetTable
+	sourceRows, err := rangeRows(source, table, mismatch, false)
+	if err != nil {
+		return nil, err
+	}
+	targetRows, err := rangeRows(target, &routed, mismatch, lock)
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted, updated, inserted [][]interface{}
+	existing := make(map[string][]interface{}, len(targetRows))
+	for _, row := range targetRows {
+		existing[rowKey(table, row)] = row
+	}
+	for _, row := range sourceRows {
+		key := rowKey(table, row)
+		current, ok := existing[key]
+		delete(existing, key)
+		switch {
+		case !ok:
+			inserted = append(inserted, row)
+		case !sameRow(table, current, row):
+			updated = append(updated, current, row)
+		}
+	}
+	for _, row := range targetRows {
+		if _, ok := existing[rowKey(table, row)]; ok {
+			deleted = append(deleted, row)
+		}
+	}
+	repair := &rangeRepair{
+		sourceRows: sourceRows,
+		report:     RepairReport{Deleted: len(deleted), Updated: len(updated) / 2, Inserted: len(inserted)},
+	}
+	for _, event := range []*canal.RowsEvent{
+		{Table: &routed, Action: canal.DeleteAction, Rows: deleted},
+		{Table: &routed, Action: canal.UpdateAction, Rows: updated},
+		{Table: &routed, Action: canal.InsertAction, Rows: inserted},
+	} {
+		if len(event.Rows) > 0 {
+			repair.events = append(repair.events, event)
+		}
+	}
+	return repair, nil
+}
+
+// rangeRows reads the rows of table in the range of mismatch, as canal
+// decodes them from the binlog. The rows are locked FOR UPDATE with lock
+func rangeRows(l loader.MySQLLoader, table *schema.Table, mismatch *Mismatch, lock bool) ([][]interface{}, error) {
+	from, err := keyArgs(table, mismatch.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := keyArgs(table, mismatch.To)
+	if err != nil {
+		return nil, err
+	}
+	query, args := rangeQuery(table, from, to)
+	if lock {
+		query += " FOR UPDATE"
+	}
+	res, err := l.Exec(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]interface{}
+	if res != nil && res.Resultset != nil {
+		for _, values := range res.Values {
+			rows = append(rows, snapshotRow(table, values))
+		}
+	}
+	return rows, nil
+}
+
+// sameRow reports whether two rows hold the same values once converted as
+// applied on targets, integers of different widths are equal
+func sameRow(table *schema.Table, a []interface{}, b []interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, errX := canonicalValue(&table.Columns[i], a[i])
+		y, errY := canonicalValue(&table.Columns[i], b[i])
+		if errX != nil || errY != nil || x != y {
+			return false
+		}
+	}
+	return true
+}
+
+// sameRows reports whether two lists of rows hold the same rows in the same
+// order
+func sameRows(table *schema.Table, a [][]interface{}, b [][]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameRow(table, a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyRepair applies the repair of a range in the current transaction of the
+// target, it reports whether the source rows changed in the meantime. Updates
+// only set the columns of the source
+func applyRepair(source loader.MySQLLoader, target loader.MySQLLoader, table *schema.Table, mismatch *Mismatch, builder dmlbuilder.Builder) (*rangeRepair, bool, error) {
+	repair, err := repairEvents(source, target, table, mismatch, true)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(repair.events) == 0 {
+		return repair, false, nil
+	}
+	var statements []loader.Statement
+	for _, event := range repair.events {
+		s, err := builder.Statements(event)
+		if err != nil {
+			return nil, false, err
+		}
+		statements = append(statements, s...)
+	}
+	if err := target.ExecStatements(statements); err != nil {
+		return nil, false, err
+	}
+	current, err := rangeRows(source, table, mismatch, false)
+	if err != nil {
+		return nil, false, err
+	}
+	return repair, !sameRows(table, repair.sourceRows, current), nil
+}
+
+// writeRepair writes the statements of events as SQL to output
+func writeRepair(output io.Writer, builder dmlbuilder.Builder, events []*canal.RowsEvent) error {
+	for _, event := range events {
+		queries, err := builder.DMLs(event)
+		if err != nil {
+			return err
+		}
+		for _, query := range queries {
+			if _, err := fmt.Fprintf(output, "%s;\n", query); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
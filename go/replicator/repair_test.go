@@ -0,0 +1,142 @@
+package replicator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+// newRepairTarget returns a target whose archive.orders differs from the
+// backfill source: row 2 changed, row 3 missing and row 4 extra. Rows are read
+// FOR UPDATE when applied
+func newRepairTarget() *snapshotSource {
+	target := &snapshotSource{results: map[string][][]interface{}{}}
+	for _, lock := range []string{"", " FOR UPDATE"} {
+		target.results["SELECT `id`,`status`,`flags` FROM `archive`.`orders` WHERE (`id`) <= (?) ORDER BY `id`"+lock+"[2]"] = [][]interface{}{
+			{int64(1), "new", nil},
+			{int64(2), "lost", nil},
+		}
+		target.results["SELECT `id`,`status`,`flags` FROM `archive`.`orders` WHERE (`id`) > (?) ORDER BY `id`"+lock+"[2]"] = [][]interface{}{
+			{int64(4), []byte("sent"), nil},
+		}
+	}
+	return target
+}
+
+func repairMismatches() []*Mismatch {
+	return []*Mismatch{
+		{Schema: "shop", Table: "orders", TargetSchema: "archive", TargetTable: "orders", To: []interface{}{int32(2)}},
+		{Schema: "shop", Table: "orders", TargetSchema: "archive", TargetTable: "orders", From: []interface{}{int32(2)}},
+	}
+}
+
+func TestRepair(t *testing.T) {
+	source := newBackfillSource().snapshotSource
+	target := newRepairTarget()
+	report, err := Repair(source, target, repairMismatches(), RepairOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if report.Ranges != 2 || report.Inserted != 1 || report.Updated != 1 || report.Deleted != 1 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	expected := []string{
+		"UPDATE `archive`.`orders` SET `id`=?,`status`=?,`flags`=? WHERE `id`=?",
+		"DELETE FROM `archive`.`orders` WHERE `id`=?",
+		"INSERT INTO `archive`.`orders` (`id`,`status`,`flags`) VALUES (?,?,?)",
+	}
+	if strings.Join(target.queries, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected %v, got %v", expected, target.queries)
+	}
+	if target.begin != 2 || target.commit != 2 {
+		t.Errorf("Expected a transaction per range, got %d begins and %d commits", target.begin, target.commit)
+	}
+}
+
+// changingSource updates row 2 of shop.orders after the first read of its
+// range, or after every read when flapping, as replication would
+type changingSource struct {
+	*snapshotSource
+	flapping bool
+	reads    int
+}
+
+func (s *changingSource) Exec(query string, args ...interface{}) (*mysql.Result, error) {
+	res, err := s.snapshotSource.Exec(query, args...)
+	if key := "SELECT `id`,`status`,`flags` FROM `shop`.`orders` WHERE (`id`) <= (?) ORDER BY `id`"; query == key {
+		if s.reads++; s.reads == 1 || s.flapping {
+			s.results[key+"[2]"] = [][]interface{}{
+				{int32(1), []byte("new"), nil},
+				{int32(2), []byte(fmt.Sprintf("refunded %d", s.reads)), nil},
+			}
+		}
+	}
+	return res, err
+}
+
+func TestRepairRetriesChangedSource(t *testing.T) {
+	source := &changingSource{snapshotSource: newBackfillSource().snapshotSource}
+	target := newRepairTarget()
+	report, err := Repair(source, target, repairMismatches()[:1], RepairOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if target.begin != 2 || target.rollback != 1 || target.commit != 1 || report.Updated != 1 {
+		t.Errorf("Expected the repair to be rolled back and applied again, got %d begins, %d rollbacks and %d commits", target.begin, target.rollback, target.commit)
+	}
+	if status := fmt.Sprintf("%s", target.args[len(target.args)-1][1]); status != "refunded 1" {
+		t.Errorf("Expected the changed source row to be applied, got %s", status)
+	}
+	for _, query := range target.reads {
+		if !strings.HasSuffix(query, " FOR UPDATE") {
+			t.Errorf("Expected the target rows to be locked, got %s", query)
+		}
+	}
+
+	source = &changingSource{snapshotSource: newBackfillSource().snapshotSource, flapping: true}
+	target = newRepairTarget()
+	if _, err := Repair(source, target, repairMismatches()[:1], RepairOptions{Retries: 2}); err == nil {
+		t.Error("Expected error when the source rows change during every repair")
+	}
+	if target.begin != 3 || target.commit != 0 {
+		t.Errorf("Expected 3 repairs rolled back, got %d begins and %d commits", target.begin, target.commit)
+	}
+}
+
+func TestRepairOutput(t *testing.T) {
+	source := newBackfillSource().snapshotSource
+	target := newRepairTarget()
+	// Bounds read back from a JSON report
+	var mismatches []*Mismatch
+	data, _ := json.Marshal(repairMismatches())
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&mismatches); err != nil {
+		t.Fatal(err)
+	}
+	var output bytes.Buffer
+	if _, err := Repair(source, target, mismatches, RepairOptions{Output: &output}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := "UPDATE `archive`.`orders` SET `id`=2,`status`='paid',`flags`=NULL WHERE `id`=2;\n" +
+		"DELETE FROM `archive`.`orders` WHERE `id`=4;\n" +
+		"INSERT INTO `archive`.`orders` (`id`,`status`,`flags`) VALUES (3,'sent',b'1');\n"
+	if output.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, output.String())
+	}
+	if len(target.queries) != 0 || target.begin != 0 {
+		t.Errorf("Expected nothing applied, got %v", target.queries)
+	}
+}
+
+func TestRepairWithoutPrimaryKey(t *testing.T) {
+	source := newBackfillSource().snapshotSource
+	mismatches := []*Mismatch{{Schema: "shop", Table: "notes", TargetSchema: "shop", TargetTable: "notes"}}
+	if _, err := Repair(source, &MockLoader{}, mismatches, RepairOptions{}); err == nil {
+		t.Error("Expected error repairing a table without a primary key")
+	}
+}
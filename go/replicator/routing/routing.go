@@ -0,0 +1,134 @@
+// Package routing maps source schemas and tables to the names they are
+// replicated to on the target
+package routing
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Wildcard matches any name in Rule.From and keeps the source name in Rule.To
+const Wildcard = "*"
+
+// Rule routes the tables matching From to To, both written "schema.table".
+// "src_db.* -> dst_db.*" moves a schema and "shop.orders -> archive.orders_2026"
+// moves a single table
+type Rule struct {
+	From string
+	To   string
+}
+
+type rule struct {
+	schema, table     string
+	toSchema, toTable string
+}
+
+// specificity orders rules matching the same table, exact table names win
+// over exact schema names which win over wildcards
+func (r rule) specificity() int {
+	s := 0
+	if r.table != Wildcard {
+		s += 2
+	}
+	if r.schema != Wildcard {
+		s++
+	}
+	return s
+}
+
+func (r rule) matches(schema string, table string) bool {
+	return (r.schema == Wildcard || r.schema == schema) && (r.table == Wildcard || r.table == table)
+}
+
+// Router resolves target names, a nil Router keeps every source name
+type Router struct {
+	rules []rule
+}
+
+// Parse parses a rule written "<schema>.<table> -> <schema>.<table>"
+func Parse(spec string) (Rule, error) {
+	parts := strings.Split(spec, "->")
+	if len(parts) != 2 {
+		return Rule{}, fmt.Errorf("Invalid route %s, expected <schema>.<table> -> <schema>.<table>", spec)
+	}
+	r := Rule{From: strings.TrimSpace(parts[0]), To: strings.TrimSpace(parts[1])}
+	_, err := r.compile()
+	return r, err
+}
+
+// New returns a Router for rules, when several rules match a table the most
+// specific one is used
+func New(rules ...Rule) (*Router, error) {
+	router := &Router{}
+	for _, r := range rules {
+		compiled, err := r.compile()
+		if err != nil {
+			return nil, err
+		}
+		router.rules = append(router.rules, compiled)
+	}
+	return router, nil
+}
+
+func (r Rule) compile() (rule, error) {
+	from := strings.SplitN(r.From, ".", 2)
+	to := strings.SplitN(r.To, ".", 2)
+	if len(from) != 2 || len(to) != 2 || from[0] == "" || from[1] == "" || to[0] == "" || to[1] == "" {
+		return rule{}, fmt.Errorf("Invalid route %s -> %s, names are written <schema>.<table>", r.From, r.To)
+	}
+	if from[1] == Wildcard && to[1] != Wildcard {
+		return rule{}, fmt.Errorf("Invalid route %s -> %s, every table would be written to %s", r.From, r.To, r.To)
+	}
+	if from[0] == Wildcard && from[1] != Wildcard && to[0] != Wildcard {
+		// Tables with the same name in different schemas would be merged
+		return rule{}, fmt.Errorf("Invalid route %s -> %s, the target schema must be %s", r.From, r.To, Wildcard)
+	}
+	return rule{schema: from[0], table: from[1], toSchema: to[0], toTable: to[1]}, nil
+}
+
+// Table returns the target schema and table of schema.table
+func (r *Router) Table(schema string, table string) (string, string) {
+	if r == nil {
+		return schema, table
+	}
+	var match *rule
+	for i := range r.rules {
+		if r.rules[i].matches(schema, table) && (match == nil || r.rules[i].specificity() > match.specificity()) {
+			match = &r.rules[i]
+		}
+	}
+	if match == nil {
+		return schema, table
+	}
+	if match.toSchema != Wildcard {
+		schema = match.toSchema
+	}
+	if match.toTable != Wildcard {
+		table = match.toTable
+	}
+	return schema, table
+}
+
+// Schema returns the target of schema according to the rules routing every
+// table of a schema, rules for single tables are ignored
+func (r *Router) Schema(schema string) string {
+	if r == nil {
+		return schema
+	}
+	var match *rule
+	for i := range r.rules {
+		if r.rules[i].table == Wildcard && r.rules[i].matches(schema, Wildcard) &&
+			(match == nil || r.rules[i].specificity() > match.specificity()) {
+			match = &r.rules[i]
+		}
+	}
+	if match == nil || match.toSchema == Wildcard {
+		return schema
+	}
+	return match.toSchema
+}
+
+// ToSchema returns a Router writing every table to schema
+func ToSchema(schema string) *Router {
+	return &Router{rules: []rule{{schema: Wildcard, table: Wildcard, toSchema: schema, toTable: Wildcard}}}
+}
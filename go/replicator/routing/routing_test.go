@@ -0,0 +1,53 @@
+package routing
+
+import "testing"
+
+func TestRouterTable(t *testing.T) {
+	router, err := New(
+		Rule{From: "src_db.*", To: "dst_db.*"},
+		Rule{From: "shop.orders", To: "archive.orders_2026"},
+		Rule{From: "shop.*", To: "store.*"},
+		Rule{From: "*.audit", To: "*.audit_log"},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	cases := []struct{ schema, table, toSchema, toTable string }{
+		{"src_db", "users", "dst_db", "users"},
+		{"shop", "orders", "archive", "orders_2026"},
+		{"shop", "items", "store", "items"},
+		{"billing", "audit", "billing", "audit_log"},
+		{"shop", "audit", "shop", "audit_log"},
+		{"other", "users", "other", "users"},
+	}
+	for _, c := range cases {
+		if schema, table := router.Table(c.schema, c.table); schema != c.toSchema || table != c.toTable {
+			t.Errorf("Expected %s.%s routed to %s.%s, got %s.%s", c.schema, c.table, c.toSchema, c.toTable, schema, table)
+		}
+	}
+	if router.Schema("shop") != "store" || router.Schema("billing") != "billing" {
+		t.Fatalf("Unexpected schema routes %s %s", router.Schema("shop"), router.Schema("billing"))
+	}
+}
+
+func TestNilRouter(t *testing.T) {
+	var router *Router
+	if schema, table := router.Table("a", "b"); schema != "a" || table != "b" {
+		t.Fatalf("Nil router should keep names, got %s.%s", schema, table)
+	}
+	if ToSchema("target").Schema("a") != "target" {
+		t.Fatalf("Every schema should be routed to target")
+	}
+}
+
+func TestParse(t *testing.T) {
+	rule, err := Parse(" shop.orders ->archive.orders_2026")
+	if err != nil || rule.From != "shop.orders" || rule.To != "archive.orders_2026" {
+		t.Fatalf("Unexpected rule %v %v", rule, err)
+	}
+	for _, spec := range []string{"shop.orders", "shop -> archive", "shop.* -> archive.orders", "*.orders -> archive.orders", ".t -> a.t"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Expected error for %s", spec)
+		}
+	}
+}
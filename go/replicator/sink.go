@@ -0,0 +1,387 @@
+package replicator
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+	"mysqlreplicator/replicator/routing"
+)
+
+// ChangeEvent is a row change or a DDL statement of a source transaction
+type ChangeEvent struct {
+	// Action is canal.InsertAction, canal.UpdateAction, canal.DeleteAction
+	// or DDLAction
+	Action string
+	// Schema and Table are the routed names of the changed table
+	Schema string
+	Table  string
+	// Source is the source table the rows are read with, nil for DDL
+	Source *schema.Table
+	// Before is nil for inserts and After for deletes
+	Before []interface{}
+	After  []interface{}
+	// Row is the index of the row in its rows event
+	Row int
+	// Query is the statement of a DDL event
+	Query string
+	// ServerID and Timestamp are read from the binlog event header
+	ServerID  uint32
+	Timestamp uint32
+	// Pos is the position the transaction ends at and GTID its GTID
+	Pos  mysql.Position
+	GTID string
+}
+
+// Key identifies the changed row as "schema.table" followed by the primary
+// key values, tables without a primary key and DDL events only have the name
+func (e *ChangeEvent) Key() string {
+	key := e.Schema + "." + e.Table
+	row := e.After
+	if row == nil {
+		row = e.Before
+	}
+	if e.Source == nil || len(e.Source.PKColumns) == 0 || row == nil {
+		return key
+	}
+	values := make([]string, len(e.Source.PKColumns))
+	for i, column := range e.Source.PKColumns {
+		if column < len(row) {
+			values[i] = fmt.Sprintf("%v", keyValue(row[column]))
+		}
+	}
+	return key + ":" + strings.Join(values, ",")
+}
+
+func keyValue(v interface{}) interface{} {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return v
+}
+
+// Sink publishes change events in place of applying them to a target server
+type Sink interface {
+	// Publish returns once the events of a transaction are durable, the
+	// transaction is checkpointed after it
+	Publish(events []*ChangeEvent) error
+	Close() error
+}
+
+// Encoder serialises change events for sinks
+type Encoder interface {
+	Encode(event *ChangeEvent) ([]byte, error)
+}
+
+// KeyEncoder is implemented by encoders serialising message keys, sinks use
+// ChangeEvent.Key as the key of encoders that do not implement it
+type KeyEncoder interface {
+	EncodeKey(event *ChangeEvent) ([]byte, error)
+}
+
+// JSONEncoder encodes events as a JSON object with the rows as objects keyed
+// by column name
+type JSONEncoder struct{}
+
+type jsonEvent struct {
+	Action string                 `json:"action"`
+	Schema string                 `json:"schema"`
+	Table  string                 `json:"table"`
+	Before map[string]interface{} `json:"before,omitempty"`
+	After  map[string]interface{} `json:"after,omitempty"`
+	Query  string                 `json:"query,omitempty"`
+	File   string                 `json:"file"`
+	Pos    uint32                 `json:"pos"`
+	GTID   string                 `json:"gtid,omitempty"`
+	TS     uint32                 `json:"ts"`
+}
+
+func (JSONEncoder) Encode(event *ChangeEvent) ([]byte, error) {
+	return json.Marshal(jsonEvent{
+		Action: event.Action,
+		Schema: event.Schema,
+		Table:  event.Table,
+		Before: rowMap(event.Source, event.Before),
+		After:  rowMap(event.Source, event.After),
+		Query:  event.Query,
+		File:   event.Pos.Name,
+		Pos:    event.Pos.Pos,
+		GTID:   event.GTID,
+		TS:     event.Timestamp,
+	})
+}
+
+func rowMap(table *schema.Table, row []interface{}) map[string]interface{} {
+	if table == nil || row == nil {
+		return nil
+	}
+	m := make(map[string]interface{}, len(row))
+	for i, column := range table.Columns {
+		if i < len(row) {
+			m[column.Name] = row[i]
+		}
+	}
+	return m
+}
+
+// sinkHandler publishes the events of every source transaction to a Sink
+// once the transaction ends, the position is checkpointed after the sink
+// returns
+type sinkHandler struct {
+	canal.DummyEventHandler
+	mutex         sync.Mutex
+	sink          Sink
+	router        *routing.Router
+	store         CheckpointStore
+	filter        *tableFilter
+	listeners     []TableListener
+	position      *mysql.Position
+	gtid          *mysql.GTIDSet
+	pendingGTID   mysql.GTIDSet
+	events        []*ChangeEvent
+	inTransaction bool
+	skipped       bool
+	rotated       bool
+	changedTable  [2]string
+}
+
+// NewSinkHandler returns a handler publishing change events to sink,
+// options.Schema, Routes, Checkpoint and TableListener are used as by
+// NewWdHandlerWithOptions. A sink that is a TableListener is notified too
+func NewSinkHandler(sink Sink, options HandlerOptions) DefaultWDHandler {
+	router := options.Routes
+	if router == nil && options.Schema != "" {
+		router = routing.ToSchema(options.Schema)
+	}
+	handler := &sinkHandler{sink: sink, router: router, store: options.Checkpoint}
+	if listener, ok := sink.(TableListener); ok {
+		handler.listeners = append(handler.listeners, listener)
+	}
+	if options.TableListener != nil {
+		handler.listeners = append(handler.listeners, options.TableListener)
+	}
+	return handler
+}
+
+func (h *sinkHandler) String() string {
+	return "sinkHandler"
+}
+
+func (h *sinkHandler) SetFilter(filter Filter) error {
+	compiled, err := filter.compile()
+	if err != nil {
+		return err
+	}
+	h.filter = compiled
+	return nil
+}
+
+func (h *sinkHandler) CheckpointStore() CheckpointStore {
+	return h.store
+}
+
+func (h *sinkHandler) LastCommittedGITD() *mysql.GTIDSet {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.gtid
+}
+
+func (h *sinkHandler) LastCommittedPos() *mysql.Position {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.position
+}
+
+func (h *sinkHandler) SetGITD(set *mysql.GTIDSet) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.gtid = set
+}
+
+func (h *sinkHandler) SetPos(pos *mysql.Position) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.position = pos
+}
+
+func (h *sinkHandler) Close() error {
+	return h.sink.Close()
+}
+
+func (h *sinkHandler) OnRow(ev *canal.RowsEvent) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if ev.Table == nil {
+		return nil
+	}
+	if h.filter != nil && !h.filter.allows(ev.Table.Schema, ev.Table.Name, ev.Action) {
+		return nil
+	}
+	schema, table := h.router.Table(ev.Table.Schema, ev.Table.Name)
+	event := ChangeEvent{Action: ev.Action, Schema: schema, Table: table, Source: ev.Table}
+	if ev.Header != nil {
+		event.ServerID, event.Timestamp = ev.Header.ServerID, ev.Header.Timestamp
+	}
+	step := 1
+	if ev.Action == canal.UpdateAction {
+		step = 2
+	}
+	for i := 0; i+step <= len(ev.Rows); i += step {
+		e := event
+		e.Row = i / step
+		switch ev.Action {
+		case canal.InsertAction:
+			e.After = ev.Rows[i]
+		case canal.DeleteAction:
+			e.Before = ev.Rows[i]
+		case canal.UpdateAction:
+			e.Before, e.After = ev.Rows[i], ev.Rows[i+1]
+		}
+		h.events = append(h.events, &e)
+	}
+	h.inTransaction = true
+	return nil
+}
+
+func (h *sinkHandler) OnRotate(ev *replication.RotateEvent) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.position = &mysql.Position{Name: string(ev.NextLogName), Pos: uint32(ev.Position)}
+	h.rotated = true
+	return nil
+}
+
+func (h *sinkHandler) OnGTID(gtid mysql.GTIDSet) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.pendingGTID = gtid
+	return nil
+}
+
+func (h *sinkHandler) OnXID(nextPos mysql.Position) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.inTransaction {
+		h.skipped = true
+	}
+	return nil
+}
+
+func (h *sinkHandler) OnTableChanged(schema string, table string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.changedTable = [2]string{schema, table}
+	for _, listener := range h.listeners {
+		if err := listener.TableChanged(schema, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OnDDL publishes the statement as it was executed on the source with the
+// routed name of the table it changes
+func (h *sinkHandler) OnDDL(nextPos mysql.Position, queryEvent *replication.QueryEvent) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.inTransaction {
+		return fmt.Errorf("Current transaction has not ended, unexpected DDL query received")
+	}
+	changed := h.changedTable
+	h.changedTable = [2]string{}
+	if schema, table := ddlTable(changed, queryEvent); h.filter != nil && !h.filter.allows(schema, table, DDLAction) {
+		h.skipped = true
+		return nil
+	}
+	schema, table := h.router.Table(changed[0], changed[1])
+	h.events = append(h.events, &ChangeEvent{
+		Action: DDLAction,
+		Schema: schema,
+		Table:  table,
+		Query:  string(queryEvent.Query),
+	})
+	h.inTransaction = true
+	return nil
+}
+
+func (h *sinkHandler) OnPosSynced(position mysql.Position, force bool) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	switch {
+	case h.inTransaction:
+		if h.position != nil && position.Compare(*h.position) == 0 {
+			// Canal syncs the last position again when it is closed in the
+			// middle of a transaction, the partial transaction is discarded
+			log.Infof("Discarding incomplete transaction after %v", position)
+			h.discard()
+			return nil
+		}
+	case h.rotated:
+		h.rotated = false
+		return h.saveCheckpoint(&Checkpoint{Pos: h.position, GTID: h.gtidSet()})
+	case !h.skipped:
+		// Canal syncs the position when it is closed
+		return nil
+	}
+	h.skipped = false
+
+	gtid, err := h.committedGTID()
+	if err != nil {
+		h.discard()
+		return err
+	}
+	if len(h.events) > 0 {
+		var gtidString string
+		if h.pendingGTID != nil {
+			gtidString = h.pendingGTID.String()
+		}
+		for _, e := range h.events {
+			e.Pos, e.GTID = position, gtidString
+		}
+		if err := h.sink.Publish(h.events); err != nil {
+			h.discard()
+			return fmt.Errorf("Unable to publish transaction ending at %v: %v", position, err)
+		}
+	}
+	h.discard()
+	h.position = &position
+	if gtid != nil {
+		h.gtid = &gtid
+	}
+	return h.saveCheckpoint(&Checkpoint{Pos: &position, GTID: gtid})
+}
+
+func (h *sinkHandler) discard() {
+	h.events = nil
+	h.inTransaction = false
+	h.pendingGTID = nil
+}
+
+func (h *sinkHandler) saveCheckpoint(checkpoint *Checkpoint) error {
+	if h.store == nil {
+		return nil
+	}
+	if err := h.store.Save(checkpoint); err != nil {
+		return fmt.Errorf("Unable to save checkpoint %v: %v", checkpoint.Pos, err)
+	}
+	return nil
+}
+
+func (h *sinkHandler) gtidSet() mysql.GTIDSet {
+	if h.gtid == nil {
+		return nil
+	}
+	return *h.gtid
+}
+
+func (h *sinkHandler) committedGTID() (mysql.GTIDSet, error) {
+	if h.gtid == nil || *h.gtid == nil {
+		return nil, nil
+	}
+	return mergeGTID(*h.gtid, h.pendingGTID)
+}
@@ -0,0 +1,63 @@
+package replicator
+
+import (
+	"testing"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+type MockSink struct {
+	published [][]*ChangeEvent
+}
+
+func (s *MockSink) Publish(events []*ChangeEvent) error {
+	s.published = append(s.published, events)
+	return nil
+}
+
+func (s *MockSink) Close() error {
+	return nil
+}
+
+func TestSinkHandlerEvents(t *testing.T) {
+	sink := &MockSink{}
+	handler := NewSinkHandler(sink, HandlerOptions{Schema: "archive"})
+	if err := handler.(Filterable).SetFilter(Filter{Actions: []ActionFilter{{Table: "^test\\.", Actions: []string{canal.DeleteAction}}}}); err != nil {
+		t.Fatal(err)
+	}
+	set, _ := mysql.ParseGTIDSet(mysql.MySQLFlavor, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5")
+	handler.SetGITD(&set)
+	table := &schema.Table{Schema: "test", Name: "t"}
+	table.AddColumn("a", "int", "", "")
+	table.AddColumn("b", "varchar(10)", "", "")
+	table.PKColumns = []int{0, 1}
+
+	gtid, _ := mysql.ParseMysqlGTIDSet("3e11fa47-71ca-11e1-9e33-c80aa9429562:6")
+	handler.OnGTID(gtid)
+	handler.OnRow(&canal.RowsEvent{Table: table, Action: canal.InsertAction, Rows: [][]interface{}{{1, []byte("x")}}})
+	handler.OnRow(&canal.RowsEvent{Table: table, Action: canal.DeleteAction, Rows: [][]interface{}{{1, []byte("x")}}})
+	if err := handler.OnPosSynced(mysql.Position{Name: "log", Pos: 100}, false); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(sink.published) != 1 || len(sink.published[0]) != 1 {
+		t.Fatalf("Expected a transaction with the insert only, got %v", sink.published)
+	}
+	event := sink.published[0][0]
+	if event.Key() != "archive.t:1,x" || event.Pos.Pos != 100 || event.GTID != "3e11fa47-71ca-11e1-9e33-c80aa9429562:6" {
+		t.Fatalf("Unexpected event %+v with key %s", event, event.Key())
+	}
+	if handler.LastCommittedGITD() == nil || (*handler.LastCommittedGITD()).String() != "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-6" {
+		t.Fatalf("Unexpected GTID set %v", handler.LastCommittedGITD())
+	}
+
+	// Canal closes in the middle of a transaction
+	handler.OnRow(&canal.RowsEvent{Table: table, Action: canal.InsertAction, Rows: [][]interface{}{{2, []byte("y")}}})
+	if err := handler.OnPosSynced(mysql.Position{Name: "log", Pos: 100}, true); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(sink.published) != 1 {
+		t.Fatalf("Incomplete transaction should not be published")
+	}
+}
@@ -0,0 +1,340 @@
+package replicator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+	"mysqlreplicator/loader"
+	"mysqlreplicator/replicator/dmlbuilder"
+	"mysqlreplicator/replicator/routing"
+)
+
+// DefaultChunkRows is the number of rows a snapshot copies at once
+const DefaultChunkRows = 1000
+
+// SnapshotOptions configures Snapshot
+type SnapshotOptions struct {
+	// Filter selects the tables copied as it selects the tables replicated,
+	// action filters are ignored
+	Filter Filter
+	// Routes maps source tables to target tables, nil keeps the source names
+	Routes *routing.Router
+	// ChunkRows is the number of rows read and committed on the target at
+	// once, DefaultChunkRows when 0
+	ChunkRows int
+	// BatchRows is the maximum number of rows of an INSERT statement
+	BatchRows int
+	// DropTables drops the target tables and creates them again from the
+	// source definition. Missing tables are otherwise created and the copy
+	// refuses target tables holding rows
+	DropTables bool
+	// KeepTables copies rows into the tables existing on the target even if
+	// they hold rows, as when a failed snapshot is taken again
+	KeepTables bool
+}
+
+// Snapshot copies the tables selected by options.Filter from source to
+// target as of a consistent read and returns the checkpoint of the binlog
+// position the copy matches, replication starts from it. The source is locked
+// with FLUSH TABLES WITH READ LOCK until the read and its position are taken,
+// only InnoDB tables are read consistently. Rows are written as REPLACE
+// statements, a failed snapshot can be taken again
+func Snapshot(source loader.MySQLLoader, target loader.MySQLLoader, options SnapshotOptions) (*Checkpoint, error) {
+	filter, err := options.Filter.compile()
+	if err != nil {
+		return nil, err
+	}
+	if options.DropTables && options.KeepTables {
+		return nil, fmt.Errorf("DropTables and KeepTables are exclusive")
+	}
+	if options.ChunkRows <= 0 {
+		options.ChunkRows = DefaultChunkRows
+	}
+	// Ends the consistent read
+	defer source.Rollback()
+	checkpoint, err := startConsistentRead(source)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := snapshotTables(source, filter)
+	if err != nil {
+		return nil, err
+	}
+	// Tables are created and filled regardless of their foreign keys
+	if _, err := target.Exec("SET FOREIGN_KEY_CHECKS = 0"); err != nil {
+		return nil, err
+	}
+	defer target.Exec("SET FOREIGN_KEY_CHECKS = 1")
+	for _, name := range tables {
+		if err := copyTable(source, target, name[0], name[1], options); err != nil {
+			return nil, fmt.Errorf("Unable to copy %s.%s: %v", name[0], name[1], err)
+		}
+	}
+	log.Infof("Snapshot of %d tables taken at %v", len(tables), checkpoint.Pos)
+	return checkpoint, nil
+}
+
+// startConsistentRead starts a transaction reading the source as of the
+// returned checkpoint
+func startConsistentRead(source loader.MySQLLoader) (*Checkpoint, error) {
+	if _, err := source.Exec("FLUSH TABLES WITH READ LOCK"); err != nil {
+		return nil, fmt.Errorf("Unable to lock the source tables: %v", err)
+	}
+	defer source.Exec("UNLOCK TABLES")
+	err := source.ExecBatch([]string{
+		"SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ",
+		"START TRANSACTION WITH CONSISTENT SNAPSHOT",
+	})
+	if err != nil {
+		return nil, err
+	}
+	pos, err := masterPosition(source)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &Checkpoint{Pos: pos}
+	gtid, err := source.GTid()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the source GTID set: %v", err)
+	}
+	if gtid != nil && gtid.String() != "" {
+		checkpoint.GTID = gtid
+	}
+	return checkpoint, nil
+}
+
+// masterPosition returns the current binlog position of source
+func masterPosition(source loader.MySQLLoader) (*mysql.Position, error) {
+	status, err := source.Exec("SHOW MASTER STATUS")
+	if err != nil {
+		return nil, err
+	}
+	if status == nil || status.Resultset == nil || status.RowNumber() == 0 {
+		return nil, fmt.Errorf("Binary logging is disabled on the source")
+	}
+	name, err := status.GetString(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	pos, err := status.GetUint(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &mysql.Position{Name: name, Pos: uint32(pos)}, nil
+}
+
+// snapshotTables returns the schema and name of the source tables filter
+// selects
+func snapshotTables(source loader.MySQLLoader, filter *tableFilter) ([][2]string, error) {
+	res, err := source.Exec("SELECT TABLE_SCHEMA, TABLE_NAME FROM information_schema.TABLES " +
+		"WHERE TABLE_TYPE = 'BASE TABLE' AND TABLE_SCHEMA NOT IN ('information_schema', 'performance_schema', 'sys') " +
+		"ORDER BY TABLE_SCHEMA, TABLE_NAME")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list the source tables: %v", err)
+	}
+	var tables [][2]string
+	for i := 0; res != nil && res.Resultset != nil && i < res.RowNumber(); i++ {
+		schemaName, _ := res.GetString(i, 0)
+		tableName, _ := res.GetString(i, 1)
+		// No action is skipped by action filters
+		if filter.allows(schemaName, tableName, "") {
+			tables = append(tables, [2]string{schemaName, tableName})
+		}
+	}
+	return tables, nil
+}
+
+// copyTable copies a source table in chunks of options.ChunkRows rows, read
+// in primary key order. Tables without a primary key are read by offset, in
+// the order of all their columns
+func copyTable(source loader.MySQLLoader, target loader.MySQLLoader, schemaName string, tableName string, options SnapshotOptions) error {
+	table, err := schema.NewTable(executer{source}, schemaName, tableName)
+	if err != nil {
+		return err
+	}
+	toSchema, toTable := options.Routes.Table(schemaName, tableName)
+	if !options.KeepTables {
+		if err := createTable(source, target, table, toSchema, toTable, options.DropTables); err != nil {
+			return err
+		}
+	}
+	if !options.KeepTables && !options.DropTables {
+		res, err := target.Exec(fmt.Sprintf("SELECT 1 FROM %s.%s LIMIT 1", quoteName(toSchema), quoteName(toTable)))
+		if err != nil {
+			return err
+		}
+		if res != nil && res.Resultset != nil && res.RowNumber() > 0 {
+			return fmt.Errorf("Target table %s.%s is not empty, set DropTables to replace it or KeepTables to copy into it", toSchema, toTable)
+		}
+	}
+	builder := dmlbuilder.Builder{BatchRows: options.BatchRows, Router: options.Routes}
+	var last []interface{}
+	copied := 0
+	for {
+		query, args := chunkQuery(table, last, copied, options.ChunkRows)
+		res, err := source.Exec(query, args...)
+		if err != nil {
+			return err
+		}
+		if res == nil || res.Resultset == nil || res.RowNumber() == 0 {
+			break
+		}
+		rows := make([][]interface{}, res.RowNumber())
+		for i, values := range res.Values {
+			rows[i] = snapshotRow(table, values)
+		}
+		statements, err := builder.Statements(&canal.RowsEvent{Table: table, Action: canal.InsertAction, Rows: rows})
+		if err != nil {
+			return err
+		}
+		if err := applyChunk(target, statements); err != nil {
+			return err
+		}
+		copied += len(rows)
+		if len(rows) < options.ChunkRows {
+			break
+		}
+		last = last[:0]
+		for _, i := range table.PKColumns {
+			last = append(last, res.Values[len(rows)-1][i])
+		}
+	}
+	log.Infof("Copied %d rows of %s.%s to %s.%s", copied, schemaName, tableName, toSchema, toTable)
+	return nil
+}
+
+// createTable creates the target table as defined on the source unless it
+// exists, it is dropped first with drop
+func createTable(source loader.MySQLLoader, target loader.MySQLLoader, table *schema.Table, toSchema string, toTable string, drop bool) error {
+	res, err := source.Exec(fmt.Sprintf("SHOW CREATE TABLE %s.%s", quoteName(table.Schema), quoteName(table.Name)))
+	if err != nil {
+		return err
+	}
+	if res == nil || res.Resultset == nil || res.RowNumber() == 0 {
+		return fmt.Errorf("No definition for %s", table)
+	}
+	create, err := res.GetString(0, 1)
+	if err != nil {
+		return err
+	}
+	// The definition names the table without its schema
+	prefix := "CREATE TABLE " + quoteName(table.Name)
+	if !strings.HasPrefix(create, prefix) {
+		return fmt.Errorf("Unexpected definition of %s: %s", table, create)
+	}
+	name := quoteName(toSchema) + "." + quoteName(toTable)
+	if drop {
+		log.Warningf("Dropping %s.%s on the target", toSchema, toTable)
+		return target.ExecBatch([]string{
+			"CREATE DATABASE IF NOT EXISTS " + quoteName(toSchema),
+			"DROP TABLE IF EXISTS " + name,
+			"CREATE TABLE " + name + create[len(prefix):],
+		})
+	}
+	return target.ExecBatch([]string{
+		"CREATE DATABASE IF NOT EXISTS " + quoteName(toSchema),
+		"CREATE TABLE IF NOT EXISTS " + name + create[len(prefix):],
+	})
+}
+
+// chunkQuery selects the limit rows following last, the primary key of the
+// last row copied, or offset rows for tables without a primary key. Those are
+// ordered by every column so that the chunks of the consistent read neither
+// overlap nor skip rows, identical rows are interchangeable
+func chunkQuery(table *schema.Table, last []interface{}, offset int, limit int) (string, []interface{}) {
+	columns := selectColumns(table)
+	query := fmt.Sprintf("SELECT %s FROM %s.%s", columns, quoteName(table.Schema), quoteName(table.Name))
+	if len(table.PKColumns) == 0 {
+		return fmt.Sprintf("%s ORDER BY %s LIMIT %d, %d", query, columns, offset, limit), nil
+	}
+	pk, placeholders := primaryKey(table)
+	if len(last) > 0 {
+		query += fmt.Sprintf(" WHERE (%s) > (%s)", pk, placeholders)
+	}
+	return fmt.Sprintf("%s ORDER BY %s LIMIT %d", query, pk, limit), last
+}
+
+// selectColumns returns the quoted columns of table
+func selectColumns(table *schema.Table) string {
+	columns := make([]string, len(table.Columns))
+	for i := range table.Columns {
+		columns[i] = quoteName(table.Columns[i].Name)
+	}
+	return strings.Join(columns, ",")
+}
+
+// primaryKey returns the quoted primary key columns of table and as many
+// placeholders
+func primaryKey(table *schema.Table) (string, string) {
+	pk := make([]string, len(table.PKColumns))
+	placeholders := make([]string, len(table.PKColumns))
+	for i, column := range table.PKColumns {
+		pk[i] = quoteName(table.Columns[column].Name)
+		placeholders[i] = "?"
+	}
+	return strings.Join(pk, ","), strings.Join(placeholders, ",")
+}
+
+// snapshotRow converts the values of a query into the values canal decodes
+// from the binlog, BIT values are read as big-endian bytes
+func snapshotRow(table *schema.Table, values []interface{}) []interface{} {
+	row := make([]interface{}, len(values))
+	for i, value := range values {
+		row[i] = value
+		if b, ok := value.([]byte); ok && i < len(table.Columns) && table.Columns[i].Type == schema.TYPE_BIT {
+			var bits uint64
+			for _, c := range b {
+				bits = bits<<8 | uint64(c)
+			}
+			row[i] = int64(bits)
+		}
+	}
+	return row
+}
+
+// applyChunk commits the statements of a chunk in a target transaction
+func applyChunk(target loader.MySQLLoader, statements []loader.Statement) error {
+	if err := target.Begin(); err != nil {
+		return err
+	}
+	if err := target.ExecStatements(statements); err != nil {
+		target.Rollback()
+		return err
+	}
+	return target.Commit()
+}
+
+// executer runs the queries of schema.NewTable on a loader
+type executer struct {
+	loader loader.MySQLLoader
+}
+
+func (e executer) Execute(query string, args ...interface{}) (*mysql.Result, error) {
+	return e.loader.Exec(query, args...)
+}
+
+// SetStartCheckpoint sets the position and GTID set wdcanal starts from, such
+// as the checkpoint of a Snapshot, and saves it in the CheckpointStore of
+// handler so that a restart resumes from it
+func SetStartCheckpoint(wdcanal WDCanal, handler DefaultWDHandler, checkpoint *Checkpoint) error {
+	if checkpoint.GTID != nil {
+		gtid := checkpoint.GTID
+		if err := wdcanal.SetGTID(&gtid); err != nil {
+			return err
+		}
+	}
+	if checkpoint.Pos != nil {
+		if err := wdcanal.SetPos(checkpoint.Pos); err != nil {
+			return err
+		}
+	}
+	if c, ok := handler.(Checkpointer); ok && c.CheckpointStore() != nil {
+		if err := c.CheckpointStore().Save(checkpoint); err != nil {
+			return fmt.Errorf("Unable to save checkpoint %v: %v", checkpoint.Pos, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package replicator
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"mysqlreplicator/replicator/routing"
+)
+
+// snapshotSource answers the queries of a snapshot with results keyed by
+// query prefix
+type snapshotSource struct {
+	MockLoader
+	results map[string][][]interface{}
+	reads   []string
+	reading [][]interface{}
+}
+
+func (s *snapshotSource) Exec(query string, args ...interface{}) (*mysql.Result, error) {
+	s.reads = append(s.reads, query)
+	s.reading = append(s.reading, args)
+	key := query
+	if len(args) > 0 {
+		key += fmt.Sprintf("%v", args)
+	}
+	for prefix, rows := range s.results {
+		if strings.HasPrefix(key, prefix) {
+			return &mysql.Result{Resultset: &mysql.Resultset{Fields: make([]*mysql.Field, len(rows[0])), Values: rows}}, nil
+		}
+	}
+	return &mysql.Result{Resultset: &mysql.Resultset{}}, nil
+}
+
+func (s *snapshotSource) GTid() (mysql.GTIDSet, error) {
+	return mysql.ParseGTIDSet(mysql.MySQLFlavor, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5")
+}
+
+func newSnapshotSource() *snapshotSource {
+	return &snapshotSource{results: map[string][][]interface{}{
+		"SHOW MASTER STATUS":  {{"mysql-bin.000003", uint64(154)}},
+		"SELECT TABLE_SCHEMA": {{"mysql", "user"}, {"shop", "notes"}, {"shop", "orders"}, {"shop", "tmp_orders"}},
+		"show full columns from `shop`.`orders`": {
+			{"id", "int(11)", "", "NO", "PRI", nil, ""},
+			{"status", "varchar(10)", "utf8_general_ci", "YES", "", nil, ""},
+			{"flags", "bit(8)", "", "YES", "", nil, ""},
+		},
+		"show index from `shop`.`orders`":       {{"orders", 0, "PRIMARY", 1, "id", "A", uint64(3)}},
+		"show full columns from `shop`.`notes`": {{"body", "text", "utf8_general_ci", "YES", "", nil, ""}},
+		"SHOW CREATE TABLE `shop`.`orders`":     {{"orders", "CREATE TABLE `orders` (\n  `id` int(11) NOT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB"}},
+		"SHOW CREATE TABLE `shop`.`notes`":      {{"notes", "CREATE TABLE `notes` (\n  `body` text\n) ENGINE=InnoDB"}},
+		"SELECT `id`,`status`,`flags` FROM `shop`.`orders` ORDER BY `id` LIMIT 2": {
+			{int32(1), []byte("new"), []byte{5}},
+			{int32(2), []byte("paid"), nil},
+		},
+		"SELECT `id`,`status`,`flags` FROM `shop`.`orders` WHERE (`id`) > (?) ORDER BY `id` LIMIT 2[2]": {
+			{int32(3), []byte("sent"), []byte{0}},
+		},
+		"SELECT `body` FROM `shop`.`notes` ORDER BY `body` LIMIT 0, 2": {{[]byte("hello")}},
+	}}
+}
+
+func TestSnapshot(t *testing.T) {
+	source := newSnapshotSource()
+	target := &MockLoader{}
+	router, _ := routing.New(routing.Rule{From: "shop.*", To: "archive.*"})
+	checkpoint, err := Snapshot(source, target, SnapshotOptions{
+		Filter:    Filter{ExcludeTables: []string{`\.tmp_`}},
+		Routes:    router,
+		ChunkRows: 2,
+		BatchRows: 10,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if checkpoint.Pos.Name != "mysql-bin.000003" || checkpoint.Pos.Pos != 154 || checkpoint.GTID.String() != "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5" {
+		t.Fatalf("Unexpected checkpoint %v %v", checkpoint.Pos, checkpoint.GTID)
+	}
+	if source.reads[0] != "FLUSH TABLES WITH READ LOCK" || source.queries[1] != "START TRANSACTION WITH CONSISTENT SNAPSHOT" {
+		t.Fatalf("Expected a consistent read under a global read lock, got %v %v", source.reads, source.queries)
+	}
+	unlocked := false
+	for _, query := range source.reads {
+		if strings.HasPrefix(query, "SELECT `") && !unlocked {
+			t.Fatalf("Tables should be read once unlocked, got %v", source.reads)
+		}
+		unlocked = unlocked || query == "UNLOCK TABLES"
+	}
+	if source.rollback != 1 {
+		t.Errorf("Expected the consistent read to end")
+	}
+
+	expected := []string{
+		"CREATE DATABASE IF NOT EXISTS `archive`",
+		"CREATE TABLE IF NOT EXISTS `archive`.`notes` (\n  `body` text\n) ENGINE=InnoDB",
+		"REPLACE INTO `archive`.`notes` (`body`) VALUES (?)",
+		"CREATE DATABASE IF NOT EXISTS `archive`",
+		"CREATE TABLE IF NOT EXISTS `archive`.`orders` (\n  `id` int(11) NOT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB",
+		"REPLACE INTO `archive`.`orders` (`id`,`status`,`flags`) VALUES (?,?,?),(?,?,?)",
+		"REPLACE INTO `archive`.`orders` (`id`,`status`,`flags`) VALUES (?,?,?)",
+	}
+	if strings.Join(target.queries, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected queries\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(target.queries, "\n"))
+	}
+	if len(target.args) != 3 || len(target.args[1]) != 6 || fmt.Sprintf("%s", target.args[1][1]) != "new" {
+		t.Fatalf("Unexpected values %v", target.args)
+	}
+	// BIT values are read as bytes
+	if target.args[1][2] != uint64(5) || target.args[1][5] != nil || target.args[2][2] != uint64(0) {
+		t.Errorf("Unexpected BIT values %v", target.args)
+	}
+	if target.begin != 3 || target.commit != 3 {
+		t.Errorf("Expected a target transaction per chunk, got %d begin and %d commit", target.begin, target.commit)
+	}
+}
+
+func TestSnapshotDropTables(t *testing.T) {
+	source := newSnapshotSource()
+	// The existing rows are dropped with the table
+	target := &snapshotSource{results: map[string][][]interface{}{"SELECT 1 FROM `shop`.`notes`": {{1}}}}
+	if _, err := Snapshot(source, target, SnapshotOptions{Filter: Filter{IncludeTables: []string{`^shop\.notes$`}}, ChunkRows: 2, DropTables: true}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := []string{
+		"CREATE DATABASE IF NOT EXISTS `shop`",
+		"DROP TABLE IF EXISTS `shop`.`notes`",
+		"CREATE TABLE `shop`.`notes` (\n  `body` text\n) ENGINE=InnoDB",
+		"REPLACE INTO `shop`.`notes` (`body`) VALUES (?)",
+	}
+	if strings.Join(target.queries, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected the table created again, got %v", target.queries)
+	}
+}
+
+func TestSnapshotNotEmpty(t *testing.T) {
+	source := newSnapshotSource()
+	target := &snapshotSource{results: map[string][][]interface{}{"SELECT 1 FROM `shop`.`notes`": {{1}}}}
+	_, err := Snapshot(source, target, SnapshotOptions{Filter: Filter{IncludeTables: []string{`^shop\.notes$`}}, ChunkRows: 2})
+	if err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Fatalf("Expected a non-empty target table to be refused, got %v", err)
+	}
+	for _, query := range target.queries {
+		if strings.HasPrefix(query, "DROP") || strings.HasPrefix(query, "REPLACE") {
+			t.Fatalf("Expected the target table to be left as is, got %v", target.queries)
+		}
+	}
+	if _, err := Snapshot(source, target, SnapshotOptions{DropTables: true, KeepTables: true}); err == nil {
+		t.Errorf("Expected DropTables and KeepTables to be exclusive")
+	}
+}
+
+func TestSnapshotKeepTables(t *testing.T) {
+	source := newSnapshotSource()
+	target := &snapshotSource{results: map[string][][]interface{}{"SELECT 1 FROM `shop`.`notes`": {{1}}}}
+	if _, err := Snapshot(source, target, SnapshotOptions{Filter: Filter{IncludeTables: []string{`^shop\.notes$`}}, ChunkRows: 2, KeepTables: true}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(target.queries) != 1 || target.queries[0] != "REPLACE INTO `shop`.`notes` (`body`) VALUES (?)" {
+		t.Fatalf("Expected rows copied into the existing table, got %v", target.queries)
+	}
+}
+
+func TestSnapshotWithoutBinlog(t *testing.T) {
+	source := newSnapshotSource()
+	delete(source.results, "SHOW MASTER STATUS")
+	if _, err := Snapshot(source, &MockLoader{}, SnapshotOptions{}); err == nil || !strings.Contains(err.Error(), "Binary logging") {
+		t.Fatalf("Expected an error without binary log, got %v", err)
+	}
+	if source.reads[len(source.reads)-1] != "UNLOCK TABLES" || source.rollback != 1 {
+		t.Errorf("Expected the source to be unlocked, got %v", source.reads)
+	}
+}
+
+func TestSetStartCheckpoint(t *testing.T) {
+	loader := &MockLoader{}
+	store := &MockCheckpointStore{loader: loader}
+	handler := NewCheckpointedWdHandler(loader, "", store)
+	wdcanal := NewWdCanal(uint32(100), "127.0.0.1", 3306, "root", "", handler)
+	gtid, _ := mysql.ParseGTIDSet(mysql.MySQLFlavor, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5")
+	checkpoint := &Checkpoint{Pos: &mysql.Position{Name: "mysql-bin.000003", Pos: 154}, GTID: gtid}
+	if err := SetStartCheckpoint(wdcanal, handler, checkpoint); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if handler.LastCommittedPos().Pos != 154 || (*handler.LastCommittedGITD()).String() != gtid.String() {
+		t.Errorf("Expected canal to start from the checkpoint, got %v %v", handler.LastCommittedPos(), handler.LastCommittedGITD())
+	}
+	if len(store.saved) != 1 || store.saved[0] != checkpoint {
+		t.Errorf("Expected the checkpoint to be saved, got %v", store.saved)
+	}
+}
@@ -0,0 +1,145 @@
+package replicator
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SupervisorPolicy controls how a Supervisor restarts a failed canal
+type SupervisorPolicy struct {
+	// First delay before a restart, doubled after every consecutive failure
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Consecutive restarts attempted before giving up, negative retries forever
+	MaxRetries int
+	// A canal running longer than StableAfter resets the retry count
+	StableAfter time.Duration
+	// How often the canal state is checked
+	CheckInterval time.Duration
+}
+
+func DefaultSupervisorPolicy() SupervisorPolicy {
+	return SupervisorPolicy{
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Minute,
+		MaxRetries:     10,
+		StableAfter:    time.Minute,
+		CheckInterval:  time.Second,
+	}
+}
+
+// Supervisor keeps a WDCanal running, restarting it from the handler last
+// committed position whenever it terminates with an error
+type Supervisor struct {
+	canal  WDCanal
+	policy SupervisorPolicy
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// NewSupervisor returns a supervisor of canal, the durations of policy that
+// are not set default to those of DefaultSupervisorPolicy
+func NewSupervisor(canal WDCanal, policy SupervisorPolicy) *Supervisor {
+	defaults := DefaultSupervisorPolicy()
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = defaults.InitialBackoff
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = defaults.MaxBackoff
+	}
+	if policy.StableAfter <= 0 {
+		policy.StableAfter = defaults.StableAfter
+	}
+	if policy.CheckInterval <= 0 {
+		policy.CheckInterval = defaults.CheckInterval
+	}
+	return &Supervisor{
+		canal:  canal,
+		policy: policy,
+		stop:   make(chan struct{}),
+	}
+}
+
+// Run blocks until Stop is called or the retries are exhausted, in which case
+// the last canal error is returned
+func (s *Supervisor) Run() error {
+	retries := 0
+	for {
+		started := time.Now()
+		err := s.canal.Start()
+		if err == nil {
+			if err = s.wait(); err == nil {
+				return nil
+			}
+		}
+		if s.stopped() {
+			return nil
+		}
+		if time.Since(started) >= s.policy.StableAfter {
+			retries = 0
+		}
+		if s.policy.MaxRetries >= 0 && retries >= s.policy.MaxRetries {
+			return fmt.Errorf("Giving up after %d restarts: %v", retries, err)
+		}
+		delay := s.backoff(retries)
+		retries++
+		log.Warningf("Replication failed: %v, restart %d in %v", err, retries, delay)
+		select {
+		case <-time.After(delay):
+		case <-s.stop:
+			return nil
+		}
+	}
+}
+
+// Stop stops the canal and makes Run return
+func (s *Supervisor) Stop() {
+	s.once.Do(func() {
+		close(s.stop)
+	})
+}
+
+func (s *Supervisor) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait watches the canal until it terminates, nil is returned when the canal
+// has been stopped
+func (s *Supervisor) wait() error {
+	ticker := time.NewTicker(s.policy.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			s.canal.Stop()
+			return nil
+		case <-ticker.C:
+			switch state, err := s.canal.State(); state {
+			case Terminated:
+				if err == nil {
+					err = fmt.Errorf("Canal terminated")
+				}
+				return err
+			case Stopped:
+				return nil
+			}
+		}
+	}
+}
+
+func (s *Supervisor) backoff(retries int) time.Duration {
+	delay := s.policy.InitialBackoff
+	for i := 0; i < retries && delay < s.policy.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > s.policy.MaxBackoff {
+		delay = s.policy.MaxBackoff
+	}
+	return delay
+}
@@ -0,0 +1,113 @@
+package replicator
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+// MockCanal terminates with an error after every start until failures is 0
+type MockCanal struct {
+	sync.Mutex
+	failures int
+	starts   int
+	state    State
+	err      error
+}
+
+func (c *MockCanal) Start() error {
+	c.Lock()
+	defer c.Unlock()
+	c.starts++
+	c.state, c.err = Running, nil
+	if c.failures > 0 {
+		c.failures--
+		c.state, c.err = Terminated, fmt.Errorf("connection lost")
+	}
+	return nil
+}
+
+func (c *MockCanal) Stop() {
+	c.Lock()
+	defer c.Unlock()
+	c.state = Stopped
+}
+
+func (c *MockCanal) State() (State, error) {
+	c.Lock()
+	defer c.Unlock()
+	return c.state, c.err
+}
+
+func (c *MockCanal) SetGTID(*mysql.GTIDSet) error { return nil }
+func (c *MockCanal) SetPos(*mysql.Position) error { return nil }
+func (c *MockCanal) SetFilter(Filter) error       { return nil }
+func (c *MockCanal) Resync(string, string, ResyncOptions) error {
+	return nil
+}
+
+func testPolicy(retries int) SupervisorPolicy {
+	return SupervisorPolicy{
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     4 * time.Millisecond,
+		MaxRetries:     retries,
+		StableAfter:    time.Minute,
+		CheckInterval:  time.Millisecond,
+	}
+}
+
+func TestSupervisorRestartsCanal(t *testing.T) {
+	c := &MockCanal{failures: 3}
+	supervisor := NewSupervisor(c, testPolicy(5))
+	done := make(chan error)
+	go func() {
+		done <- supervisor.Run()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if state, _ := c.State(); state != Running {
+		t.Fatalf("Canal should be running after restarts, state %d", state)
+	}
+	supervisor.Stop()
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error from a stopped supervisor: %v", err)
+	}
+	if c.starts != 4 {
+		t.Fatalf("Expected 4 starts, got %d", c.starts)
+	}
+	if state, _ := c.State(); state != Stopped {
+		t.Fatalf("Canal should be stopped with the supervisor")
+	}
+}
+
+func TestSupervisorGivesUp(t *testing.T) {
+	c := &MockCanal{failures: 10}
+	supervisor := NewSupervisor(c, testPolicy(2))
+	if err := supervisor.Run(); err == nil {
+		t.Fatalf("Expected error once retries are exhausted")
+	}
+	if c.starts != 3 {
+		t.Fatalf("Expected 3 starts, got %d", c.starts)
+	}
+}
+
+func TestSupervisorBackoff(t *testing.T) {
+	supervisor := NewSupervisor(&MockCanal{}, SupervisorPolicy{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second})
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, delay := range expected {
+		if d := supervisor.backoff(i); d != delay {
+			t.Fatalf("Expected backoff %v for retry %d, got %v", delay, i, d)
+		}
+	}
+}
+
+func TestSupervisorDefaults(t *testing.T) {
+	supervisor := NewSupervisor(&MockCanal{}, SupervisorPolicy{MaxRetries: 2, MaxBackoff: -time.Second})
+	expected := DefaultSupervisorPolicy()
+	expected.MaxRetries = 2
+	if supervisor.policy != expected {
+		t.Fatalf("Expected the default durations, got %+v", supervisor.policy)
+	}
+}
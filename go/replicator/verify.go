@@ -0,0 +1,308 @@
+package replicator
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/siddontang/go-mysql/schema"
+	"mysqlreplicator/loader"
+	"mysqlreplicator/replicator/routing"
+)
+
+const (
+	// DefaultRecheckDelay is the delay before a differing chunk is checked
+	// again
+	DefaultRecheckDelay = 5 * time.Second
+	// DefaultRecheckTimeout bounds the wait for the target to replicate a
+	// differing chunk
+	DefaultRecheckTimeout = 5 * time.Minute
+)
+
+// VerifyOptions configures Verify
+type VerifyOptions struct {
+	// Filter selects the tables verified as it selects the tables
+	// replicated, action filters are ignored
+	Filter Filter
+	// Tables are regular expressions on "schema.table" selecting the tables
+	// verified among the replicated ones, every one when empty
+	Tables []string
+	// Routes maps source tables to target tables, nil keeps the source names
+	Routes *routing.Router
+	// ChunkRows is the number of source rows of a chunk, DefaultChunkRows
+	// when 0. Tables without a primary key are a single chunk
+	ChunkRows int
+	// RowsPerSecond limits the rows checksummed on each server, unlimited
+	// when 0
+	RowsPerSecond int
+	// Rechecks is the number of times a differing chunk is checked again
+	// before it is reported, its rows may still be replicated
+	Rechecks int
+	// Checkpoint is the checkpoint store of the replication, a differing
+	// chunk is checked again once the target replicated the source position
+	// read after the difference. Rechecks wait RecheckDelay when nil
+	Checkpoint CheckpointStore
+	// RecheckDelay is the delay before a chunk is checked again and between
+	// two loads of the checkpoint, DefaultRecheckDelay when 0
+	RecheckDelay time.Duration
+	// RecheckTimeout bounds the wait for the checkpoint, the chunk is checked
+	// again afterwards. DefaultRecheckTimeout when 0
+	RecheckTimeout time.Duration
+}
+
+// VerifyReport is the result of Verify
+type VerifyReport struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Tables   int       `json:"tables"`
+	Chunks   int       `json:"chunks"`
+	Rows     int64     `json:"rows"`
+	// Mismatches are the chunks still differing once checked again
+	Mismatches []*Mismatch `json:"mismatches"`
+}
+
+// Mismatch is a chunk differing between source and target
+type Mismatch struct {
+	Schema       string `json:"schema"`
+	Table        string `json:"table"`
+	TargetSchema string `json:"target_schema"`
+	TargetTable  string `json:"target_table"`
+	// From and To bound the primary keys of the chunk as in a Chunk
+	From           []interface{} `json:"from"`
+	To             []interface{} `json:"to"`
+	SourceRows     int64         `json:"source_rows"`
+	TargetRows     int64         `json:"target_rows"`
+	SourceChecksum uint64        `json:"source_checksum"`
+	TargetChecksum uint64        `json:"target_checksum"`
+}
+
+// Verify compares the tables selected by options.Filter on source and target,
+// one primary key range at a time: both servers return the number of rows of
+// the range and the BIT_XOR of their CRC32. Replication keeps running, a
+// differing range is checked again once the target replicated the changes of
+// the source before it is reported. Nothing is locked, each range is read by
+// a statement of its own
+func Verify(source loader.MySQLLoader, target loader.MySQLLoader, options VerifyOptions) (*VerifyReport, error) {
+	v, err := newVerifier(source, target, options)
+	if err != nil {
+		return nil, err
+	}
+	return v.verify()
+}
+
+type verifier struct {
+	source  loader.MySQLLoader
+	target  loader.MySQLLoader
+	options VerifyOptions
+	filter  *tableFilter
+	tables  []*regexp.Regexp
+	now     func() time.Time
+	sleep   func(time.Duration)
+}
+
+func newVerifier(source loader.MySQLLoader, target loader.MySQLLoader, options VerifyOptions) (*verifier, error) {
+	filter, err := options.Filter.compile()
+	if err != nil {
+		return nil, err
+	}
+	tables, err := compileAll(options.Tables)
+	if err != nil {
+		return nil, err
+	}
+	if options.ChunkRows <= 0 {
+		options.ChunkRows = DefaultChunkRows
+	}
+	if options.RecheckDelay <= 0 {
+		options.RecheckDelay = DefaultRecheckDelay
+	}
+	if options.RecheckTimeout <= 0 {
+		options.RecheckTimeout = DefaultRecheckTimeout
+	}
+	return &verifier{
+		source:  source,
+		target:  target,
+		options: options,
+		filter:  filter,
+		tables:  tables,
+		now:     time.Now,
+		sleep:   time.Sleep,
+	}, nil
+}
+
+func (v *verifier) verify() (*VerifyReport, error) {
+	report := &VerifyReport{Started: v.now(), Mismatches: []*Mismatch{}}
+	names, err := snapshotTables(v.source, v.filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		key := name[0] + "." + name[1]
+		if len(v.tables) > 0 && !matchAny(v.tables, key) {
+			continue
+		}
+		if err := v.verifyTable(report, name[0], name[1]); err != nil {
+			return nil, fmt.Errorf("Unable to verify %s: %v", key, err)
+		}
+		report.Tables++
+	}
+	report.Finished = v.now()
+	log.Infof("Verified %d rows of %d tables in %d chunks, %d chunks differ", report.Rows, report.Tables, report.Chunks, len(report.Mismatches))
+	return report, nil
+}
+
+func (v *verifier) verifyTable(report *VerifyReport, schemaName string, tableName string) error {
+	table, err := schema.NewTable(executer{v.source}, schemaName, tableName)
+	if err != nil {
+		return err
+	}
+	toSchema, toTable := v.options.Routes.Table(schemaName, tableName)
+	chunks, err := planChunks(v.source, table, v.options.ChunkRows)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		mismatch, rows, err := v.verifyChunk(table, toSchema, toTable, chunk)
+		if err != nil {
+			return err
+		}
+		report.Chunks++
+		report.Rows += rows
+		if mismatch != nil {
+			log.Warningf("%s.%s differs from %s.%s between %v and %v", schemaName, tableName, toSchema, toTable, chunk.From, chunk.To)
+			report.Mismatches = append(report.Mismatches, mismatch)
+		}
+	}
+	return nil
+}
+
+// verifyChunk compares a chunk on both servers, checking it again while it
+// differs. It returns the difference if any and the source rows
+func (v *verifier) verifyChunk(table *schema.Table, toSchema string, toTable string, chunk *Chunk) (*Mismatch, int64, error) {
+	var source, target checksum
+	for check := 0; ; check++ {
+		started := v.now()
+		var err error
+		if source, err = tableChecksum(v.source, table, table.Schema, table.Name, chunk); err != nil {
+			return nil, 0, err
+		}
+		if target, err = tableChecksum(v.target, table, toSchema, toTable, chunk); err != nil {
+			return nil, 0, err
+		}
+		rows := source.rows
+		if target.rows > rows {
+			rows = target.rows
+		}
+		v.throttle(rows, v.now().Sub(started))
+		if source == target || check >= v.options.Rechecks {
+			break
+		}
+		if err := v.waitReplicated(); err != nil {
+			return nil, 0, err
+		}
+	}
+	if source == target {
+		return nil, source.rows, nil
+	}
+	return &Mismatch{
+		Schema:         table.Schema,
+		Table:          table.Name,
+		TargetSchema:   toSchema,
+		TargetTable:    toTable,
+		From:           chunk.From,
+		To:             chunk.To,
+		SourceRows:     source.rows,
+		TargetRows:     target.rows,
+		SourceChecksum: source.crc,
+		TargetChecksum: target.crc,
+	}, source.rows, nil
+}
+
+// throttle sleeps so that rows read in elapsed are read at RowsPerSecond at
+// most
+func (v *verifier) throttle(rows int64, elapsed time.Duration) {
+	if v.options.RowsPerSecond <= 0 {
+		return
+	}
+	if expected := time.Duration(rows) * time.Second / time.Duration(v.options.RowsPerSecond); expected > elapsed {
+		v.sleep(expected - elapsed)
+	}
+}
+
+// waitReplicated waits until the checkpoint reaches the current source
+// position, the rows changed before it are then replicated. It only waits
+// RecheckDelay without a checkpoint store and gives up after RecheckTimeout
+func (v *verifier) waitReplicated() error {
+	if v.options.Checkpoint == nil {
+		v.sleep(v.options.RecheckDelay)
+		return nil
+	}
+	pos, err := masterPosition(v.source)
+	if err != nil {
+		return err
+	}
+	deadline := v.now().Add(v.options.RecheckTimeout)
+	for {
+		checkpoint, err := v.options.Checkpoint.Load()
+		if err != nil {
+			return fmt.Errorf("Unable to load the checkpoint: %v", err)
+		}
+		if checkpoint != nil && checkpoint.Pos != nil && checkpoint.Pos.Compare(*pos) >= 0 {
+			return nil
+		}
+		if !v.now().Before(deadline) {
+			log.Warningf("The target did not replicate %s within %v", pos, v.options.RecheckTimeout)
+			return nil
+		}
+		v.sleep(v.options.RecheckDelay)
+	}
+}
+
+// checksum is the number of rows of a chunk and the BIT_XOR of their CRC32
+type checksum struct {
+	rows int64
+	crc  uint64
+}
+
+func tableChecksum(l loader.MySQLLoader, table *schema.Table, schemaName string, tableName string, chunk *Chunk) (checksum, error) {
+	from, err := keyArgs(table, chunk.From)
+	if err != nil {
+		return checksum{}, err
+	}
+	to, err := keyArgs(table, chunk.To)
+	if err != nil {
+		return checksum{}, err
+	}
+	query, args := checksumQuery(table, schemaName, tableName, from, to)
+	res, err := l.Exec(query, args...)
+	if err != nil {
+		return checksum{}, err
+	}
+	if res == nil || res.Resultset == nil || res.RowNumber() == 0 {
+		return checksum{}, fmt.Errorf("No checksum returned for %s.%s", schemaName, tableName)
+	}
+	rows, err := res.GetInt(0, 0)
+	if err != nil {
+		return checksum{}, err
+	}
+	crc, err := res.GetUint(0, 1)
+	if err != nil {
+		return checksum{}, err
+	}
+	return checksum{rows: rows, crc: crc}, nil
+}
+
+// checksumQuery counts the rows of schemaName.tableName with a primary key in
+// (from, to] and XORs their CRC32, the columns are the columns of table. The
+// ISNULL flags tell NULL values apart, CONCAT_WS skips them
+func checksumQuery(table *schema.Table, schemaName string, tableName string, from []interface{}, to []interface{}) (string, []interface{}) {
+	columns := make([]string, len(table.Columns))
+	nulls := make([]string, len(table.Columns))
+	for i := range table.Columns {
+		columns[i] = quoteName(table.Columns[i].Name)
+		nulls[i] = fmt.Sprintf("ISNULL(%s)", columns[i])
+	}
+	where, args := rangeCondition(table, from, to)
+	return fmt.Sprintf("SELECT COUNT(*), BIT_XOR(CRC32(CONCAT_WS('#', %s, CONCAT(%s)))) FROM %s.%s%s",
+		strings.Join(columns, ", "), strings.Join(nulls, ", "), quoteName(schemaName), quoteName(tableName), where), args
+}
@@ -0,0 +1,121 @@
+package replicator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"mysqlreplicator/replicator/routing"
+)
+
+const (
+	checksumOrders = "SELECT COUNT(*), BIT_XOR(CRC32(CONCAT_WS('#', `id`, `status`, `flags`, CONCAT(ISNULL(`id`), ISNULL(`status`), ISNULL(`flags`))))) FROM "
+	firstChunk     = " WHERE (`id`) <= (?)[2]"
+	lastChunk      = " WHERE (`id`) > (?)[2]"
+)
+
+// newVerifySource returns a source with two chunks of shop.orders and a
+// target whose last chunk differs
+func newVerifySource() (*snapshotSource, *snapshotSource) {
+	source := newBackfillSource().snapshotSource
+	source.results[checksumOrders+"`shop`.`orders`"+firstChunk] = [][]interface{}{{int64(2), uint64(10)}}
+	source.results[checksumOrders+"`shop`.`orders`"+lastChunk] = [][]interface{}{{int64(1), uint64(7)}}
+	target := &snapshotSource{results: map[string][][]interface{}{
+		checksumOrders + "`archive`.`orders`" + firstChunk: {{int64(2), uint64(10)}},
+		checksumOrders + "`archive`.`orders`" + lastChunk:  {{int64(1), uint64(8)}},
+	}}
+	return source, target
+}
+
+func newTestVerifier(t *testing.T, source *snapshotSource, target *snapshotSource, options VerifyOptions) (*verifier, *[]time.Duration) {
+	router, _ := routing.New(routing.Rule{From: "shop.*", To: "archive.*"})
+	options.Routes = router
+	options.Tables = []string{`^shop\.orders$`}
+	options.ChunkRows = 2
+	v, err := newVerifier(source, target, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sleeps []time.Duration
+	now := time.Unix(0, 0)
+	v.now = func() time.Time {
+		return now
+	}
+	v.sleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+		now = now.Add(d)
+	}
+	return v, &sleeps
+}
+
+func TestVerify(t *testing.T) {
+	source, target := newVerifySource()
+	v, sleeps := newTestVerifier(t, source, target, VerifyOptions{Rechecks: 2, RecheckDelay: time.Second})
+	report, err := v.verify()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if report.Tables != 1 || report.Chunks != 2 || report.Rows != 3 {
+		t.Errorf("Expected 3 rows verified in 2 chunks, got %+v", report)
+	}
+	if len(report.Mismatches) != 1 {
+		t.Fatalf("Expected the last chunk to differ, got %v", report.Mismatches)
+	}
+	mismatch := report.Mismatches[0]
+	if mismatch.Schema != "shop" || mismatch.TargetSchema != "archive" || mismatch.TargetTable != "orders" ||
+		len(mismatch.From) != 1 || mismatch.From[0] != int32(2) || mismatch.To != nil ||
+		mismatch.SourceRows != 1 || mismatch.TargetRows != 1 || mismatch.SourceChecksum != 7 || mismatch.TargetChecksum != 8 {
+		t.Errorf("Unexpected mismatch %+v", mismatch)
+	}
+	if len(*sleeps) != 2 || (*sleeps)[0] != time.Second {
+		t.Errorf("Expected the chunk checked again twice, got sleeps %v", *sleeps)
+	}
+}
+
+func TestVerifyInFlight(t *testing.T) {
+	source, target := newVerifySource()
+	store := &MockCheckpointStore{checkpoint: &Checkpoint{Pos: &mysql.Position{Name: "mysql-bin.000003", Pos: 100}}}
+	v, sleeps := newTestVerifier(t, source, target, VerifyOptions{Rechecks: 1, Checkpoint: store, RecheckDelay: time.Second})
+	sleep := v.sleep
+	v.sleep = func(d time.Duration) {
+		sleep(d)
+		// The change is replicated with the position read after the difference
+		store.checkpoint = &Checkpoint{Pos: &mysql.Position{Name: "mysql-bin.000003", Pos: 154}}
+		target.results[checksumOrders+"`archive`.`orders`"+lastChunk] = [][]interface{}{{int64(1), uint64(7)}}
+	}
+	report, err := v.verify()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(report.Mismatches) != 0 {
+		t.Errorf("Expected the replicated chunk to match, got %v", report.Mismatches)
+	}
+	if len(*sleeps) != 1 {
+		t.Errorf("Expected to wait for the checkpoint once, got %v", *sleeps)
+	}
+}
+
+func TestVerifyRecheckTimeout(t *testing.T) {
+	source, target := newVerifySource()
+	store := &MockCheckpointStore{checkpoint: &Checkpoint{Pos: &mysql.Position{Name: "mysql-bin.000003", Pos: 100}}}
+	v, sleeps := newTestVerifier(t, source, target, VerifyOptions{Rechecks: 1, Checkpoint: store, RecheckDelay: time.Second, RecheckTimeout: 3 * time.Second})
+	report, err := v.verify()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(report.Mismatches) != 1 || len(*sleeps) != 3 {
+		t.Errorf("Expected the chunk reported once the wait timed out, got %v after %v", report.Mismatches, *sleeps)
+	}
+}
+
+func TestVerifyRateLimit(t *testing.T) {
+	source, target := newVerifySource()
+	target.results[checksumOrders+"`archive`.`orders`"+lastChunk] = [][]interface{}{{int64(1), uint64(7)}}
+	v, sleeps := newTestVerifier(t, source, target, VerifyOptions{RowsPerSecond: 4})
+	if _, err := v.verify(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(*sleeps) != 2 || (*sleeps)[0] != 500*time.Millisecond || (*sleeps)[1] != 250*time.Millisecond {
+		t.Errorf("Expected to read 4 rows per second, got sleeps %v", *sleeps)
+	}
+}